@@ -0,0 +1,178 @@
+package socks5
+
+import (
+	"reflect"
+	"strings"
+)
+
+// hotFields are the fields of the Config which ApplyConfig applies to
+// a running server. They are read for each connection, while the other
+// fields are used once, for example when a listener starts serving.
+var hotFields = map[string]bool{
+	"AuthMethods":                 true,
+	"Credentials":                 true,
+	"MaxFQDNLength":               true,
+	"FQDNValidator":               true,
+	"RequireFQDN":                 true,
+	"DenyFQDN":                    true,
+	"EnabledCommands":             true,
+	"Rules":                       true,
+	"Rewriter":                    true,
+	"Logger":                      true,
+	"LogLevel":                    true,
+	"Trace":                       true,
+	"DialTimeout":                 true,
+	"MaxDialsPerDest":             true,
+	"DialQueueTimeout":            true,
+	"OnDeny":                      true,
+	"MaxRequestBytes":             true,
+	"ClientFilter":                true,
+	"DenySelf":                    true,
+	"SelfAllowlist":               true,
+	"StreamPolicy":                true,
+	"IdleTimeout":                 true,
+	"ByteQuota":                   true,
+	"AssociateIdleTimeout":        true,
+	"MaxConnectionLifetime":       true,
+	"MaxConnectionLifetimeJitter": true,
+	"HandshakeTimeout":            true,
+	"GreetingTimeout":             true,
+	"AuthTimeout":                 true,
+	"RequestTimeout":              true,
+}
+
+// ConfigDiff describes the outcome of ApplyConfig
+type ConfigDiff struct {
+	// Applied are the fields which changed and were applied
+	Applied []string
+
+	// Restart are the fields which changed but were not applied, as
+	// they require restarting the listeners or the server, for example
+	// with Upgrade
+	Restart []string
+}
+
+// Changed checks if any field changed
+func (d *ConfigDiff) Changed() bool {
+	return len(d.Applied) > 0 || len(d.Restart) > 0
+}
+
+// ApplyConfig compares a new Config with the one being served, and
+// atomically applies the changes of the fields read for each connection,
+// such as the Rules, Credentials, timeouts, limits and log level. The
+// changes apply to the connections accepted afterwards, while those
+// being served keep their Config. Changes of the other fields, such as
+// the Metrics or MaxConcurrentConnections, are not applied but reported,
+// as they need a restart. The Config is compared as given to New, so
+// unset fields compare equal, using the defaults. Listeners served
+// with ServeWithConfig keep their own Config.
+//
+// Values, slices and maps are compared deeply, while pointers and
+// functions are compared by identity. It allows reloads on SIGHUP:
+//
+//	for range hup {
+//		diff, err := serv.ApplyConfig(loadConfig())
+//		...
+//	}
+func (s *Server) ApplyConfig(conf *Config) (*ConfigDiff, error) {
+	if err := checkPlatform(conf); err != nil {
+		return nil, err
+	}
+	st := s.state
+	st.l.Lock()
+	defer st.l.Unlock()
+	current := s
+	if st.applied != nil {
+		current = st.applied
+	}
+
+	diff := &ConfigDiff{}
+	merged := *st.given
+	cur := reflect.ValueOf(&merged).Elem()
+	upd := reflect.ValueOf(conf).Elem()
+	for i := 0; i < cur.NumField(); i++ {
+		name := cur.Type().Field(i).Name
+		if fieldEqual(cur.Field(i), upd.Field(i)) {
+			continue
+		}
+		if !hotFields[name] {
+			diff.Restart = append(diff.Restart, name)
+			continue
+		}
+		cur.Field(i).Set(upd.Field(i))
+		diff.Applied = append(diff.Applied, name)
+	}
+	if len(diff.Applied) > 0 {
+		st.given = &merged
+		configured := merged
+		current = s.withConfig(&configured)
+		st.applied = current
+		s.SetTrace(merged.Trace)
+		current.logf(LogInfo, "Applied config changes to %s", strings.Join(diff.Applied, ", "))
+	}
+	if len(diff.Restart) > 0 {
+		current.logf(LogWarn, "Config changes to %s require a restart", strings.Join(diff.Restart, ", "))
+	}
+	return diff, nil
+}
+
+// live returns the server using the Config last applied with
+// ApplyConfig, which serves the new connections, unless the server
+// serves a listener with its own Config
+func (s *Server) live() *Server {
+	st := s.state
+	if st == nil || s.listenerConfig {
+		return s
+	}
+	st.l.Lock()
+	defer st.l.Unlock()
+	if st.applied != nil {
+		return st.applied
+	}
+	return s
+}
+
+// fieldEqual compares two fields of a Config. Values, slices and
+// maps are compared deeply, while pointers and functions are compared
+// by identity, as they may refer to objects in use, such as a Logger.
+func fieldEqual(a, b reflect.Value) bool {
+	switch a.Kind() {
+	case reflect.Func:
+		return a.Pointer() == b.Pointer()
+	case reflect.Interface:
+		if a.IsNil() || b.IsNil() {
+			return a.IsNil() && b.IsNil()
+		}
+		return a.Elem().Type() == b.Elem().Type() && fieldEqual(a.Elem(), b.Elem())
+	case reflect.Slice:
+		if a.Len() != b.Len() {
+			return false
+		}
+		for i := 0; i < a.Len(); i++ {
+			if !fieldEqual(a.Index(i), b.Index(i)) {
+				return false
+			}
+		}
+		return true
+	case reflect.Map:
+		if a.Len() != b.Len() {
+			return false
+		}
+		iter := a.MapRange()
+		for iter.Next() {
+			v := b.MapIndex(iter.Key())
+			if !v.IsValid() || !fieldEqual(iter.Value(), v) {
+				return false
+			}
+		}
+		return true
+	case reflect.Struct:
+		for i := 0; i < a.NumField(); i++ {
+			if !fieldEqual(a.Field(i), b.Field(i)) {
+				return false
+			}
+		}
+		return true
+	}
+	return a.Equal(b)
+}
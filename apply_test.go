@@ -0,0 +1,132 @@
+package socks5
+
+import (
+	"io"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestServer_ApplyConfig(t *testing.T) {
+	serv, _ := New(&Config{
+		Credentials:              StaticCredentials{"foo": "bar"},
+		MaxConcurrentConnections: 10,
+	})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer serv.Close()
+	serv.AddListener(l)
+
+	auth := func(pass string) byte {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(time.Second))
+		msg := []byte{5, 1, UserPassAuth, 1, 3, 'f', 'o', 'o', byte(len(pass))}
+		conn.Write(append(msg, pass...))
+		out := make([]byte, 4)
+		if _, err := io.ReadFull(conn, out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		return out[3]
+	}
+	if auth("bar") != authSuccess || auth("baz") != authFailure {
+		t.Fatalf("bad")
+	}
+
+	// The credentials are applied, but not the connection limit
+	diff, err := serv.ApplyConfig(&Config{
+		Credentials:              StaticCredentials{"foo": "baz"},
+		MaxConcurrentConnections: 20,
+		IdleTimeout:              time.Minute,
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	applied := []string{"Credentials", "IdleTimeout"}
+	if len(diff.Applied) != len(applied) || len(diff.Restart) != 1 || diff.Restart[0] != "MaxConcurrentConnections" {
+		t.Fatalf("bad: %#v", diff)
+	}
+	for i, name := range applied {
+		if diff.Applied[i] != name {
+			t.Fatalf("bad: %#v", diff)
+		}
+	}
+	if auth("bar") != authFailure || auth("baz") != authSuccess {
+		t.Fatalf("bad")
+	}
+
+	// Applying the same Config changes nothing
+	diff, err = serv.ApplyConfig(&Config{
+		Credentials:              StaticCredentials{"foo": "baz"},
+		MaxConcurrentConnections: 10,
+		IdleTimeout:              time.Minute,
+	})
+	if err != nil || diff.Changed() {
+		t.Fatalf("bad: %#v %v", diff, err)
+	}
+}
+
+func TestFieldEqual(t *testing.T) {
+	a := &Config{SelfAllowlist: []string{"a"}, Credentials: StaticCredentials{"a": "b"}, Metrics: NoopMetrics{}}
+	b := &Config{SelfAllowlist: []string{"a"}, Credentials: StaticCredentials{"a": "b"}, Metrics: NoopMetrics{}}
+	equal := func(name string) bool {
+		return fieldEqual(reflect.ValueOf(a).Elem().FieldByName(name), reflect.ValueOf(b).Elem().FieldByName(name))
+	}
+	for _, name := range []string{"SelfAllowlist", "Credentials", "Metrics", "Logger"} {
+		if !equal(name) {
+			t.Fatalf("bad: %v", name)
+		}
+	}
+
+	// Pointers are compared by identity
+	a.Logger, b.Logger = newDefaultLogger(), newDefaultLogger()
+	a.Bandwidth, b.Bandwidth = NewBandwidthLimiter(1, nil), NewBandwidthLimiter(1, nil)
+	a.Credentials = StaticCredentials{"a": "c"}
+	for _, name := range []string{"Logger", "Bandwidth", "Credentials"} {
+		if equal(name) {
+			t.Fatalf("bad: %v", name)
+		}
+	}
+}
+
+func TestServer_ApplyConfig_ServeWithConfig(t *testing.T) {
+	serv, _ := New(&Config{})
+	defer serv.Close()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	go serv.ServeWithConfig(l, &Config{Credentials: StaticCredentials{"foo": "bar"}})
+
+	method := func() byte {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(time.Second))
+		conn.Write([]byte{5, 1, NoAuth})
+		out := make([]byte, 2)
+		if _, err := io.ReadFull(conn, out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		return out[1]
+	}
+	if m := method(); m != noAcceptable {
+		t.Fatalf("bad: %v", m)
+	}
+
+	// Applying a Config to the server keeps the Config of the listener
+	if _, err := serv.ApplyConfig(&Config{LogLevel: LogWarn}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if m := method(); m != noAcceptable {
+		t.Fatalf("bad: %v", m)
+	}
+}
@@ -0,0 +1,486 @@
+package socks5
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// maxAssociationDests bounds the destinations an association
+// remembers, forgetting all of them once exceeded
+const maxAssociationDests = 1024
+
+// UDPClientBinding selects the sources an association accepts
+// datagrams from, as anyone able to reach the relay could
+// otherwise use it
+type UDPClientBinding uint8
+
+const (
+	// UDPBindAnnounced requires datagrams from the address the client
+	// announced in its request. Zero parts of it, as commonly sent by
+	// clients which do not know their address, e.g. 0.0.0.0:0, are
+	// learned from the first datagram.
+	UDPBindAnnounced UDPClientBinding = iota
+
+	// UDPBindClientIP requires datagrams from the IP of the client's
+	// TCP connection, from any port, to tolerate NATs which change
+	// the source port. Replies go to the latest source port.
+	UDPBindClientIP
+
+	// UDPBindClientAddr requires datagrams from the IP of the client's
+	// TCP connection, and from the port it announced, or the port of
+	// the first datagram if it announced zero.
+	UDPBindClientAddr
+)
+
+// association is the state of a UDP association, which is only
+// accessed by the goroutine relaying its datagrams
+type association struct {
+	// active is the time of the last datagram relayed in either
+	// direction, in Unix nanoseconds. It is first to keep it
+	// 64-bit aligned for atomic access.
+	active int64
+
+	s       *Server
+	ctx     context.Context
+	req     *Request
+	pc      *net.UDPConn
+	session *streamCounters
+
+	// clientIP and clientPort are required for datagrams of the
+	// client, unless nil or zero. client is set once it sent one.
+	clientIP   net.IP
+	clientPort int
+	client     *net.UDPAddr
+
+	// altIP is the IP the client announced from the other family
+	// than clientIP, which is accepted too, for dual-stack clients
+	// whose datagrams do not use the family of their TCP connection
+	altIP net.IP
+
+	// dests are the resolved destinations by requested address,
+	// nil if denied. peers are the destinations datagrams were
+	// sent to, whose replies are relayed to the client.
+	dests map[string]*net.UDPAddr
+	peers map[string]struct{}
+
+	// err is the ICMP error which ended the association, if any
+	err error
+}
+
+// handleAssociate is used to handle an associate command
+func (s *Server) handleAssociate(ctx context.Context, conn conn, req *Request) error {
+	// Check if this is allowed
+	if ctx_, ok := s.config.Rules.Allow(ctx, req); !ok {
+		denial := denialFromContext(ctx_)
+		err := denial.denyError("Associate", req.DestAddr)
+		s.deny(ctx, req, DenyRule, denial.Reply, err)
+		if err := s.reply(conn, req, denial.Reply, nil); err != nil {
+			return fmt.Errorf("Failed to send reply: %v", err)
+		}
+		return err
+	} else {
+		ctx = ctx_
+	}
+
+	pc, err := s.listenRelay(req)
+	if err != nil {
+		err = fmt.Errorf("Failed to listen for associate: %v", err)
+		if err := s.reply(conn, req, ServerFailure, nil); err != nil {
+			return fmt.Errorf("Failed to send reply: %v", err)
+		}
+		return err
+	}
+	defer pc.Close()
+	if !s.state.trackResource(pc, true) {
+		s.reply(conn, req, ServerFailure, nil)
+		return ErrServerClosed
+	}
+	defer s.state.trackResource(pc, false)
+	if err := enableICMPErrors(pc); err != nil && !errors.Is(err, ErrUnsupportedPlatform) {
+		s.logf(LogWarn, "Failed to enable ICMP errors for associate: %v", err)
+	}
+
+	// The relay address is sent as is, as it must be reachable,
+	// unless it is the wildcard address of a dual-stack socket
+	bound := pc.LocalAddr().(*net.UDPAddr)
+	bind := &AddrSpec{IP: bound.IP, Port: bound.Port, Zone: bound.Zone}
+	if bound.IP.IsUnspecified() && req.localAddr != nil {
+		bind.IP, bind.Zone = req.localAddr.IP, req.localAddr.Zone
+	}
+	if ip := s.config.UDPAdvertiseIP; ip != nil {
+		bind.IP, bind.Zone = ip, ""
+	}
+	if err := s.sendReply(conn, req, SuccessReply, bind); err != nil {
+		return fmt.Errorf("Failed to send reply: %v", err)
+	}
+
+	a := s.newAssociation(ctx, req, pc)
+	s.tracef(ctx, "associate", "relaying on %v for %v", bound, req.RemoteAddr)
+	relay := &relayEntry{ctx: ctx, req: req, session: a.session}
+	s.state.trackRelay(relay, true)
+	defer s.state.trackRelay(relay, false)
+	relayDone := make(chan struct{})
+	s.spawn("associate", func() {
+		defer close(relayDone)
+		a.relay()
+	})
+	defer func() {
+		pc.Close()
+		<-relayDone
+		stats := a.session.snapshot()
+		s.tracef(ctx, "associate", "ended after %v, %d bytes up, %d bytes down", stats.Elapsed, stats.BytesUp, stats.BytesDown)
+	}()
+
+	// The association lasts as long as the TCP connection, which
+	// is probed to detect clients which vanished, if enabled
+	if period := s.config.AssociateKeepAlive; period > 0 {
+		if ka, ok := conn.(keepAliveConn); ok {
+			if err := ka.SetKeepAlive(true); err == nil {
+				ka.SetKeepAlivePeriod(period)
+			}
+		}
+	}
+	closed := make(chan struct{})
+	s.spawn("associate", func() {
+		defer close(closed)
+		if req.bufConn != nil {
+			io.Copy(io.Discard, req.bufConn)
+		}
+	})
+
+	// Wait, checking the StreamPolicy periodically and
+	// reaping the association once idle, if enabled
+	var tick <-chan time.Time
+	if s.config.StreamPolicy != nil {
+		ticker := time.NewTicker(s.streamPolicyInterval())
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	var idle <-chan time.Time
+	idleTimeout := s.config.AssociateIdleTimeout
+	var idleTimer *time.Timer
+	if idleTimeout > 0 {
+		idleTimer = time.NewTimer(idleTimeout)
+		defer idleTimer.Stop()
+		idle = idleTimer.C
+	}
+	for {
+		select {
+		case <-closed:
+			s.tracef(ctx, "associate", "control connection closed")
+			return nil
+		case <-relayDone:
+			if a.err != nil {
+				return fmt.Errorf("Association of %v ended: %v", req.RemoteAddr, a.err)
+			}
+			return fmt.Errorf("Association relay on %v failed", bound)
+		case <-tick:
+			if err := s.config.StreamPolicy.Check(ctx, req, a.session.snapshot()); err != nil {
+				s.metrics().IncrCounter([]string{"socks5", "stream", "terminated"}, 1)
+				return fmt.Errorf("Association of %v terminated by policy: %v", req.RemoteAddr, err)
+			}
+		case <-idle:
+			last := time.Unix(0, atomic.LoadInt64(&a.active))
+			if left := idleTimeout - time.Since(last); left > 0 {
+				idleTimer.Reset(left)
+				continue
+			}
+			s.metrics().IncrCounter([]string{"socks5", "handshake", "reaped"}, 1, Label{Name: "kind", Value: "associate"})
+			s.tracef(ctx, "associate", "idle for %v, reaped", idleTimeout)
+			req.relayEnd = &RelayEnd{Side: SideProxy, Class: errClassTimeout, Err: ErrIdleTimeout}
+			return fmt.Errorf("Association of %v reaped: %v", req.RemoteAddr, ErrIdleTimeout)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// keepAliveConn is implemented by connections supporting
+// TCP keepalives, such as *net.TCPConn
+type keepAliveConn interface {
+	SetKeepAlive(keepalive bool) error
+	SetKeepAlivePeriod(d time.Duration) error
+}
+
+// PortRange is an inclusive range of ports
+type PortRange struct {
+	Min, Max int
+}
+
+// listenRelay is used to bind the UDP relay of an association,
+// within the UDPPortRange if set
+func (s *Server) listenRelay(req *Request) (*net.UDPConn, error) {
+	addr := s.relayAddr(req)
+	r := s.config.UDPPortRange
+	if r.Min <= 0 && r.Max <= 0 {
+		return net.ListenUDP("udp", addr)
+	}
+	if r.Min <= 0 || r.Max < r.Min || r.Max > 65535 {
+		return nil, fmt.Errorf("Invalid UDP port range %d-%d", r.Min, r.Max)
+	}
+
+	// Start at a random port, to spread the associations
+	size := r.Max - r.Min + 1
+	offset := rand.Intn(size)
+	var err error
+	for i := 0; i < size; i++ {
+		addr.Port = r.Min + (offset+i)%size
+		var pc *net.UDPConn
+		if pc, err = net.ListenUDP("udp", addr); err == nil {
+			return pc, nil
+		}
+	}
+	return nil, fmt.Errorf("No free port in %d-%d: %w", r.Min, r.Max, err)
+}
+
+// relayAddr returns the address to relay the datagrams of an
+// association on, which is the address the client reached us at
+// unless configured otherwise
+func (s *Server) relayAddr(req *Request) *net.UDPAddr {
+	switch {
+	case s.config.UDPDualStack:
+		// The wildcard address accepts datagrams of both families
+		return &net.UDPAddr{}
+	case s.config.BindIP != nil:
+		return &net.UDPAddr{IP: s.config.BindIP}
+	case req.localAddr != nil:
+		return &net.UDPAddr{IP: req.localAddr.IP, Zone: req.localAddr.Zone}
+	}
+	return &net.UDPAddr{}
+}
+
+// newAssociation prepares the state of an association,
+// applying the StrictUDPClientBinding
+func (s *Server) newAssociation(ctx context.Context, req *Request, pc *net.UDPConn) *association {
+	a := &association{
+		s:       s,
+		ctx:     ctx,
+		req:     req,
+		pc:      pc,
+		session: &streamCounters{start: time.Now()},
+		active:  time.Now().UnixNano(),
+		dests:   make(map[string]*net.UDPAddr),
+		peers:   make(map[string]struct{}),
+	}
+	announced := req.DestAddr
+	switch s.config.StrictUDPClientBinding {
+	case UDPBindClientIP, UDPBindClientAddr:
+		if req.RemoteAddr != nil {
+			a.clientIP = req.RemoteAddr.IP
+			if specified(announced.IP) && isIPv4(announced.IP) != isIPv4(a.clientIP) {
+				a.altIP = announced.IP
+			}
+		}
+		if s.config.StrictUDPClientBinding == UDPBindClientAddr {
+			a.clientPort = announced.Port
+		}
+	default:
+		if specified(announced.IP) {
+			a.clientIP = announced.IP
+		}
+		a.clientPort = announced.Port
+	}
+	return a
+}
+
+// relay is used to forward datagrams until the socket is closed
+func (a *association) relay() {
+	buf := make([]byte, maxUDPPacketSize)
+	for {
+		n, from, err := a.pc.ReadFromUDP(buf)
+		if err != nil {
+			if isICMPError(err) && a.icmp(err) {
+				continue
+			}
+			return
+		}
+		if _, ok := a.peers[from.String()]; ok {
+			a.fromPeer(buf[:n], from)
+			continue
+		}
+		if !a.isClient(from) {
+			a.drop("source")
+			continue
+		}
+		a.fromClient(buf[:n], from)
+		if a.err != nil {
+			return
+		}
+	}
+}
+
+// icmp handles the ICMP errors reported following err, returning
+// false if they end the association
+func (a *association) icmp(err error) bool {
+	for _, e := range readICMPErrors(a.pc, err) {
+		a.s.metrics().IncrCounter([]string{"socks5", "udp", "icmp"}, 1, Label{Name: "reason", Value: e.reason()})
+		a.s.tracef(a.ctx, "associate", "%v", e)
+		if a.s.config.UDPUnreachableTeardown && e.unreachable() {
+			a.err = e
+		}
+	}
+	return a.err == nil
+}
+
+// isClient checks if a datagram comes from the client, learning
+// the parts of its address which were not known yet
+func (a *association) isClient(from *net.UDPAddr) bool {
+	ip := a.clientIP
+	if ip != nil && isIPv4(ip) != isIPv4(from.IP) {
+		// Only an announced IP of the other family is accepted
+		if ip = a.altIP; ip == nil {
+			return false
+		}
+	}
+	if ip != nil && !ip.Equal(from.IP) {
+		return false
+	}
+	if a.clientPort != 0 && a.clientPort != from.Port {
+		return false
+	}
+	if a.client == nil && a.s.config.StrictUDPClientBinding != UDPBindClientIP {
+		// Lock in the first source
+		if a.clientIP == nil {
+			a.clientIP = from.IP
+		}
+		a.clientPort = from.Port
+	}
+	a.client = from
+	return true
+}
+
+func (a *association) drop(reason string) {
+	a.s.metrics().IncrCounter([]string{"socks5", "udp", "dropped"}, 1, Label{Name: "reason", Value: reason})
+}
+
+// fromClient is used to forward a datagram of the client
+func (a *association) fromClient(b []byte, from *net.UDPAddr) {
+	d, err := readUDPDatagram(b)
+	if err != nil {
+		a.drop("malformed")
+		return
+	}
+	if err := a.s.checkReserved("datagram", d.rsv); err != nil {
+		a.drop("malformed")
+		return
+	}
+	// Fragmentation is optional, and not supported
+	if d.Frag != 0 {
+		a.drop("fragment")
+		return
+	}
+
+	dest := a.destination(d.DestAddr)
+	if dest == nil {
+		a.drop("denied")
+		return
+	}
+	_, err = a.pc.WriteToUDP(d.Data, dest)
+	if err != nil && isICMPError(err) {
+		// The error is of an earlier datagram
+		if !a.icmp(err) {
+			return
+		}
+		_, err = a.pc.WriteToUDP(d.Data, dest)
+	}
+	if err != nil {
+		a.drop("write")
+		return
+	}
+	if len(a.peers) >= maxAssociationDests {
+		a.peers = make(map[string]struct{})
+	}
+	a.peers[dest.String()] = struct{}{}
+	atomic.AddUint64(&a.s.state.stats().bytesUp, uint64(len(d.Data)))
+	atomic.AddUint64(&a.session.up, uint64(len(d.Data)))
+	atomic.StoreInt64(&a.active, time.Now().UnixNano())
+}
+
+// fromPeer is used to relay a reply to the client
+func (a *association) fromPeer(b []byte, from *net.UDPAddr) {
+	if a.client == nil {
+		return
+	}
+	d := &UDPDatagram{DestAddr: &AddrSpec{IP: from.IP, Port: from.Port, Zone: from.Zone}, Data: b}
+	pkt, err := d.marshal()
+	if err != nil {
+		return
+	}
+	if _, err := a.pc.WriteToUDP(pkt, a.client); err != nil {
+		a.drop("write")
+		return
+	}
+	atomic.AddUint64(&a.s.state.stats().bytesDown, uint64(len(b)))
+	atomic.AddUint64(&a.session.down, uint64(len(b)))
+	atomic.StoreInt64(&a.active, time.Now().UnixNano())
+}
+
+// destination resolves the destination of a datagram and checks it
+// against the rules, remembering the outcome. Returns nil if denied.
+func (a *association) destination(addr *AddrSpec) *net.UDPAddr {
+	key := addr.String()
+	if dest, ok := a.dests[key]; ok {
+		return dest
+	}
+	if len(a.dests) >= maxAssociationDests {
+		a.dests = make(map[string]*net.UDPAddr)
+	}
+	dest := a.check(addr)
+	a.dests[key] = dest
+	return dest
+}
+
+// check is used to resolve and approve a new destination
+func (a *association) check(addr *AddrSpec) *net.UDPAddr {
+	s, ctx := a.s, a.ctx
+	dest := *addr
+	req := *a.req
+	req.DestAddr, req.realDestAddr = &dest, &dest
+	req.SentFQDN = dest.FQDN != ""
+	if err := s.checkAddrType(req.SentFQDN); err != nil {
+		s.deny(ctx, &req, DenyAddress, 0, fmt.Errorf("Invalid datagram destination: %v", err))
+		return nil
+	}
+	if dest.FQDN != "" {
+		name, err := s.validateFQDN(dest.FQDN)
+		if err != nil {
+			s.deny(ctx, &req, DenyAddress, 0, fmt.Errorf("Invalid datagram destination: %v", err))
+			return nil
+		}
+		dest.FQDN = name
+		_, ip, err := s.config.Resolver.Resolve(ctx, name)
+		if err != nil {
+			s.logf(LogWarn, "Failed to resolve datagram destination %q: %v", name, err)
+			return nil
+		}
+		dest.IP = ip
+	}
+
+	if err := s.checkSelf(&req); err != nil {
+		s.deny(ctx, &req, DenySelf, 0, err)
+		return nil
+	}
+	if ctx_, ok := s.config.Rules.Allow(ctx, &req); !ok {
+		s.deny(ctx, &req, DenyRule, 0, denialFromContext(ctx_).denyError("Datagram", &dest))
+		return nil
+	}
+	return &net.UDPAddr{IP: dest.IP, Port: dest.Port, Zone: dest.Zone}
+}
+
+// specified checks if ip is set to an address other than the wildcard
+func specified(ip net.IP) bool {
+	return ip != nil && !ip.IsUnspecified()
+}
+
+// isIPv4 checks if ip is an IPv4 address, including the IPv4-mapped
+// form which IPv4 sources have on dual-stack sockets
+func isIPv4(ip net.IP) bool {
+	return ip.To4() != nil
+}
@@ -0,0 +1,505 @@
+package socks5
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// udpEcho starts a UDP server echoing datagrams back to their source
+func udpEcho(t *testing.T) *net.UDPConn {
+	pc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := pc.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			pc.WriteToUDP(buf[:n], from)
+		}
+	}()
+	return pc
+}
+
+// associate sets up an association through the server at addr,
+// announcing the given address, and returns the control connection
+// and relay address
+func associate(t *testing.T, addr net.Addr, announced *AddrSpec) (net.Conn, *net.UDPAddr) {
+	conn, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	req := []byte{5, 1, NoAuth, 5, AssociateCommand, 0}
+	body, _ := formatAddrSpec(announced)
+	conn.Write(append(req, body...))
+
+	out := make([]byte, 2)
+	if _, err := io.ReadFull(conn, out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp, bind, err := ReadReply(conn)
+	if err != nil || resp != SuccessReply {
+		t.Fatalf("bad: %v %v", resp, err)
+	}
+	return conn, &net.UDPAddr{IP: bind.IP, Port: bind.Port}
+}
+
+// exchange sends a datagram to dest through the relay, and waits
+// for a reply. Returns nil if none arrives.
+func exchange(t *testing.T, pc *net.UDPConn, relay *net.UDPAddr, dest *AddrSpec, data []byte) *UDPDatagram {
+	pkt, err := (&UDPDatagram{DestAddr: dest, Data: data}).MarshalBinary()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := pc.WriteToUDP(pkt, relay); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	pc.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	buf := make([]byte, 1500)
+	n, _, err := pc.ReadFromUDP(buf)
+	if err != nil {
+		return nil
+	}
+	d, err := readUDPDatagram(buf[:n])
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return d
+}
+
+func udpClient(t *testing.T) *net.UDPConn {
+	pc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return pc
+}
+
+func TestAssociate_Unspecified(t *testing.T) {
+	echo := udpEcho(t)
+	defer echo.Close()
+	echoAddr := echo.LocalAddr().(*net.UDPAddr)
+	dest := &AddrSpec{IP: echoAddr.IP, Port: echoAddr.Port}
+
+	metrics := newTestMetrics()
+	serv, _ := New(&Config{Metrics: metrics})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	go serv.Serve(l)
+
+	// Clients commonly announce 0.0.0.0:0
+	ctrl, relay := associate(t, l.Addr(), &AddrSpec{IP: net.IPv4zero})
+	defer ctrl.Close()
+	if !relay.IP.Equal(net.IPv4(127, 0, 0, 1)) || relay.Port == 0 {
+		t.Fatalf("bad: %v", relay)
+	}
+
+	pc := udpClient(t)
+	defer pc.Close()
+	d := exchange(t, pc, relay, dest, []byte("ping"))
+	if d == nil {
+		t.Fatalf("no reply")
+	}
+	if !bytes.Equal(d.Data, []byte("ping")) || !d.DestAddr.IP.Equal(echoAddr.IP) || d.DestAddr.Port != echoAddr.Port {
+		t.Fatalf("bad: %v", d)
+	}
+	if stats := serv.Stats(); stats.BytesUp != 4 || stats.BytesDown != 4 {
+		t.Fatalf("bad: %v", stats)
+	}
+
+	// The association is bound to the first source
+	other := udpClient(t)
+	defer other.Close()
+	if d := exchange(t, other, relay, dest, []byte("ping")); d != nil {
+		t.Fatalf("unexpected reply: %v", d)
+	}
+	if metrics.counter("socks5.udp.dropped") != 1 {
+		t.Fatalf("bad: %v", metrics.counters)
+	}
+
+	// Closing the control connection ends the association
+	ctrl.Close()
+	deadline := time.Now().Add(time.Second)
+	for {
+		if d := exchange(t, pc, relay, dest, []byte("ping")); d == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("association still relaying")
+		}
+	}
+}
+
+func TestAssociate_StrictBinding(t *testing.T) {
+	echo := udpEcho(t)
+	defer echo.Close()
+	echoAddr := echo.LocalAddr().(*net.UDPAddr)
+	dest := &AddrSpec{IP: echoAddr.IP, Port: echoAddr.Port}
+
+	for _, binding := range []UDPClientBinding{UDPBindClientIP, UDPBindClientAddr} {
+		serv, _ := New(&Config{StrictUDPClientBinding: binding})
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		go serv.Serve(l)
+
+		pc, other := udpClient(t), udpClient(t)
+		port := pc.LocalAddr().(*net.UDPAddr).Port
+
+		// The announced IP is ignored in favor of the client's
+		ctrl, relay := associate(t, l.Addr(), &AddrSpec{IP: net.IPv4(192, 0, 2, 1), Port: port})
+		if d := exchange(t, pc, relay, dest, []byte("ping")); d == nil {
+			t.Fatalf("no reply for %v", binding)
+		}
+
+		// Only binding to the IP tolerates port changes
+		d := exchange(t, other, relay, dest, []byte("ping"))
+		if (d != nil) != (binding == UDPBindClientIP) {
+			t.Fatalf("bad: %v %v", binding, d)
+		}
+
+		ctrl.Close()
+		pc.Close()
+		other.Close()
+		l.Close()
+	}
+}
+
+func TestAssociate_Rules(t *testing.T) {
+	echo := udpEcho(t)
+	defer echo.Close()
+	echoAddr := echo.LocalAddr().(*net.UDPAddr)
+
+	metrics := newTestMetrics()
+	serv, _ := New(&Config{Rules: &PermitCommand{EnableAssociate: true}, DenySelf: true, Metrics: metrics})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	go serv.Serve(l)
+
+	ctrl, relay := associate(t, l.Addr(), &AddrSpec{IP: net.IPv4zero})
+	defer ctrl.Close()
+	pc := udpClient(t)
+	defer pc.Close()
+
+	// Datagrams to the proxy itself are dropped
+	if d := exchange(t, pc, relay, &AddrSpec{IP: echoAddr.IP, Port: echoAddr.Port}, []byte("ping")); d != nil {
+		t.Fatalf("unexpected reply: %v", d)
+	}
+	if metrics.counter("socks5.udp.dropped") != 1 {
+		t.Fatalf("bad: %v", metrics.counters)
+	}
+}
+
+func TestAssociate_DualStack(t *testing.T) {
+	if l, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6loopback}); err != nil {
+		t.Skipf("IPv6 loopback not available: %v", err)
+	} else {
+		l.Close()
+	}
+	echo := udpEcho(t)
+	defer echo.Close()
+	echoAddr := echo.LocalAddr().(*net.UDPAddr)
+	dest := &AddrSpec{IP: echoAddr.IP, Port: echoAddr.Port}
+
+	serv, _ := New(&Config{UDPDualStack: true, StrictUDPClientBinding: UDPBindClientIP})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	go serv.Serve(l)
+
+	// The client connects over IPv4, but announces its IPv6 address
+	ctrl, relay := associate(t, l.Addr(), &AddrSpec{IP: net.IPv6loopback})
+	defer ctrl.Close()
+	if !relay.IP.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Fatalf("bad: %v", relay)
+	}
+
+	pc6, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6loopback})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer pc6.Close()
+	relay6 := &net.UDPAddr{IP: net.IPv6loopback, Port: relay.Port}
+	d := exchange(t, pc6, relay6, dest, []byte("ping"))
+	if d == nil {
+		t.Fatalf("no reply")
+	}
+	if !d.DestAddr.IP.Equal(echoAddr.IP) || len(d.DestAddr.IP) != net.IPv4len {
+		t.Fatalf("bad: %v", d.DestAddr)
+	}
+
+	// Datagrams over IPv4 are still accepted
+	pc := udpClient(t)
+	defer pc.Close()
+	if d := exchange(t, pc, relay, dest, []byte("ping")); d == nil {
+		t.Fatalf("no reply")
+	}
+}
+
+func TestAssociate_OtherFamily(t *testing.T) {
+	if l, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6loopback}); err != nil {
+		t.Skipf("IPv6 loopback not available: %v", err)
+	} else {
+		l.Close()
+	}
+	metrics := newTestMetrics()
+	serv, _ := New(&Config{UDPDualStack: true, StrictUDPClientBinding: UDPBindClientIP, Metrics: metrics})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	go serv.Serve(l)
+
+	// Without an announced IPv6 address, IPv6 sources are not the client
+	ctrl, relay := associate(t, l.Addr(), &AddrSpec{IP: net.IPv4zero})
+	defer ctrl.Close()
+	pc6, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6loopback})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer pc6.Close()
+	relay6 := &net.UDPAddr{IP: net.IPv6loopback, Port: relay.Port}
+	if d := exchange(t, pc6, relay6, &AddrSpec{IP: net.IPv6loopback, Port: 9}, []byte("ping")); d != nil {
+		t.Fatalf("unexpected reply: %v", d)
+	}
+	if metrics.counter("socks5.udp.dropped") != 1 {
+		t.Fatalf("bad: %v", metrics.counters)
+	}
+}
+
+// closedUDPPort returns an address on which nothing listens
+func closedUDPPort(t *testing.T) *AddrSpec {
+	pc := udpClient(t)
+	addr := pc.LocalAddr().(*net.UDPAddr)
+	pc.Close()
+	return &AddrSpec{IP: addr.IP, Port: addr.Port}
+}
+
+func TestAssociate_ICMPError(t *testing.T) {
+	if !supportsICMPErrors {
+		t.Skip("ICMP errors not supported")
+	}
+	echo := udpEcho(t)
+	defer echo.Close()
+	echoAddr := echo.LocalAddr().(*net.UDPAddr)
+	dest := &AddrSpec{IP: echoAddr.IP, Port: echoAddr.Port}
+
+	metrics := newTestMetrics()
+	serv, _ := New(&Config{Metrics: metrics})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	go serv.Serve(l)
+
+	ctrl, relay := associate(t, l.Addr(), &AddrSpec{IP: net.IPv4zero})
+	defer ctrl.Close()
+	pc := udpClient(t)
+	defer pc.Close()
+
+	// The port unreachable error is counted, and the association survives
+	if d := exchange(t, pc, relay, closedUDPPort(t), []byte("ping")); d != nil {
+		t.Fatalf("unexpected reply: %v", d)
+	}
+	if d := exchange(t, pc, relay, dest, []byte("ping")); d == nil {
+		t.Fatalf("no reply")
+	}
+	if metrics.counter("socks5.udp.icmp") != 1 {
+		t.Fatalf("bad: %v", metrics.counters)
+	}
+}
+
+func TestAssociate_UnreachableTeardown(t *testing.T) {
+	if !supportsICMPErrors {
+		t.Skip("ICMP errors not supported")
+	}
+	serv, _ := New(&Config{UDPUnreachableTeardown: true})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	go serv.Serve(l)
+
+	ctrl, relay := associate(t, l.Addr(), &AddrSpec{IP: net.IPv4zero})
+	defer ctrl.Close()
+	pc := udpClient(t)
+	defer pc.Close()
+	exchange(t, pc, relay, closedUDPPort(t), []byte("ping"))
+
+	// The server ends the association by closing the connection
+	ctrl.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := ctrl.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestAssociate_PortRange(t *testing.T) {
+	free, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	port := free.LocalAddr().(*net.UDPAddr).Port
+	free.Close()
+
+	advertised := net.IPv4(203, 0, 113, 1)
+	serv, _ := New(&Config{
+		UDPAdvertiseIP: advertised,
+		UDPPortRange:   PortRange{Min: port, Max: port},
+	})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	go serv.Serve(l)
+
+	conn, relay := associate(t, l.Addr(), &AddrSpec{IP: net.IPv4zero})
+	defer conn.Close()
+	if !relay.IP.Equal(advertised) || relay.Port != port {
+		t.Fatalf("bad: %v", relay)
+	}
+
+	// The range is exhausted while the association is open
+	conn2, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn2.Close()
+	conn2.SetDeadline(time.Now().Add(time.Second))
+	conn2.Write([]byte{5, 1, NoAuth, 5, AssociateCommand, 0, ipv4Address, 0, 0, 0, 0, 0, 0})
+	if _, err := io.ReadFull(conn2, make([]byte, 2)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if resp, _, err := ReadReply(conn2); err != nil || resp != ServerFailure {
+		t.Fatalf("bad: %v %v", resp, err)
+	}
+}
+
+// keepAlivePipe records the keepalive set on a pipe
+type keepAlivePipe struct {
+	net.Conn
+	period chan time.Duration
+}
+
+func (p *keepAlivePipe) SetKeepAlive(keepalive bool) error {
+	return nil
+}
+
+func (p *keepAlivePipe) SetKeepAlivePeriod(d time.Duration) error {
+	p.period <- d
+	return nil
+}
+
+func TestAssociate_KeepAlive(t *testing.T) {
+	s := &Server{config: &Config{
+		Rules:              PermitAll(),
+		Logger:             newDefaultLogger(),
+		AssociateKeepAlive: 5 * time.Second,
+	}}
+	client, server := net.Pipe()
+	conn := &keepAlivePipe{Conn: server, period: make(chan time.Duration, 1)}
+	req := &Request{
+		Version:   socks5Version,
+		Command:   AssociateCommand,
+		DestAddr:  &AddrSpec{IP: net.IPv4zero},
+		bufConn:   server,
+		localAddr: &AddrSpec{IP: net.IPv4(127, 0, 0, 1)},
+	}
+	errCh := make(chan error, 1)
+	go func() { errCh <- s.handleAssociate(context.Background(), conn, req) }()
+
+	client.SetDeadline(time.Now().Add(time.Second))
+	if resp, _, err := ReadReply(client); err != nil || resp != SuccessReply {
+		t.Fatalf("bad: %v %v", resp, err)
+	}
+	select {
+	case period := <-conn.period:
+		if period != 5*time.Second {
+			t.Fatalf("bad: %v", period)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected keepalive")
+	}
+
+	// The association ends with its control connection
+	client.Close()
+	select {
+	case err := <-errCh:
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timeout")
+	}
+}
+
+func TestAssociate_IdleTimeout(t *testing.T) {
+	metrics := newTestMetrics()
+	serv, _ := New(&Config{AssociateIdleTimeout: 100 * time.Millisecond, Metrics: metrics})
+	closed := make(chan *Event, 1)
+	serv.Subscribe(func(e *Event) {
+		if e.Type == EventConnClosed {
+			closed <- e
+		}
+	})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	go serv.Serve(l)
+
+	echo := udpEcho(t)
+	defer echo.Close()
+	target := echo.LocalAddr().(*net.UDPAddr)
+	ctrl, relay := associate(t, l.Addr(), &AddrSpec{IP: net.IPv4zero})
+	defer ctrl.Close()
+	pc := udpClient(t)
+	defer pc.Close()
+
+	// Traffic keeps the association open past the timeout
+	for i := 0; i < 5; i++ {
+		if d := exchange(t, pc, relay, &AddrSpec{IP: target.IP, Port: target.Port}, []byte("ping")); d == nil {
+			t.Fatalf("%d: no reply", i)
+		}
+		time.Sleep(40 * time.Millisecond)
+	}
+
+	// Once idle, the server reaps it by closing the connection
+	ctrl.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := ctrl.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("err: %v", err)
+	}
+	select {
+	case e := <-closed:
+		if e.Reason != CloseIdleTimeout {
+			t.Fatalf("bad: %v", e.Reason)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timeout")
+	}
+	if metrics.counter("socks5.handshake.reaped") != 1 {
+		t.Fatalf("bad: %v", metrics.counters)
+	}
+}
@@ -3,6 +3,9 @@ package socks5
 import (
 	"fmt"
 	"io"
+	"net"
+
+	"golang.org/x/net/context"
 )
 
 const (
@@ -17,8 +20,23 @@ const (
 var (
 	UserAuthFailed  = fmt.Errorf("User authentication failed")
 	NoSupportedAuth = fmt.Errorf("No supported authentication mechanism")
+
+	// ErrEmptyCredentials is returned when RejectEmpty is set
+	// and the client sent an empty username or password
+	ErrEmptyCredentials = fmt.Errorf("%w: empty username or password", UserAuthFailed)
+
+	// ErrCredentialsTooLong is returned when the client sent a username
+	// or password exceeding MaxUsernameLen or MaxPasswordLen
+	ErrCredentialsTooLong = fmt.Errorf("%w: username or password too long", UserAuthFailed)
+
+	// ErrAuthNotExclusive is returned when an Exclusive method was
+	// offered by the client along with other methods
+	ErrAuthNotExclusive = fmt.Errorf("%w: method must be offered exclusively", NoSupportedAuth)
 )
 
+// maxUserPassLen is the longest username or password RFC 1929 allows
+const maxUserPassLen = 255
+
 // A Request encapsulates authentication state provided
 // during negotiation
 type AuthContext struct {
@@ -35,6 +53,16 @@ type Authenticator interface {
 	GetCode() uint8
 }
 
+// ConnAuthenticator is an optional interface for Authenticators which
+// need the underlying connection, for example to check its TLS state or
+// peer address, or to set deadlines during the sub-negotiation. It is
+// used instead of Authenticate when the connection is known. Reads must
+// go through reader, which holds any data already buffered from conn.
+type ConnAuthenticator interface {
+	Authenticator
+	AuthenticateConn(ctx context.Context, conn net.Conn, reader io.Reader) (*AuthContext, error)
+}
+
 // NoAuthAuthenticator is used to handle the "No Authentication" mode
 type NoAuthAuthenticator struct{}
 
@@ -51,62 +79,121 @@ func (a NoAuthAuthenticator) Authenticate(reader io.Reader, writer io.Writer) (*
 // authentication
 type UserPassAuthenticator struct {
 	Credentials CredentialStore
+
+	// RejectEmpty fails zero-length usernames and passwords,
+	// which RFC 1929 does not allow, without checking them
+	// against the Credentials
+	RejectEmpty bool
+
+	// MaxUsernameLen and MaxPasswordLen bound the accepted lengths,
+	// below the 255 bytes of RFC 1929. Zero allows 255 bytes.
+	MaxUsernameLen int
+	MaxPasswordLen int
+
+	// Exclusive requires the client to offer only user/pass auth,
+	// rejecting clients which would fall back to other methods
+	Exclusive bool
 }
 
 func (a UserPassAuthenticator) GetCode() uint8 {
 	return UserPassAuth
 }
 
+func (a UserPassAuthenticator) exclusive() bool {
+	return a.Exclusive
+}
+
+// validate checks the lengths of the credentials sent by the client
+func (a UserPassAuthenticator) validate(user, pass string) error {
+	if a.RejectEmpty && (user == "" || pass == "") {
+		return ErrEmptyCredentials
+	}
+	if len(user) > maxLen(a.MaxUsernameLen) || len(pass) > maxLen(a.MaxPasswordLen) {
+		return ErrCredentialsTooLong
+	}
+	return nil
+}
+
+// maxLen returns the configured maximum length, defaulting to RFC 1929
+func maxLen(n int) int {
+	if n <= 0 || n > maxUserPassLen {
+		return maxUserPassLen
+	}
+	return n
+}
+
 func (a UserPassAuthenticator) Authenticate(reader io.Reader, writer io.Writer) (*AuthContext, error) {
 	// Tell the client to use user/pass auth
 	if _, err := writer.Write([]byte{socks5Version, UserPassAuth}); err != nil {
 		return nil, err
 	}
 
+	// Get the username and password
+	user, pass, err := readUserPass(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	// Validate the lengths before the password
+	if err := a.validate(user, pass); err != nil {
+		if _, werr := writer.Write([]byte{userAuthVersion, authFailure}); werr != nil {
+			return nil, werr
+		}
+		return nil, err
+	}
+
+	// Verify the password
+	payload, valid := credentialAttributes(a.Credentials, user, pass)
+	if valid {
+		if _, err := writer.Write([]byte{userAuthVersion, authSuccess}); err != nil {
+			return nil, err
+		}
+	} else {
+		if _, err := writer.Write([]byte{userAuthVersion, authFailure}); err != nil {
+			return nil, err
+		}
+		return nil, UserAuthFailed
+	}
+
+	// Done
+	payload["Username"] = user
+	return &AuthContext{UserPassAuth, payload}, nil
+}
+
+// readUserPass is used to read the RFC 1929 username/password
+// sub-negotiation request
+func readUserPass(reader io.Reader) (string, string, error) {
 	// Get the version and username length
 	header := []byte{0, 0}
 	if _, err := io.ReadAtLeast(reader, header, 2); err != nil {
-		return nil, err
+		return "", "", err
 	}
 
 	// Ensure we are compatible
 	if header[0] != userAuthVersion {
-		return nil, fmt.Errorf("Unsupported auth version: %v", header[0])
+		return "", "", fmt.Errorf("Unsupported auth version: %v", header[0])
 	}
 
 	// Get the user name
 	userLen := int(header[1])
 	user := make([]byte, userLen)
 	if _, err := io.ReadAtLeast(reader, user, userLen); err != nil {
-		return nil, err
+		return "", "", err
 	}
 
 	// Get the password length
-	if _, err := reader.Read(header[:1]); err != nil {
-		return nil, err
+	if _, err := io.ReadFull(reader, header[:1]); err != nil {
+		return "", "", err
 	}
 
 	// Get the password
 	passLen := int(header[0])
 	pass := make([]byte, passLen)
 	if _, err := io.ReadAtLeast(reader, pass, passLen); err != nil {
-		return nil, err
+		return "", "", err
 	}
 
-	// Verify the password
-	if a.Credentials.Valid(string(user), string(pass)) {
-		if _, err := writer.Write([]byte{userAuthVersion, authSuccess}); err != nil {
-			return nil, err
-		}
-	} else {
-		if _, err := writer.Write([]byte{userAuthVersion, authFailure}); err != nil {
-			return nil, err
-		}
-		return nil, UserAuthFailed
-	}
-
-	// Done
-	return &AuthContext{UserPassAuth, map[string]string{"Username": string(user)}}, nil
+	return string(user), string(pass), nil
 }
 
 // authenticate is used to handle connection authentication
@@ -114,21 +201,42 @@ func (s *Server) authenticate(conn io.Writer, bufConn io.Reader) (*AuthContext,
 	// Get the methods
 	methods, err := readMethods(bufConn)
 	if err != nil {
-		return nil, fmt.Errorf("Failed to get auth methods: %v", err)
+		return nil, fmt.Errorf("Failed to get auth methods: %w", err)
 	}
 
+	return selectAuth(context.Background(), nil, s.authMethods, methods, bufConn, conn)
+}
+
+// selectAuth is used to pick the first of the offered methods
+// we support and authenticate the client using it. If netConn is
+// set, it is handed to ConnAuthenticators.
+func selectAuth(ctx context.Context, netConn net.Conn, authMethods map[uint8]Authenticator, methods []byte, bufConn io.Reader, conn io.Writer) (*AuthContext, error) {
 	// Select a usable method
 	for _, method := range methods {
-		cator, found := s.authMethods[method]
-		if found {
-			return cator.Authenticate(bufConn, conn)
+		cator, found := authMethods[method]
+		if !found {
+			continue
+		}
+		if ex, ok := cator.(exclusiveAuthenticator); ok && ex.exclusive() && len(methods) > 1 {
+			noAcceptableAuth(conn)
+			return nil, ErrAuthNotExclusive
 		}
+		if ca, ok := cator.(ConnAuthenticator); ok && netConn != nil {
+			return ca.AuthenticateConn(ctx, netConn, bufConn)
+		}
+		return cator.Authenticate(bufConn, conn)
 	}
 
 	// No usable method found
 	return nil, noAcceptableAuth(conn)
 }
 
+// exclusiveAuthenticator is implemented by Authenticators
+// which may require being the only method offered
+type exclusiveAuthenticator interface {
+	exclusive() bool
+}
+
 // noAcceptableAuth is used to handle when we have no eligible
 // authentication mechanism
 func noAcceptableAuth(conn io.Writer) error {
@@ -140,7 +248,7 @@ func noAcceptableAuth(conn io.Writer) error {
 // and proceeding auth methods
 func readMethods(r io.Reader) ([]byte, error) {
 	header := []byte{0}
-	if _, err := r.Read(header); err != nil {
+	if _, err := io.ReadFull(r, header); err != nil {
 		return nil, err
 	}
 
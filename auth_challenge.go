@@ -0,0 +1,143 @@
+package socks5
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"io"
+)
+
+const (
+	// MinPrivateAuth and MaxPrivateAuth bound the method codes
+	// RFC 1928 reserves for private authentication methods
+	MinPrivateAuth = uint8(0x80)
+	MaxPrivateAuth = uint8(0xFE)
+
+	challengeVersion = uint8(1)
+	challengeSize    = 32
+)
+
+// ReadSubnegotiation reads a single framed sub-negotiation message.
+// A frame is a version byte, a two byte big-endian length and the payload.
+func ReadSubnegotiation(r io.Reader) (uint8, []byte, error) {
+	header := []byte{0, 0, 0}
+	if _, err := io.ReadAtLeast(r, header, 3); err != nil {
+		return 0, nil, err
+	}
+
+	payloadLen := (int(header[1]) << 8) | int(header[2])
+	payload := make([]byte, payloadLen)
+	if _, err := io.ReadAtLeast(r, payload, payloadLen); err != nil {
+		return 0, nil, err
+	}
+	return header[0], payload, nil
+}
+
+// WriteSubnegotiation writes a single framed sub-negotiation message,
+// the counterpart of ReadSubnegotiation
+func WriteSubnegotiation(w io.Writer, version uint8, payload []byte) error {
+	if len(payload) > 0xffff {
+		return fmt.Errorf("Sub-negotiation payload too large: %d", len(payload))
+	}
+	msg := make([]byte, 3+len(payload))
+	msg[0] = version
+	msg[1] = byte(len(payload) >> 8)
+	msg[2] = byte(len(payload) & 0xff)
+	copy(msg[3:], payload)
+	_, err := w.Write(msg)
+	return err
+}
+
+// SecretStore is used to look up the shared secret of a user
+// for challenge-response authentication
+type SecretStore interface {
+	Secret(user string) ([]byte, bool)
+}
+
+// StaticSecrets enables using a map directly as a secret store
+type StaticSecrets map[string][]byte
+
+func (s StaticSecrets) Secret(user string) ([]byte, bool) {
+	secret, ok := s[user]
+	return secret, ok
+}
+
+// ChallengeResponse computes the response a client must send
+// for the given challenge
+func ChallengeResponse(secret, challenge []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(challenge)
+	return mac.Sum(nil)
+}
+
+// ChallengeAuthenticator is an example private authentication method
+// based on an HMAC-SHA256 challenge-response exchange. The server sends
+// a random challenge frame, the client replies with a frame holding the
+// username length, the username and ChallengeResponse of its secret.
+// The server then replies with the version and a status byte.
+type ChallengeAuthenticator struct {
+	// Code is the method code, which should be between
+	// MinPrivateAuth and MaxPrivateAuth
+	Code uint8
+
+	// Secrets is used to look up the secret of a user
+	Secrets SecretStore
+
+	// Rand is the source of challenges. Defaults to crypto/rand.
+	Rand io.Reader
+}
+
+func (a ChallengeAuthenticator) GetCode() uint8 {
+	return a.Code
+}
+
+func (a ChallengeAuthenticator) Authenticate(reader io.Reader, writer io.Writer) (*AuthContext, error) {
+	// Tell the client to use our method
+	if _, err := writer.Write([]byte{socks5Version, a.Code}); err != nil {
+		return nil, err
+	}
+
+	// Send the challenge
+	src := a.Rand
+	if src == nil {
+		src = rand.Reader
+	}
+	challenge := make([]byte, challengeSize)
+	if _, err := io.ReadFull(src, challenge); err != nil {
+		return nil, fmt.Errorf("Failed to generate challenge: %v", err)
+	}
+	if err := WriteSubnegotiation(writer, challengeVersion, challenge); err != nil {
+		return nil, err
+	}
+
+	// Read the response
+	version, payload, err := ReadSubnegotiation(reader)
+	if err != nil {
+		return nil, err
+	}
+	if version != challengeVersion {
+		return nil, fmt.Errorf("Unsupported auth version: %v", version)
+	}
+	if len(payload) < 1 || len(payload) < 1+int(payload[0]) {
+		return nil, fmt.Errorf("Malformed challenge response")
+	}
+	userLen := int(payload[0])
+	user := string(payload[1 : 1+userLen])
+	response := payload[1+userLen:]
+
+	// Verify the response
+	secret, ok := a.Secrets.Secret(user)
+	if !ok || !hmac.Equal(response, ChallengeResponse(secret, challenge)) {
+		if _, err := writer.Write([]byte{challengeVersion, authFailure}); err != nil {
+			return nil, err
+		}
+		return nil, UserAuthFailed
+	}
+	if _, err := writer.Write([]byte{challengeVersion, authSuccess}); err != nil {
+		return nil, err
+	}
+
+	// Done
+	return &AuthContext{a.Code, map[string]string{"Username": user}}, nil
+}
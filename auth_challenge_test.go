@@ -0,0 +1,87 @@
+package socks5
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSubnegotiation_RoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteSubnegotiation(&buf, 1, []byte("hello")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.Equal(buf.Bytes(), []byte{1, 0, 5, 'h', 'e', 'l', 'l', 'o'}) {
+		t.Fatalf("bad: %v", buf.Bytes())
+	}
+
+	version, payload, err := ReadSubnegotiation(&buf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if version != 1 || string(payload) != "hello" {
+		t.Fatalf("bad: %v %v", version, payload)
+	}
+}
+
+func challengeRequest(user string, secret []byte, challenge []byte) *bytes.Buffer {
+	req := bytes.NewBuffer(nil)
+	req.Write([]byte{1, 0x80})
+	payload := append([]byte{byte(len(user))}, user...)
+	payload = append(payload, ChallengeResponse(secret, challenge)...)
+	WriteSubnegotiation(req, challengeVersion, payload)
+	return req
+}
+
+func TestChallengeAuth_Valid(t *testing.T) {
+	challenge := bytes.Repeat([]byte{7}, challengeSize)
+	req := challengeRequest("foo", []byte("secret"), challenge)
+	var resp bytes.Buffer
+
+	cator := ChallengeAuthenticator{
+		Code:    0x80,
+		Secrets: StaticSecrets{"foo": []byte("secret")},
+		Rand:    bytes.NewReader(challenge),
+	}
+	s, _ := New(&Config{AuthMethods: []Authenticator{cator}})
+
+	ctx, err := s.authenticate(&resp, req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if ctx.Method != 0x80 || ctx.Payload["Username"] != "foo" {
+		t.Fatalf("bad: %v", ctx)
+	}
+
+	expected := []byte{socks5Version, 0x80, challengeVersion, 0, challengeSize}
+	expected = append(expected, challenge...)
+	expected = append(expected, challengeVersion, authSuccess)
+	if !bytes.Equal(resp.Bytes(), expected) {
+		t.Fatalf("bad: %v", resp.Bytes())
+	}
+}
+
+func TestChallengeAuth_Invalid(t *testing.T) {
+	challenge := bytes.Repeat([]byte{7}, challengeSize)
+	req := challengeRequest("foo", []byte("wrong"), challenge)
+	var resp bytes.Buffer
+
+	cator := ChallengeAuthenticator{
+		Code:    0x80,
+		Secrets: StaticSecrets{"foo": []byte("secret")},
+		Rand:    bytes.NewReader(challenge),
+	}
+	s, _ := New(&Config{AuthMethods: []Authenticator{cator}})
+
+	ctx, err := s.authenticate(&resp, req)
+	if err != UserAuthFailed {
+		t.Fatalf("err: %v", err)
+	}
+	if ctx != nil {
+		t.Fatalf("bad: %v", ctx)
+	}
+
+	out := resp.Bytes()
+	if !bytes.Equal(out[len(out)-2:], []byte{challengeVersion, authFailure}) {
+		t.Fatalf("bad: %v", out)
+	}
+}
@@ -2,7 +2,11 @@ package socks5
 
 import (
 	"bytes"
+	"io"
+	"net"
 	"testing"
+
+	"golang.org/x/net/context"
 )
 
 func TestNoAuth(t *testing.T) {
@@ -117,3 +121,116 @@ func TestNoSupportedAuth(t *testing.T) {
 		t.Fatalf("bad: %v", out)
 	}
 }
+
+func TestPasswordAuth_Strict(t *testing.T) {
+	cred := StaticCredentials{
+		"foo": "",
+		"":    "bar",
+		"bar": "bazbaz",
+	}
+	cases := []struct {
+		offered []byte
+		user    string
+		pass    string
+		err     error
+	}{
+		{[]byte{UserPassAuth}, "foo", "", ErrEmptyCredentials},
+		{[]byte{UserPassAuth}, "", "bar", ErrEmptyCredentials},
+		{[]byte{UserPassAuth}, "bar", "bazbaz", ErrCredentialsTooLong},
+		{[]byte{NoAuth, UserPassAuth}, "foo", "bar", ErrAuthNotExclusive},
+	}
+	for _, tc := range cases {
+		req := bytes.NewBuffer(nil)
+		req.WriteByte(byte(len(tc.offered)))
+		req.Write(tc.offered)
+		req.Write([]byte{1, byte(len(tc.user))})
+		req.WriteString(tc.user)
+		req.WriteByte(byte(len(tc.pass)))
+		req.WriteString(tc.pass)
+		var resp bytes.Buffer
+
+		cator := UserPassAuthenticator{
+			Credentials:    cred,
+			RejectEmpty:    true,
+			MaxPasswordLen: 4,
+			Exclusive:      true,
+		}
+		s, _ := New(&Config{AuthMethods: []Authenticator{cator}})
+
+		_, err := s.authenticate(&resp, req)
+		if err != tc.err {
+			t.Fatalf("err: %v", err)
+		}
+
+		expected := []byte{socks5Version, UserPassAuth, 1, authFailure}
+		if tc.err == ErrAuthNotExclusive {
+			expected = []byte{socks5Version, noAcceptable}
+		}
+		if !bytes.Equal(resp.Bytes(), expected) {
+			t.Fatalf("bad: %v", resp.Bytes())
+		}
+	}
+
+	// Without the options, the credentials are checked as sent
+	req := bytes.NewBuffer([]byte{1, UserPassAuth, 1, 3, 'f', 'o', 'o', 0})
+	var resp bytes.Buffer
+	s, _ := New(&Config{Credentials: cred})
+	if _, err := s.authenticate(&resp, req); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+type connAuthenticator struct {
+	conn net.Conn
+	ctx  context.Context
+}
+
+func (a *connAuthenticator) GetCode() uint8 {
+	return NoAuth
+}
+
+func (a *connAuthenticator) Authenticate(reader io.Reader, writer io.Writer) (*AuthContext, error) {
+	return &AuthContext{NoAuth, map[string]string{"via": "reader"}}, nil
+}
+
+func (a *connAuthenticator) AuthenticateConn(ctx context.Context, conn net.Conn, reader io.Reader) (*AuthContext, error) {
+	a.conn, a.ctx = conn, ctx
+	return &AuthContext{NoAuth, map[string]string{"via": "conn"}}, nil
+}
+
+func TestConnAuthenticator(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	cator := &connAuthenticator{}
+	ctx := WithUser(context.Background(), "foo")
+
+	h := NewHandshake([]Authenticator{cator})
+	h.SetConn(ctx, server)
+	in := bytes.NewBuffer([]byte{5, 1, NoAuth})
+	var out bytes.Buffer
+	for i := 0; i < 2; i++ {
+		if err := h.Step(in, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	if h.AuthContext.Payload["via"] != "conn" {
+		t.Fatalf("bad: %v", h.AuthContext)
+	}
+	if cator.conn != server || cator.ctx != ctx {
+		t.Fatalf("bad: %v %v", cator.conn, cator.ctx)
+	}
+
+	// Without a connection, Authenticate is used
+	h = NewHandshake([]Authenticator{cator})
+	in = bytes.NewBuffer([]byte{5, 1, NoAuth})
+	for i := 0; i < 2; i++ {
+		if err := h.Step(in, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	if h.AuthContext.Payload["via"] != "reader" {
+		t.Fatalf("bad: %v", h.AuthContext)
+	}
+}
@@ -0,0 +1,57 @@
+package socks5
+
+import (
+	"io"
+)
+
+// TokenValidator is used to validate bearer tokens, for example by
+// verifying a JWT or through OAuth token introspection. On success
+// it returns the claims of the token.
+type TokenValidator interface {
+	ValidateToken(user, token string) (map[string]string, error)
+}
+
+// TokenAuthenticator is used to handle token based authentication.
+// It speaks the username/password sub-negotiation, with the token
+// sent in place of the password. The claims returned by the
+// validator are merged into the AuthContext payload.
+type TokenAuthenticator struct {
+	Validator TokenValidator
+}
+
+func (a TokenAuthenticator) GetCode() uint8 {
+	return UserPassAuth
+}
+
+func (a TokenAuthenticator) Authenticate(reader io.Reader, writer io.Writer) (*AuthContext, error) {
+	// Tell the client to use user/pass auth
+	if _, err := writer.Write([]byte{socks5Version, UserPassAuth}); err != nil {
+		return nil, err
+	}
+
+	// Get the username and token
+	user, token, err := readUserPass(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	// Verify the token
+	claims, err := a.Validator.ValidateToken(user, token)
+	if err != nil {
+		if _, err := writer.Write([]byte{userAuthVersion, authFailure}); err != nil {
+			return nil, err
+		}
+		return nil, UserAuthFailed
+	}
+	if _, err := writer.Write([]byte{userAuthVersion, authSuccess}); err != nil {
+		return nil, err
+	}
+
+	// Map the claims, the username is always that of the client
+	payload := make(map[string]string, len(claims)+1)
+	for k, v := range claims {
+		payload[k] = v
+	}
+	payload["Username"] = user
+	return &AuthContext{UserPassAuth, payload}, nil
+}
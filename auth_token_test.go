@@ -0,0 +1,61 @@
+package socks5
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+type staticTokens map[string]map[string]string
+
+func (s staticTokens) ValidateToken(user, token string) (map[string]string, error) {
+	claims, ok := s[token]
+	if !ok {
+		return nil, errors.New("invalid token")
+	}
+	return claims, nil
+}
+
+func TestTokenAuth_Valid(t *testing.T) {
+	req := bytes.NewBuffer(nil)
+	req.Write([]byte{1, UserPassAuth})
+	req.Write([]byte{1, 3, 'f', 'o', 'o', 3, 't', 'o', 'k'})
+	var resp bytes.Buffer
+
+	cator := TokenAuthenticator{Validator: staticTokens{
+		"tok": {"role": "admin", "Username": "spoofed"},
+	}}
+	s, _ := New(&Config{AuthMethods: []Authenticator{cator}})
+
+	ctx, err := s.authenticate(&resp, req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if ctx.Payload["Username"] != "foo" || ctx.Payload["role"] != "admin" {
+		t.Fatalf("bad: %v", ctx.Payload)
+	}
+
+	out := resp.Bytes()
+	if !bytes.Equal(out, []byte{socks5Version, UserPassAuth, 1, authSuccess}) {
+		t.Fatalf("bad: %v", out)
+	}
+}
+
+func TestTokenAuth_Invalid(t *testing.T) {
+	req := bytes.NewBuffer(nil)
+	req.Write([]byte{1, UserPassAuth})
+	req.Write([]byte{1, 3, 'f', 'o', 'o', 3, 'b', 'a', 'd'})
+	var resp bytes.Buffer
+
+	cator := TokenAuthenticator{Validator: staticTokens{}}
+	s, _ := New(&Config{AuthMethods: []Authenticator{cator}})
+
+	if _, err := s.authenticate(&resp, req); err != UserAuthFailed {
+		t.Fatalf("err: %v", err)
+	}
+
+	out := resp.Bytes()
+	if !bytes.Equal(out, []byte{socks5Version, UserPassAuth, 1, authFailure}) {
+		t.Fatalf("bad: %v", out)
+	}
+}
@@ -0,0 +1,135 @@
+package socks5
+
+import (
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// BalancePolicy selects how connections are spread over backends
+type BalancePolicy uint8
+
+const (
+	// BalanceRandom picks a random backend
+	BalanceRandom BalancePolicy = iota
+	// BalanceRoundRobin cycles through the backends
+	BalanceRoundRobin
+	// BalanceLeastConn picks the backend with the fewest open connections
+	BalanceLeastConn
+	// BalanceOrdered keeps the order of the registry, e.g. by
+	// the priority and weight of SRV records
+	BalanceOrdered
+)
+
+const (
+	defaultFailureTimeout = 10 * time.Second
+)
+
+// backendsKey is the context key of the ordered backends to try
+type backendsKey struct{}
+
+// backendStats tracks the state of a single backend
+type backendStats struct {
+	active     int
+	lastFailed time.Time
+}
+
+// balancer tracks the backends of a ServiceRouter
+type balancer struct {
+	l     sync.Mutex
+	next  int
+	stats map[string]*backendStats
+}
+
+// statsFor returns the stats of a backend, the lock must be held
+func (b *balancer) statsFor(addr *AddrSpec) *backendStats {
+	if b.stats == nil {
+		b.stats = make(map[string]*backendStats)
+	}
+	key := addr.Address()
+	st, ok := b.stats[key]
+	if !ok {
+		st = &backendStats{}
+		b.stats[key] = st
+	}
+	return st
+}
+
+// order returns the backends in the order they should be tried.
+// Backends which recently failed are moved to the end.
+func (b *balancer) order(policy BalancePolicy, timeout time.Duration, backends []*Backend) []*Backend {
+	b.l.Lock()
+	defer b.l.Unlock()
+
+	out := make([]*Backend, len(backends))
+	switch policy {
+	case BalanceRoundRobin:
+		start := b.next % len(backends)
+		b.next++
+		for i := range backends {
+			out[i] = backends[(start+i)%len(backends)]
+		}
+	case BalanceLeastConn:
+		copy(out, backends)
+		sort.SliceStable(out, func(i, j int) bool {
+			return b.statsFor(out[i].Addr).active < b.statsFor(out[j].Addr).active
+		})
+	case BalanceOrdered:
+		copy(out, backends)
+	default:
+		for i, j := range rand.Perm(len(backends)) {
+			out[i] = backends[j]
+		}
+	}
+
+	now := time.Now()
+	sort.SliceStable(out, func(i, j int) bool {
+		failedI := now.Sub(b.statsFor(out[i].Addr).lastFailed) < timeout
+		failedJ := now.Sub(b.statsFor(out[j].Addr).lastFailed) < timeout
+		return !failedI && failedJ
+	})
+	return out
+}
+
+// failed records a failed dial to a backend
+func (b *balancer) failed(addr *AddrSpec) {
+	b.l.Lock()
+	defer b.l.Unlock()
+	b.statsFor(addr).lastFailed = time.Now()
+}
+
+// opened records a connection to a backend, which
+// is released once the connection is closed
+func (b *balancer) opened(addr *AddrSpec, conn net.Conn) net.Conn {
+	b.l.Lock()
+	defer b.l.Unlock()
+	st := b.statsFor(addr)
+	st.active++
+	st.lastFailed = time.Time{}
+	return &backendConn{Conn: conn, release: func() {
+		b.l.Lock()
+		defer b.l.Unlock()
+		st.active--
+	}}
+}
+
+// backendConn releases its backend once closed
+type backendConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *backendConn) Close() error {
+	c.once.Do(c.release)
+	return c.Conn.Close()
+}
+
+func (c *backendConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
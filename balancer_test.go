@@ -0,0 +1,161 @@
+package socks5
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func testBackends(n int) []*Backend {
+	out := make([]*Backend, n)
+	for i := range out {
+		out[i] = &Backend{Addr: &AddrSpec{IP: net.IPv4(10, 0, 0, byte(i)), Port: 80}, Healthy: true}
+	}
+	return out
+}
+
+func TestBalancer_RoundRobin(t *testing.T) {
+	var b balancer
+	backends := testBackends(3)
+	for i := 0; i < 6; i++ {
+		out := b.order(BalanceRoundRobin, time.Second, backends)
+		if out[0] != backends[i%3] || out[1] != backends[(i+1)%3] {
+			t.Fatalf("bad order at %d: %v", i, out)
+		}
+	}
+}
+
+func TestBalancer_LeastConn(t *testing.T) {
+	var b balancer
+	backends := testBackends(2)
+	client, _ := net.Pipe()
+	conn := b.opened(backends[0].Addr, client)
+
+	if out := b.order(BalanceLeastConn, time.Second, backends); out[0] != backends[1] {
+		t.Fatalf("bad: %v", out)
+	}
+
+	conn.Close()
+	if out := b.order(BalanceLeastConn, time.Second, backends); out[0] != backends[0] {
+		t.Fatalf("bad: %v", out)
+	}
+}
+
+func TestBalancer_Failed(t *testing.T) {
+	var b balancer
+	backends := testBackends(2)
+	b.failed(backends[0].Addr)
+
+	for i := 0; i < 4; i++ {
+		if out := b.order(BalanceRoundRobin, time.Second, backends); out[1] != backends[0] {
+			t.Fatalf("bad: %v", out)
+		}
+	}
+
+	// Failures expire
+	if out := b.order(BalanceRoundRobin, 0, backends); out[0] != backends[0] {
+		t.Fatalf("bad: %v", out)
+	}
+}
+
+func TestServiceRouter_DialRetry(t *testing.T) {
+	backends := testBackends(3)
+	var addrs []*AddrSpec
+	for _, b := range backends {
+		addrs = append(addrs, b.Addr)
+	}
+	r := &ServiceRouter{
+		Registry: StaticRegistry{"web:80": addrs},
+		Policy:   BalanceRoundRobin,
+	}
+
+	var tried []string
+	dial := r.Dial(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		tried = append(tried, addr)
+		if addr != backends[2].Addr.Address() {
+			return nil, errors.New("connection refused")
+		}
+		client, _ := net.Pipe()
+		return client, nil
+	})
+
+	ctx, addr, err := r.Rewrite(context.Background(), &Request{DestAddr: &AddrSpec{FQDN: "web", Port: 80}})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	conn, err := dial(ctx, "tcp", addr.Address())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	if len(tried) != 3 {
+		t.Fatalf("bad: %v", tried)
+	}
+
+	// The failed backends are now tried last
+	_, addr, _ = r.Rewrite(context.Background(), &Request{DestAddr: &AddrSpec{FQDN: "web", Port: 80}})
+	if addr != backends[2].Addr {
+		t.Fatalf("bad: %v", addr)
+	}
+}
+
+func TestServiceRouter_Failover(t *testing.T) {
+	target := echoTarget(t)
+	defer target.Close()
+
+	// The first backend refuses connections on another loopback IP
+	dead, err := net.Listen("tcp", "127.0.0.2:0")
+	if err != nil {
+		t.Skipf("no loopback alias: %v", err)
+	}
+	deadAddr := dead.Addr().(*net.TCPAddr)
+	dead.Close()
+	live := target.Addr().(*net.TCPAddr)
+
+	r := &ServiceRouter{
+		Registry: healthRegistry{
+			{Addr: &AddrSpec{IP: deadAddr.IP, Port: deadAddr.Port}, Healthy: true},
+			{Addr: &AddrSpec{IP: live.IP, Port: live.Port}, Healthy: true},
+		},
+		Suffix: ".internal",
+		Policy: BalanceRoundRobin,
+	}
+	serv, _ := New(&Config{Resolver: r, Rewriter: r, Dial: r.Dial(nil)})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	go serv.Serve(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	msg := []byte{5, 1, NoAuth, 5, ConnectCommand, 0, fqdnAddress, 12}
+	msg = append(msg, "web.internal"...)
+	msg = append(msg, 0, 80)
+	conn.Write(msg)
+	if _, err := io.ReadFull(conn, make([]byte, 2)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp, _, err := ReadReply(conn)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if resp != SuccessReply {
+		t.Fatalf("bad: %v", resp)
+	}
+
+	conn.Write([]byte("ping"))
+	out := make([]byte, 4)
+	if _, err := io.ReadFull(conn, out); err != nil || string(out) != "ping" {
+		t.Fatalf("bad: %q %v", out, err)
+	}
+}
@@ -0,0 +1,256 @@
+package socks5
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// BlocklistSource is used to fetch a destination block list.
+// The list holds one entry per line, either a domain, which also
+// blocks its subdomains, an IP address or a CIDR block. Blank
+// lines and lines starting with '#' are ignored.
+type BlocklistSource interface {
+	Open() (io.ReadCloser, error)
+}
+
+// FileBlocklist reads a block list from a file
+type FileBlocklist string
+
+func (f FileBlocklist) Open() (io.ReadCloser, error) {
+	return os.Open(string(f))
+}
+
+// defaultBlocklistClient fetches the URL block lists, bounding
+// each fetch so a stalled server cannot hang the reloads
+var defaultBlocklistClient = &http.Client{Timeout: 30 * time.Second}
+
+// URLBlocklist fetches a block list over HTTP
+type URLBlocklist struct {
+	URL string
+	// Client defaults to a client with a 30 second timeout
+	Client *http.Client
+}
+
+func (u *URLBlocklist) Open() (io.ReadCloser, error) {
+	client := u.Client
+	if client == nil {
+		client = defaultBlocklistClient
+	}
+	resp, err := client.Get(u.URL)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("Unexpected status fetching %s: %s", u.URL, resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// blocklist is an immutable set of blocked destinations
+type blocklist struct {
+	domains  map[string]struct{}
+	networks []*net.IPNet
+}
+
+// parseBlocklist reads a block list
+func parseBlocklist(r io.Reader) (*blocklist, error) {
+	b := &blocklist{domains: make(map[string]struct{})}
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		entry := strings.TrimSpace(scanner.Text())
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+
+		switch {
+		case strings.Contains(entry, "/"):
+			_, n, err := net.ParseCIDR(entry)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid block list entry on line %d: %v", line, err)
+			}
+			b.networks = append(b.networks, n)
+		case net.ParseIP(entry) != nil:
+			ip := net.ParseIP(entry)
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			b.networks = append(b.networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+		default:
+			b.domains[strings.ToLower(strings.TrimSuffix(entry, "."))] = struct{}{}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// blocksDomain checks the domain and all its parent domains
+func (b *blocklist) blocksDomain(name string) bool {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	for name != "" {
+		if _, ok := b.domains[name]; ok {
+			return true
+		}
+		i := strings.IndexByte(name, '.')
+		if i < 0 {
+			break
+		}
+		name = name[i+1:]
+	}
+	return false
+}
+
+// DynamicRuleSet is a RuleSet denying destinations on a block list,
+// such as a malware feed, which is periodically reloaded. Reloads
+// atomically swap the list, keeping the previous one on errors.
+// The fields must be set before Start, which loads the list:
+//
+//	d := &socks5.DynamicRuleSet{Source: source, Interval: time.Hour, OnError: onError}
+//	if err := d.Start(); err != nil {
+//		...
+//	}
+type DynamicRuleSet struct {
+	// Source is the block list
+	Source BlocklistSource
+
+	// Interval is how often the list is reloaded. Zero
+	// disables reloading.
+	Interval time.Duration
+
+	// Rules is consulted for destinations which are not blocked.
+	// Defaults to PermitAll.
+	Rules RuleSet
+
+	// Metrics receives hit and reload counts. Defaults to NoopMetrics.
+	Metrics Metrics
+
+	// OnChange is invoked after each successful reload with
+	// the number of blocked domains and networks
+	OnChange func(domains, networks int)
+
+	// OnError is invoked when a reload fails
+	OnError func(err error)
+
+	table    atomic.Value
+	initOnce sync.Once
+	stopOnce sync.Once
+	stopCh   chan struct{}
+}
+
+// NewDynamicRuleSet loads the block list and reloads it every interval,
+// until Stop is called. An interval of zero disables reloading. As it
+// starts reloading right away, use Start to set Metrics or the hooks.
+func NewDynamicRuleSet(source BlocklistSource, interval time.Duration) (*DynamicRuleSet, error) {
+	d := &DynamicRuleSet{Source: source, Interval: interval}
+	if err := d.Start(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// Start loads the block list, then reloads it every Interval until
+// Stop is called. The initial load is reported to Metrics and OnChange
+// as the reloads are. Start must be called once, before use.
+func (d *DynamicRuleSet) Start() error {
+	if err := d.Reload(); err != nil {
+		return err
+	}
+	if d.Interval > 0 {
+		go d.run(d.stop())
+	}
+	return nil
+}
+
+// stop returns the channel closed by Stop
+func (d *DynamicRuleSet) stop() chan struct{} {
+	d.initOnce.Do(func() { d.stopCh = make(chan struct{}) })
+	return d.stopCh
+}
+
+func (d *DynamicRuleSet) metrics() Metrics {
+	if d.Metrics == nil {
+		return NoopMetrics{}
+	}
+	return d.Metrics
+}
+
+// Reload fetches the block list and swaps it in
+func (d *DynamicRuleSet) Reload() error {
+	b, err := d.load()
+	if err != nil {
+		d.metrics().IncrCounter([]string{"socks5", "blocklist", "reload_error"}, 1)
+		return err
+	}
+	d.table.Store(b)
+	d.metrics().IncrCounter([]string{"socks5", "blocklist", "reload"}, 1)
+	d.metrics().SetGauge([]string{"socks5", "blocklist", "entries"}, float32(len(b.domains)+len(b.networks)))
+	if d.OnChange != nil {
+		d.OnChange(len(b.domains), len(b.networks))
+	}
+	return nil
+}
+
+func (d *DynamicRuleSet) load() (*blocklist, error) {
+	r, err := d.Source.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return parseBlocklist(r)
+}
+
+// Stop ends the periodic reloading
+func (d *DynamicRuleSet) Stop() {
+	d.stopOnce.Do(func() { close(d.stop()) })
+}
+
+func (d *DynamicRuleSet) run(stopCh chan struct{}) {
+	ticker := time.NewTicker(d.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := d.Reload(); err != nil && d.OnError != nil {
+				d.OnError(err)
+			}
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+func (d *DynamicRuleSet) Allow(ctx context.Context, req *Request) (context.Context, bool) {
+	// Fail closed until the list was loaded
+	b, ok := d.table.Load().(*blocklist)
+	if !ok {
+		return DenyWith(ctx, RuleFailure, "block list not loaded"), false
+	}
+	for _, dest := range []*AddrSpec{req.DestAddr, req.realDestAddr} {
+		if dest == nil {
+			continue
+		}
+		if (dest.FQDN != "" && b.blocksDomain(dest.FQDN)) ||
+			(dest.IP != nil && containsIP(b.networks, dest.IP)) {
+			d.metrics().IncrCounter([]string{"socks5", "blocklist", "hit"}, 1)
+			return DenyWith(ctx, RuleFailure, "destination blocklisted"), false
+		}
+	}
+
+	if d.Rules == nil {
+		return ctx, true
+	}
+	return d.Rules.Allow(ctx, req)
+}
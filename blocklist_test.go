@@ -0,0 +1,163 @@
+package socks5
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestParseBlocklist(t *testing.T) {
+	b, err := parseBlocklist(strings.NewReader(`
+# malware feed
+evil.com
+10.0.0.0/8
+192.0.2.1
+2001:db8::1
+`))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if !b.blocksDomain("evil.com") || !b.blocksDomain("www.Evil.com.") || b.blocksDomain("notevil.com") {
+		t.Fatalf("bad domains: %v", b.domains)
+	}
+	for ip, blocked := range map[string]bool{
+		"10.1.2.3":    true,
+		"192.0.2.1":   true,
+		"192.0.2.2":   false,
+		"2001:db8::1": true,
+		"2001:db8::2": false,
+	} {
+		if containsIP(b.networks, net.ParseIP(ip)) != blocked {
+			t.Fatalf("bad: %v", ip)
+		}
+	}
+
+	if _, err := parseBlocklist(strings.NewReader("10.0.0.0/99")); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestDynamicRuleSet_File(t *testing.T) {
+	dir, err := ioutil.TempDir("", "socks5")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "blocklist")
+	ioutil.WriteFile(path, []byte("evil.com\n"), 0644)
+
+	m := newTestMetrics()
+	var changes int
+	d := &DynamicRuleSet{
+		Source:   FileBlocklist(path),
+		Metrics:  m,
+		OnChange: func(domains, networks int) { changes++ },
+	}
+
+	// Nothing is allowed before the list is loaded
+	ctx := context.Background()
+	if _, ok := d.Allow(ctx, &Request{DestAddr: &AddrSpec{FQDN: "good.com", Port: 80}}); ok {
+		t.Fatalf("expected deny")
+	}
+
+	// The initial load is reported
+	if err := d.Start(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer d.Stop()
+	if changes != 1 || m.counter("socks5.blocklist.reload") != 1 {
+		t.Fatalf("bad: %d %v", changes, m.counters)
+	}
+
+	evil := &Request{Command: ConnectCommand, DestAddr: &AddrSpec{FQDN: "evil.com", Port: 80}}
+	good := &Request{Command: ConnectCommand, DestAddr: &AddrSpec{IP: net.ParseIP("10.0.0.1"), Port: 80}}
+	if _, ok := d.Allow(ctx, evil); ok {
+		t.Fatalf("expected deny")
+	}
+	if _, ok := d.Allow(ctx, good); !ok {
+		t.Fatalf("expected allow")
+	}
+	if m.counter("socks5.blocklist.hit") != 1 {
+		t.Fatalf("bad: %v", m.counters)
+	}
+
+	// Reloading swaps the list
+	ioutil.WriteFile(path, []byte("10.0.0.0/8\n"), 0644)
+	if err := d.Reload(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, ok := d.Allow(ctx, evil); !ok {
+		t.Fatalf("expected allow")
+	}
+	if _, ok := d.Allow(ctx, good); ok {
+		t.Fatalf("expected deny")
+	}
+	if changes != 2 {
+		t.Fatalf("bad: %d", changes)
+	}
+
+	// A failed reload keeps the previous list
+	os.Remove(path)
+	if err := d.Reload(); err == nil {
+		t.Fatalf("expected error")
+	}
+	if _, ok := d.Allow(ctx, good); ok {
+		t.Fatalf("expected deny")
+	}
+}
+
+func TestDynamicRuleSet_URL(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "evil.com\n")
+	}))
+	defer srv.Close()
+
+	d, err := NewDynamicRuleSet(&URLBlocklist{URL: srv.URL}, 0)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	req := &Request{Command: ConnectCommand, DestAddr: &AddrSpec{FQDN: "a.evil.com", Port: 80}}
+	if _, ok := d.Allow(context.Background(), req); ok {
+		t.Fatalf("expected deny")
+	}
+}
+
+func TestDynamicRuleSet_Interval(t *testing.T) {
+	var changes int32
+	d := &DynamicRuleSet{
+		Source:   blocklistString("evil.com\n"),
+		Interval: 5 * time.Millisecond,
+		Metrics:  newTestMetrics(),
+		OnChange: func(domains, networks int) { atomic.AddInt32(&changes, 1) },
+	}
+	if err := d.Start(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer d.Stop()
+
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt32(&changes) < 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("not reloaded")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// blocklistString is a BlocklistSource serving a fixed list
+type blocklistString string
+
+func (b blocklistString) Open() (io.ReadCloser, error) {
+	return ioutil.NopCloser(strings.NewReader(string(b))), nil
+}
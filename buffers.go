@@ -0,0 +1,49 @@
+package socks5
+
+import (
+	"fmt"
+	"sync"
+)
+
+const (
+	// defaultReadBufferSize is the size of the client read
+	// buffer, matching the default of bufio
+	defaultReadBufferSize = 4096
+
+	// defaultRelayBufferSize is the size of the relay
+	// buffers, matching the default of io.Copy
+	defaultRelayBufferSize = 32 * 1024
+)
+
+// relayBuffers are pools of relay buffers by size
+var relayBuffers sync.Map
+
+// readBufferSize returns the size of the client read buffer
+func (s *Server) readBufferSize() int {
+	if s.config.ReadBufferSize > 0 {
+		return s.config.ReadBufferSize
+	}
+	return defaultReadBufferSize
+}
+
+// relay is used to proxy one direction of a connection,
+// using a pooled buffer of the RelayBufferSize
+func (s *Server) relay(c *relayCopy, errCh chan error) {
+	defer func() {
+		if r := recover(); r != nil {
+			s.logPanic(r)
+			errCh <- fmt.Errorf("Panic while relaying: %v", r)
+		}
+	}()
+	size := s.config.RelayBufferSize
+	if size <= 0 {
+		size = defaultRelayBufferSize
+	}
+	p, _ := relayBuffers.LoadOrStore(size, &sync.Pool{
+		New: func() interface{} { return make([]byte, size) },
+	})
+	pool := p.(*sync.Pool)
+	buf := pool.Get().([]byte)
+	defer pool.Put(buf)
+	proxy(c, buf, errCh)
+}
@@ -0,0 +1,40 @@
+package socks5
+
+import (
+	"bytes"
+	"testing"
+)
+
+// maxWriter records the largest write
+type maxWriter struct {
+	bytes.Buffer
+	max int
+}
+
+func (w *maxWriter) Write(b []byte) (int, error) {
+	if len(b) > w.max {
+		w.max = len(b)
+	}
+	return w.Buffer.Write(b)
+}
+
+func TestServer_RelayBufferSize(t *testing.T) {
+	s := &Server{config: &Config{RelayBufferSize: 1024}}
+	if s.readBufferSize() != defaultReadBufferSize {
+		t.Fatalf("bad: %v", s.readBufferSize())
+	}
+
+	data := bytes.Repeat([]byte("x"), 100*1024)
+	dst := &maxWriter{}
+	errCh := make(chan error, 1)
+	s.relay(&relayCopy{dst: dst, src: bytes.NewReader(data)}, errCh)
+	if err := <-errCh; err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.Equal(dst.Bytes(), data) {
+		t.Fatalf("bad: %v", dst.Len())
+	}
+	if dst.max != 1024 {
+		t.Fatalf("bad: %v", dst.max)
+	}
+}
@@ -0,0 +1,62 @@
+package client
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/armon/go-socks5"
+)
+
+// Authenticator is the client side of an auth method. It mirrors
+// the Authenticator of the socks5 package, so custom or private
+// methods can be implemented on both sides.
+type Authenticator interface {
+	// Authenticate runs the sub-negotiation after the proxy selected
+	// the method, returning an error if it failed
+	Authenticate(conn io.ReadWriter) error
+	GetCode() uint8
+}
+
+// NoAuthAuthenticator is used to offer the "No Authentication" method
+type NoAuthAuthenticator struct{}
+
+func (a NoAuthAuthenticator) GetCode() uint8 {
+	return socks5.NoAuth
+}
+
+func (a NoAuthAuthenticator) Authenticate(conn io.ReadWriter) error {
+	return nil
+}
+
+// UserPassAuthenticator is used to authenticate with
+// a username and password as described in RFC 1929
+type UserPassAuthenticator struct {
+	Username string
+	Password string
+}
+
+func (a UserPassAuthenticator) GetCode() uint8 {
+	return socks5.UserPassAuth
+}
+
+func (a UserPassAuthenticator) Authenticate(conn io.ReadWriter) error {
+	if len(a.Username) > 255 || len(a.Password) > 255 {
+		return fmt.Errorf("Username or password too long")
+	}
+	msg := []byte{userAuthVersion, byte(len(a.Username))}
+	msg = append(msg, a.Username...)
+	msg = append(msg, byte(len(a.Password)))
+	msg = append(msg, a.Password...)
+	if _, err := conn.Write(msg); err != nil {
+		return fmt.Errorf("Failed to send credentials: %v", err)
+	}
+
+	status := []byte{0, 0}
+	if _, err := io.ReadFull(conn, status); err != nil {
+		return fmt.Errorf("Failed to read auth status: %v", err)
+	}
+	if status[1] != 0 {
+		return ErrAuthFailed
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package client
+
+import (
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/armon/go-socks5"
+	"github.com/armon/go-socks5/socks5test"
+)
+
+// tokenAuth is a private auth method sending a fixed token
+const tokenAuth = uint8(0x80)
+
+type tokenClient struct{ token byte }
+
+func (a tokenClient) GetCode() uint8 { return tokenAuth }
+
+func (a tokenClient) Authenticate(conn io.ReadWriter) error {
+	if _, err := conn.Write([]byte{a.token}); err != nil {
+		return err
+	}
+	status := []byte{0}
+	if _, err := io.ReadFull(conn, status); err != nil {
+		return err
+	}
+	if status[0] != 0 {
+		return ErrAuthFailed
+	}
+	return nil
+}
+
+type tokenServer struct{ token byte }
+
+func (a tokenServer) GetCode() uint8 { return tokenAuth }
+
+func (a tokenServer) Authenticate(r io.Reader, w io.Writer) (*socks5.AuthContext, error) {
+	if _, err := w.Write([]byte{5, tokenAuth}); err != nil {
+		return nil, err
+	}
+	token := []byte{0}
+	if _, err := io.ReadFull(r, token); err != nil {
+		return nil, err
+	}
+	if token[0] != a.token {
+		w.Write([]byte{1})
+		return nil, fmt.Errorf("bad token")
+	}
+	_, err := w.Write([]byte{0})
+	return &socks5.AuthContext{Method: tokenAuth}, err
+}
+
+func TestClient_AuthMethods(t *testing.T) {
+	echo, err := socks5test.NewEchoServer()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer echo.Close()
+
+	c := &Client{
+		ProxyAddr: testProxy(t, &socks5.Config{
+			AuthMethods: []socks5.Authenticator{tokenServer{42}},
+		}),
+		AuthMethods: []Authenticator{NoAuthAuthenticator{}, tokenClient{42}},
+	}
+	conn, err := c.Dial("tcp", echo.Addr())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	conn.Close()
+
+	// A wrong token is rejected
+	c.AuthMethods = []Authenticator{tokenClient{7}}
+	if _, err := c.Dial("tcp", echo.Addr()); err != ErrAuthFailed {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The proxy accepts none of the offered methods
+	c.AuthMethods = []Authenticator{NoAuthAuthenticator{}}
+	if _, err := c.Dial("tcp", echo.Addr()); err != ErrNoAcceptableAuth {
+		t.Fatalf("err: %v", err)
+	}
+}
@@ -0,0 +1,110 @@
+package client
+
+import (
+	"errors"
+	"net"
+	"sync"
+
+	"github.com/armon/go-socks5"
+	"golang.org/x/net/context"
+)
+
+var (
+	// ErrBindAccepted is returned by Accept once the single
+	// connection of a BIND request has been accepted
+	ErrBindAccepted = errors.New("BIND connection already accepted")
+)
+
+// Bind asks the proxy to listen for a single incoming connection from
+// expectedPeer, as used by active FTP and peer-to-peer callbacks. The
+// returned Listener reports the address the proxy bound, which should
+// be passed to the peer, and its Accept blocks until the peer connects.
+// An empty expectedPeer lets the proxy accept any peer.
+func (c *Client) Bind(ctx context.Context, expectedPeer string) (*Listener, error) {
+	peer := &socks5.AddrSpec{IP: net.IPv4zero}
+	if expectedPeer != "" {
+		var err error
+		if peer, err = socks5.ParseAddrSpec(expectedPeer); err != nil {
+			return nil, err
+		}
+	}
+
+	conn, err := c.dialProxy(ctx)
+	if err != nil {
+		return nil, err
+	}
+	bound, err := c.request(ctx, conn, socks5.BindCommand, peer)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	// A proxy bound to an unspecified address is reached at its IP
+	if bound.FQDN == "" && (bound.IP == nil || bound.IP.IsUnspecified()) {
+		if tcp, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+			bound.IP = tcp.IP
+		}
+	}
+	return &Listener{conn: conn, bound: bound}, nil
+}
+
+// Listener is the proxy side listener of a BIND request.
+// It yields a single connection.
+type Listener struct {
+	conn  net.Conn
+	bound *socks5.AddrSpec
+
+	l        sync.Mutex
+	accepted bool
+	returned bool
+}
+
+// Accept waits for the peer to connect to the proxy,
+// returning the relayed connection
+func (l *Listener) Accept() (net.Conn, error) {
+	l.l.Lock()
+	if l.accepted {
+		l.l.Unlock()
+		return nil, ErrBindAccepted
+	}
+	l.accepted = true
+	l.l.Unlock()
+
+	peer, err := readReply(l.conn)
+	if err != nil {
+		l.conn.Close()
+		return nil, err
+	}
+
+	l.l.Lock()
+	defer l.l.Unlock()
+	l.returned = true
+	return &bindConn{Conn: l.conn, peer: peer}, nil
+}
+
+// Close stops waiting for the peer, unblocking Accept. Once
+// accepted, the connection must be closed separately.
+func (l *Listener) Close() error {
+	l.l.Lock()
+	defer l.l.Unlock()
+	if l.returned {
+		return nil
+	}
+	return l.conn.Close()
+}
+
+// Addr returns the address the proxy listens on for the peer
+func (l *Listener) Addr() net.Addr {
+	return l.bound
+}
+
+// bindConn is a connection relayed from the peer of a BIND request
+type bindConn struct {
+	net.Conn
+	peer *socks5.AddrSpec
+}
+
+// RemoteAddr returns the address of the peer, rather than the proxy
+func (b *bindConn) RemoteAddr() net.Addr {
+	return b.peer
+}
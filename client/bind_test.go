@@ -0,0 +1,101 @@
+package client
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/armon/go-socks5"
+	"golang.org/x/net/context"
+)
+
+// fakeBind serves a single BIND request, relaying a
+// connection from a peer to the listener it binds
+func fakeBind(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	go func() {
+		defer l.Close()
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		greeting := make([]byte, 3)
+		io.ReadFull(conn, greeting)
+		conn.Write([]byte{5, socks5.NoAuth})
+		if cmd, _, err := socks5.ReadReply(conn); err != nil || cmd != socks5.BindCommand {
+			return
+		}
+
+		peerL, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return
+		}
+		defer peerL.Close()
+		bound := peerL.Addr().(*net.TCPAddr)
+		socks5.SendReply(conn, socks5.SuccessReply, &socks5.AddrSpec{IP: net.IPv4zero, Port: bound.Port})
+
+		peer, err := peerL.Accept()
+		if err != nil {
+			return
+		}
+		defer peer.Close()
+		from := peer.RemoteAddr().(*net.TCPAddr)
+		socks5.SendReply(conn, socks5.SuccessReply, &socks5.AddrSpec{IP: from.IP, Port: from.Port})
+		go io.Copy(conn, peer)
+		io.Copy(peer, conn)
+	}()
+	return l.Addr().String()
+}
+
+func TestClient_Bind(t *testing.T) {
+	c := &Client{ProxyAddr: fakeBind(t)}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	l, err := c.Bind(ctx, "")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+
+	// The unspecified bound address is replaced by the proxy IP
+	bound := l.Addr().(*socks5.AddrSpec)
+	if !bound.IP.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Fatalf("bad: %v", bound)
+	}
+
+	// The peer connects to the bound address
+	go func() {
+		peer, err := net.Dial("tcp", bound.Address())
+		if err != nil {
+			return
+		}
+		defer peer.Close()
+		peer.Write([]byte("hello"))
+		io.Copy(io.Discard, peer)
+	}()
+
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+	out := make([]byte, 5)
+	if _, err := io.ReadFull(conn, out); err != nil || string(out) != "hello" {
+		t.Fatalf("bad: %v %v", out, err)
+	}
+	if peer := conn.RemoteAddr().(*socks5.AddrSpec); !peer.IP.IsLoopback() {
+		t.Fatalf("bad: %v", peer)
+	}
+
+	if _, err := l.Accept(); err != ErrBindAccepted {
+		t.Fatalf("err: %v", err)
+	}
+}
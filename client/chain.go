@@ -0,0 +1,68 @@
+package client
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/armon/go-socks5"
+	"golang.org/x/net/context"
+)
+
+// ChainClient connects to destinations through an ordered list of
+// proxies, each reached through a tunnel of the previous one
+type ChainClient struct {
+	// Hops are the proxies in the order they are traversed. The
+	// auth methods and TLSConfig of each hop are used with it,
+	// and the ProxyDial of the first hop to reach the circuit.
+	Hops []*Client
+}
+
+// Dial connects to the address through the chain of proxies
+func (c *ChainClient) Dial(network, addr string) (net.Conn, error) {
+	return c.DialContext(context.Background(), network, addr)
+}
+
+// DialContext connects to the address through the chain of proxies
+// using the provided context. Only the "tcp" networks are supported.
+func (c *ChainClient) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("Unsupported network: %v", network)
+	}
+	if len(c.Hops) == 0 {
+		return nil, fmt.Errorf("No proxies in the chain")
+	}
+	dest, err := socks5.ParseAddrSpec(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := c.Hops[0].dialProxy(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for i, hop := range c.Hops {
+		// Each hop connects to the next one, and the last to the target
+		next := dest
+		if i+1 < len(c.Hops) {
+			next, err = socks5.ParseAddrSpec(c.Hops[i+1].ProxyAddr)
+			if err != nil {
+				conn.Close()
+				return nil, err
+			}
+		}
+		if _, err := hop.request(ctx, conn, socks5.ConnectCommand, next); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("Hop %d (%s): %w", i+1, hop.ProxyAddr, err)
+		}
+
+		// Negotiate TLS with the next hop inside the tunnel
+		if i+1 < len(c.Hops) {
+			if conn, err = c.Hops[i+1].wrapTLS(ctx, conn); err != nil {
+				return nil, fmt.Errorf("Hop %d (%s): %w", i+2, c.Hops[i+1].ProxyAddr, err)
+			}
+		}
+	}
+	return conn, nil
+}
@@ -0,0 +1,58 @@
+package client
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/armon/go-socks5"
+	"github.com/armon/go-socks5/socks5test"
+	"golang.org/x/net/context"
+)
+
+func TestChainClient_Dial(t *testing.T) {
+	echo, err := socks5test.NewEchoServer()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer echo.Close()
+
+	hop1 := testProxy(t, &socks5.Config{})
+	hop2 := testProxy(t, &socks5.Config{
+		Credentials: socks5.StaticCredentials{"foo": "bar"},
+	})
+	c := &ChainClient{Hops: []*Client{
+		{ProxyAddr: hop1},
+		{ProxyAddr: hop2, Username: "foo", Password: "bar"},
+	}}
+
+	conn, err := c.Dial("tcp", echo.Addr())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+	conn.Write([]byte("ping"))
+	out := make([]byte, 4)
+	if _, err := io.ReadFull(conn, out); err != nil || string(out) != "ping" {
+		t.Fatalf("bad: %v %v", out, err)
+	}
+
+	// A failure names the hop
+	c.Hops[1].Password = "baz"
+	if _, err := c.Dial("tcp", echo.Addr()); !errors.Is(err, ErrAuthFailed) {
+		t.Fatalf("err: %v", err)
+	}
+
+	// An unreachable hop is reported by the previous one
+	dead, _ := net.Listen("tcp", "127.0.0.1:0")
+	dead.Close()
+	c.Hops[1].ProxyAddr = dead.Addr().String()
+	_, err = c.DialContext(context.Background(), "tcp", echo.Addr())
+	var reply *ReplyError
+	if !errors.As(err, &reply) || reply.Code != socks5.ConnectionRefused {
+		t.Fatalf("err: %v", err)
+	}
+}
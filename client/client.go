@@ -0,0 +1,246 @@
+// Package client implements a SOCKS5 client, for connecting
+// through a proxy such as the one of the socks5 package.
+package client
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/armon/go-socks5"
+	"golang.org/x/net/context"
+)
+
+const (
+	socks5Version   = uint8(5)
+	userAuthVersion = uint8(1)
+	noAcceptable    = uint8(255)
+)
+
+var (
+	// ErrAuthFailed is returned when the proxy rejected the credentials
+	ErrAuthFailed = errors.New("SOCKS5 authentication failed")
+
+	// ErrNoAcceptableAuth is returned when the proxy
+	// supports none of the offered auth methods
+	ErrNoAcceptableAuth = errors.New("No acceptable SOCKS5 authentication method")
+)
+
+// ReplyError is returned when the proxy rejects a request
+type ReplyError struct {
+	// Code is the reply code, such as socks5.RuleFailure
+	Code uint8
+}
+
+func (e *ReplyError) Error() string {
+	return fmt.Sprintf("SOCKS5 request failed: %s", replyText(e.Code))
+}
+
+// replyText describes a reply code
+func replyText(code uint8) string {
+	switch code {
+	case socks5.ServerFailure:
+		return "general server failure"
+	case socks5.RuleFailure:
+		return "connection not allowed by ruleset"
+	case socks5.NetworkUnreachable:
+		return "network unreachable"
+	case socks5.HostUnreachable:
+		return "host unreachable"
+	case socks5.ConnectionRefused:
+		return "connection refused"
+	case socks5.TTLExpired:
+		return "TTL expired"
+	case socks5.CommandNotSupported:
+		return "command not supported"
+	case socks5.AddrTypeNotSupported:
+		return "address type not supported"
+	}
+	return "reply " + strconv.Itoa(int(code))
+}
+
+// Client connects to destinations through a SOCKS5 proxy
+type Client struct {
+	// ProxyAddr is the host:port of the proxy
+	ProxyAddr string
+
+	// Username and Password are used to authenticate, if set.
+	// Otherwise only the "No Authentication" method is offered.
+	Username string
+	Password string
+
+	// AuthMethods are the auth methods to offer, in order of
+	// preference. If set, Username and Password are ignored.
+	AuthMethods []Authenticator
+
+	// ProxyDial is used to connect to the proxy.
+	// Defaults to a net.Dialer.
+	ProxyDial func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// TLSConfig enables connecting to the proxy over TLS, as served
+	// by ListenAndServeTLS. Client certificates, session resumption
+	// and ALPN are configured on it as usual. Unless it sets a
+	// ServerName, the host of ProxyAddr is used.
+	TLSConfig *tls.Config
+}
+
+// Dial connects to the address through the proxy
+func (c *Client) Dial(network, addr string) (net.Conn, error) {
+	return c.DialContext(context.Background(), network, addr)
+}
+
+// DialContext connects to the address through the proxy using the
+// provided context. Only the "tcp" networks are supported.
+func (c *Client) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("Unsupported network: %v", network)
+	}
+	dest, err := socks5.ParseAddrSpec(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := c.dialProxy(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := c.request(ctx, conn, socks5.ConnectCommand, dest); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// dialProxy is used to connect to the proxy
+func (c *Client) dialProxy(ctx context.Context) (net.Conn, error) {
+	dial := c.ProxyDial
+	if dial == nil {
+		dial = new(net.Dialer).DialContext
+	}
+	conn, err := dial(ctx, "tcp", c.ProxyAddr)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to connect to proxy: %v", err)
+	}
+	return c.wrapTLS(ctx, conn)
+}
+
+// wrapTLS is used to negotiate TLS with the proxy, if configured
+func (c *Client) wrapTLS(ctx context.Context, conn net.Conn) (net.Conn, error) {
+	if c.TLSConfig == nil {
+		return conn, nil
+	}
+
+	conf := c.TLSConfig
+	if conf.ServerName == "" {
+		host, _, err := net.SplitHostPort(c.ProxyAddr)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conf = conf.Clone()
+		conf.ServerName = host
+	}
+	tlsConn := tls.Client(conn, conf)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("TLS handshake with proxy failed: %v", err)
+	}
+	return tlsConn, nil
+}
+
+// request is used to negotiate with the proxy and send a request,
+// returning the bound address of the reply. The context bounds
+// the negotiation, but not the use of the connection afterwards.
+func (c *Client) request(ctx context.Context, conn net.Conn, cmd uint8, dest *socks5.AddrSpec) (*socks5.AddrSpec, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+
+	if err := c.authenticate(conn); err != nil {
+		return nil, err
+	}
+
+	addr, err := dest.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	msg := append([]byte{socks5Version, cmd, 0}, addr...)
+	if _, err := conn.Write(msg); err != nil {
+		return nil, fmt.Errorf("Failed to send request: %v", err)
+	}
+	return readReply(conn)
+}
+
+// readReply is used to read a reply, failing unless it succeeded
+func readReply(r io.Reader) (*socks5.AddrSpec, error) {
+	resp, bind, err := socks5.ReadReply(r)
+	if err != nil {
+		return nil, err
+	}
+	if resp != socks5.SuccessReply {
+		return nil, &ReplyError{Code: resp}
+	}
+	return bind, nil
+}
+
+// authenticate is used to negotiate the auth method and authenticate
+func (c *Client) authenticate(conn net.Conn) error {
+	auths := c.authenticators()
+	methods := make([]byte, 0, len(auths))
+	for _, a := range auths {
+		methods = append(methods, a.GetCode())
+	}
+	if len(methods) == 0 || len(methods) > 255 {
+		return fmt.Errorf("Invalid number of auth methods: %d", len(methods))
+	}
+	greeting := append([]byte{socks5Version, byte(len(methods))}, methods...)
+	if _, err := conn.Write(greeting); err != nil {
+		return fmt.Errorf("Failed to send greeting: %v", err)
+	}
+
+	selected := []byte{0, 0}
+	if _, err := io.ReadFull(conn, selected); err != nil {
+		return fmt.Errorf("Failed to read auth method: %v", err)
+	}
+	if selected[0] != socks5Version {
+		return fmt.Errorf("Unsupported SOCKS version: %v", selected[0])
+	}
+	if selected[1] == noAcceptable {
+		return ErrNoAcceptableAuth
+	}
+
+	// The proxy may only select one of the offered methods
+	for _, a := range auths {
+		if a.GetCode() == selected[1] {
+			return a.Authenticate(conn)
+		}
+	}
+	return fmt.Errorf("Unexpected auth method: %v", selected[1])
+}
+
+// authenticators returns the auth methods to offer, in order of preference
+func (c *Client) authenticators() []Authenticator {
+	if len(c.AuthMethods) > 0 {
+		return c.AuthMethods
+	}
+	if c.Username != "" {
+		return []Authenticator{UserPassAuthenticator{Username: c.Username, Password: c.Password}}
+	}
+	return []Authenticator{NoAuthAuthenticator{}}
+}
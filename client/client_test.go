@@ -0,0 +1,67 @@
+package client
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/armon/go-socks5"
+	"github.com/armon/go-socks5/socks5test"
+)
+
+// testProxy starts a proxy server, returning its address
+func testProxy(t *testing.T, conf *socks5.Config) string {
+	serv, err := socks5.New(conf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	go serv.Serve(l)
+	t.Cleanup(func() { serv.Close() })
+	return l.Addr().String()
+}
+
+func TestClient_Dial(t *testing.T) {
+	echo, err := socks5test.NewEchoServer()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer echo.Close()
+
+	creds := socks5.StaticCredentials{"foo": "bar"}
+	c := &Client{
+		ProxyAddr: testProxy(t, &socks5.Config{Credentials: creds}),
+		Username:  "foo",
+		Password:  "bar",
+	}
+	conn, err := c.Dial("tcp", echo.Addr())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+
+	conn.Write([]byte("ping"))
+	out := make([]byte, 4)
+	if _, err := io.ReadFull(conn, out); err != nil || string(out) != "ping" {
+		t.Fatalf("bad: %v %v", out, err)
+	}
+
+	// Wrong credentials are rejected
+	c.Password = "baz"
+	if _, err := c.Dial("tcp", echo.Addr()); err != ErrAuthFailed {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestClient_DialRejected(t *testing.T) {
+	c := &Client{ProxyAddr: testProxy(t, &socks5.Config{Rules: socks5.PermitNone()})}
+	_, err := c.Dial("tcp", "127.0.0.1:80")
+	if re, ok := err.(*ReplyError); !ok || re.Code != socks5.RuleFailure {
+		t.Fatalf("err: %v", err)
+	}
+}
@@ -0,0 +1,24 @@
+package client
+
+import (
+	"net/http"
+
+	"golang.org/x/net/proxy"
+)
+
+// Client can be used anywhere a dialer of x/net/proxy is expected
+var (
+	_ proxy.Dialer        = &Client{}
+	_ proxy.ContextDialer = &Client{}
+)
+
+// Transport returns an http.Transport which connects through the proxy.
+// HTTPS requests are tunneled by the SOCKS5 CONNECT command, with TLS
+// negotiated end to end with the server, so no HTTP proxy is involved
+// and the environment proxy settings are ignored.
+func (c *Client) Transport() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Proxy = nil
+	t.DialContext = c.DialContext
+	return t
+}
@@ -0,0 +1,38 @@
+package client
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/armon/go-socks5"
+)
+
+func TestClient_Transport(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	})
+	plain := httptest.NewServer(handler)
+	defer plain.Close()
+	secure := httptest.NewTLSServer(handler)
+	defer secure.Close()
+
+	c := &Client{ProxyAddr: testProxy(t, &socks5.Config{})}
+	transport := c.Transport()
+	transport.TLSClientConfig = secure.Client().Transport.(*http.Transport).TLSClientConfig
+	defer transport.CloseIdleConnections()
+	httpClient := &http.Client{Transport: transport}
+
+	for _, url := range []string{plain.URL, secure.URL} {
+		resp, err := httpClient.Get(url)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil || string(body) != "hello" {
+			t.Fatalf("bad: %s %v", body, err)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package client
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/armon/go-socks5"
+	"github.com/armon/go-socks5/socks5test"
+)
+
+// testCert returns a self-signed certificate for 127.0.0.1
+// and a pool trusting it
+func testCert(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "socks5 test"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+func TestClient_TLS(t *testing.T) {
+	echo, err := socks5test.NewEchoServer()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer echo.Close()
+
+	// The proxy requires a client certificate
+	cert, pool := testCert(t)
+	serv, _ := socks5.New(&socks5.Config{})
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		NextProtos:   []string{"socks5"},
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	go serv.Serve(l)
+	defer serv.Close()
+
+	c := &Client{
+		ProxyAddr: l.Addr().String(),
+		TLSConfig: &tls.Config{
+			RootCAs:            pool,
+			Certificates:       []tls.Certificate{cert},
+			NextProtos:         []string{"socks5"},
+			ClientSessionCache: tls.NewLRUClientSessionCache(1),
+		},
+	}
+	dial := func() *tls.Conn {
+		conn, err := c.Dial("tcp", echo.Addr())
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		conn.SetDeadline(time.Now().Add(time.Second))
+		conn.Write([]byte("ping"))
+		out := make([]byte, 4)
+		if _, err := io.ReadFull(conn, out); err != nil || string(out) != "ping" {
+			t.Fatalf("bad: %v %v", out, err)
+		}
+		return conn.(*tls.Conn)
+	}
+
+	conn := dial()
+	if proto := conn.ConnectionState().NegotiatedProtocol; proto != "socks5" {
+		t.Fatalf("bad: %v", proto)
+	}
+	conn.Close()
+
+	// The session is resumed
+	conn = dial()
+	if !conn.ConnectionState().DidResume {
+		t.Fatalf("expected resumption")
+	}
+	conn.Close()
+
+	// Without a client certificate the proxy is unusable
+	c.TLSConfig = &tls.Config{RootCAs: pool}
+	if _, err := c.Dial("tcp", echo.Addr()); err == nil {
+		t.Fatalf("expected error")
+	}
+}
@@ -0,0 +1,165 @@
+package client
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/armon/go-socks5"
+	"golang.org/x/net/context"
+)
+
+const (
+	// maxUDPPacketSize bounds the size of received datagrams
+	maxUDPPacketSize = 64 * 1024
+
+	// keepAlivePeriod is used for the TCP control connection
+	// of associations, which may be idle for long
+	keepAlivePeriod = 30 * time.Second
+)
+
+// DialUDPAssociate sets up a UDP association through the proxy,
+// returning a net.PacketConn which transparently adds and removes the
+// SOCKS UDP header. Datagrams are sent from a local socket bound to
+// laddr, or to any port if empty. The TCP control connection is kept
+// alive until the PacketConn is closed; if the proxy closes it, the
+// association has ended and reads fail.
+func (c *Client) DialUDPAssociate(ctx context.Context, laddr string) (net.PacketConn, error) {
+	var local *net.UDPAddr
+	if laddr != "" {
+		var err error
+		if local, err = net.ResolveUDPAddr("udp", laddr); err != nil {
+			return nil, err
+		}
+	}
+
+	ctrl, err := c.dialProxy(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if tcp, ok := ctrl.(*net.TCPConn); ok {
+		tcp.SetKeepAlive(true)
+		tcp.SetKeepAlivePeriod(keepAlivePeriod)
+	}
+
+	udp, err := net.ListenUDP("udp", local)
+	if err != nil {
+		ctrl.Close()
+		return nil, err
+	}
+
+	// Announce the address we send from, as seen by the proxy
+	source := &socks5.AddrSpec{IP: net.IPv4zero, Port: udp.LocalAddr().(*net.UDPAddr).Port}
+	if tcp, ok := ctrl.LocalAddr().(*net.TCPAddr); ok {
+		source.IP = tcp.IP
+	}
+	bind, err := c.request(ctx, ctrl, socks5.AssociateCommand, source)
+	if err != nil {
+		udp.Close()
+		ctrl.Close()
+		return nil, err
+	}
+
+	// A relay on an unspecified address is reached at the proxy's IP
+	relay := &net.UDPAddr{IP: bind.IP, Port: bind.Port, Zone: bind.Zone}
+	if relay.IP == nil || relay.IP.IsUnspecified() {
+		if tcp, ok := ctrl.RemoteAddr().(*net.TCPAddr); ok {
+			relay.IP = tcp.IP
+		}
+	}
+
+	p := &packetConn{ctrl: ctrl, udp: udp, relay: relay}
+	go p.watch()
+	return p, nil
+}
+
+// packetConn is a net.PacketConn relayed through a UDP association
+type packetConn struct {
+	ctrl  net.Conn
+	udp   *net.UDPConn
+	relay *net.UDPAddr
+
+	closeOnce sync.Once
+}
+
+// watch is used to tear down the association
+// once the proxy closes the control connection
+func (p *packetConn) watch() {
+	io.Copy(io.Discard, p.ctrl)
+	p.Close()
+}
+
+// ReadFrom reads a datagram, returning the address of the
+// destination which sent it. FQDN sources are returned as
+// *socks5.AddrSpec, others as *net.UDPAddr. Fragmented
+// datagrams are not supported and are dropped.
+func (p *packetConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	buf := make([]byte, maxUDPPacketSize)
+	for {
+		n, from, err := p.udp.ReadFromUDP(buf)
+		if err != nil {
+			return 0, nil, err
+		}
+		if !from.IP.Equal(p.relay.IP) || from.Port != p.relay.Port {
+			continue
+		}
+
+		var d socks5.UDPDatagram
+		if err := d.UnmarshalBinary(buf[:n]); err != nil || d.Frag != 0 {
+			continue
+		}
+		var addr net.Addr = d.DestAddr
+		if d.DestAddr.IP != nil {
+			addr = &net.UDPAddr{IP: d.DestAddr.IP, Port: d.DestAddr.Port, Zone: d.DestAddr.Zone}
+		}
+		return copy(b, d.Data), addr, nil
+	}
+}
+
+// WriteTo sends a datagram to the address through the relay.
+// The address may be a *socks5.AddrSpec to let the proxy resolve it.
+func (p *packetConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	dest, ok := addr.(*socks5.AddrSpec)
+	if !ok {
+		var err error
+		if dest, err = socks5.ParseAddrSpec(addr.String()); err != nil {
+			return 0, err
+		}
+	}
+	d := &socks5.UDPDatagram{DestAddr: dest, Data: b}
+	pkt, err := d.MarshalBinary()
+	if err != nil {
+		return 0, err
+	}
+	if _, err := p.udp.WriteToUDP(pkt, p.relay); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Close ends the association
+func (p *packetConn) Close() error {
+	var err error
+	p.closeOnce.Do(func() {
+		err = p.udp.Close()
+		p.ctrl.Close()
+	})
+	return err
+}
+
+func (p *packetConn) LocalAddr() net.Addr {
+	return p.udp.LocalAddr()
+}
+
+func (p *packetConn) SetDeadline(t time.Time) error {
+	return p.udp.SetDeadline(t)
+}
+
+func (p *packetConn) SetReadDeadline(t time.Time) error {
+	return p.udp.SetReadDeadline(t)
+}
+
+func (p *packetConn) SetWriteDeadline(t time.Time) error {
+	return p.udp.SetWriteDeadline(t)
+}
@@ -0,0 +1,101 @@
+package client
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/armon/go-socks5"
+	"golang.org/x/net/context"
+)
+
+// fakeAssociate serves a single UDP association, echoing datagrams
+// back from their destination. Closing stop ends the association.
+func fakeAssociate(t *testing.T, stop chan struct{}) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	go func() {
+		defer l.Close()
+		defer relay.Close()
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		greeting := make([]byte, 3)
+		io.ReadFull(conn, greeting)
+		conn.Write([]byte{5, socks5.NoAuth})
+
+		// Requests have the same layout as replies
+		if cmd, _, err := socks5.ReadReply(conn); err != nil || cmd != socks5.AssociateCommand {
+			return
+		}
+		bind := &socks5.AddrSpec{IP: net.IPv4zero, Port: relay.LocalAddr().(*net.UDPAddr).Port}
+		socks5.SendReply(conn, socks5.SuccessReply, bind)
+
+		go func() {
+			buf := make([]byte, 1500)
+			for {
+				n, from, err := relay.ReadFromUDP(buf)
+				if err != nil {
+					return
+				}
+				relay.WriteToUDP(buf[:n], from)
+			}
+		}()
+		<-stop
+	}()
+	return l.Addr().String()
+}
+
+func TestClient_DialUDPAssociate(t *testing.T) {
+	stop := make(chan struct{})
+	c := &Client{ProxyAddr: fakeAssociate(t, stop)}
+
+	pc, err := c.DialUDPAssociate(context.Background(), "")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer pc.Close()
+	pc.SetDeadline(time.Now().Add(time.Second))
+
+	dest := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 53}
+	if _, err := pc.WriteTo([]byte("query"), dest); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	buf := make([]byte, 64)
+	n, from, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(buf[:n]) != "query" || from.String() != dest.String() {
+		t.Fatalf("bad: %s %v", buf[:n], from)
+	}
+
+	// FQDN destinations are passed to the proxy
+	if _, err := pc.WriteTo([]byte("named"), &socks5.AddrSpec{FQDN: "example.com", Port: 53}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	n, from, err = pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if addr, ok := from.(*socks5.AddrSpec); !ok || addr.FQDN != "example.com" {
+		t.Fatalf("bad: %v", from)
+	}
+
+	// The association ends with the control connection
+	close(stop)
+	if _, _, err := pc.ReadFrom(buf); err == nil {
+		t.Fatalf("expected error")
+	}
+}
@@ -0,0 +1,96 @@
+package socks5
+
+import (
+	"errors"
+)
+
+// CloseReason tells why a connection closed
+type CloseReason uint8
+
+const (
+	// CloseError is used for the failures without a reason of their own
+	CloseError CloseReason = iota
+	// CloseClientEOF is used once the client closed the connection
+	CloseClientEOF
+	// CloseTargetEOF is used once the target closed the relay
+	CloseTargetEOF
+	// CloseRuleDenied is used once the request was denied, or the
+	// relay terminated by the StreamPolicy
+	CloseRuleDenied
+	// CloseAuthFailed is used once the client failed to authenticate
+	CloseAuthFailed
+	// CloseIdleTimeout is used once the relay reached the IdleTimeout
+	CloseIdleTimeout
+	// CloseLifetime is used once the relay reached the
+	// MaxConnectionLifetime
+	CloseLifetime
+	// CloseQuota is used once the relay reached the ByteQuota
+	CloseQuota
+	// CloseShutdown is used once the server closed the connection
+	// as it shut down
+	CloseShutdown
+)
+
+func (r CloseReason) String() string {
+	switch r {
+	case CloseError:
+		return "error"
+	case CloseClientEOF:
+		return "client_eof"
+	case CloseTargetEOF:
+		return "target_eof"
+	case CloseRuleDenied:
+		return "rule_denied"
+	case CloseAuthFailed:
+		return "auth_failed"
+	case CloseIdleTimeout:
+		return "idle_timeout"
+	case CloseLifetime:
+		return "lifetime"
+	case CloseQuota:
+		return "quota"
+	case CloseShutdown:
+		return "shutdown"
+	}
+	return "unknown"
+}
+
+// closeReason is used to classify why a connection closed, given its
+// request if it was read and the error it was served with
+func (s *Server) closeReason(req *Request, err error) CloseReason {
+	if errors.Is(err, UserAuthFailed) || errors.Is(err, NoSupportedAuth) {
+		return CloseAuthFailed
+	}
+	if req != nil && req.denied {
+		return CloseRuleDenied
+	}
+	if end := closeRelayEnd(req); end != nil {
+		switch {
+		case end.Err == ErrIdleTimeout:
+			return CloseIdleTimeout
+		case end.Err == ErrMaxLifetime:
+			return CloseLifetime
+		case end.Err == ErrQuotaExceeded:
+			return CloseQuota
+		case end.Class == errClassEOF && end.Side == SideClient:
+			return CloseClientEOF
+		case end.Class == errClassEOF && end.Side == SideTarget:
+			return CloseTargetEOF
+		}
+	}
+	if s.state.isClosed() {
+		return CloseShutdown
+	}
+	if err == nil || classifyError(err) == errClassEOF {
+		return CloseClientEOF
+	}
+	return CloseError
+}
+
+// closeRelayEnd returns how the relay of a request ended, if any
+func closeRelayEnd(req *Request) *RelayEnd {
+	if req == nil {
+		return nil
+	}
+	return req.relayEnd
+}
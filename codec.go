@@ -0,0 +1,53 @@
+package socks5
+
+import (
+	"io"
+)
+
+// Codec encodes and decodes the request and reply messages exchanged
+// once the client authenticated. Swapping the codec of a server allows
+// experimental extensions of the protocol, such as longer address types
+// or vendor data following the request, while the default RFC1928Codec
+// remains strict.
+type Codec interface {
+	// ReadRequest reads the request of the client. The returned Request
+	// must have its Version, Command and DestAddr set, as NewRequest
+	// does. Extension data may be kept in its Extensions.
+	ReadRequest(r io.Reader) (*Request, error)
+
+	// WriteReply writes the reply to a request, with the bound address,
+	// nil for 0.0.0.0:0. The request is nil if the reply is sent before
+	// it could be read, for example for an unrecognized address type.
+	WriteReply(w io.Writer, req *Request, resp uint8, addr *AddrSpec) error
+}
+
+// RFC1928Codec is the wire format of RFC 1928, the default Codec.
+// Requests with unknown address types fail with an error which is
+// answered with AddrTypeNotSupported.
+type RFC1928Codec struct {
+	// PreferIPv6Reply encodes the reply addresses sent to clients which
+	// connected over IPv6 as IPv6, using the IPv4-mapped form if needed
+	PreferIPv6Reply bool
+}
+
+// ReadRequest reads a request with NewRequest
+func (c RFC1928Codec) ReadRequest(r io.Reader) (*Request, error) {
+	return NewRequest(r)
+}
+
+// WriteReply writes a reply as SendReply does
+func (c RFC1928Codec) WriteReply(w io.Writer, req *Request, resp uint8, addr *AddrSpec) error {
+	ipv6 := false
+	if c.PreferIPv6Reply && req != nil && req.RemoteAddr != nil && req.RemoteAddr.IP.To4() == nil {
+		ipv6 = true
+	}
+	return writeReply(w, resp, addr, ipv6)
+}
+
+// codec returns the Codec of the server
+func (s *Server) codec() Codec {
+	if s.config.Codec != nil {
+		return s.config.Codec
+	}
+	return RFC1928Codec{PreferIPv6Reply: s.config.PreferIPv6Reply}
+}
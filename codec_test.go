@@ -0,0 +1,61 @@
+package socks5
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// tlvCodec reads a length prefixed vendor extension after the request
+type tlvCodec struct {
+	RFC1928Codec
+}
+
+func (c tlvCodec) ReadRequest(r io.Reader) (*Request, error) {
+	req, err := c.RFC1928Codec.ReadRequest(r)
+	if err != nil {
+		return nil, err
+	}
+	size := []byte{0}
+	if _, err := io.ReadFull(r, size); err != nil {
+		return nil, err
+	}
+	req.Extensions = make([]byte, size[0])
+	if _, err := io.ReadFull(r, req.Extensions); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// extensionRules denies all requests, reporting their extensions
+type extensionRules chan []byte
+
+func (r extensionRules) Allow(ctx context.Context, req *Request) (context.Context, bool) {
+	r <- req.Extensions
+	return ctx, false
+}
+
+func TestServer_Codec(t *testing.T) {
+	rules := make(extensionRules, 1)
+	serv, _ := New(&Config{Rules: rules, Codec: tlvCodec{}})
+	client, server := net.Pipe()
+	defer client.Close()
+	go serv.ServeConn(server)
+
+	client.SetDeadline(time.Now().Add(time.Second))
+	go client.Write([]byte{5, 1, NoAuth, 5, 1, 0, 1, 127, 0, 0, 1, 0, 80, 3, 'v', 'n', 'd'})
+	out := make([]byte, 2)
+	if _, err := io.ReadFull(client, out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if resp, _, err := ReadReply(client); err != nil || resp != RuleFailure {
+		t.Fatalf("bad: %v %v", resp, err)
+	}
+	if ext := <-rules; !bytes.Equal(ext, []byte("vnd")) {
+		t.Fatalf("bad: %v", ext)
+	}
+}
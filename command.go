@@ -0,0 +1,68 @@
+package socks5
+
+import (
+	"io"
+	"net"
+
+	"golang.org/x/net/context"
+)
+
+// CommandHandler is used to serve a request command, such as vendor
+// specific extensions beyond CONNECT, BIND and ASSOCIATE. The request
+// destination has already been resolved and rewritten. The handler is
+// responsible for sending the reply, see SendReply, and for any access
+// control, as the Rules are not consulted for registered commands.
+type CommandHandler interface {
+	Handle(ctx context.Context, req *Request, conn net.Conn) error
+}
+
+// CommandHandlerFunc is an adapter to allow using a
+// function as a CommandHandler
+type CommandHandlerFunc func(ctx context.Context, req *Request, conn net.Conn) error
+
+func (f CommandHandlerFunc) Handle(ctx context.Context, req *Request, conn net.Conn) error {
+	return f(ctx, req, conn)
+}
+
+// RegisterCommand is used to serve a command code with the given
+// handler, replacing any previous handler. Registering one of the
+// standard commands overrides the builtin implementation. A nil
+// handler removes the registration.
+func (s *Server) RegisterCommand(code uint8, handler CommandHandler) {
+	st := s.state
+	st.l.Lock()
+	defer st.l.Unlock()
+	if handler == nil {
+		delete(st.commands, code)
+		return
+	}
+	st.commands[code] = handler
+}
+
+// command returns the registered handler of a command, if any
+func (st *serverState) command(code uint8) CommandHandler {
+	if st == nil {
+		return nil
+	}
+	st.l.Lock()
+	defer st.l.Unlock()
+	return st.commands[code]
+}
+
+// bufferedConn is used to hand the connection to a command handler
+// without losing bytes which are already buffered
+type bufferedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *bufferedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
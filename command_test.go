@@ -0,0 +1,49 @@
+package socks5
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestRegisterCommand(t *testing.T) {
+	const resolveCommand = uint8(0xF0)
+	serv, _ := New(&Config{})
+	serv.RegisterCommand(resolveCommand, CommandHandlerFunc(func(ctx context.Context, req *Request, conn net.Conn) error {
+		return SendReply(conn, SuccessReply, &AddrSpec{IP: req.DestAddr.IP})
+	}))
+
+	greeting := []byte{5, 1, NoAuth}
+	resolve := append(append([]byte{}, greeting...), 5, resolveCommand, 0, fqdnAddress, 9)
+	resolve = append(resolve, "localhost"...)
+	resolve = append(resolve, 0, 0)
+
+	run := func() []byte {
+		client, server := net.Pipe()
+		defer client.Close()
+		go serv.ServeConn(server)
+		go client.Write(resolve)
+		client.SetDeadline(time.Now().Add(time.Second))
+		out, err := io.ReadAll(client)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		return out
+	}
+
+	expected := []byte{5, NoAuth, 5, SuccessReply, 0, ipv4Address, 127, 0, 0, 1, 0, 0}
+	if out := run(); !bytes.Equal(out, expected) {
+		t.Fatalf("bad: %v", out)
+	}
+
+	// Without the handler the command is not supported
+	serv.RegisterCommand(resolveCommand, nil)
+	expected = []byte{5, NoAuth, 5, CommandNotSupported, 0, ipv4Address, 0, 0, 0, 0, 0, 0}
+	if out := run(); !bytes.Equal(out, expected) {
+		t.Fatalf("bad: %v", out)
+	}
+}
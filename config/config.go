@@ -0,0 +1,453 @@
+// Package config loads a socks5.Server from a declarative JSON file,
+// describing its listeners, authentication, access control, timeouts,
+// limits and logging, so binaries embedding the server do not need to
+// parse each option themselves:
+//
+//	{
+//		"listeners": ["127.0.0.1:1080"],
+//		"auth": {"users": {"foo": "bar"}},
+//		"acl": {"commands": ["connect"], "allow_clients": ["10.0.0.0/8"]},
+//		"timeouts": {"handshake": "10s", "idle": "5m"},
+//		"limits": {"max_connections": 1000},
+//		"log": {"level": "info"}
+//	}
+//
+// Unknown fields are rejected, so typos do not silently fall back to
+// the defaults. YAML files can be converted to JSON before loading.
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/armon/go-socks5"
+	"github.com/armon/go-socks5/htpasswdauth"
+)
+
+// File is the declarative configuration of a server. Omitted
+// fields keep the defaults of socks5.Config.
+type File struct {
+	// Listeners are the TCP addresses served, as host:port
+	Listeners []string `json:"listeners"`
+
+	Auth     Auth     `json:"auth"`
+	ACL      ACL      `json:"acl"`
+	Timeouts Timeouts `json:"timeouts"`
+	Limits   Limits   `json:"limits"`
+	Log      Log      `json:"log"`
+}
+
+// Auth configures the username and password authentication. Without
+// users or a htpasswd file, clients do not authenticate.
+type Auth struct {
+	// Users maps the usernames to their passwords
+	Users map[string]string `json:"users"`
+
+	// Htpasswd is the path of a htpasswd file, reloaded on changes
+	// until the server is closed
+	Htpasswd string `json:"htpasswd"`
+}
+
+// ACL configures which clients and requests are served
+type ACL struct {
+	// Commands are the commands served: connect, bind and associate.
+	// Defaults to all of them.
+	Commands []string `json:"commands"`
+
+	// AllowClients and DenyClients are CIDR blocks of the clients
+	// accepted, as with socks5.NewCIDRFilter
+	AllowClients []string `json:"allow_clients"`
+	DenyClients  []string `json:"deny_clients"`
+
+	// Blocklist is the path of a block list of destinations, as read
+	// by socks5.FileBlocklist, reloaded every BlocklistReload if set
+	Blocklist       string   `json:"blocklist"`
+	BlocklistReload Duration `json:"blocklist_reload"`
+
+	RequireFQDN bool `json:"require_fqdn"`
+	DenyFQDN    bool `json:"deny_fqdn"`
+	DenySelf    bool `json:"deny_self"`
+}
+
+// Timeouts configures the timeouts of socks5.Config of the same names
+type Timeouts struct {
+	Handshake      Duration `json:"handshake"`
+	Greeting       Duration `json:"greeting"`
+	Auth           Duration `json:"auth"`
+	Request        Duration `json:"request"`
+	Dial           Duration `json:"dial"`
+	Idle           Duration `json:"idle"`
+	Lifetime       Duration `json:"lifetime"`
+	LifetimeJitter Duration `json:"lifetime_jitter"`
+}
+
+// Limits configures the limits of socks5.Config
+type Limits struct {
+	MaxConnections  int    `json:"max_connections"`
+	MaxDialsPerDest int    `json:"max_dials_per_dest"`
+	MaxRequestBytes int    `json:"max_request_bytes"`
+	ByteQuota       uint64 `json:"byte_quota"`
+}
+
+// Log configures the logging of the server, to stderr
+type Log struct {
+	// Level is the minimum level logged: debug, info, warn, error
+	// or off. Defaults to info.
+	Level string `json:"level"`
+
+	// Trace logs the progress of each connection
+	Trace bool `json:"trace"`
+}
+
+// Duration is a time.Duration read from a string such as "1m30s"
+type Duration time.Duration
+
+// UnmarshalJSON parses the duration with time.ParseDuration
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("Duration must be a string such as \"30s\"")
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	if v < 0 {
+		return fmt.Errorf("Negative duration: %q", s)
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// MarshalJSON formats the duration as a string
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// commands maps the names of the commands to their flags
+var commands = map[string]socks5.CommandSet{
+	"connect":   socks5.ConnectEnabled,
+	"bind":      socks5.BindEnabled,
+	"associate": socks5.AssociateEnabled,
+}
+
+// levels maps the names of the log levels to their values
+var levels = map[string]socks5.LogLevel{
+	"debug": socks5.LogDebug,
+	"info":  socks5.LogInfo,
+	"warn":  socks5.LogWarn,
+	"error": socks5.LogError,
+	"off":   socks5.LogOff,
+}
+
+// logger is the Logger of the servers, shared so reloads
+// with Apply do not report it as changed
+var logger = log.New(os.Stderr, "", log.LstdFlags)
+
+// watcher notices the changes of the htpasswd files
+var watcher htpasswdauth.FileWatcher = &htpasswdauth.PollWatcher{}
+
+// Load reads and validates the configuration file at the path
+func Load(path string) (*File, error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+	f, err := Parse(fh)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load %s: %w", path, err)
+	}
+	return f, nil
+}
+
+// Parse reads and validates a configuration
+func Parse(r io.Reader) (*File, error) {
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	f := &File{}
+	if err := dec.Decode(f); err != nil {
+		return nil, err
+	}
+	if err := f.Validate(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Validate checks the configuration, without opening any file
+func (f *File) Validate() error {
+	if len(f.Listeners) == 0 {
+		return fmt.Errorf("No listeners")
+	}
+	for _, addr := range f.Listeners {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return fmt.Errorf("Invalid listener %q: %v", addr, err)
+		}
+	}
+	if len(f.Auth.Users) > 0 && f.Auth.Htpasswd != "" {
+		return fmt.Errorf("Auth users and htpasswd are exclusive")
+	}
+	for _, name := range f.ACL.Commands {
+		if _, ok := commands[strings.ToLower(name)]; !ok {
+			return fmt.Errorf("Unknown command %q", name)
+		}
+	}
+	if _, err := socks5.NewCIDRFilter(f.ACL.AllowClients, f.ACL.DenyClients); err != nil {
+		return fmt.Errorf("Invalid client networks: %v", err)
+	}
+	if f.ACL.RequireFQDN && f.ACL.DenyFQDN {
+		return fmt.Errorf("ACL require_fqdn and deny_fqdn are exclusive")
+	}
+	if f.Log.Level != "" {
+		if _, ok := levels[strings.ToLower(f.Log.Level)]; !ok {
+			return fmt.Errorf("Unknown log level %q", f.Log.Level)
+		}
+	}
+	l := f.Limits
+	if l.MaxConnections < 0 || l.MaxDialsPerDest < 0 || l.MaxRequestBytes < 0 {
+		return fmt.Errorf("Negative limit")
+	}
+	return nil
+}
+
+// stores are the reloaded Credentials and Rules of a Config, and the
+// files they were loaded from, so Apply can reuse them while the files
+// do not change rather than reporting them as changed on each reload.
+// The ClientFilter is likewise kept while its CIDR blocks are the same.
+type stores struct {
+	htpasswd string
+	creds    *htpasswdauth.Store
+
+	allowClients []string
+	denyClients  []string
+	filter       *socks5.CIDRFilter
+
+	blocklist string
+	reload    Duration
+	rules     *socks5.DynamicRuleSet
+}
+
+// stop stops reloading the stores which are not reused by next
+func (s *stores) stop(next *stores) {
+	if s.creds != nil && s.creds != next.creds {
+		s.creds.Stop()
+	}
+	if s.rules != nil && s.rules != next.rules {
+		s.rules.Stop()
+	}
+}
+
+// served are the stores of the servers created by Server or
+// reloaded with Apply, until the servers are closed
+var served = struct {
+	sync.Mutex
+	m map[*socks5.Server]*stores
+}{m: make(map[*socks5.Server]*stores)}
+
+// Config creates the socks5.Config described by the file, loading
+// the htpasswd file and block list, if any. They are reloaded until
+// stopped with Stop, which Server does once the server is closed.
+func (f *File) Config() (*socks5.Config, error) {
+	conf, _, err := f.config(&stores{})
+	return conf, err
+}
+
+// config creates the socks5.Config described by the file, reusing
+// the stores of prev which were loaded from the same files
+func (f *File) config(prev *stores) (*socks5.Config, *stores, error) {
+	if err := f.Validate(); err != nil {
+		return nil, nil, err
+	}
+	conf := &socks5.Config{
+		RequireFQDN:                 f.ACL.RequireFQDN,
+		DenyFQDN:                    f.ACL.DenyFQDN,
+		DenySelf:                    f.ACL.DenySelf,
+		HandshakeTimeout:            time.Duration(f.Timeouts.Handshake),
+		GreetingTimeout:             time.Duration(f.Timeouts.Greeting),
+		AuthTimeout:                 time.Duration(f.Timeouts.Auth),
+		RequestTimeout:              time.Duration(f.Timeouts.Request),
+		DialTimeout:                 time.Duration(f.Timeouts.Dial),
+		IdleTimeout:                 time.Duration(f.Timeouts.Idle),
+		MaxConnectionLifetime:       time.Duration(f.Timeouts.Lifetime),
+		MaxConnectionLifetimeJitter: time.Duration(f.Timeouts.LifetimeJitter),
+		MaxConcurrentConnections:    f.Limits.MaxConnections,
+		MaxDialsPerDest:             f.Limits.MaxDialsPerDest,
+		MaxRequestBytes:             f.Limits.MaxRequestBytes,
+		ByteQuota:                   f.Limits.ByteQuota,
+		Logger:                      logger,
+		LogLevel:                    socks5.LogInfo,
+		Trace:                       f.Log.Trace,
+	}
+	if f.Log.Level != "" {
+		conf.LogLevel = levels[strings.ToLower(f.Log.Level)]
+	}
+
+	next := &stores{}
+	switch {
+	case len(f.Auth.Users) > 0:
+		conf.Credentials = socks5.StaticCredentials(f.Auth.Users)
+	case f.Auth.Htpasswd != "" && prev.creds != nil && prev.htpasswd == f.Auth.Htpasswd:
+		next.htpasswd, next.creds = prev.htpasswd, prev.creds
+		conf.Credentials = prev.creds
+	case f.Auth.Htpasswd != "":
+		creds, err := htpasswdauth.New(f.Auth.Htpasswd)
+		if err != nil {
+			return nil, nil, err
+		}
+		if conf.LogLevel <= socks5.LogError {
+			creds.OnError = func(err error) {
+				logger.Printf("[ERR] socks: Failed to reload %s: %v", f.Auth.Htpasswd, err)
+			}
+		}
+		if err := creds.Watch(watcher); err != nil {
+			return nil, nil, err
+		}
+		next.htpasswd, next.creds = f.Auth.Htpasswd, creds
+		conf.Credentials = creds
+	}
+
+	for _, name := range f.ACL.Commands {
+		conf.EnabledCommands |= commands[strings.ToLower(name)]
+	}
+	switch {
+	case len(f.ACL.AllowClients) == 0 && len(f.ACL.DenyClients) == 0:
+	case prev.filter != nil && sameStrings(prev.allowClients, f.ACL.AllowClients) && sameStrings(prev.denyClients, f.ACL.DenyClients):
+		next.allowClients, next.denyClients, next.filter = prev.allowClients, prev.denyClients, prev.filter
+		conf.ClientFilter = prev.filter
+	default:
+		filter, _ := socks5.NewCIDRFilter(f.ACL.AllowClients, f.ACL.DenyClients)
+		next.allowClients, next.denyClients, next.filter = f.ACL.AllowClients, f.ACL.DenyClients, filter
+		conf.ClientFilter = filter
+	}
+	switch {
+	case f.ACL.Blocklist != "" && prev.rules != nil && prev.blocklist == f.ACL.Blocklist && prev.reload == f.ACL.BlocklistReload:
+		next.blocklist, next.reload, next.rules = prev.blocklist, prev.reload, prev.rules
+		conf.Rules = prev.rules
+	case f.ACL.Blocklist != "":
+		rules, err := socks5.NewDynamicRuleSet(socks5.FileBlocklist(f.ACL.Blocklist), time.Duration(f.ACL.BlocklistReload))
+		if err != nil {
+			next.stop(prev)
+			return nil, nil, fmt.Errorf("Failed to load block list: %v", err)
+		}
+		next.blocklist, next.reload, next.rules = f.ACL.Blocklist, f.ACL.BlocklistReload, rules
+		conf.Rules = rules
+	}
+	return conf, next, nil
+}
+
+// sameStrings checks if two lists hold the same strings in order
+func sameStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Stop stops reloading the htpasswd file and block list
+// of a Config created by Config
+func Stop(conf *socks5.Config) {
+	if creds, ok := conf.Credentials.(*htpasswdauth.Store); ok {
+		creds.Stop()
+	}
+	if rules, ok := conf.Rules.(*socks5.DynamicRuleSet); ok {
+		rules.Stop()
+	}
+}
+
+// Apply applies the configuration to a running server with ApplyConfig,
+// for example once the file was reloaded on SIGHUP. The htpasswd file
+// and block list of a server created by Server are kept while their
+// paths do not change, and otherwise loaded again, stopping the ones
+// replaced. Changes of the listeners are not detected, and need a
+// restart.
+func (f *File) Apply(serv *socks5.Server) (*socks5.ConfigDiff, error) {
+	diff, tracked, err := f.apply(serv)
+	if err != nil {
+		return nil, err
+	}
+	if !tracked {
+		serv.OnClose(func() { untrack(serv) })
+	}
+	return diff, nil
+}
+
+// apply is used to apply the configuration, returning if the
+// stores of the server were tracked already
+func (f *File) apply(serv *socks5.Server) (*socks5.ConfigDiff, bool, error) {
+	served.Lock()
+	defer served.Unlock()
+	prev, tracked := served.m[serv]
+	if !tracked {
+		prev = &stores{}
+	}
+	conf, next, err := f.config(prev)
+	if err != nil {
+		return nil, tracked, err
+	}
+	diff, err := serv.ApplyConfig(conf)
+	if err != nil {
+		next.stop(prev)
+		return nil, tracked, err
+	}
+	prev.stop(next)
+	served.m[serv] = next
+	return diff, tracked, nil
+}
+
+// untrack is used to stop the stores of a server once it is closed
+func untrack(serv *socks5.Server) {
+	served.Lock()
+	defer served.Unlock()
+	if st, ok := served.m[serv]; ok {
+		st.stop(&stores{})
+		delete(served.m, serv)
+	}
+}
+
+// Server creates the server described by the file and starts serving
+// its listeners, which are returned in order, for example to find the
+// ports bound for the addresses with port 0. The listeners are closed
+// by Close or Shutdown of the server.
+func (f *File) Server() (*socks5.Server, []net.Listener, error) {
+	conf, st, err := f.config(&stores{})
+	if err != nil {
+		return nil, nil, err
+	}
+	serv, err := socks5.New(conf)
+	if err != nil {
+		st.stop(&stores{})
+		return nil, nil, err
+	}
+	served.Lock()
+	served.m[serv] = st
+	served.Unlock()
+	serv.OnClose(func() { untrack(serv) })
+	listeners := make([]net.Listener, 0, len(f.Listeners))
+	for _, addr := range f.Listeners {
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			serv.Close()
+			return nil, nil, fmt.Errorf("Failed to listen on %s: %v", addr, err)
+		}
+		if err := serv.AddListener(l); err != nil {
+			l.Close()
+			serv.Close()
+			return nil, nil, err
+		}
+		listeners = append(listeners, l)
+	}
+	return serv, listeners, nil
+}
@@ -0,0 +1,249 @@
+package config
+
+import (
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/armon/go-socks5"
+	"github.com/armon/go-socks5/htpasswdauth"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestParse(t *testing.T) {
+	f, err := Parse(strings.NewReader(`{
+		"listeners": ["127.0.0.1:0"],
+		"auth": {"users": {"foo": "bar"}},
+		"acl": {"commands": ["connect", "Associate"], "deny_clients": ["10.0.0.0/8"]},
+		"timeouts": {"handshake": "10s", "lifetime": "1h"},
+		"limits": {"max_connections": 100},
+		"log": {"level": "warn"}
+	}`))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	conf, err := f.Config()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if conf.HandshakeTimeout != 10*time.Second || conf.MaxConnectionLifetime != time.Hour {
+		t.Fatalf("bad: %v %v", conf.HandshakeTimeout, conf.MaxConnectionLifetime)
+	}
+	if conf.EnabledCommands != socks5.ConnectEnabled|socks5.AssociateEnabled {
+		t.Fatalf("bad: %v", conf.EnabledCommands)
+	}
+	if conf.MaxConcurrentConnections != 100 || conf.LogLevel != socks5.LogWarn {
+		t.Fatalf("bad: %v %v", conf.MaxConcurrentConnections, conf.LogLevel)
+	}
+	if !conf.Credentials.Valid("foo", "bar") || conf.ClientFilter == nil {
+		t.Fatalf("bad: %v %v", conf.Credentials, conf.ClientFilter)
+	}
+}
+
+func TestParse_Invalid(t *testing.T) {
+	cases := []string{
+		`{}`,
+		`{"listeners": ["nope"]}`,
+		`{"listeners": [":1080"], "unknown": 1}`,
+		`{"listeners": [":1080"], "acl": {"commands": ["ping"]}}`,
+		`{"listeners": [":1080"], "acl": {"allow_clients": ["10.0.0.0"]}}`,
+		`{"listeners": [":1080"], "timeouts": {"idle": 30}}`,
+		`{"listeners": [":1080"], "timeouts": {"idle": "-1s"}}`,
+		`{"listeners": [":1080"], "log": {"level": "loud"}}`,
+		`{"listeners": [":1080"], "auth": {"users": {"a": "b"}, "htpasswd": "/x"}}`,
+	}
+	for _, c := range cases {
+		if _, err := Parse(strings.NewReader(c)); err == nil {
+			t.Fatalf("expected error for %s", c)
+		}
+	}
+}
+
+func TestLoad_Server(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "socks5.json")
+	if err := os.WriteFile(path, []byte(`{"listeners": ["127.0.0.1:0"], "log": {"level": "off"}}`), 0600); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	f, err := Load(path)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	serv, listeners, err := f.Server()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer serv.Close()
+	if len(listeners) != 1 {
+		t.Fatalf("bad: %v", listeners)
+	}
+
+	conn, err := net.Dial("tcp", listeners[0].Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+	conn.Write([]byte{5, 1, socks5.NoAuth})
+	out := make([]byte, 2)
+	if _, err := io.ReadFull(conn, out); err != nil || out[1] != socks5.NoAuth {
+		t.Fatalf("bad: %v %v", out, err)
+	}
+}
+
+func TestFile_Apply(t *testing.T) {
+	f, err := Parse(strings.NewReader(`{
+		"listeners": ["127.0.0.1:0"],
+		"acl": {"allow_clients": ["127.0.0.0/8"]},
+		"log": {"level": "off"}
+	}`))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	serv, _, err := f.Server()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer serv.Close()
+
+	// Reloading the same file changes nothing
+	if diff, err := f.Apply(serv); err != nil || diff.Changed() {
+		t.Fatalf("bad: %#v %v", diff, err)
+	}
+
+	// Changed CIDR blocks replace the ClientFilter
+	f.ACL.AllowClients = []string{"10.0.0.0/8"}
+	if diff, err := f.Apply(serv); err != nil || len(diff.Applied) != 1 || diff.Applied[0] != "ClientFilter" {
+		t.Fatalf("bad: %#v %v", diff, err)
+	}
+
+	f.Timeouts.Idle = Duration(time.Minute)
+	f.Limits.MaxConnections = 10
+	diff, err := f.Apply(serv)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(diff.Applied) != 1 || diff.Applied[0] != "IdleTimeout" {
+		t.Fatalf("bad: %#v", diff)
+	}
+	if len(diff.Restart) != 1 || diff.Restart[0] != "MaxConcurrentConnections" {
+		t.Fatalf("bad: %#v", diff)
+	}
+}
+
+// writeHtpasswd writes an htpasswd file with the users, all
+// using the password "bar", and a comment
+func writeHtpasswd(t *testing.T, path, comment string, users ...string) {
+	var buf strings.Builder
+	for _, user := range users {
+		hash, err := bcrypt.GenerateFromPassword([]byte("bar"), bcrypt.MinCost)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		buf.WriteString(user + ":" + string(hash) + "\n")
+	}
+	buf.WriteString("# " + comment + "\n")
+	if err := os.WriteFile(path, []byte(buf.String()), 0600); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestFile_HtpasswdReload(t *testing.T) {
+	defer func(w htpasswdauth.FileWatcher) { watcher = w }(watcher)
+	watcher = &htpasswdauth.PollWatcher{Interval: 5 * time.Millisecond}
+
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	writeHtpasswd(t, path, "initial", "foo")
+	f := &File{Listeners: []string{"127.0.0.1:0"}, Auth: Auth{Htpasswd: path}, Log: Log{Level: "off"}}
+	conf, err := f.Config()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer Stop(conf)
+	if !conf.Credentials.Valid("foo", "bar") {
+		t.Fatalf("expected valid")
+	}
+
+	writeHtpasswd(t, path, "rotated", "baz")
+	deadline := time.Now().Add(time.Second)
+	for !conf.Credentials.Valid("baz", "bar") {
+		if time.Now().After(deadline) {
+			t.Fatalf("not reloaded")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// Changes are ignored once stopped
+	Stop(conf)
+	writeHtpasswd(t, path, "stopped", "qux")
+	time.Sleep(50 * time.Millisecond)
+	if conf.Credentials.Valid("qux", "bar") {
+		t.Fatalf("unexpected reload")
+	}
+}
+
+func TestFile_ApplyStores(t *testing.T) {
+	dir := t.TempDir()
+	htpasswd := filepath.Join(dir, "htpasswd")
+	writeHtpasswd(t, htpasswd, "users", "foo")
+	blocklist := filepath.Join(dir, "blocklist")
+	if err := os.WriteFile(blocklist, []byte("evil.com\n"), 0600); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	f := &File{
+		Listeners: []string{"127.0.0.1:0"},
+		Auth:      Auth{Htpasswd: htpasswd},
+		ACL:       ACL{Blocklist: blocklist, BlocklistReload: Duration(time.Minute)},
+		Log:       Log{Level: "off"},
+	}
+	before := runtime.NumGoroutine()
+	serv, _, err := f.Server()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Reloading the same files reuses their stores
+	started := runtime.NumGoroutine()
+	for i := 0; i < 10; i++ {
+		if diff, err := f.Apply(serv); err != nil || diff.Changed() {
+			t.Fatalf("bad: %#v %v", diff, err)
+		}
+	}
+	if n := runtime.NumGoroutine(); n > started {
+		t.Fatalf("leaked %d goroutines", n-started)
+	}
+
+	// A changed path loads the file again, stopping the old store
+	other := filepath.Join(dir, "blocklist2")
+	if err := os.WriteFile(other, []byte("evil.org\n"), 0600); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	f.ACL.Blocklist = other
+	diff, err := f.Apply(serv)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(diff.Applied) != 1 || diff.Applied[0] != "Rules" {
+		t.Fatalf("bad: %#v", diff)
+	}
+	waitGoroutines(t, started)
+
+	// Closing the server stops the stores
+	serv.Close()
+	waitGoroutines(t, before)
+}
+
+// waitGoroutines waits for the number of goroutines to drop to n
+func waitGoroutines(t *testing.T, n int) {
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > n {
+		if time.Now().After(deadline) {
+			t.Fatalf("leaked %d goroutines", runtime.NumGoroutine()-n)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
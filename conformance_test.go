@@ -0,0 +1,233 @@
+package socks5
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// failResolver fails every lookup
+type failResolver struct{}
+
+func (failResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	return ctx, nil, errors.New("no such host")
+}
+
+// failDial returns a Dial function which always fails with the given error
+func failDial(msg string) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return nil, errors.New(msg)
+	}
+}
+
+// conformanceCase is a scripted client exchange. The server must
+// reply with exactly the expected bytes and then close the connection,
+// unless open is set, in which case only the prefix is checked.
+type conformanceCase struct {
+	name   string
+	conf   func() *Config
+	send   []byte
+	expect []byte
+	open   bool
+}
+
+func runConformance(t *testing.T, tc conformanceCase) {
+	conf := tc.conf()
+	conf.Logger = log.New(os.Stdout, "", log.LstdFlags)
+	serv, _ := New(conf)
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go serv.ServeConn(server)
+	go client.Write(tc.send)
+
+	client.SetDeadline(time.Now().Add(time.Second))
+	var out []byte
+	var err error
+	if tc.open {
+		out = make([]byte, len(tc.expect))
+		_, err = io.ReadFull(client, out)
+	} else {
+		out, err = io.ReadAll(client)
+	}
+	if err != nil {
+		t.Fatalf("%s: err: %v", tc.name, err)
+	}
+	if !bytes.Equal(out, tc.expect) {
+		t.Fatalf("%s: bad: %v expected %v", tc.name, out, tc.expect)
+	}
+}
+
+func TestConformance_RFC1928(t *testing.T) {
+	// Target for successful connects
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	lAddr := l.Addr().(*net.TCPAddr)
+	target := []byte{ipv4Address, 127, 0, 0, 1, byte(lAddr.Port >> 8), byte(lAddr.Port)}
+
+	greeting := []byte{5, 1, NoAuth}
+	connect := func(addr ...byte) []byte {
+		msg := append([]byte{}, greeting...)
+		msg = append(msg, 5, ConnectCommand, 0)
+		return append(msg, addr...)
+	}
+	failed := func(code uint8) []byte {
+		return []byte{5, NoAuth, 5, code, 0, ipv4Address, 0, 0, 0, 0, 0, 0}
+	}
+	unreachable := []byte{ipv4Address, 10, 0, 0, 1, 0, 80}
+
+	cases := []conformanceCase{
+		{
+			name:   "succeeded",
+			conf:   func() *Config { return &Config{} },
+			send:   connect(target...),
+			expect: []byte{5, NoAuth, 5, SuccessReply, 0, ipv4Address, 127, 0, 0, 1},
+			open:   true,
+		},
+		{
+			name:   "connection not allowed by ruleset",
+			conf:   func() *Config { return &Config{Rules: PermitNone()} },
+			send:   connect(target...),
+			expect: failed(RuleFailure),
+		},
+		{
+			name:   "network unreachable",
+			conf:   func() *Config { return &Config{Dial: failDial("connect: network is unreachable")} },
+			send:   connect(unreachable...),
+			expect: failed(NetworkUnreachable),
+		},
+		{
+			name:   "host unreachable",
+			conf:   func() *Config { return &Config{Dial: failDial("connect: no route to host")} },
+			send:   connect(unreachable...),
+			expect: failed(HostUnreachable),
+		},
+		{
+			name:   "host unreachable on resolve",
+			conf:   func() *Config { return &Config{Resolver: failResolver{}} },
+			send:   connect(fqdnAddress, 3, 'f', 'o', 'o', 0, 80),
+			expect: failed(HostUnreachable),
+		},
+		{
+			name:   "host unreachable on invalid name",
+			conf:   func() *Config { return &Config{} },
+			send:   connect(fqdnAddress, 5, 'f', '\n', 'o', 'o', '.', 0, 80),
+			expect: failed(HostUnreachable),
+		},
+		{
+			name:   "connection refused",
+			conf:   func() *Config { return &Config{Dial: failDial("connect: connection refused")} },
+			send:   connect(unreachable...),
+			expect: failed(ConnectionRefused),
+		},
+		{
+			name:   "command not supported",
+			conf:   func() *Config { return &Config{} },
+			send:   append(append([]byte{}, greeting...), 5, 9, 0, ipv4Address, 10, 0, 0, 1, 0, 80),
+			expect: failed(CommandNotSupported),
+		},
+		{
+			name:   "address type not supported",
+			conf:   func() *Config { return &Config{} },
+			send:   connect(9, 10, 0, 0, 1, 0, 80),
+			expect: failed(AddrTypeNotSupported),
+		},
+		{
+			name:   "reserved not zero",
+			conf:   func() *Config { return &Config{} },
+			send:   append(append([]byte{}, greeting...), 5, ConnectCommand, 1, ipv4Address, 10, 0, 0, 1, 0, 80),
+			expect: failed(ServerFailure),
+		},
+		{
+			name:   "reserved not zero, lenient",
+			conf:   func() *Config { return &Config{LenientRSV: true, Rules: PermitNone()} },
+			send:   append(append([]byte{}, greeting...), 5, ConnectCommand, 1, ipv4Address, 10, 0, 0, 1, 0, 80),
+			expect: failed(RuleFailure),
+		},
+		{
+			name:   "no acceptable methods",
+			conf:   func() *Config { return &Config{} },
+			send:   []byte{5, 1, UserPassAuth},
+			expect: []byte{5, noAcceptable},
+		},
+		{
+			name:   "unsupported version",
+			conf:   func() *Config { return &Config{} },
+			send:   []byte{4, 1, 0, 80, 10, 0, 0, 1, 0},
+			expect: []byte{},
+		},
+	}
+	for _, tc := range cases {
+		runConformance(t, tc)
+	}
+}
+
+func TestConformance_RFC1929(t *testing.T) {
+	creds := func() *Config {
+		return &Config{Credentials: StaticCredentials{"foo": "bar"}, Rules: PermitNone()}
+	}
+	greeting := []byte{5, 1, UserPassAuth}
+	login := func(user, pass string) []byte {
+		msg := append([]byte{}, greeting...)
+		msg = append(msg, userAuthVersion, byte(len(user)))
+		msg = append(msg, user...)
+		msg = append(msg, byte(len(pass)))
+		return append(msg, pass...)
+	}
+
+	cases := []conformanceCase{
+		{
+			name: "success",
+			conf: creds,
+			send: append(login("foo", "bar"), 5, ConnectCommand, 0, ipv4Address, 10, 0, 0, 1, 0, 80),
+			expect: []byte{5, UserPassAuth, userAuthVersion, authSuccess,
+				5, RuleFailure, 0, ipv4Address, 0, 0, 0, 0, 0, 0},
+		},
+		{
+			name:   "failure",
+			conf:   creds,
+			send:   login("foo", "baz"),
+			expect: []byte{5, UserPassAuth, userAuthVersion, authFailure},
+		},
+		{
+			name:   "unknown user",
+			conf:   creds,
+			send:   login("nobody", "bar"),
+			expect: []byte{5, UserPassAuth, userAuthVersion, authFailure},
+		},
+		{
+			name:   "unsupported version",
+			conf:   creds,
+			send:   append(append([]byte{}, greeting...), 5, 3, 'f', 'o', 'o', 3, 'b', 'a', 'r'),
+			expect: []byte{5, UserPassAuth},
+		},
+		{
+			name:   "no auth offered",
+			conf:   creds,
+			send:   []byte{5, 1, NoAuth},
+			expect: []byte{5, noAcceptable},
+		},
+	}
+	for _, tc := range cases {
+		runConformance(t, tc)
+	}
+}
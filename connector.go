@@ -0,0 +1,183 @@
+package socks5
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// StreamConnector relays to destinations which are only reachable
+// through streams opened by a function, rather than dialed, such as
+// Kubernetes port-forward streams over SPDY or WebSockets. Its Dial
+// is used as the Dial of the Config:
+//
+//	connector := &socks5.StreamConnector{Open: openPortForward}
+//	conf := &socks5.Config{Dial: connector.Dial}
+//
+// The streams are wrapped in virtual net.Conns. Read deadlines are
+// emulated for streams which do not support them, as the server
+// relies on them to interrupt relays. Half-closes are passed on to
+// streams implementing CloseWrite.
+type StreamConnector struct {
+	// Open opens a stream to the address on the network, as passed
+	// to a Dial. The context carries the values of the request, e.g.
+	// UserFromContext, and bounds the opening, but may be canceled
+	// as soon as Open returns, so streams must not be tied to it.
+	// The stream is closed once the relay ends.
+	Open func(ctx context.Context, network, addr string) (io.ReadWriteCloser, error)
+
+	// LocalAddr is reported as the local address of the virtual
+	// conns, and so sent as BND.ADDR in the reply to CONNECT if it is
+	// a *net.TCPAddr or *AddrSpec. By default the reply carries the
+	// placeholder 0.0.0.0:0, as streams have no local address.
+	LocalAddr net.Addr
+}
+
+// Dial opens a stream to the address, as a virtual net.Conn
+func (c *StreamConnector) Dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	stream, err := c.Open(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	remote := &AddrSpec{}
+	if host, port, err := net.SplitHostPort(addr); err == nil {
+		remote.IP = net.ParseIP(host)
+		if remote.IP == nil {
+			remote.FQDN = host
+		}
+		remote.Port, _ = net.LookupPort(network, port)
+	}
+	return &streamConn{stream: stream, local: c.LocalAddr, remote: remote}, nil
+}
+
+// deadlineReader is implemented by streams supporting read deadlines
+type deadlineReader interface {
+	SetReadDeadline(t time.Time) error
+}
+
+// streamConn is a virtual net.Conn over a stream
+type streamConn struct {
+	stream io.ReadWriteCloser
+	local  net.Addr
+	remote net.Addr
+
+	// The emulated read deadline, with the read which is pending
+	// in the background since a Read timed out, if any
+	l        sync.Mutex
+	deadline time.Time
+	pending  chan streamRead
+}
+
+type streamRead struct {
+	b   []byte
+	err error
+}
+
+func (c *streamConn) Read(b []byte) (int, error) {
+	if _, ok := c.stream.(deadlineReader); ok {
+		return c.stream.Read(b)
+	}
+
+	c.l.Lock()
+	deadline, pending := c.deadline, c.pending
+	c.l.Unlock()
+	if pending == nil && deadline.IsZero() {
+		return c.stream.Read(b)
+	}
+
+	// Read in the background, to give up at the deadline
+	// without losing the data read meanwhile
+	if pending == nil {
+		pending = make(chan streamRead, 1)
+		buf := make([]byte, len(b))
+		go func() {
+			n, err := c.stream.Read(buf)
+			pending <- streamRead{buf[:n], err}
+		}()
+	}
+	var expired <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case r := <-pending:
+		c.l.Lock()
+		c.pending = nil
+		c.l.Unlock()
+		n := copy(b, r.b)
+		if n < len(r.b) {
+			// Keep the rest for the next Read
+			rest := make(chan streamRead, 1)
+			rest <- streamRead{r.b[n:], r.err}
+			c.l.Lock()
+			c.pending = rest
+			c.l.Unlock()
+			return n, nil
+		}
+		return n, r.err
+	case <-expired:
+		c.l.Lock()
+		c.pending = pending
+		c.l.Unlock()
+		return 0, &net.OpError{Op: "read", Net: "stream", Addr: c.remote, Err: os.ErrDeadlineExceeded}
+	}
+}
+
+func (c *streamConn) Write(b []byte) (int, error) {
+	return c.stream.Write(b)
+}
+
+func (c *streamConn) Close() error {
+	return c.stream.Close()
+}
+
+// CloseWrite half-closes the stream, if it supports it
+func (c *streamConn) CloseWrite() error {
+	if cw, ok := c.stream.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+func (c *streamConn) LocalAddr() net.Addr {
+	if c.local == nil {
+		return &AddrSpec{IP: net.IPv4zero}
+	}
+	return c.local
+}
+
+func (c *streamConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *streamConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+func (c *streamConn) SetReadDeadline(t time.Time) error {
+	if dr, ok := c.stream.(deadlineReader); ok {
+		return dr.SetReadDeadline(t)
+	}
+	c.l.Lock()
+	c.deadline = t
+	c.l.Unlock()
+	return nil
+}
+
+// SetWriteDeadline is passed on to streams supporting it, and
+// otherwise ignored
+func (c *streamConn) SetWriteDeadline(t time.Time) error {
+	if dw, ok := c.stream.(interface{ SetWriteDeadline(time.Time) error }); ok {
+		return dw.SetWriteDeadline(t)
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package socks5
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// plainStream hides the deadlines of a net.Conn
+type plainStream struct {
+	io.ReadWriteCloser
+}
+
+// echoStream returns a stream echoing what is written to it
+func echoStream() io.ReadWriteCloser {
+	client, server := net.Pipe()
+	go func() {
+		defer server.Close()
+		io.Copy(server, server)
+	}()
+	return plainStream{client}
+}
+
+func TestStreamConnector_Connect(t *testing.T) {
+	var opened string
+	var user interface{}
+	connector := &StreamConnector{
+		Open: func(ctx context.Context, network, addr string) (io.ReadWriteCloser, error) {
+			opened = addr
+			user, _ = UserFromContext(ctx)
+			return echoStream(), nil
+		},
+	}
+	serv, _ := New(&Config{
+		Credentials: StaticCredentials{"foo": "bar"},
+		Resolver:    loopbackResolver{},
+		Dial:        connector.Dial,
+	})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	go serv.Serve(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+	req := bytes.NewBuffer(nil)
+	req.Write([]byte{5, 1, UserPassAuth, 1, 3, 'f', 'o', 'o', 3, 'b', 'a', 'r'})
+	req.Write([]byte{5, ConnectCommand, 0, fqdnAddress, 3, 'p', 'o', 'd', 0, 80})
+	req.WriteString("ping")
+	conn.Write(req.Bytes())
+
+	if _, err := io.ReadFull(conn, make([]byte, 4)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp, bind, err := ReadReply(conn)
+	if err != nil || resp != SuccessReply {
+		t.Fatalf("bad: %v %v", resp, err)
+	}
+
+	// Streams have no local address
+	if !bind.IP.Equal(net.IPv4zero) || bind.Port != 0 {
+		t.Fatalf("bad: %v", bind)
+	}
+	out := make([]byte, 4)
+	if _, err := io.ReadFull(conn, out); err != nil || !bytes.Equal(out, []byte("ping")) {
+		t.Fatalf("bad: %v %v", out, err)
+	}
+	if opened != "127.0.0.1:80" || user != "foo" {
+		t.Fatalf("bad: %v %v", opened, user)
+	}
+}
+
+func TestStreamConn_ReadDeadline(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	local := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234}
+	connector := &StreamConnector{
+		Open: func(ctx context.Context, network, addr string) (io.ReadWriteCloser, error) {
+			return plainStream{client}, nil
+		},
+		LocalAddr: local,
+	}
+	conn, err := connector.Dial(context.Background(), "tcp", "pod:80")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	if conn.LocalAddr() != local || conn.RemoteAddr().(*AddrSpec).FQDN != "pod" {
+		t.Fatalf("bad: %v %v", conn.LocalAddr(), conn.RemoteAddr())
+	}
+
+	// A deadline interrupts a blocked read
+	conn.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	buf := make([]byte, 2)
+	if _, err := conn.Read(buf); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The data arriving later is not lost
+	conn.SetReadDeadline(time.Time{})
+	go server.Write([]byte("pong"))
+	out := make([]byte, 4)
+	if _, err := io.ReadFull(conn, out); err != nil || !bytes.Equal(out, []byte("pong")) {
+		t.Fatalf("bad: %v %v", out, err)
+	}
+}
@@ -0,0 +1,66 @@
+package socks5
+
+import (
+	"sync/atomic"
+
+	"golang.org/x/net/context"
+)
+
+// contextKey is the type of the context keys used by this package
+type contextKey int
+
+const (
+	userKey contextKey = iota
+	requestKey
+	connIDKey
+	qosClassKey
+)
+
+// lastConnID is used to number the served connections
+var lastConnID uint64
+
+// WithUser returns a context carrying the authenticated user name.
+// The server sets it after a successful username based authentication.
+func WithUser(ctx context.Context, user string) context.Context {
+	return context.WithValue(ctx, userKey, user)
+}
+
+// UserFromContext returns the authenticated user name, if any
+func UserFromContext(ctx context.Context) (string, bool) {
+	user, ok := ctx.Value(userKey).(string)
+	return user, ok
+}
+
+// withRequest returns a context carrying the client request
+func withRequest(ctx context.Context, req *Request) context.Context {
+	return context.WithValue(ctx, requestKey, req)
+}
+
+// RequestFromContext returns the request being served, if any.
+// It is set before the resolver, rewriter and rules are invoked.
+func RequestFromContext(ctx context.Context) (*Request, bool) {
+	req, ok := ctx.Value(requestKey).(*Request)
+	return req, ok
+}
+
+// withConnID returns a context carrying a new connection ID
+func withConnID(ctx context.Context) context.Context {
+	return context.WithValue(ctx, connIDKey, atomic.AddUint64(&lastConnID, 1))
+}
+
+// ConnIDFromContext returns the ID of the client connection, which
+// is unique within the process. Useful to correlate hook invocations
+// and log lines of the same connection.
+func ConnIDFromContext(ctx context.Context) (uint64, bool) {
+	id, ok := ctx.Value(connIDKey).(uint64)
+	return id, ok
+}
+
+// context returns the context of the request, which
+// is only set for requests read by the server
+func (r *Request) context() context.Context {
+	if r.ctx == nil {
+		return context.Background()
+	}
+	return r.ctx
+}
@@ -0,0 +1,86 @@
+package socks5
+
+import (
+	"bytes"
+	"log"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// ctxRules records the context passed to the rules
+type ctxRules struct {
+	ctx chan context.Context
+}
+
+func (r *ctxRules) Allow(ctx context.Context, req *Request) (context.Context, bool) {
+	r.ctx <- ctx
+	return ctx, false
+}
+
+func TestContext_Helpers(t *testing.T) {
+	ctx := context.Background()
+	if _, ok := UserFromContext(ctx); ok {
+		t.Fatalf("unexpected user")
+	}
+	if _, ok := RequestFromContext(ctx); ok {
+		t.Fatalf("unexpected request")
+	}
+	if _, ok := ConnIDFromContext(ctx); ok {
+		t.Fatalf("unexpected conn id")
+	}
+
+	if user, ok := UserFromContext(WithUser(ctx, "foo")); !ok || user != "foo" {
+		t.Fatalf("bad: %v", user)
+	}
+	id1, _ := ConnIDFromContext(withConnID(ctx))
+	id2, _ := ConnIDFromContext(withConnID(ctx))
+	if id1 == id2 {
+		t.Fatalf("bad: %d %d", id1, id2)
+	}
+}
+
+func TestContext_Hooks(t *testing.T) {
+	rules := &ctxRules{ctx: make(chan context.Context, 1)}
+	serv, _ := New(&Config{
+		Credentials: StaticCredentials{"foo": "bar"},
+		Rules:       rules,
+		Logger:      log.New(os.Stdout, "", log.LstdFlags),
+	})
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go serv.ServeConn(server)
+
+	req := bytes.NewBuffer(nil)
+	req.Write([]byte{5, 1, UserPassAuth, userAuthVersion, 3, 'f', 'o', 'o', 3, 'b', 'a', 'r'})
+	req.Write([]byte{5, ConnectCommand, 0, ipv4Address, 10, 0, 0, 1, 0, 80})
+	go client.Write(req.Bytes())
+	go func() {
+		buf := make([]byte, 64)
+		for {
+			if _, err := client.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+
+	var ctx context.Context
+	select {
+	case ctx = <-rules.ctx:
+	case <-time.After(time.Second):
+		t.Fatalf("timeout")
+	}
+	if user, ok := UserFromContext(ctx); !ok || user != "foo" {
+		t.Fatalf("bad: %v", user)
+	}
+	if r, ok := RequestFromContext(ctx); !ok || r.DestAddr.Port != 80 {
+		t.Fatalf("bad: %v", r)
+	}
+	if _, ok := ConnIDFromContext(ctx); !ok {
+		t.Fatalf("missing conn id")
+	}
+}
@@ -0,0 +1,299 @@
+package socks5
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+var (
+	// ErrIdleTimeout ends a relay which relayed no data in either
+	// direction for the IdleTimeout
+	ErrIdleTimeout = errors.New("Relay idle timeout")
+
+	// ErrQuotaExceeded ends a relay which relayed the ByteQuota
+	ErrQuotaExceeded = errors.New("Byte quota exceeded")
+
+	// ErrMaxLifetime ends a relay which lasted MaxConnectionLifetime
+	ErrMaxLifetime = errors.New("Relay reached its maximum lifetime")
+)
+
+// RelaySide is a side of a relay
+type RelaySide uint8
+
+const (
+	// SideClient is the client of the proxy
+	SideClient RelaySide = iota
+	// SideTarget is the destination the client connected to
+	SideTarget
+	// SideProxy is the proxy itself, ending the relay due to a
+	// timeout, quota, policy or shutdown
+	SideProxy
+)
+
+func (s RelaySide) String() string {
+	switch s {
+	case SideClient:
+		return "client"
+	case SideTarget:
+		return "target"
+	case SideProxy:
+		return "proxy"
+	}
+	return "unknown"
+}
+
+// RelayEnd describes how a relay ended, telling if the client or the
+// target closed or failed first, to diagnose dropped connections
+type RelayEnd struct {
+	// Side is the side which closed or failed first
+	Side RelaySide
+
+	// Class is how it ended: eof for a close, lifetime once it lasted
+	// MaxConnectionLifetime, or the class of the error, such as reset
+	// or timeout
+	Class string
+
+	// Err is the error which ended the relay, nil for a close
+	Err error
+}
+
+// relayShared is the state shared by both directions of a relay
+type relayShared struct {
+	// active is the time of the last chunk in either
+	// direction, in Unix nanoseconds
+	active int64
+
+	// quota is the number of bytes left to relay,
+	// if limited is set
+	quota   int64
+	limited bool
+}
+
+func newRelayShared(quota uint64) *relayShared {
+	r := &relayShared{active: time.Now().UnixNano()}
+	if quota > 0 {
+		r.quota, r.limited = int64(quota), true
+	}
+	return r
+}
+
+// take is used to reserve up to n bytes of the quota
+func (r *relayShared) take(n int) int {
+	if !r.limited {
+		return n
+	}
+	for {
+		left := atomic.LoadInt64(&r.quota)
+		if left <= 0 {
+			return 0
+		}
+		granted := int64(n)
+		if granted > left {
+			granted = left
+		}
+		if atomic.CompareAndSwapInt64(&r.quota, left, left-granted) {
+			return int(granted)
+		}
+	}
+}
+
+// refund is used to return bytes of the quota which were not read
+func (r *relayShared) refund(n int) {
+	if r.limited && n > 0 {
+		atomic.AddInt64(&r.quota, int64(n))
+	}
+}
+
+// relayCopy is the copy loop of one direction of a relay. Unlike
+// io.Copy it stops once the context is done, ends idle relays, paces
+// the chunks with the BandwidthLimiter, enforces the byte quota and
+// reports the progress of each chunk, all on the relaying goroutine.
+type relayCopy struct {
+	ctx context.Context
+	dst io.Writer
+	src io.Reader
+
+	// conn is the connection src reads from, whose read deadline
+	// interrupts reads once the relay is idle for idle
+	conn interface{ SetReadDeadline(time.Time) error }
+	idle time.Duration
+
+	limiter *BandwidthLimiter
+	class   string
+
+	shared *relayShared
+
+	// progress is called with the size of each chunk read
+	progress func(n int)
+
+	// from and to are the sides src and dst face, and writeFailed
+	// is set if the copy ended as writing to dst failed
+	from, to    RelaySide
+	writeFailed bool
+}
+
+// end is used to describe how the relay ended, once the copy
+// finished first with the error
+func (c *relayCopy) end(err error) *RelayEnd {
+	switch {
+	case err == nil:
+		return &RelayEnd{Side: c.from, Class: errClassEOF}
+	case err == ErrIdleTimeout:
+		return &RelayEnd{Side: SideProxy, Class: errClassTimeout, Err: err}
+	case err == ErrQuotaExceeded, err == context.Canceled, err == context.DeadlineExceeded:
+		return &RelayEnd{Side: SideProxy, Class: errClassClosed, Err: err}
+	case c.writeFailed:
+		return &RelayEnd{Side: c.to, Class: classifyError(err), Err: err}
+	}
+	return &RelayEnd{Side: c.from, Class: classifyError(err), Err: err}
+}
+
+// run copies until src is exhausted, returning nil on EOF as io.Copy
+func (c *relayCopy) run(buf []byte) (written int64, err error) {
+	ctx := c.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	shared := c.shared
+	if shared == nil {
+		shared = newRelayShared(0)
+	}
+	idle := c.idle
+	if c.conn == nil {
+		idle = 0
+	}
+	var deadline time.Time
+	if idle > 0 {
+		deadline = time.Now().Add(idle)
+		c.conn.SetReadDeadline(deadline)
+		defer c.conn.SetReadDeadline(time.Time{})
+	}
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return written, err
+		}
+		size := shared.take(len(buf))
+		if size == 0 {
+			return written, ErrQuotaExceeded
+		}
+		if c.limiter != nil {
+			granted, err := c.limiter.wait(ctx, c.class, size)
+			if err != nil {
+				shared.refund(size)
+				return written, err
+			}
+			shared.refund(size - granted)
+			size = granted
+		}
+
+		n, rerr := c.src.Read(buf[:size])
+		shared.refund(size - n)
+		if c.limiter != nil && n < size {
+			c.limiter.refund(c.class, size-n)
+		}
+		if n > 0 {
+			atomic.StoreInt64(&shared.active, time.Now().UnixNano())
+			if c.progress != nil {
+				c.progress(n)
+			}
+			nw, werr := c.dst.Write(buf[:n])
+			if nw < 0 || nw > n {
+				nw, werr = 0, errors.New("invalid write result")
+			}
+			written += int64(nw)
+			if werr == nil && nw != n {
+				werr = io.ErrShortWrite
+			}
+			if werr != nil {
+				c.writeFailed = true
+				return written, werr
+			}
+		}
+		if rerr == nil {
+			continue
+		}
+		if rerr == io.EOF {
+			return written, nil
+		}
+
+		// Keep waiting while the other direction is active, unless
+		// the read was interrupted before the idle deadline
+		if ne, ok := rerr.(net.Error); ok && ne.Timeout() && idle > 0 && !time.Now().Before(deadline) {
+			last := time.Unix(0, atomic.LoadInt64(&shared.active))
+			if time.Since(last) >= idle {
+				return written, ErrIdleTimeout
+			}
+			deadline = last.Add(idle)
+			c.conn.SetReadDeadline(deadline)
+			continue
+		}
+		return written, rerr
+	}
+}
+
+// relayLifetime returns the lifetime of a new relay, including the
+// jitter, or zero if unlimited
+func (s *Server) relayLifetime() time.Duration {
+	lifetime := s.config.MaxConnectionLifetime
+	if lifetime <= 0 {
+		return 0
+	}
+	if jitter := s.config.MaxConnectionLifetimeJitter; jitter > 0 {
+		lifetime += time.Duration(rand.Int63n(int64(jitter) + 1))
+	}
+	return lifetime
+}
+
+// relayCopies prepares the copy loops of a relay, from the client to
+// the target and back, counting the bytes into the stats and session
+// and sharing the bandwidth by QoS class, if limited
+func (s *Server) relayCopies(ctx context.Context, client conn, target net.Conn, session *streamCounters) (up, down *relayCopy) {
+	shared := newRelayShared(s.config.ByteQuota)
+	stats := s.state.stats()
+	up = &relayCopy{
+		ctx:    ctx,
+		idle:   s.config.IdleTimeout,
+		shared: shared,
+		from:   SideClient,
+		to:     SideTarget,
+		progress: func(n int) {
+			atomic.AddUint64(&stats.bytesUp, uint64(n))
+			atomic.AddUint64(&session.up, uint64(n))
+		},
+	}
+	if c, ok := client.(interface{ SetReadDeadline(time.Time) error }); ok {
+		up.conn = c
+	}
+
+	start, first := time.Now(), true
+	down = &relayCopy{
+		ctx:    ctx,
+		conn:   target,
+		idle:   s.config.IdleTimeout,
+		shared: shared,
+		from:   SideTarget,
+		to:     SideClient,
+		progress: func(n int) {
+			if first {
+				first = false
+				s.metrics().MeasureSince([]string{"socks5", "first_byte"}, start)
+			}
+			atomic.AddUint64(&stats.bytesDown, uint64(n))
+			atomic.AddUint64(&session.down, uint64(n))
+		},
+	}
+
+	if limiter := s.config.Bandwidth; limiter != nil {
+		class := QoSClassFromContext(ctx)
+		up.limiter, up.class = limiter, class
+		down.limiter, down.class = limiter, class
+	}
+	return up, down
+}
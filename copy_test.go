@@ -0,0 +1,158 @@
+package socks5
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestRelayCopy_Quota(t *testing.T) {
+	shared := newRelayShared(150)
+	var progress int
+	up := &relayCopy{
+		dst:      &bytes.Buffer{},
+		src:      bytes.NewReader(make([]byte, 100)),
+		shared:   shared,
+		progress: func(n int) { progress += n },
+	}
+	if n, err := up.run(make([]byte, 32)); err != nil || n != 100 {
+		t.Fatalf("bad: %v %v", n, err)
+	}
+
+	// The quota is shared by both directions
+	down := &relayCopy{
+		dst:      &bytes.Buffer{},
+		src:      bytes.NewReader(make([]byte, 100)),
+		shared:   shared,
+		progress: func(n int) { progress += n },
+	}
+	if n, err := down.run(make([]byte, 32)); err != ErrQuotaExceeded || n != 50 {
+		t.Fatalf("bad: %v %v", n, err)
+	}
+	if progress != 150 {
+		t.Fatalf("bad: %v", progress)
+	}
+}
+
+func TestRelayCopy_Context(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	c := &relayCopy{ctx: ctx, dst: io.Discard, src: bytes.NewReader(make([]byte, 100))}
+	if n, err := c.run(make([]byte, 32)); err != context.Canceled || n != 0 {
+		t.Fatalf("bad: %v %v", n, err)
+	}
+}
+
+func TestServer_IdleTimeout(t *testing.T) {
+	target := echoTarget(t)
+	defer target.Close()
+
+	serv, _ := New(&Config{IdleTimeout: 200 * time.Millisecond})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	go serv.Serve(l)
+
+	conn, resp := connectThrough(t, l.Addr(), target.Addr())
+	defer conn.Close()
+	if resp != SuccessReply {
+		t.Fatalf("bad: %v", resp)
+	}
+
+	// Traffic keeps the relay open past the timeout
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	for i := 0; i < 5; i++ {
+		time.Sleep(80 * time.Millisecond)
+		conn.Write([]byte("ping"))
+		out := make([]byte, 4)
+		if _, err := io.ReadFull(conn, out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	// And is closed once idle
+	start := time.Now()
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("err: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Fatalf("too fast: %v", elapsed)
+	}
+}
+
+func TestServer_MaxConnectionLifetime(t *testing.T) {
+	target := echoTarget(t)
+	defer target.Close()
+
+	metrics := newTestMetrics()
+	expired := make(chan *ExpireEvent, 1)
+	serv, _ := New(&Config{
+		MaxConnectionLifetime:       200 * time.Millisecond,
+		MaxConnectionLifetimeJitter: 100 * time.Millisecond,
+		Metrics:                     metrics,
+		OnExpire: func(ctx context.Context, req *Request, e *ExpireEvent) {
+			expired <- e
+		},
+	})
+	closed := make(chan *RelayEnd, 1)
+	serv.Subscribe(func(e *Event) {
+		if e.Type == EventConnClosed {
+			closed <- e.Relay
+		}
+	})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	go serv.Serve(l)
+
+	start := time.Now()
+	conn, resp := connectThrough(t, l.Addr(), target.Addr())
+	defer conn.Close()
+	if resp != SuccessReply {
+		t.Fatalf("bad: %v", resp)
+	}
+
+	// Active relays are closed as well
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	for {
+		conn.Write([]byte("ping"))
+		out := make([]byte, 4)
+		if _, err := io.ReadFull(conn, out); err != nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond || elapsed > time.Second {
+		t.Fatalf("bad: %v", elapsed)
+	}
+
+	select {
+	case end := <-closed:
+		if end == nil || end.Side != SideProxy || end.Class != "lifetime" || end.Err != ErrMaxLifetime {
+			t.Fatalf("bad: %#v", end)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timeout")
+	}
+
+	// The session expiry is reported
+	select {
+	case e := <-expired:
+		if e.Reason != ExpireSession || e.Err != ErrMaxLifetime || e.Elapsed < 200*time.Millisecond || e.Elapsed > 300*time.Millisecond {
+			t.Fatalf("bad: %#v", e)
+		}
+	default:
+		t.Fatalf("expected expiry")
+	}
+	if metrics.counter("socks5.expired") != 1 {
+		t.Fatalf("bad: %v", metrics.counters)
+	}
+}
@@ -5,6 +5,30 @@ type CredentialStore interface {
 	Valid(user, password string) bool
 }
 
+// AttributeCredentialStore is an optional interface for CredentialStores
+// which know attributes of their users, such as their groups or an
+// assigned address. The attributes of valid credentials are added to
+// the Payload of the AuthContext, except for "Username".
+type AttributeCredentialStore interface {
+	CredentialStore
+	Attributes(user, password string) (map[string]string, bool)
+}
+
+// credentialAttributes checks the credentials against a store, returning
+// a fresh payload holding any attributes of the user if they are valid
+func credentialAttributes(store CredentialStore, user, password string) (map[string]string, bool) {
+	payload := make(map[string]string)
+	as, ok := store.(AttributeCredentialStore)
+	if !ok {
+		return payload, store.Valid(user, password)
+	}
+	attrs, valid := as.Attributes(user, password)
+	for k, v := range attrs {
+		payload[k] = v
+	}
+	return payload, valid
+}
+
 // StaticCredentials enables using a map directly as a credential store
 type StaticCredentials map[string]string
 
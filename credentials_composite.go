@@ -0,0 +1,146 @@
+package socks5
+
+import (
+	"crypto/sha256"
+	"sync"
+	"time"
+)
+
+const defaultCredentialCacheSize = 4096
+
+// CredentialSource is one of the stores of a CompositeCredentialStore
+type CredentialSource struct {
+	// Store is used to check the credentials
+	Store CredentialStore
+
+	// Timeout bounds a lookup, for remote stores. A store which
+	// times out is skipped, and its lookup left to finish in the
+	// background. Defaults to no timeout.
+	Timeout time.Duration
+}
+
+// CompositeCredentialStore consults multiple stores in order, accepting
+// credentials valid in any of them. This allows mixed user populations,
+// for example service accounts in a StaticCredentials map and humans in
+// a remote directory:
+//
+//	creds := &socks5.CompositeCredentialStore{
+//		Stores: []socks5.CredentialSource{
+//			{Store: serviceAccounts},
+//			{Store: directory, Timeout: 2 * time.Second},
+//		},
+//		CacheTTL: time.Minute,
+//	}
+type CompositeCredentialStore struct {
+	// Stores are consulted in order, until one accepts the credentials
+	Stores []CredentialSource
+
+	// CacheTTL is how long successful lookups are cached, sparing the
+	// stores repeated lookups. Only a digest of the password is kept.
+	// Failed lookups are never cached. Defaults to no caching.
+	CacheTTL time.Duration
+
+	// CacheSize bounds the number of cached lookups. Defaults to 4096.
+	CacheSize int
+
+	// Metrics receives the cache hits and store timeouts.
+	// Defaults to NoopMetrics.
+	Metrics Metrics
+
+	l     sync.Mutex
+	cache map[credentialKey]credentialEntry
+}
+
+type credentialEntry struct {
+	attrs   map[string]string
+	expires time.Time
+}
+
+type credentialKey struct {
+	user   string
+	digest [sha256.Size]byte
+}
+
+func (c *CompositeCredentialStore) metrics() Metrics {
+	if c.Metrics == nil {
+		return NoopMetrics{}
+	}
+	return c.Metrics
+}
+
+func (c *CompositeCredentialStore) Valid(user, password string) bool {
+	_, valid := c.Attributes(user, password)
+	return valid
+}
+
+// Attributes checks the credentials, returning the attributes of the
+// user from the store which accepted them
+func (c *CompositeCredentialStore) Attributes(user, password string) (map[string]string, bool) {
+	key := credentialKey{user: user, digest: sha256.Sum256([]byte(password))}
+	if c.CacheTTL > 0 {
+		c.l.Lock()
+		entry, ok := c.cache[key]
+		c.l.Unlock()
+		if ok && time.Now().Before(entry.expires) {
+			c.metrics().IncrCounter([]string{"socks5", "credentials", "cache_hit"}, 1)
+			return entry.attrs, true
+		}
+	}
+
+	for _, src := range c.Stores {
+		attrs, valid := c.lookup(src, user, password)
+		if !valid {
+			continue
+		}
+		if c.CacheTTL > 0 {
+			c.store(key, attrs)
+		}
+		return attrs, true
+	}
+	return nil, false
+}
+
+// lookup checks the credentials against a store, within its timeout
+func (c *CompositeCredentialStore) lookup(src CredentialSource, user, password string) (map[string]string, bool) {
+	if src.Timeout <= 0 {
+		return credentialAttributes(src.Store, user, password)
+	}
+	type result struct {
+		attrs map[string]string
+		valid bool
+	}
+	done := make(chan result, 1)
+	go func() {
+		attrs, valid := credentialAttributes(src.Store, user, password)
+		done <- result{attrs, valid}
+	}()
+	timer := time.NewTimer(src.Timeout)
+	defer timer.Stop()
+	select {
+	case r := <-done:
+		return r.attrs, r.valid
+	case <-timer.C:
+		c.metrics().IncrCounter([]string{"socks5", "credentials", "timeout"}, 1)
+		return nil, false
+	}
+}
+
+func (c *CompositeCredentialStore) store(key credentialKey, attrs map[string]string) {
+	size := c.CacheSize
+	if size == 0 {
+		size = defaultCredentialCacheSize
+	}
+	c.l.Lock()
+	defer c.l.Unlock()
+	if c.cache == nil || len(c.cache) >= size {
+		c.cache = make(map[credentialKey]credentialEntry)
+	}
+	c.cache[key] = credentialEntry{attrs: attrs, expires: time.Now().Add(c.CacheTTL)}
+}
+
+// Invalidate drops all cached lookups, e.g. once a password was revoked
+func (c *CompositeCredentialStore) Invalidate() {
+	c.l.Lock()
+	defer c.l.Unlock()
+	c.cache = nil
+}
@@ -0,0 +1,84 @@
+package socks5
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// slowCredentials counts its lookups, which take delay
+type slowCredentials struct {
+	StaticCredentials
+	delay time.Duration
+	calls int32
+}
+
+func (s *slowCredentials) Valid(user, password string) bool {
+	atomic.AddInt32(&s.calls, 1)
+	time.Sleep(s.delay)
+	return s.StaticCredentials.Valid(user, password)
+}
+
+func TestCompositeCredentialStore(t *testing.T) {
+	remote := &slowCredentials{StaticCredentials: StaticCredentials{"alice": "secret"}}
+	metrics := newTestMetrics()
+	c := &CompositeCredentialStore{
+		Stores: []CredentialSource{
+			{Store: StaticCredentials{"svc": "token"}},
+			{Store: remote, Timeout: time.Second},
+		},
+		CacheTTL: time.Minute,
+		Metrics:  metrics,
+	}
+
+	if !c.Valid("svc", "token") || atomic.LoadInt32(&remote.calls) != 0 {
+		t.Fatalf("expect valid from the first store")
+	}
+	for i := 0; i < 3; i++ {
+		if !c.Valid("alice", "secret") {
+			t.Fatalf("expect valid")
+		}
+	}
+	if atomic.LoadInt32(&remote.calls) != 1 || metrics.counter("socks5.credentials.cache_hit") != 2 {
+		t.Fatalf("bad: %v %v", remote.calls, metrics.counters)
+	}
+
+	// Failures are not cached, and other passwords are not matched
+	if c.Valid("alice", "wrong") || c.Valid("alice", "wrong") {
+		t.Fatalf("expect invalid")
+	}
+	if atomic.LoadInt32(&remote.calls) != 3 {
+		t.Fatalf("bad: %v", remote.calls)
+	}
+
+	// Invalidation drops the cached lookups
+	c.Invalidate()
+	c.Valid("alice", "secret")
+	if atomic.LoadInt32(&remote.calls) != 4 {
+		t.Fatalf("bad: %v", remote.calls)
+	}
+}
+
+func TestCompositeCredentialStore_Timeout(t *testing.T) {
+	remote := &slowCredentials{StaticCredentials: StaticCredentials{"alice": "secret"}, delay: time.Second}
+	metrics := newTestMetrics()
+	c := &CompositeCredentialStore{
+		Stores: []CredentialSource{
+			{Store: remote, Timeout: 20 * time.Millisecond},
+			{Store: StaticCredentials{"alice": "secret"}},
+		},
+		Metrics: metrics,
+	}
+
+	// The slow store is skipped in favor of the next one
+	start := time.Now()
+	if !c.Valid("alice", "secret") {
+		t.Fatalf("expect valid")
+	}
+	if time.Since(start) > 500*time.Millisecond {
+		t.Fatalf("lookup was not bounded")
+	}
+	if metrics.counter("socks5.credentials.timeout") != 1 {
+		t.Fatalf("bad: %v", metrics.counters)
+	}
+}
@@ -1,6 +1,7 @@
 package socks5
 
 import (
+	"bytes"
 	"testing"
 )
 
@@ -22,3 +23,27 @@ func TestStaticCredentials(t *testing.T) {
 		t.Fatalf("expect invalid")
 	}
 }
+
+// groupCredentials is an AttributeCredentialStore
+type groupCredentials struct {
+	StaticCredentials
+}
+
+func (g groupCredentials) Attributes(user, password string) (map[string]string, bool) {
+	return map[string]string{"Groups": "admins", "Username": "spoofed"}, g.Valid(user, password)
+}
+
+func TestAttributeCredentialStore(t *testing.T) {
+	req := bytes.NewBuffer([]byte{1, UserPassAuth, 1, 3, 'f', 'o', 'o', 3, 'b', 'a', 'r'})
+	var resp bytes.Buffer
+
+	cator := UserPassAuthenticator{Credentials: groupCredentials{StaticCredentials{"foo": "bar"}}}
+	s, _ := New(&Config{AuthMethods: []Authenticator{cator}})
+	ctx, err := s.authenticate(&resp, req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if ctx.Payload["Groups"] != "admins" || ctx.Payload["Username"] != "foo" {
+		t.Fatalf("bad: %v", ctx.Payload)
+	}
+}
@@ -0,0 +1,171 @@
+package socks5
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// DebugInfo is a snapshot of the internal accounting of a Server.
+// Counts which keep growing while the load does not indicate leaked
+// goroutines or sockets.
+type DebugInfo struct {
+	// Goroutines is the number of running goroutines spawned
+	// by the server, by their purpose
+	Goroutines map[string]int `json:"goroutines"`
+
+	// Upstreams is the number of open upstream connections being
+	// relayed, and Parked those kept for resumption
+	Upstreams int `json:"upstreams"`
+	Parked    int `json:"parked"`
+
+	// Resources is the number of open UDP relay and BIND sockets
+	Resources int `json:"resources"`
+
+	// Relays are the relays in progress, by connection ID
+	Relays []RelayInfo `json:"relays"`
+
+	// Destinations are the destinations with the most recent
+	// traffic, if the Config has a DestinationTracker
+	Destinations []DestinationStats `json:"destinations,omitempty"`
+}
+
+// RelayInfo describes a relay in progress
+type RelayInfo struct {
+	ConnID    uint64    `json:"conn_id"`
+	Command   uint8     `json:"command"`
+	Client    string    `json:"client"`
+	Dest      string    `json:"dest"`
+	User      string    `json:"user,omitempty"`
+	Started   time.Time `json:"started"`
+	BytesUp   uint64    `json:"bytes_up"`
+	BytesDown uint64    `json:"bytes_down"`
+}
+
+// debugState is the accounting of the goroutines, upstream sockets
+// and relays of a serverState
+type debugState struct {
+	l          sync.Mutex
+	goroutines map[string]int
+	upstreams  int
+	relays     map[*relayEntry]struct{}
+}
+
+// relayEntry is a relay in progress, as listed by Debug
+type relayEntry struct {
+	ctx     context.Context
+	req     *Request
+	session *streamCounters
+}
+
+// spawn is used to run f on a new goroutine, accounted by its kind
+func (s *Server) spawn(kind string, f func()) {
+	st := s.state
+	if st == nil {
+		go f()
+		return
+	}
+	st.goroutine(kind, 1)
+	go func() {
+		defer st.goroutine(kind, -1)
+		f()
+	}()
+}
+
+func (st *serverState) goroutine(kind string, delta int) {
+	d := &st.debug
+	d.l.Lock()
+	defer d.l.Unlock()
+	if d.goroutines == nil {
+		d.goroutines = make(map[string]int)
+	}
+	if d.goroutines[kind] += delta; d.goroutines[kind] == 0 {
+		delete(d.goroutines, kind)
+	}
+}
+
+// upstream is used to account for an opened or closed upstream
+func (st *serverState) upstream(delta int) {
+	if st == nil {
+		return
+	}
+	st.debug.l.Lock()
+	st.debug.upstreams += delta
+	st.debug.l.Unlock()
+}
+
+// trackRelay is used to add or remove a relay in progress
+func (st *serverState) trackRelay(e *relayEntry, add bool) {
+	if st == nil {
+		return
+	}
+	d := &st.debug
+	d.l.Lock()
+	defer d.l.Unlock()
+	if !add {
+		delete(d.relays, e)
+		return
+	}
+	if d.relays == nil {
+		d.relays = make(map[*relayEntry]struct{})
+	}
+	d.relays[e] = struct{}{}
+}
+
+// Debug returns a snapshot of the internal accounting of the server,
+// to detect leaks in production
+func (s *Server) Debug() DebugInfo {
+	info := DebugInfo{
+		Goroutines:   make(map[string]int),
+		Destinations: s.config.Destinations.top(),
+	}
+	st := s.state
+	if st == nil {
+		return info
+	}
+	st.l.Lock()
+	info.Resources = len(st.resources)
+	st.l.Unlock()
+	info.Parked = st.sessions.len()
+
+	d := &st.debug
+	d.l.Lock()
+	defer d.l.Unlock()
+	for kind, n := range d.goroutines {
+		info.Goroutines[kind] = n
+	}
+	info.Upstreams = d.upstreams
+	for e := range d.relays {
+		stats := e.session.snapshot()
+		relay := RelayInfo{
+			Command:   e.req.Command,
+			Dest:      e.req.DestAddr.String(),
+			Started:   e.session.start,
+			BytesUp:   stats.BytesUp,
+			BytesDown: stats.BytesDown,
+		}
+		if e.req.RemoteAddr != nil {
+			relay.Client = e.req.RemoteAddr.String()
+		}
+		relay.ConnID, _ = ConnIDFromContext(e.ctx)
+		relay.User, _ = UserFromContext(e.ctx)
+		info.Relays = append(info.Relays, relay)
+	}
+	sort.Slice(info.Relays, func(i, j int) bool {
+		return info.Relays[i].ConnID < info.Relays[j].ConnID
+	})
+	return info
+}
+
+// DebugHandler returns an http.Handler serving the Debug snapshot
+// as JSON, to be mounted on an internal debug port
+func (s *Server) DebugHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.Debug())
+	})
+}
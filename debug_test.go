@@ -0,0 +1,92 @@
+package socks5
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestServer_Debug(t *testing.T) {
+	// Create a local listener
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer target.Close()
+	go func() {
+		conn, err := target.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+	lAddr := target.Addr().(*net.TCPAddr)
+
+	serv, _ := New(&Config{Credentials: StaticCredentials{"foo": "bar"}})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	go serv.Serve(l)
+	defer serv.Close()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+	req := bytes.NewBuffer(nil)
+	req.Write([]byte{5, 1, UserPassAuth, 1, 3, 'f', 'o', 'o', 3, 'b', 'a', 'r'})
+	req.Write([]byte{5, 1, 0, 1, 127, 0, 0, 1, byte(lAddr.Port >> 8), byte(lAddr.Port)})
+	req.WriteString("ping")
+	conn.Write(req.Bytes())
+	out := make([]byte, 2+2+10+4)
+	if _, err := io.ReadFull(conn, out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The relay in progress is listed
+	info := serv.Debug()
+	if info.Goroutines["conn"] != 1 || info.Goroutines["relay"] != 2 || info.Upstreams != 1 {
+		t.Fatalf("bad: %#v", info)
+	}
+	if len(info.Relays) != 1 {
+		t.Fatalf("bad: %#v", info.Relays)
+	}
+	relay := info.Relays[0]
+	if relay.ConnID == 0 || relay.User != "foo" || relay.Command != ConnectCommand ||
+		relay.Dest != lAddr.String() || relay.Client != conn.LocalAddr().String() || relay.BytesDown != 4 {
+		t.Fatalf("bad: %#v", relay)
+	}
+
+	// It is also served as JSON
+	w := httptest.NewRecorder()
+	serv.DebugHandler().ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	var served DebugInfo
+	if err := json.Unmarshal(w.Body.Bytes(), &served); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if served.Upstreams != 1 || len(served.Relays) != 1 || served.Relays[0].ConnID != relay.ConnID {
+		t.Fatalf("bad: %s", w.Body.Bytes())
+	}
+
+	// Everything is released once the client goes away
+	conn.Close()
+	deadline := time.Now().Add(time.Second)
+	for {
+		info = serv.Debug()
+		if len(info.Goroutines) == 0 && info.Upstreams == 0 && len(info.Relays) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("bad: %#v", info)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,78 @@
+package socks5
+
+import (
+	"sync/atomic"
+
+	"golang.org/x/net/context"
+)
+
+// DenyKind classifies why a client was denied
+type DenyKind uint8
+
+const (
+	// DenyRule is used when the RuleSet rejected the request
+	DenyRule DenyKind = iota
+	// DenyAuth is used when the client failed to authenticate
+	DenyAuth
+	// DenyCommand is used when the command is not supported
+	DenyCommand
+	// DenyRewrite is used when the Rewriter vetoed the destination
+	DenyRewrite
+	// DenyAddress is used when the destination address is invalid
+	DenyAddress
+	// DenySelf is used when the destination is the proxy itself
+	DenySelf
+	// DenyGreeting is used when OnGreeting rejected the client
+	DenyGreeting
+)
+
+func (k DenyKind) String() string {
+	switch k {
+	case DenyRule:
+		return "rule"
+	case DenyAuth:
+		return "auth"
+	case DenyCommand:
+		return "command"
+	case DenyRewrite:
+		return "rewrite"
+	case DenyAddress:
+		return "address"
+	case DenySelf:
+		return "self"
+	case DenyGreeting:
+		return "greeting"
+	}
+	return "unknown"
+}
+
+// DenyReason provides the details of a denial to the OnDeny hook
+type DenyReason struct {
+	// Kind of the denial
+	Kind DenyKind
+	// Reply code sent to the client. Not set for auth failures and
+	// rejected greetings, which are signalled during the auth
+	// negotiation.
+	Reply uint8
+	// Err describes the denial
+	Err error
+}
+
+// deny is used to report a denied client to the OnDeny hook
+func (s *Server) deny(ctx context.Context, req *Request, kind DenyKind, reply uint8, err error) {
+	atomic.AddUint64(&s.state.stats().denied, 1)
+	event := &Event{Type: EventRuleDenied, Request: req, Err: err}
+	if kind == DenyAuth || kind == DenyGreeting {
+		event.Type = EventAuthFailed
+	} else {
+		req.denied = true
+	}
+	if req.RemoteAddr != nil {
+		event.Addr = req.RemoteAddr
+	}
+	s.emit(event)
+	if s.config.OnDeny == nil {
+		return
+	}
+	s.config.OnDeny(ctx, req, &DenyReason{Kind: kind, Reply: reply, Err: err})
+}
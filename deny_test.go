@@ -0,0 +1,131 @@
+package socks5
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestDeny_Rule(t *testing.T) {
+	var reasons []*DenyReason
+	s := &Server{config: &Config{
+		Rules:    PermitNone(),
+		Resolver: DNSResolver{},
+		Logger:   log.New(os.Stdout, "", log.LstdFlags),
+		OnDeny: func(ctx context.Context, req *Request, reason *DenyReason) {
+			reasons = append(reasons, reason)
+		},
+	}}
+
+	buf := bytes.NewBuffer([]byte{5, 1, 0, 1, 127, 0, 0, 1, 0, 80})
+	req, err := NewRequest(buf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := s.handleRequest(req, &MockConn{}); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	if len(reasons) != 1 || reasons[0].Kind != DenyRule || reasons[0].Reply != RuleFailure {
+		t.Fatalf("bad: %v", reasons)
+	}
+}
+
+func TestDeny_Command(t *testing.T) {
+	var reasons []*DenyReason
+	s := &Server{config: &Config{
+		Rules:    PermitAll(),
+		Resolver: DNSResolver{},
+		Logger:   log.New(os.Stdout, "", log.LstdFlags),
+		OnDeny: func(ctx context.Context, req *Request, reason *DenyReason) {
+			reasons = append(reasons, reason)
+		},
+	}}
+
+	buf := bytes.NewBuffer([]byte{5, 9, 0, 1, 127, 0, 0, 1, 0, 80})
+	req, err := NewRequest(buf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := s.handleRequest(req, &MockConn{}); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	if len(reasons) != 1 || reasons[0].Kind != DenyCommand || reasons[0].Reply != CommandNotSupported {
+		t.Fatalf("bad: %v", reasons)
+	}
+}
+
+func TestDeny_Auth(t *testing.T) {
+	reasons := make(chan *DenyReason, 1)
+	s, _ := New(&Config{
+		Credentials: StaticCredentials{"foo": "bar"},
+		OnDeny: func(ctx context.Context, req *Request, reason *DenyReason) {
+			reasons <- reason
+		},
+	})
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go s.ServeConn(server)
+
+	client.SetDeadline(time.Now().Add(time.Second))
+	client.Write([]byte{5, 1, NoAuth})
+	out := make([]byte, 2)
+	if _, err := io.ReadAtLeast(client, out, 2); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	select {
+	case reason := <-reasons:
+		if reason.Kind != DenyAuth || reason.Err != NoSupportedAuth {
+			t.Fatalf("bad: %v", reason)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timeout")
+	}
+}
+
+func TestDeny_Greeting(t *testing.T) {
+	reasons := make(chan *DenyReason, 1)
+	var offered []byte
+	s, _ := New(&Config{
+		OnGreeting: func(ctx context.Context, methods []byte, conn net.Conn) error {
+			offered = methods
+			if bytes.Equal(methods, []byte{UserPassAuth, NoAuth}) {
+				return fmt.Errorf("known bad client")
+			}
+			return nil
+		},
+		OnDeny: func(ctx context.Context, req *Request, reason *DenyReason) {
+			reasons <- reason
+		},
+	})
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go s.ServeConn(server)
+
+	client.SetDeadline(time.Now().Add(time.Second))
+	client.Write([]byte{5, 2, UserPassAuth, NoAuth})
+	out := make([]byte, 2)
+	if _, err := io.ReadFull(client, out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.Equal(out, []byte{socks5Version, noAcceptable}) {
+		t.Fatalf("bad: %v", out)
+	}
+	if reason := <-reasons; reason.Kind != DenyGreeting {
+		t.Fatalf("bad: %v", reason)
+	}
+	if !bytes.Equal(offered, []byte{UserPassAuth, NoAuth}) {
+		t.Fatalf("bad: %v", offered)
+	}
+}
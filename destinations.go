@@ -0,0 +1,192 @@
+package socks5
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	defaultDestinationHosts    = 1000
+	defaultDestinationHalfLife = time.Hour
+	defaultDestinationTop      = 10
+)
+
+// DestinationOrder selects how the top destinations are ranked
+type DestinationOrder uint8
+
+const (
+	// ByBytes ranks destinations by the bytes relayed both ways
+	ByBytes DestinationOrder = iota
+	// ByConnections ranks destinations by their connections
+	ByConnections
+)
+
+// DestinationStats is the aggregated traffic of a destination host.
+// The counts decay over time, so they reflect the recent traffic.
+type DestinationStats struct {
+	Host        string `json:"host"`
+	Connections uint64 `json:"connections"`
+	BytesUp     uint64 `json:"bytes_up"`
+	BytesDown   uint64 `json:"bytes_down"`
+}
+
+// DestinationTracker aggregates the connections and bytes of CONNECT
+// relays by destination host, the requested FQDN or IP, so operators
+// can see where the traffic goes without logging every flow. The
+// bytes of a relay are counted once it ends. Set it as the
+// Destinations of the Config to include the top destinations in the
+// Debug snapshot of the server, as served by its DebugHandler.
+type DestinationTracker struct {
+	// MaxHosts bounds the number of tracked hosts. Once reached, the
+	// host with the least bytes is forgotten for a new one.
+	// Defaults to 1000.
+	MaxHosts int
+
+	// HalfLife is the time after which the counts are halved.
+	// Defaults to an hour.
+	HalfLife time.Duration
+
+	// TopN is the number of destinations included in the Debug
+	// snapshot of the server, ranked ByBytes. Defaults to 10.
+	TopN int
+
+	// Clock returns the current time. Defaults to time.Now.
+	Clock func() time.Time
+
+	l     sync.Mutex
+	hosts map[string]*destCounters
+}
+
+// destCounters are the decayed counts of a host, as of updated
+type destCounters struct {
+	conns, up, down float64
+	updated         time.Time
+}
+
+func (d *DestinationTracker) now() time.Time {
+	if d.Clock != nil {
+		return d.Clock()
+	}
+	return time.Now()
+}
+
+// decay is used to bring the counts of a host up to now
+func (d *DestinationTracker) decay(c *destCounters, now time.Time) {
+	halfLife := d.HalfLife
+	if halfLife <= 0 {
+		halfLife = defaultDestinationHalfLife
+	}
+	if elapsed := now.Sub(c.updated); elapsed > 0 {
+		f := math.Exp2(-float64(elapsed) / float64(halfLife))
+		c.conns *= f
+		c.up *= f
+		c.down *= f
+	}
+	c.updated = now
+}
+
+// counters returns the counts of a host, evicting the host with the
+// least bytes if needed. The lock must be held.
+func (d *DestinationTracker) counters(host string, now time.Time) *destCounters {
+	if c, ok := d.hosts[host]; ok {
+		d.decay(c, now)
+		return c
+	}
+	if d.hosts == nil {
+		d.hosts = make(map[string]*destCounters)
+	}
+	max := d.MaxHosts
+	if max <= 0 {
+		max = defaultDestinationHosts
+	}
+	if len(d.hosts) >= max {
+		var victim string
+		least := math.Inf(1)
+		for h, c := range d.hosts {
+			d.decay(c, now)
+			if total := c.up + c.down; total < least {
+				victim, least = h, total
+			}
+		}
+		delete(d.hosts, victim)
+	}
+	c := &destCounters{updated: now}
+	d.hosts[host] = c
+	return c
+}
+
+// opened is used to count a connection to a destination
+func (d *DestinationTracker) opened(dest *AddrSpec) {
+	if d == nil {
+		return
+	}
+	d.l.Lock()
+	defer d.l.Unlock()
+	d.counters(destHost(dest), d.now()).conns++
+}
+
+// closed is used to count the bytes of a relay which ended
+func (d *DestinationTracker) closed(dest *AddrSpec, stats *StreamStats) {
+	if d == nil {
+		return
+	}
+	d.l.Lock()
+	defer d.l.Unlock()
+	c := d.counters(destHost(dest), d.now())
+	c.up += float64(stats.BytesUp)
+	c.down += float64(stats.BytesDown)
+}
+
+// Top returns up to n destinations with the most traffic
+func (d *DestinationTracker) Top(n int, order DestinationOrder) []DestinationStats {
+	d.l.Lock()
+	now := d.now()
+	out := make([]DestinationStats, 0, len(d.hosts))
+	for host, c := range d.hosts {
+		d.decay(c, now)
+		out = append(out, DestinationStats{
+			Host:        host,
+			Connections: uint64(math.Round(c.conns)),
+			BytesUp:     uint64(math.Round(c.up)),
+			BytesDown:   uint64(math.Round(c.down)),
+		})
+	}
+	d.l.Unlock()
+
+	sort.Slice(out, func(i, j int) bool {
+		a, b := out[i], out[j]
+		if order == ByConnections && a.Connections != b.Connections {
+			return a.Connections > b.Connections
+		}
+		if a.BytesUp+a.BytesDown != b.BytesUp+b.BytesDown {
+			return a.BytesUp+a.BytesDown > b.BytesUp+b.BytesDown
+		}
+		return a.Host < b.Host
+	})
+	if len(out) > n {
+		out = out[:n]
+	}
+	return out
+}
+
+// top returns the destinations included in the Debug snapshot
+func (d *DestinationTracker) top() []DestinationStats {
+	if d == nil {
+		return nil
+	}
+	n := d.TopN
+	if n <= 0 {
+		n = defaultDestinationTop
+	}
+	return d.Top(n, ByBytes)
+}
+
+// destHost returns the host a destination is aggregated by
+func destHost(dest *AddrSpec) string {
+	if dest.FQDN != "" {
+		return dest.FQDN
+	}
+	return dest.ipString()
+}
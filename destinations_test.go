@@ -0,0 +1,80 @@
+package socks5
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDestinationTracker(t *testing.T) {
+	now := time.Now()
+	d := &DestinationTracker{MaxHosts: 2, HalfLife: time.Minute, Clock: func() time.Time { return now }}
+
+	a := &AddrSpec{FQDN: "a.example", IP: net.ParseIP("10.0.0.1"), Port: 80}
+	b := &AddrSpec{IP: net.ParseIP("10.0.0.2"), Port: 443}
+	for i := 0; i < 3; i++ {
+		d.opened(a)
+		d.closed(a, &StreamStats{BytesUp: 10, BytesDown: 100})
+	}
+	d.opened(b)
+	d.closed(b, &StreamStats{BytesUp: 1000, BytesDown: 1000})
+
+	top := d.Top(10, ByBytes)
+	if len(top) != 2 || top[0].Host != "10.0.0.2" || top[0].BytesUp != 1000 {
+		t.Fatalf("bad: %v", top)
+	}
+	top = d.Top(1, ByConnections)
+	if len(top) != 1 || top[0].Host != "a.example" || top[0].Connections != 3 || top[0].BytesDown != 300 {
+		t.Fatalf("bad: %v", top)
+	}
+
+	// The counts decay
+	now = now.Add(time.Minute)
+	if top := d.Top(1, ByBytes); top[0].BytesUp != 500 {
+		t.Fatalf("bad: %v", top)
+	}
+
+	// New hosts replace the one with the least bytes
+	d.opened(&AddrSpec{FQDN: "c.example", Port: 80})
+	top = d.Top(10, ByBytes)
+	if len(top) != 2 || top[0].Host != "10.0.0.2" || top[1].Host != "c.example" {
+		t.Fatalf("bad: %v", top)
+	}
+}
+
+func TestServer_DestinationStats(t *testing.T) {
+	target := echoTarget(t)
+	defer target.Close()
+
+	serv, _ := New(&Config{Destinations: &DestinationTracker{}})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	go serv.Serve(l)
+
+	conn, resp := connectThrough(t, l.Addr(), target.Addr())
+	if resp != SuccessReply {
+		t.Fatalf("bad: %v", resp)
+	}
+	conn.Write([]byte("ping"))
+	if _, err := io.ReadFull(conn, make([]byte, 4)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	conn.Close()
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		dests := serv.Debug().Destinations
+		if len(dests) == 1 && dests[0].Host == "127.0.0.1" && dests[0].Connections == 1 &&
+			dests[0].BytesUp == 4 && dests[0].BytesDown == 4 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("bad: %v", dests)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
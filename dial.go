@@ -0,0 +1,270 @@
+package socks5
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// DialRetry configures retrying of failed upstream dials, for
+// example to ride out refused connections during a rolling deploy
+type DialRetry struct {
+	// Attempts is the total number of dials, including the first one
+	Attempts int
+
+	// Backoff is the delay before each retry
+	Backoff time.Duration
+
+	// RetryOn decides if a dial error is retried. Defaults to
+	// retrying refused connections and timeouts.
+	RetryOn func(err error) bool
+
+	// AlternateIPs makes retries of FQDN destinations try the other
+	// addresses the name resolves to, in turn. They are resolved with
+	// the Resolver, if it is an IPResolver, and checked as the first
+	// address was before being dialed.
+	AlternateIPs bool
+}
+
+// dialErrorReply maps a dial error to the reply code for the client
+func dialErrorReply(err error) uint8 {
+	switch {
+	case errors.Is(err, ErrDialLimit), errors.Is(err, context.DeadlineExceeded):
+		return TTLExpired
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return ConnectionRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return NetworkUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH):
+		return HostUnreachable
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return TTLExpired
+	}
+
+	// Fall back to the message, for dialers which do
+	// not preserve the underlying errors
+	msg := err.Error()
+	switch {
+	case strings.Contains(msg, "refused"):
+		return ConnectionRefused
+	case strings.Contains(msg, "network is unreachable"):
+		return NetworkUnreachable
+	}
+	return HostUnreachable
+}
+
+// retryDialError is the default RetryOn policy
+func retryDialError(err error) bool {
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return true
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return true
+	}
+	return false
+}
+
+// dial is used to connect to the destination of a request,
+// retrying according to the DialRetry configuration
+func (s *Server) dial(ctx context.Context, req *Request) (net.Conn, error) {
+	dial := s.config.Dial
+	if dial == nil {
+		dialer := new(net.Dialer)
+		if s.hasUpstreamOptions() {
+			dialer.Control = s.upstreamControl
+		}
+		dial = dialer.DialContext
+	}
+	if timeout := s.config.DialTimeout; timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	addr := req.realDestAddr.Address()
+
+	// Bound the concurrent dials to the destination
+	if max := s.config.MaxDialsPerDest; max > 0 && s.state != nil {
+		if err := s.state.dials.acquire(ctx, addr, max, s.config.DialQueueTimeout); err != nil {
+			if err == ErrDialLimit {
+				s.metrics().IncrCounter([]string{"socks5", "dial", "limited"}, 1)
+			}
+			return nil, err
+		}
+		defer s.state.dials.release(addr)
+	}
+
+	retry := s.config.DialRetry
+	if retry == nil || retry.Attempts <= 1 {
+		return dial(ctx, "tcp", addr)
+	}
+	retryOn := retry.RetryOn
+	if retryOn == nil {
+		retryOn = retryDialError
+	}
+
+	// Gather the alternate addresses, only if the destination was
+	// not rewritten. As they were not approved by the rules yet,
+	// each is checked before being tried.
+	addrs := []*AddrSpec{req.realDestAddr}
+	if retry.AlternateIPs && req.realDestAddr == req.DestAddr && req.DestAddr.FQDN != "" {
+		for _, ip := range s.resolveAll(ctx, req.DestAddr.FQDN) {
+			alt := &AddrSpec{FQDN: req.DestAddr.FQDN, IP: ip, Port: req.DestAddr.Port}
+			if alt.Address() != addr && s.allowAlternate(ctx, req, alt) {
+				addrs = append(addrs, alt)
+			}
+		}
+	}
+
+	var err error
+	for attempt := 0; attempt < retry.Attempts; attempt++ {
+		if attempt > 0 {
+			s.metrics().IncrCounter([]string{"socks5", "dial", "retry"}, 1)
+			select {
+			case <-time.After(retry.Backoff):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+
+		dest := addrs[attempt%len(addrs)]
+		var target net.Conn
+		target, err = dial(ctx, "tcp", dest.Address())
+		if err == nil {
+			if req.PinnedIP != nil {
+				req.PinnedIP = dest.IP
+			}
+			return target, nil
+		}
+		if !retryOn(err) {
+			return nil, err
+		}
+	}
+	return nil, err
+}
+
+// resolveAll returns all the addresses of a name with the Resolver,
+// or none if it cannot list them
+func (s *Server) resolveAll(ctx context.Context, name string) []net.IP {
+	resolver := s.config.Resolver
+	if resolver == nil {
+		resolver = DNSResolver{}
+	}
+	r, ok := resolver.(IPResolver)
+	if !ok {
+		return nil
+	}
+	ips, err := r.ResolveAll(ctx, name)
+	if err != nil {
+		s.logf(LogDebug, "Failed to resolve the alternate addresses of %s: %v", name, err)
+		return nil
+	}
+	return ips
+}
+
+// allowAlternate checks an alternate address of the destination
+// against the rules before it may be dialed, and against the proxy
+// itself, if guarded
+func (s *Server) allowAlternate(ctx context.Context, req *Request, alt *AddrSpec) bool {
+	check := *req
+	check.realDestAddr = alt
+	if s.checkSelf(&check) != nil {
+		return false
+	}
+	if s.config.Rules == nil {
+		return true
+	}
+	_, ok := s.config.Rules.Allow(ctx, &check)
+	return ok
+}
+
+// approveBackends is used to check the backends a ServiceRouter fails
+// over to against the rules, as only the first one was approved. The
+// backends which are denied are dropped, and the IPs of the others
+// are allowed besides the PinnedIP.
+func (s *Server) approveBackends(ctx context.Context, req *Request) context.Context {
+	backends, ok := ctx.Value(backendsKey{}).([]*Backend)
+	if !ok {
+		return ctx
+	}
+	approved := make([]*Backend, 0, len(backends))
+	for _, b := range backends {
+		if b.Addr.Address() != req.realDestAddr.Address() && !s.allowAlternate(ctx, req, b.Addr) {
+			continue
+		}
+		approved = append(approved, b)
+		if b.Addr.IP != nil {
+			req.failoverIPs = append(req.failoverIPs, b.Addr.IP)
+		}
+	}
+	return context.WithValue(ctx, backendsKey{}, approved)
+}
+
+// pinned checks if an IP is the PinnedIP, or one of the approved
+// backends a ServiceRouter may fail over to
+func (req *Request) pinned(ip net.IP) bool {
+	if ip.Equal(req.PinnedIP) {
+		return true
+	}
+	for _, alt := range req.failoverIPs {
+		if ip.Equal(alt) {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyTarget is used to ensure a dialed connection reached the pinned
+// destination IP, and to run the VerifyDial hook. This prevents DNS
+// rebinding between the rules check and the dial.
+func (s *Server) verifyTarget(ctx context.Context, req *Request, target net.Conn) error {
+	remote := target.RemoteAddr()
+	if req.PinnedIP != nil {
+		if ip := addrIP(remote); ip != nil && !req.pinned(ip) {
+			return fmt.Errorf("Connected to %v instead of pinned %v", ip, req.PinnedIP)
+		}
+	}
+	if s.config.VerifyDial != nil {
+		return s.config.VerifyDial(ctx, req, remote)
+	}
+	return nil
+}
+
+// watchClient is used to invoke cancel once the client closes or resets
+// its connection, rather than noticing only once the upstream is dialed.
+// The returned function stops watching, and must be called before
+// reading from the client again.
+func (s *Server) watchClient(conn conn, r io.Reader, cancel func()) func() {
+	br, ok := r.(*bufio.Reader)
+	dc, ok2 := conn.(interface {
+		SetReadDeadline(t time.Time) error
+	})
+	if !ok || !ok2 {
+		return func() {}
+	}
+
+	var stopping int32
+	done := make(chan struct{})
+	s.spawn("watch", func() {
+		defer close(done)
+		if _, err := br.Peek(1); err != nil && atomic.LoadInt32(&stopping) == 0 {
+			cancel()
+		}
+	})
+	return func() {
+		// Interrupt the pending read, without consuming any data
+		atomic.StoreInt32(&stopping, 1)
+		dc.SetReadDeadline(time.Now())
+		<-done
+		dc.SetReadDeadline(time.Time{})
+	}
+}
@@ -0,0 +1,85 @@
+package socks5
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+var (
+	// ErrDialLimit is returned when a destination has MaxDialsPerDest
+	// dials in progress for longer than the DialQueueTimeout
+	ErrDialLimit = errors.New("Too many concurrent dials to destination")
+)
+
+// dialLimiter bounds the concurrent dials per destination
+type dialLimiter struct {
+	l     sync.Mutex
+	slots map[string]*dialSlot
+}
+
+// dialSlot is the semaphore of a destination
+type dialSlot struct {
+	sem  chan struct{}
+	refs int
+}
+
+// acquire waits up to the timeout for one of max dial slots of a
+// destination. On success, release must be called once the dial is done.
+func (d *dialLimiter) acquire(ctx context.Context, key string, max int, timeout time.Duration) error {
+	d.l.Lock()
+	if d.slots == nil {
+		d.slots = make(map[string]*dialSlot)
+	}
+	slot, ok := d.slots[key]
+	if !ok {
+		slot = &dialSlot{sem: make(chan struct{}, max)}
+		d.slots[key] = slot
+	}
+	slot.refs++
+	d.l.Unlock()
+
+	select {
+	case slot.sem <- struct{}{}:
+		return nil
+	default:
+	}
+
+	var err error
+	if timeout <= 0 {
+		err = ErrDialLimit
+	} else {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		select {
+		case slot.sem <- struct{}{}:
+			return nil
+		case <-timer.C:
+			err = ErrDialLimit
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	}
+	d.unref(key, slot)
+	return err
+}
+
+// release frees the dial slot of a destination
+func (d *dialLimiter) release(key string) {
+	d.l.Lock()
+	slot := d.slots[key]
+	d.l.Unlock()
+	<-slot.sem
+	d.unref(key, slot)
+}
+
+// unref drops a reference to a slot, removing unused slots
+func (d *dialLimiter) unref(key string, slot *dialSlot) {
+	d.l.Lock()
+	defer d.l.Unlock()
+	if slot.refs--; slot.refs == 0 {
+		delete(d.slots, key)
+	}
+}
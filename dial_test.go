@@ -0,0 +1,286 @@
+package socks5
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestDial_Retry(t *testing.T) {
+	attempts := 0
+	s := &Server{config: &Config{
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			attempts++
+			if attempts < 3 {
+				return nil, &net.OpError{Op: "dial", Net: network, Err: syscall.ECONNREFUSED}
+			}
+			client, _ := net.Pipe()
+			return client, nil
+		},
+		DialRetry: &DialRetry{Attempts: 3},
+	}}
+	dest := &AddrSpec{IP: net.IPv4(10, 0, 0, 1), Port: 80}
+	req := &Request{DestAddr: dest, realDestAddr: dest}
+
+	conn, err := s.dial(context.Background(), req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	conn.Close()
+	if attempts != 3 {
+		t.Fatalf("bad: %d", attempts)
+	}
+}
+
+func TestDial_RetryOn(t *testing.T) {
+	attempts := 0
+	fatal := errors.New("fatal")
+	s := &Server{config: &Config{
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			attempts++
+			return nil, fatal
+		},
+		DialRetry: &DialRetry{Attempts: 3},
+	}}
+	dest := &AddrSpec{IP: net.IPv4(10, 0, 0, 1), Port: 80}
+	req := &Request{DestAddr: dest, realDestAddr: dest}
+
+	if _, err := s.dial(context.Background(), req); err != fatal {
+		t.Fatalf("err: %v", err)
+	}
+	if attempts != 1 {
+		t.Fatalf("bad: %d", attempts)
+	}
+}
+
+func TestDial_AlternateIPs(t *testing.T) {
+	var tried []string
+	s := &Server{config: &Config{
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			tried = append(tried, addr)
+			return nil, syscall.ECONNREFUSED
+		},
+		DialRetry: &DialRetry{Attempts: 4, AlternateIPs: true},
+	}}
+	dest := &AddrSpec{FQDN: "localhost", IP: net.IPv4(192, 0, 2, 1), Port: 80}
+	req := &Request{DestAddr: dest, realDestAddr: dest}
+
+	if _, err := s.dial(context.Background(), req); err == nil {
+		t.Fatalf("expected error")
+	}
+	if len(tried) != 4 || tried[0] != "192.0.2.1:80" || tried[1] == tried[0] {
+		t.Fatalf("bad: %v", tried)
+	}
+}
+
+func TestDial_Pinned(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			conn.Close()
+		}
+	}()
+	target, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer target.Close()
+
+	var verified net.Addr
+	s := &Server{config: &Config{
+		VerifyDial: func(ctx context.Context, req *Request, remote net.Addr) error {
+			verified = remote
+			return nil
+		},
+	}}
+	req := &Request{PinnedIP: net.IPv4(127, 0, 0, 1)}
+	if err := s.verifyTarget(context.Background(), req, target); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if verified != target.RemoteAddr() {
+		t.Fatalf("bad: %v", verified)
+	}
+
+	// A rebound name must not be relayed
+	req.PinnedIP = net.IPv4(192, 0, 2, 1)
+	if err := s.verifyTarget(context.Background(), req, target); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	// The hook can veto unpinned destinations
+	req.PinnedIP = nil
+	s.config.VerifyDial = func(ctx context.Context, req *Request, remote net.Addr) error {
+		return errors.New("denied")
+	}
+	if err := s.verifyTarget(context.Background(), req, target); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestSOCKS5_CancelOnClientClose(t *testing.T) {
+	dialed := make(chan struct{})
+	canceled := make(chan struct{})
+	serv, _ := New(&Config{
+		CancelOnClientClose: true,
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			close(dialed)
+			<-ctx.Done()
+			close(canceled)
+			return nil, ctx.Err()
+		},
+	})
+
+	client, server := net.Pipe()
+	errCh := make(chan error, 1)
+	go func() { errCh <- serv.ServeConn(server) }()
+	go client.Write([]byte{5, 1, NoAuth, 5, ConnectCommand, 0, ipv4Address, 10, 0, 0, 1, 0, 80})
+	go io.Copy(io.Discard, client)
+
+	<-dialed
+	client.Close()
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Fatalf("dial not canceled")
+	}
+	if err := <-errCh; err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestDialLimiter(t *testing.T) {
+	var d dialLimiter
+	ctx := context.Background()
+	if err := d.acquire(ctx, "a", 1, 0); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The destination is saturated, others are not
+	if err := d.acquire(ctx, "a", 1, 0); err != ErrDialLimit {
+		t.Fatalf("err: %v", err)
+	}
+	if err := d.acquire(ctx, "b", 1, 0); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	d.release("b")
+
+	// Queued dials proceed once a slot is released
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		d.release("a")
+	}()
+	if err := d.acquire(ctx, "a", 1, time.Second); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := d.acquire(ctx, "a", 1, 10*time.Millisecond); err != ErrDialLimit {
+		t.Fatalf("err: %v", err)
+	}
+	d.release("a")
+	if len(d.slots) != 0 {
+		t.Fatalf("bad: %v", d.slots)
+	}
+}
+
+func TestSOCKS5_MaxDialsPerDest(t *testing.T) {
+	block := make(chan struct{})
+	dialing := make(chan struct{}, 1)
+	serv, _ := New(&Config{
+		MaxDialsPerDest: 1,
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dialing <- struct{}{}
+			<-block
+			return nil, errors.New("connect: connection refused")
+		},
+	})
+	defer close(block)
+	connect := []byte{5, 1, NoAuth, 5, ConnectCommand, 0, ipv4Address, 10, 0, 0, 1, 0, 80}
+
+	// Occupy the only dial slot
+	first, server := net.Pipe()
+	defer first.Close()
+	go serv.ServeConn(server)
+	go first.Write(connect)
+	go io.Copy(io.Discard, first)
+	<-dialing
+
+	// The second request is rejected
+	client, server := net.Pipe()
+	defer client.Close()
+	go serv.ServeConn(server)
+	go client.Write(connect)
+	client.SetDeadline(time.Now().Add(time.Second))
+	out, err := io.ReadAll(client)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expected := []byte{5, NoAuth, 5, TTLExpired, 0, ipv4Address, 0, 0, 0, 0, 0, 0}
+	if !bytes.Equal(out, expected) {
+		t.Fatalf("bad: %v", out)
+	}
+}
+
+// listResolver resolves every name to its addresses
+type listResolver []net.IP
+
+func (r listResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	return ctx, r[0], nil
+}
+
+func (r listResolver) ResolveAll(ctx context.Context, name string) ([]net.IP, error) {
+	return r, nil
+}
+
+// denyIPRules denies a single destination IP
+type denyIPRules struct {
+	ip net.IP
+}
+
+func (r denyIPRules) Allow(ctx context.Context, req *Request) (context.Context, bool) {
+	return ctx, !req.realDestAddr.IP.Equal(r.ip)
+}
+
+func TestDial_AlternateIPsResolver(t *testing.T) {
+	var tried []string
+	s := &Server{config: &Config{
+		Resolver: listResolver{net.IPv4(192, 0, 2, 1), net.IPv4(192, 0, 2, 2), net.IPv4(192, 0, 2, 3)},
+		Rules:    denyIPRules{net.IPv4(192, 0, 2, 3)},
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			tried = append(tried, addr)
+			return nil, syscall.ECONNREFUSED
+		},
+		DialRetry: &DialRetry{Attempts: 4, AlternateIPs: true},
+	}}
+	dest := &AddrSpec{FQDN: "example.internal", IP: net.IPv4(192, 0, 2, 1), Port: 80}
+	req := &Request{DestAddr: dest, realDestAddr: dest}
+
+	// The alternates come from the Resolver, without the denied one
+	if _, err := s.dial(context.Background(), req); err == nil {
+		t.Fatalf("expected error")
+	}
+	want := []string{"192.0.2.1:80", "192.0.2.2:80", "192.0.2.1:80", "192.0.2.2:80"}
+	if strings.Join(tried, ",") != strings.Join(want, ",") {
+		t.Fatalf("bad: %v", tried)
+	}
+
+	// Resolvers which cannot list the addresses have no alternates
+	tried = nil
+	s.config.Resolver = failResolver{}
+	s.dial(context.Background(), req)
+	for _, addr := range tried {
+		if addr != "192.0.2.1:80" {
+			t.Fatalf("bad: %v", tried)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package socks5
+
+import (
+	"fmt"
+	"net"
+
+	"golang.org/x/net/context"
+)
+
+// Dialer opens connections through the outbound pipeline of a Server,
+// applying its resolver, rewriter, rules and dialer, without going
+// over the SOCKS protocol. It allows application code in the same
+// process to share the egress policy of the proxy.
+type Dialer struct {
+	server *Server
+
+	// AuthContext is passed to the rules as if the
+	// connections were requested by an authenticated client
+	AuthContext *AuthContext
+}
+
+// Dialer returns a Dialer using the pipeline of the server
+func (s *Server) Dialer() *Dialer {
+	return &Dialer{server: s}
+}
+
+// Dial connects to the address on the named network,
+// which must be "tcp", "tcp4" or "tcp6"
+func (d *Dialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+// DialContext connects to the address on the named network
+// using the provided context
+func (d *Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("Unsupported network: %v", network)
+	}
+	dest, err := ParseAddrSpec(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	req := &Request{
+		Version:     socks5Version,
+		Command:     ConnectCommand,
+		AuthContext: d.AuthContext,
+		DestAddr:    dest,
+		SentFQDN:    dest.FQDN != "",
+	}
+	if ac := d.AuthContext; ac != nil && ac.Payload["Username"] != "" {
+		ctx = WithUser(ctx, ac.Payload["Username"])
+	}
+	ctx = withRequest(ctx, req)
+
+	s := d.server
+	ctx, err = s.prepare(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	_, target, err := s.connect(ctx, req)
+	return target, err
+}
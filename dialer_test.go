@@ -0,0 +1,53 @@
+package socks5
+
+import (
+	"net"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+// userRules only allows a single user
+type userRules string
+
+func (u userRules) Allow(ctx context.Context, req *Request) (context.Context, bool) {
+	user, _ := UserFromContext(ctx)
+	return ctx, user == string(u)
+}
+
+func TestDialer(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+
+	serv, _ := New(&Config{Rules: userRules("foo")})
+	d := serv.Dialer()
+
+	// The rules apply to the dialer
+	if _, err := d.Dial("tcp", net.JoinHostPort("localhost", port)); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	d.AuthContext = &AuthContext{UserPassAuth, map[string]string{"Username": "foo"}}
+	conn, err := d.Dial("tcp", net.JoinHostPort("localhost", port))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	conn.Close()
+
+	if _, err := d.Dial("udp", l.Addr().String()); err == nil {
+		t.Fatalf("expected error")
+	}
+}
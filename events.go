@@ -0,0 +1,144 @@
+package socks5
+
+import (
+	"net"
+	"time"
+)
+
+// EventType identifies a lifecycle event of the server
+type EventType uint8
+
+const (
+	// EventServerStarted is emitted when Serve starts accepting
+	EventServerStarted EventType = iota
+	// EventListenerClosed is emitted when Serve stops accepting
+	EventListenerClosed
+	// EventConnOpened is emitted when a connection is accepted
+	EventConnOpened
+	// EventConnClosed is emitted when a connection is done
+	EventConnClosed
+	// EventAuthSucceeded is emitted when a client authenticated
+	EventAuthSucceeded
+	// EventAuthFailed is emitted when a client failed to authenticate
+	EventAuthFailed
+	// EventRuleDenied is emitted when a request is denied
+	EventRuleDenied
+	// EventRelayError is emitted when relaying fails with an error
+	EventRelayError
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventServerStarted:
+		return "server_started"
+	case EventListenerClosed:
+		return "listener_closed"
+	case EventConnOpened:
+		return "conn_opened"
+	case EventConnClosed:
+		return "conn_closed"
+	case EventAuthSucceeded:
+		return "auth_succeeded"
+	case EventAuthFailed:
+		return "auth_failed"
+	case EventRuleDenied:
+		return "rule_denied"
+	case EventRelayError:
+		return "relay_error"
+	}
+	return "unknown"
+}
+
+// Event describes a lifecycle event delivered to subscribers
+type Event struct {
+	Type EventType
+	Time time.Time
+
+	// Addr is the listener address for the server and listener
+	// events, and the client address for the others if known
+	Addr net.Addr
+
+	// Request is set for EventRuleDenied and EventRelayError
+	Request *Request
+
+	// User is set for EventAuthSucceeded, if the method has one
+	User string
+
+	// Relay is set for EventRelayError and EventConnClosed once a
+	// CONNECT was relayed, describing which side ended the relay
+	Relay *RelayEnd
+
+	// Reason is set for EventConnClosed, telling why it closed
+	Reason CloseReason
+
+	// Err describes the failure, if any
+	Err error
+}
+
+// Subscribe registers a callback for all lifecycle events, returning
+// a function to unsubscribe. Callbacks run on the goroutine serving
+// the event, so they must not block; use a buffered channel to
+// process events asynchronously.
+func (s *Server) Subscribe(fn func(*Event)) (unsubscribe func()) {
+	st := s.state
+	st.subL.Lock()
+	defer st.subL.Unlock()
+	if st.subscribers == nil {
+		st.subscribers = make(map[uint64]func(*Event))
+	}
+	st.lastSub++
+	id := st.lastSub
+	st.subscribers[id] = fn
+	return func() {
+		st.subL.Lock()
+		defer st.subL.Unlock()
+		delete(st.subscribers, id)
+	}
+}
+
+// emit delivers an event to the subscribers
+func (s *Server) emit(e *Event) {
+	st := s.state
+	if st == nil {
+		return
+	}
+	st.subL.RLock()
+	subs := make([]func(*Event), 0, len(st.subscribers))
+	for _, fn := range st.subscribers {
+		subs = append(subs, fn)
+	}
+	st.subL.RUnlock()
+	if len(subs) == 0 {
+		return
+	}
+
+	e.Time = time.Now()
+	for _, fn := range subs {
+		fn(e)
+	}
+}
+
+// openConn is used to track a new connection,
+// failing once the server is closed
+func (s *Server) openConn(conn net.Conn) bool {
+	if !s.state.trackConn(conn, true) {
+		s.state.release(conn)
+		return false
+	}
+	s.emit(&Event{Type: EventConnOpened, Addr: conn.RemoteAddr()})
+	return true
+}
+
+// closeConn is used to stop tracking a connection, with its
+// request if it was read and the error it was served with
+func (s *Server) closeConn(conn net.Conn, req *Request, err error) {
+	s.state.trackConn(conn, false)
+	s.state.release(conn)
+	reason := s.closeReason(req, err)
+	s.metrics().IncrCounter([]string{"socks5", "conn", "closed"}, 1, Label{Name: "reason", Value: reason.String()})
+	event := &Event{Type: EventConnClosed, Addr: conn.RemoteAddr(), Reason: reason, Err: err}
+	if req != nil {
+		event.Relay = req.relayEnd
+	}
+	s.emit(event)
+}
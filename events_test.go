@@ -0,0 +1,217 @@
+package socks5
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestServer_Subscribe(t *testing.T) {
+	serv, _ := New(&Config{
+		Credentials: StaticCredentials{"foo": "bar"},
+		Rules:       PermitNone(),
+	})
+	events := make(chan *Event, 16)
+	unsubscribe := serv.Subscribe(func(e *Event) { events <- e })
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	errCh := make(chan error, 1)
+	go func() { errCh <- serv.Serve(l) }()
+
+	expect := func(types ...EventType) {
+		t.Helper()
+		for _, typ := range types {
+			select {
+			case e := <-events:
+				if e.Type != typ {
+					t.Fatalf("bad: %v %v", e.Type, typ)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("timeout waiting for %v", typ)
+			}
+		}
+	}
+	expect(EventServerStarted)
+
+	send := func(pass string) {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		defer conn.Close()
+		req := bytes.NewBuffer(nil)
+		req.Write([]byte{5, 1, UserPassAuth, 1, 3, 'f', 'o', 'o', byte(len(pass))})
+		req.WriteString(pass)
+		req.Write([]byte{5, 1, 0, 1, 127, 0, 0, 1, 0, 80})
+		conn.Write(req.Bytes())
+		conn.SetDeadline(time.Now().Add(time.Second))
+		io.ReadAll(conn)
+	}
+	send("baz")
+	expect(EventConnOpened, EventAuthFailed, EventConnClosed)
+	send("bar")
+	expect(EventConnOpened, EventAuthSucceeded, EventRuleDenied, EventConnClosed)
+
+	serv.Close()
+	<-errCh
+	expect(EventListenerClosed)
+
+	// No more events once unsubscribed
+	unsubscribe()
+	serv.emit(&Event{Type: EventRelayError})
+	select {
+	case e := <-events:
+		t.Fatalf("bad: %v", e.Type)
+	default:
+	}
+}
+
+func TestServer_RelayEnd(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer target.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	serv, _ := New(&Config{})
+	closed := make(chan *Event, 1)
+	serv.Subscribe(func(e *Event) {
+		if e.Type == EventConnClosed {
+			closed <- e
+		}
+	})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	go serv.Serve(l)
+
+	cases := []struct {
+		end          func(client, upstream net.Conn)
+		side         RelaySide
+		class        string
+		relayedError bool
+		reason       CloseReason
+	}{
+		// The client closes first
+		{func(client, upstream net.Conn) {
+			client.Close()
+			io.Copy(io.Discard, upstream)
+			upstream.Close()
+		}, SideClient, "eof", false, CloseClientEOF},
+		// The target closes first
+		{func(client, upstream net.Conn) {
+			upstream.Close()
+			io.Copy(io.Discard, client)
+			client.Close()
+		}, SideTarget, "eof", false, CloseTargetEOF},
+		// The target resets the connection
+		{func(client, upstream net.Conn) {
+			upstream.(*net.TCPConn).SetLinger(0)
+			upstream.Close()
+			io.Copy(io.Discard, client)
+			client.Close()
+		}, SideTarget, "reset", true, CloseError},
+	}
+	for i, c := range cases {
+		client, resp := connectThrough(t, l.Addr(), target.Addr())
+		if resp != SuccessReply {
+			t.Fatalf("%d: bad: %v", i, resp)
+		}
+		var upstream net.Conn
+		select {
+		case upstream = <-accepted:
+		case <-time.After(time.Second):
+			t.Fatalf("%d: timeout", i)
+		}
+		client.SetDeadline(time.Now().Add(time.Second))
+		upstream.SetDeadline(time.Now().Add(time.Second))
+		c.end(client, upstream)
+
+		select {
+		case e := <-closed:
+			end := e.Relay
+			if end == nil || end.Side != c.side || end.Class != c.class || (end.Err != nil) != c.relayedError {
+				t.Fatalf("%d: bad: %+v", i, end)
+			}
+			if e.Reason != c.reason {
+				t.Fatalf("%d: bad: %v", i, e.Reason)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%d: timeout", i)
+		}
+	}
+}
+
+func TestServer_CloseReason(t *testing.T) {
+	s := &Server{config: &Config{}}
+	cases := []struct {
+		req    *Request
+		err    error
+		reason CloseReason
+	}{
+		{nil, nil, CloseClientEOF},
+		{nil, io.EOF, CloseClientEOF},
+		{nil, &handshakeError{phase: PhaseAuth, err: UserAuthFailed}, CloseAuthFailed},
+		{nil, ErrAuthNotExclusive, CloseAuthFailed},
+		{&Request{denied: true}, fmt.Errorf("denied"), CloseRuleDenied},
+		{&Request{relayEnd: &RelayEnd{Side: SideProxy, Err: ErrIdleTimeout}}, ErrIdleTimeout, CloseIdleTimeout},
+		{&Request{relayEnd: &RelayEnd{Side: SideProxy, Err: ErrMaxLifetime}}, ErrMaxLifetime, CloseLifetime},
+		{&Request{relayEnd: &RelayEnd{Side: SideProxy, Err: ErrQuotaExceeded}}, ErrQuotaExceeded, CloseQuota},
+		{&Request{relayEnd: &RelayEnd{Side: SideTarget, Class: errClassEOF}}, nil, CloseTargetEOF},
+		{&Request{}, fmt.Errorf("Failed to connect"), CloseError},
+	}
+	for i, c := range cases {
+		if got := s.closeReason(c.req, c.err); got != c.reason {
+			t.Fatalf("%d: bad: %v", i, got)
+		}
+	}
+}
+
+func TestServer_CloseReason_Denied(t *testing.T) {
+	serv, _ := New(&Config{Rules: PermitNone()})
+	closed := make(chan *Event, 1)
+	serv.Subscribe(func(e *Event) {
+		if e.Type == EventConnClosed {
+			closed <- e
+		}
+	})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	go serv.Serve(l)
+
+	target := echoTarget(t)
+	client, resp := connectThrough(t, l.Addr(), target.Addr())
+	defer client.Close()
+	if resp != RuleFailure {
+		t.Fatalf("bad: %v", resp)
+	}
+	select {
+	case e := <-closed:
+		if e.Reason != CloseRuleDenied || e.Err == nil {
+			t.Fatalf("bad: %v %v", e.Reason, e.Err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timeout")
+	}
+}
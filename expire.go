@@ -0,0 +1,52 @@
+package socks5
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// ExpireReason classifies what expired
+type ExpireReason uint8
+
+const (
+	// ExpireDial is used when the dial exceeded the DialTimeout
+	ExpireDial ExpireReason = iota
+	// ExpireDialQueue is used when the request waited too
+	// long for a dial slot, see MaxDialsPerDest
+	ExpireDialQueue
+	// ExpireSession is used when a relay exceeded its
+	// MaxConnectionLifetime and was closed
+	ExpireSession
+)
+
+func (r ExpireReason) String() string {
+	switch r {
+	case ExpireDial:
+		return "dial"
+	case ExpireDialQueue:
+		return "dial_queue"
+	case ExpireSession:
+		return "session"
+	}
+	return "unknown"
+}
+
+// ExpireEvent provides the details of an expiry to the OnExpire hook
+type ExpireEvent struct {
+	// Reason of the expiry
+	Reason ExpireReason
+	// Elapsed is how long the expired operation took
+	Elapsed time.Duration
+	// Err describes the expiry
+	Err error
+}
+
+// expire is used to report an expiry to the OnExpire hook
+func (s *Server) expire(ctx context.Context, req *Request, reason ExpireReason, elapsed time.Duration, err error) {
+	s.metrics().IncrCounter([]string{"socks5", "expired"}, 1, Label{Name: "reason", Value: reason.String()})
+	if s.config.OnExpire == nil {
+		return
+	}
+	s.config.OnExpire(ctx, req, &ExpireEvent{Reason: reason, Elapsed: elapsed, Err: err})
+}
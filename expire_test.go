@@ -0,0 +1,54 @@
+package socks5
+
+import (
+	"errors"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestDialErrorReply(t *testing.T) {
+	cases := map[error]uint8{
+		ErrDialLimit:             TTLExpired,
+		context.DeadlineExceeded: TTLExpired,
+		&net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}: ConnectionRefused,
+		&net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ENETUNREACH)}:  NetworkUnreachable,
+		&net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.EHOSTUNREACH)}: HostUnreachable,
+		errors.New("connect: connection refused"):                                          ConnectionRefused,
+		errors.New("no such host"): HostUnreachable,
+	}
+	for err, expected := range cases {
+		if resp := dialErrorReply(err); resp != expected {
+			t.Fatalf("%v: bad: %v", err, resp)
+		}
+	}
+}
+
+func TestSOCKS5_DialTimeout(t *testing.T) {
+	events := make(chan *ExpireEvent, 1)
+	conf := &Config{
+		DialTimeout: 10 * time.Millisecond,
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		},
+		OnExpire: func(ctx context.Context, req *Request, ev *ExpireEvent) {
+			events <- ev
+		},
+	}
+	runConformance(t, conformanceCase{
+		name:   "dial timeout",
+		conf:   func() *Config { return conf },
+		send:   []byte{5, 1, NoAuth, 5, ConnectCommand, 0, ipv4Address, 10, 0, 0, 1, 0, 80},
+		expect: []byte{5, NoAuth, 5, TTLExpired, 0, ipv4Address, 0, 0, 0, 0, 0, 0},
+	})
+
+	ev := <-events
+	if ev.Reason != ExpireDial || ev.Elapsed < 10*time.Millisecond {
+		t.Fatalf("bad: %v", ev)
+	}
+}
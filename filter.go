@@ -0,0 +1,118 @@
+package socks5
+
+import (
+	"net"
+	"sync"
+)
+
+// ClientFilter is used to drop unwanted clients right after
+// they are accepted, before any protocol bytes are read
+type ClientFilter interface {
+	AllowClient(addr net.Addr) bool
+}
+
+// ClientFilterFunc is an adapter to allow using a
+// function as a ClientFilter
+type ClientFilterFunc func(addr net.Addr) bool
+
+func (f ClientFilterFunc) AllowClient(addr net.Addr) bool {
+	return f(addr)
+}
+
+// CIDRFilter is a ClientFilter allowing or denying clients by network.
+// Denied networks take precedence, and if any allowed networks are set
+// clients must match one of them. It is safe to update the networks
+// while the server is running.
+type CIDRFilter struct {
+	l     sync.RWMutex
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// NewCIDRFilter creates a CIDRFilter from lists of CIDR blocks
+func NewCIDRFilter(allow, deny []string) (*CIDRFilter, error) {
+	f := &CIDRFilter{}
+	if err := f.SetAllow(allow); err != nil {
+		return nil, err
+	}
+	if err := f.SetDeny(deny); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// SetAllow replaces the allowed networks
+func (f *CIDRFilter) SetAllow(cidrs []string) error {
+	nets, err := parseCIDRs(cidrs)
+	if err != nil {
+		return err
+	}
+	f.l.Lock()
+	defer f.l.Unlock()
+	f.allow = nets
+	return nil
+}
+
+// SetDeny replaces the denied networks
+func (f *CIDRFilter) SetDeny(cidrs []string) error {
+	nets, err := parseCIDRs(cidrs)
+	if err != nil {
+		return err
+	}
+	f.l.Lock()
+	defer f.l.Unlock()
+	f.deny = nets
+	return nil
+}
+
+func (f *CIDRFilter) AllowClient(addr net.Addr) bool {
+	ip := addrIP(addr)
+	if ip == nil {
+		return false
+	}
+
+	f.l.RLock()
+	defer f.l.RUnlock()
+	if containsIP(f.deny, ip) {
+		return false
+	}
+	return len(f.allow) == 0 || containsIP(f.allow, ip)
+}
+
+// parseCIDRs parses a list of CIDR blocks
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// containsIP checks if any of the networks contains the IP
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// addrIP returns the IP of an address, if it has one
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	case *net.IPAddr:
+		return a.IP
+	case *AddrSpec:
+		return a.IP
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package socks5
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestCIDRFilter(t *testing.T) {
+	f, err := NewCIDRFilter([]string{"10.0.0.0/8", "::1/128"}, []string{"10.1.0.0/16"})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	cases := []struct {
+		ip    string
+		allow bool
+	}{
+		{"10.0.0.1", true},
+		{"10.1.0.1", false},
+		{"192.168.0.1", false},
+		{"::1", true},
+	}
+	for _, tc := range cases {
+		addr := &net.TCPAddr{IP: net.ParseIP(tc.ip), Port: 1234}
+		if f.AllowClient(addr) != tc.allow {
+			t.Fatalf("bad: %v", tc.ip)
+		}
+	}
+
+	// Without allowed networks, everything not denied is allowed
+	f.SetAllow(nil)
+	if !f.AllowClient(&net.TCPAddr{IP: net.ParseIP("192.168.0.1")}) {
+		t.Fatalf("expected allow")
+	}
+
+	if _, err := NewCIDRFilter([]string{"bogus"}, nil); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestSOCKS5_ClientFilter(t *testing.T) {
+	m := newTestMetrics()
+	serv, _ := New(&Config{
+		ClientFilter: ClientFilterFunc(func(addr net.Addr) bool { return false }),
+		Metrics:      m,
+	})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	go serv.Serve(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte{5, 1, NoAuth})
+
+	conn.SetDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 2)); err == nil {
+		t.Fatalf("expected closed connection")
+	}
+	if m.counter("socks5.client.filtered") != 1 {
+		t.Fatalf("bad: %v", m.counters)
+	}
+}
@@ -0,0 +1,91 @@
+package socks5
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	// defaultMaxFQDNLength is the longest name DNS can represent
+	defaultMaxFQDNLength = 253
+
+	// maxLabelLength is the longest label of a DNS name
+	maxLabelLength = 63
+)
+
+// ValidateHostname is the default validation of requested FQDNs. It
+// accepts letters, digits, hyphens and underscores in labels of up to
+// 63 characters, and names of up to maxLen characters. A single
+// trailing dot is removed and the name is lower cased, so the rules
+// see one spelling of each name. Internationalized names must already
+// be in their ASCII (punycode) form; to accept Unicode names, set a
+// FQDNValidator which converts them first, for example:
+//
+//	FQDNValidator: func(name string) (string, error) {
+//		ascii, err := idna.Lookup.ToASCII(name)
+//		if err != nil {
+//			return "", err
+//		}
+//		return socks5.ValidateHostname(ascii, 0)
+//	}
+//
+// A maxLen of zero uses the DNS limit of 253 characters.
+func ValidateHostname(name string, maxLen int) (string, error) {
+	if maxLen <= 0 {
+		maxLen = defaultMaxFQDNLength
+	}
+	name = strings.TrimSuffix(name, ".")
+	if name == "" {
+		return "", fmt.Errorf("Empty hostname")
+	}
+	if len(name) > maxLen {
+		return "", fmt.Errorf("Hostname exceeds %d characters", maxLen)
+	}
+
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > maxLabelLength {
+			return "", fmt.Errorf("Invalid label length in hostname %q", name)
+		}
+		if label[0] == '-' || label[len(label)-1] == '-' {
+			return "", fmt.Errorf("Invalid hyphen in hostname %q", name)
+		}
+		for i := 0; i < len(label); i++ {
+			if !isHostnameChar(label[i]) {
+				return "", fmt.Errorf("Invalid character in hostname %q", name)
+			}
+		}
+	}
+	return strings.ToLower(name), nil
+}
+
+// isHostnameChar checks if a byte may appear in a hostname label
+func isHostnameChar(c byte) bool {
+	switch {
+	case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		return true
+	case c == '-' || c == '_':
+		return true
+	}
+	return false
+}
+
+// checkAddrType is used to enforce RequireFQDN and DenyFQDN
+// on a destination sent by a client
+func (s *Server) checkAddrType(fqdn bool) error {
+	if s.config.RequireFQDN && !fqdn {
+		return fmt.Errorf("IP destinations are not allowed, an FQDN is required")
+	}
+	if s.config.DenyFQDN && fqdn {
+		return fmt.Errorf("FQDN destinations are not allowed")
+	}
+	return nil
+}
+
+// validateFQDN is used to check and normalize a requested FQDN
+// before it is resolved, using the FQDNValidator if set
+func (s *Server) validateFQDN(name string) (string, error) {
+	if s.config.FQDNValidator != nil {
+		return s.config.FQDNValidator(name)
+	}
+	return ValidateHostname(name, s.config.MaxFQDNLength)
+}
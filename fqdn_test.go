@@ -0,0 +1,123 @@
+package socks5
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestValidateHostname(t *testing.T) {
+	valid := map[string]string{
+		"example.com":       "example.com",
+		"Example.COM.":      "example.com",
+		"_srv.example.com":  "_srv.example.com",
+		"xn--bcher-kva.de":  "xn--bcher-kva.de",
+		"localhost":         "localhost",
+		"a-b.c1.example.io": "a-b.c1.example.io",
+	}
+	for name, expected := range valid {
+		out, err := ValidateHostname(name, 0)
+		if err != nil {
+			t.Fatalf("%s: err: %v", name, err)
+		}
+		if out != expected {
+			t.Fatalf("%s: bad: %s", name, out)
+		}
+	}
+
+	invalid := []string{
+		"",
+		".",
+		"example..com",
+		".example.com",
+		"example.com..",
+		"-example.com",
+		"example-.com",
+		"exa mple.com",
+		"example.com\r\n[ERR] injected",
+		"bücher.de",
+		strings.Repeat("a", 64) + ".com",
+		strings.Repeat("a.", 127) + "com",
+	}
+	for _, name := range invalid {
+		if _, err := ValidateHostname(name, 0); err == nil {
+			t.Fatalf("%q: expected error", name)
+		}
+	}
+
+	if _, err := ValidateHostname("example.com", 5); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestServer_FQDNValidator(t *testing.T) {
+	s := &Server{config: &Config{}}
+	if _, err := s.validateFQDN("bücher.de"); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	s.config.FQDNValidator = func(name string) (string, error) {
+		return strings.Replace(name, "ü", "ue", -1), nil
+	}
+	name, err := s.validateFQDN("bücher.de")
+	if err != nil || name != "buecher.de" {
+		t.Fatalf("bad: %v %v", name, err)
+	}
+}
+
+func TestServer_RequireFQDN(t *testing.T) {
+	ipReq := []byte{5, 1, 0, ipv4Address, 127, 0, 0, 1, 0, 80}
+	fqdnReq := []byte{5, 1, 0, fqdnAddress, 7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 0, 80}
+	cases := []struct {
+		require, deny bool
+		req           []byte
+		allowed       bool
+	}{
+		{false, false, ipReq, true},
+		{false, false, fqdnReq, true},
+		{true, false, ipReq, false},
+		{true, false, fqdnReq, true},
+		{false, true, ipReq, true},
+		{false, true, fqdnReq, false},
+	}
+	for i, c := range cases {
+		var denied *DenyReason
+		s := &Server{config: &Config{
+			Rules:       PermitAll(),
+			Resolver:    loopbackResolver{},
+			Logger:      newDefaultLogger(),
+			RequireFQDN: c.require,
+			DenyFQDN:    c.deny,
+			Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				client, server := net.Pipe()
+				server.Close()
+				return client, nil
+			},
+			OnDeny: func(ctx context.Context, req *Request, reason *DenyReason) {
+				denied = reason
+			},
+		}}
+		req, err := NewRequest(bytes.NewBuffer(c.req))
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		req.bufConn = bytes.NewBuffer(nil)
+		resp := &MockConn{}
+		err = s.handleRequest(req, resp)
+		if c.allowed {
+			if err != nil || denied != nil || resp.buf.Bytes()[1] != SuccessReply {
+				t.Fatalf("%d: bad: %v %v %v", i, err, denied, resp.buf.Bytes())
+			}
+			continue
+		}
+		if err == nil || denied == nil || denied.Kind != DenyAddress {
+			t.Fatalf("%d: bad: %v %v", i, err, denied)
+		}
+		if resp.buf.Bytes()[1] != AddrTypeNotSupported {
+			t.Fatalf("%d: bad: %v", i, resp.buf.Bytes())
+		}
+	}
+}
@@ -0,0 +1,105 @@
+//go:build go1.18
+
+package socks5
+
+import (
+	"bytes"
+	"testing"
+)
+
+func FuzzNewRequest(f *testing.F) {
+	f.Add([]byte{5, 1, 0, 1, 127, 0, 0, 1, 0, 80})
+	f.Add([]byte{5, 1, 0, 3, 9, 'l', 'o', 'c', 'a', 'l', 'h', 'o', 's', 't', 0, 80})
+	f.Add([]byte{5, 1, 0, 4, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0, 80})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		l := &limitedReader{r: bytes.NewReader(data), n: 262}
+		req, err := NewRequest(l)
+		if err != nil {
+			return
+		}
+		if req.DestAddr.FQDN == "" && req.DestAddr.IP == nil {
+			t.Fatalf("missing destination: %v", data)
+		}
+		if req.DestAddr.Port < 0 || req.DestAddr.Port > 0xffff {
+			t.Fatalf("bad port: %v", req.DestAddr.Port)
+		}
+	})
+}
+
+func FuzzReadAddrSpec(f *testing.F) {
+	f.Add([]byte{ipv4Address, 10, 0, 0, 1, 0, 80})
+	f.Add([]byte{fqdnAddress, 3, 'f', 'o', 'o', 1, 187})
+	f.Add([]byte{ipv6Address, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0, 53})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		addr, err := readAddrSpec(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+
+		// Anything we parse we must be able to encode again
+		out, err := formatAddrSpec(addr)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		addr2, err := readAddrSpec(bytes.NewReader(out))
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if addr2.FQDN != addr.FQDN || !addr2.IP.Equal(addr.IP) || addr2.Port != addr.Port {
+			t.Fatalf("bad: %v %v", addr, addr2)
+		}
+	})
+}
+
+func FuzzReadMethods(f *testing.F) {
+	f.Add([]byte{1, NoAuth})
+	f.Add([]byte{2, NoAuth, UserPassAuth})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		methods, err := readMethods(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+		if len(methods) != int(data[0]) {
+			t.Fatalf("bad: %v %v", methods, data)
+		}
+	})
+}
+
+func FuzzReadUserPass(f *testing.F) {
+	f.Add([]byte{1, 3, 'f', 'o', 'o', 3, 'b', 'a', 'r'})
+	f.Add([]byte{1, 0, 0})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		user, pass, err := readUserPass(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+		if len(user) > 255 || len(pass) > 255 {
+			t.Fatalf("bad: %q %q", user, pass)
+		}
+	})
+}
+
+func FuzzReadUDPDatagram(f *testing.F) {
+	f.Add([]byte{0, 0, 0, ipv4Address, 127, 0, 0, 1, 0, 53, 'h', 'i'})
+	f.Add([]byte{0, 0, 1, fqdnAddress, 3, 'f', 'o', 'o', 0, 53})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		d, err := readUDPDatagram(data)
+		if err != nil {
+			return
+		}
+
+		// Re-encoding must produce an equivalent datagram
+		out, err := d.marshal()
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		d2, err := readUDPDatagram(out)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if d2.Frag != d.Frag || !d2.DestAddr.IP.Equal(d.DestAddr.IP) ||
+			d2.DestAddr.FQDN != d.DestAddr.FQDN || !bytes.Equal(d2.Data, d.Data) {
+			t.Fatalf("bad: %v %v", d, d2)
+		}
+	})
+}
@@ -0,0 +1,158 @@
+package socks5
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	defaultGeoCacheTTL  = time.Hour
+	defaultGeoCacheSize = 4096
+)
+
+// GeoInfo is the location information of an IP address
+type GeoInfo struct {
+	// Country is the ISO 3166-1 alpha-2 country code
+	Country string
+	// ASN is the autonomous system number
+	ASN uint
+}
+
+// GeoIPProvider is used to look up the location of an IP address,
+// for example backed by a MaxMind database. Keeping the database
+// driver outside the package avoids a hard dependency.
+type GeoIPProvider interface {
+	Lookup(ip net.IP) (*GeoInfo, error)
+}
+
+// GeoRuleSet is a RuleSet allowing or denying requests based on the
+// country of the client, and the country or ASN of the destination.
+// Deny lists take precedence, and if an allow list is set the address
+// must match it. Addresses which cannot be located never match an
+// allow list. Lookups are cached.
+type GeoRuleSet struct {
+	// Provider is used to look up addresses
+	Provider GeoIPProvider
+
+	AllowClientCountries []string
+	DenyClientCountries  []string
+	AllowDestCountries   []string
+	DenyDestCountries    []string
+	DenyDestASNs         []uint
+
+	// Rules is consulted once the geo checks pass.
+	// Defaults to PermitAll.
+	Rules RuleSet
+
+	// CacheTTL is how long lookups are cached. Defaults to an hour.
+	CacheTTL time.Duration
+
+	// CacheSize bounds the number of cached lookups. Defaults to 4096.
+	CacheSize int
+
+	l     sync.Mutex
+	cache map[string]geoCacheEntry
+}
+
+type geoCacheEntry struct {
+	info    *GeoInfo
+	expires time.Time
+}
+
+func (g *GeoRuleSet) Allow(ctx context.Context, req *Request) (context.Context, bool) {
+	// Check the client
+	if req.RemoteAddr != nil {
+		info := g.lookup(req.RemoteAddr.IP)
+		if !matchCountry(info, g.AllowClientCountries, g.DenyClientCountries) {
+			return DenyWith(ctx, RuleFailure, "client country denied"), false
+		}
+	}
+
+	// Check the destination
+	dest := req.realDestAddr
+	if dest == nil {
+		dest = req.DestAddr
+	}
+	if dest != nil && dest.IP != nil {
+		info := g.lookup(dest.IP)
+		if !matchCountry(info, g.AllowDestCountries, g.DenyDestCountries) {
+			return DenyWith(ctx, RuleFailure, "destination country denied"), false
+		}
+		if info != nil {
+			for _, asn := range g.DenyDestASNs {
+				if info.ASN == asn {
+					return DenyWith(ctx, RuleFailure, "destination ASN denied"), false
+				}
+			}
+		}
+	}
+
+	if g.Rules == nil {
+		return ctx, true
+	}
+	return g.Rules.Allow(ctx, req)
+}
+
+// matchCountry applies the allow and deny lists to a location
+func matchCountry(info *GeoInfo, allow, deny []string) bool {
+	country := ""
+	if info != nil {
+		country = info.Country
+	}
+	for _, c := range deny {
+		if c == country {
+			return false
+		}
+	}
+	if len(allow) == 0 {
+		return true
+	}
+	for _, c := range allow {
+		if c == country {
+			return true
+		}
+	}
+	return false
+}
+
+// lookup returns the location of an IP, using the cache.
+// Returns nil if the address cannot be located.
+func (g *GeoRuleSet) lookup(ip net.IP) *GeoInfo {
+	if ip == nil {
+		return nil
+	}
+	key := ip.String()
+	now := time.Now()
+
+	g.l.Lock()
+	if entry, ok := g.cache[key]; ok && now.Before(entry.expires) {
+		g.l.Unlock()
+		return entry.info
+	}
+	g.l.Unlock()
+
+	info, err := g.Provider.Lookup(ip)
+	if err != nil {
+		info = nil
+	}
+
+	ttl := g.CacheTTL
+	if ttl == 0 {
+		ttl = defaultGeoCacheTTL
+	}
+	size := g.CacheSize
+	if size == 0 {
+		size = defaultGeoCacheSize
+	}
+
+	g.l.Lock()
+	defer g.l.Unlock()
+	if g.cache == nil || len(g.cache) >= size {
+		g.cache = make(map[string]geoCacheEntry)
+	}
+	g.cache[key] = geoCacheEntry{info: info, expires: now.Add(ttl)}
+	return info
+}
@@ -0,0 +1,73 @@
+package socks5
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+// staticGeo locates addresses from a map and counts lookups
+type staticGeo struct {
+	db      map[string]*GeoInfo
+	lookups int
+}
+
+func (s *staticGeo) Lookup(ip net.IP) (*GeoInfo, error) {
+	s.lookups++
+	info, ok := s.db[ip.String()]
+	if !ok {
+		return nil, errors.New("not found")
+	}
+	return info, nil
+}
+
+func TestGeoRuleSet(t *testing.T) {
+	geo := &staticGeo{db: map[string]*GeoInfo{
+		"10.0.0.1": {Country: "DE", ASN: 1},
+		"10.0.0.2": {Country: "US", ASN: 2},
+		"10.0.0.3": {Country: "FR", ASN: 3},
+	}}
+	r := &GeoRuleSet{
+		Provider:             geo,
+		AllowClientCountries: []string{"DE", "US"},
+		DenyDestCountries:    []string{"FR"},
+		DenyDestASNs:         []uint{2},
+	}
+
+	addr := func(ip string) *AddrSpec {
+		return &AddrSpec{IP: net.ParseIP(ip), Port: 80}
+	}
+	cases := []struct {
+		client, dest string
+		allow        bool
+	}{
+		{"10.0.0.1", "10.0.0.1", true},
+		{"10.0.0.3", "10.0.0.1", false},
+		{"10.0.0.9", "10.0.0.1", false},
+		{"10.0.0.1", "10.0.0.3", false},
+		{"10.0.0.1", "10.0.0.2", false},
+		{"10.0.0.1", "10.0.0.9", true},
+	}
+	for _, tc := range cases {
+		req := &Request{Command: ConnectCommand, RemoteAddr: addr(tc.client), DestAddr: addr(tc.dest)}
+		if _, ok := r.Allow(context.Background(), req); ok != tc.allow {
+			t.Fatalf("bad: %v -> %v", tc.client, tc.dest)
+		}
+	}
+
+	// Repeated lookups are served from the cache
+	lookups := geo.lookups
+	req := &Request{Command: ConnectCommand, RemoteAddr: addr("10.0.0.1"), DestAddr: addr("10.0.0.1")}
+	r.Allow(context.Background(), req)
+	if geo.lookups != lookups {
+		t.Fatalf("expected cached lookups")
+	}
+
+	// The chained rules still apply
+	r.Rules = PermitNone()
+	if _, ok := r.Allow(context.Background(), req); ok {
+		t.Fatalf("expected deny")
+	}
+}
@@ -0,0 +1,241 @@
+package socks5
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+
+	"golang.org/x/net/context"
+)
+
+// HandshakePhase is a step of the SOCKS5 negotiation
+type HandshakePhase uint8
+
+const (
+	// PhaseGreeting reads the version and offered auth methods
+	PhaseGreeting HandshakePhase = iota
+	// PhaseAuth selects a method and runs its sub-negotiation
+	PhaseAuth
+	// PhaseRequest reads the client request
+	PhaseRequest
+	// PhaseReply waits for the reply to the request to be sent
+	PhaseReply
+	// PhaseDone is reached once the reply was sent
+	PhaseDone
+)
+
+func (p HandshakePhase) String() string {
+	switch p {
+	case PhaseGreeting:
+		return "greeting"
+	case PhaseAuth:
+		return "auth"
+	case PhaseRequest:
+		return "request"
+	case PhaseReply:
+		return "reply"
+	case PhaseDone:
+		return "done"
+	}
+	return "unknown"
+}
+
+// ErrNeedMore is returned by Feed when the current phase awaits
+// more input from the client
+var ErrNeedMore = errors.New("Handshake needs more input")
+
+// Handshake is the server side of the SOCKS5 negotiation, run one
+// phase at a time. Each call to Step runs the current phase, blocking
+// until it read the whole message of the client from the stream and
+// wrote the responses, and then advances to the next phase. A Step
+// which fails, including on a short read, aborts the handshake, as
+// the input it consumed is lost. Feed instead accepts the input in
+// arbitrary chunks, as received.
+type Handshake struct {
+	phase       HandshakePhase
+	authMethods map[uint8]Authenticator
+	ctx         context.Context
+	conn        net.Conn
+	codec       Codec
+
+	// input is the input given to Feed not yet consumed, and sent
+	// the bytes of the responses of the current phase written so far
+	input []byte
+	sent  int
+
+	// Methods are the auth methods offered by the client
+	Methods []byte
+
+	// AuthContext is set once the client authenticated
+	AuthContext *AuthContext
+
+	// Request is set once the client request was read
+	Request *Request
+}
+
+// NewHandshake creates a Handshake offering the given auth methods
+func NewHandshake(methods []Authenticator) *Handshake {
+	h := &Handshake{authMethods: make(map[uint8]Authenticator)}
+	for _, a := range methods {
+		h.authMethods[a.GetCode()] = a
+	}
+	return h
+}
+
+// SetConn sets the connection the handshake runs over, which is
+// handed to ConnAuthenticators along with ctx. Without it, they
+// are used through their Authenticate method.
+func (h *Handshake) SetConn(ctx context.Context, conn net.Conn) {
+	h.ctx = ctx
+	h.conn = conn
+}
+
+// SetCodec sets the Codec reading the request and writing the
+// reply. Defaults to RFC1928Codec.
+func (h *Handshake) SetCodec(c Codec) {
+	h.codec = c
+}
+
+// getCodec returns the Codec of the handshake
+func (h *Handshake) getCodec() Codec {
+	if h.codec != nil {
+		return h.codec
+	}
+	return RFC1928Codec{}
+}
+
+// Phase returns the phase the next Step will run
+func (h *Handshake) Phase() HandshakePhase {
+	return h.phase
+}
+
+// Step runs the current phase and advances to the next one.
+// An error aborts the handshake.
+func (h *Handshake) Step(r io.Reader, w io.Writer) error {
+	switch h.phase {
+	case PhaseGreeting:
+		// Read the version byte
+		version := []byte{0}
+		if _, err := io.ReadFull(r, version); err != nil {
+			return fmt.Errorf("Failed to get version byte: %w", err)
+		}
+
+		// Ensure we are compatible
+		if version[0] != socks5Version {
+			return fmt.Errorf("Unsupported SOCKS version: %v", version)
+		}
+
+		// Get the methods
+		methods, err := readMethods(r)
+		if err != nil {
+			return fmt.Errorf("Failed to get auth methods: %w", err)
+		}
+		h.Methods = methods
+
+	case PhaseAuth:
+		ctx := h.ctx
+		if ctx == nil {
+			ctx = context.Background()
+		}
+		authContext, err := selectAuth(ctx, h.conn, h.authMethods, h.Methods, r, w)
+		if err != nil {
+			return err
+		}
+		h.AuthContext = authContext
+
+	case PhaseRequest:
+		request, err := h.getCodec().ReadRequest(r)
+		if err != nil {
+			if err == unrecognizedAddrType {
+				if err := h.getCodec().WriteReply(w, nil, AddrTypeNotSupported, nil); err != nil {
+					return fmt.Errorf("Failed to send reply: %w", err)
+				}
+			}
+			return err
+		}
+		request.AuthContext = h.AuthContext
+		h.Request = request
+
+	case PhaseReply:
+		return fmt.Errorf("Handshake is waiting for a reply")
+
+	default:
+		return fmt.Errorf("Handshake is complete")
+	}
+
+	h.phase++
+	return nil
+}
+
+// Feed runs the phases with the input received so far, buffering
+// partial messages, until the request was read. It returns ErrNeedMore
+// once it consumed the input if the current phase awaits more of it,
+// having written the responses of the phases it completed. Any other
+// error aborts the handshake. ConnAuthenticators, which write to the
+// connection themselves, cannot be fed.
+func (h *Handshake) Feed(p []byte, w io.Writer) error {
+	h.input = append(h.input, p...)
+	for h.phase < PhaseReply {
+		// Run the phase over the buffered input, sending only the
+		// responses which an earlier attempt did not send yet
+		r := &feedReader{b: h.input}
+		var out bytes.Buffer
+		err := h.Step(r, &out)
+		if out.Len() > h.sent {
+			if _, werr := w.Write(out.Bytes()[h.sent:]); werr != nil {
+				return werr
+			}
+			h.sent = out.Len()
+		}
+		if err != nil {
+			if r.short {
+				return ErrNeedMore
+			}
+			return err
+		}
+		h.input = h.input[r.off:]
+		h.sent = 0
+	}
+	return nil
+}
+
+// Buffered returns the input given to Feed beyond the request,
+// which the client sent before the reply
+func (h *Handshake) Buffered() []byte {
+	if h.phase < PhaseReply {
+		return nil
+	}
+	return h.input
+}
+
+// feedReader reads the buffered input of Feed, noting
+// when a phase tried to read past its end
+type feedReader struct {
+	b     []byte
+	off   int
+	short bool
+}
+
+func (f *feedReader) Read(p []byte) (int, error) {
+	if f.off >= len(f.b) {
+		f.short = true
+		return 0, io.EOF
+	}
+	n := copy(p, f.b[f.off:])
+	f.off += n
+	return n, nil
+}
+
+// Reply sends the reply to the request, completing the handshake
+func (h *Handshake) Reply(w io.Writer, resp uint8, bind *AddrSpec) error {
+	if h.phase != PhaseReply {
+		return fmt.Errorf("Handshake is not ready to reply, in phase %v", h.phase)
+	}
+	if err := h.getCodec().WriteReply(w, h.Request, resp, bind); err != nil {
+		return err
+	}
+	h.phase = PhaseDone
+	return nil
+}
@@ -0,0 +1,126 @@
+package socks5
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"testing/iotest"
+)
+
+func TestHandshake_ByteByByte(t *testing.T) {
+	in := bytes.NewBuffer(nil)
+	in.Write([]byte{5, 2, NoAuth, UserPassAuth})
+	in.Write([]byte{1, 3, 'f', 'o', 'o', 3, 'b', 'a', 'r'})
+	in.Write([]byte{5, 1, 0, 1, 10, 0, 0, 1, 0, 80})
+	r := iotest.OneByteReader(in)
+	var out bytes.Buffer
+
+	h := NewHandshake([]Authenticator{UserPassAuthenticator{Credentials: StaticCredentials{"foo": "bar"}}})
+	for _, phase := range []HandshakePhase{PhaseGreeting, PhaseAuth, PhaseRequest} {
+		if h.Phase() != phase {
+			t.Fatalf("bad phase: %v", h.Phase())
+		}
+		if err := h.Step(r, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	if !bytes.Equal(h.Methods, []byte{NoAuth, UserPassAuth}) {
+		t.Fatalf("bad: %v", h.Methods)
+	}
+	if h.Request.AuthContext.Payload["Username"] != "foo" {
+		t.Fatalf("bad: %v", h.Request.AuthContext)
+	}
+	if h.Request.Command != ConnectCommand || h.Request.DestAddr.Port != 80 {
+		t.Fatalf("bad: %v", h.Request)
+	}
+
+	// Stepping is not possible until we reply
+	if err := h.Step(r, &out); err == nil {
+		t.Fatalf("expected error")
+	}
+	bind := &AddrSpec{IP: net.IPv4(127, 0, 0, 1), Port: 1080}
+	if err := h.Reply(&out, SuccessReply, bind); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if h.Phase() != PhaseDone {
+		t.Fatalf("bad phase: %v", h.Phase())
+	}
+
+	expected := []byte{
+		5, UserPassAuth,
+		1, authSuccess,
+		5, SuccessReply, 0, ipv4Address, 127, 0, 0, 1, 4, 56,
+	}
+	if !bytes.Equal(out.Bytes(), expected) {
+		t.Fatalf("bad: %v", out.Bytes())
+	}
+}
+
+func TestHandshake_UnrecognizedAddrType(t *testing.T) {
+	in := bytes.NewBuffer([]byte{5, 1, NoAuth, 5, 1, 0, 9})
+	var out bytes.Buffer
+
+	h := NewHandshake([]Authenticator{NoAuthAuthenticator{}})
+	h.Step(in, &out)
+	h.Step(in, &out)
+	if err := h.Step(in, &out); err != unrecognizedAddrType {
+		t.Fatalf("err: %v", err)
+	}
+
+	expected := []byte{5, NoAuth, 5, AddrTypeNotSupported, 0, ipv4Address, 0, 0, 0, 0, 0, 0}
+	if !bytes.Equal(out.Bytes(), expected) {
+		t.Fatalf("bad: %v", out.Bytes())
+	}
+}
+
+func TestHandshake_Feed(t *testing.T) {
+	var in []byte
+	in = append(in, 5, 2, NoAuth, UserPassAuth)
+	in = append(in, 1, 3, 'f', 'o', 'o', 3, 'b', 'a', 'r')
+	in = append(in, 5, 1, 0, 1, 10, 0, 0, 1, 0, 80)
+	in = append(in, 'h', 'i')
+	var out bytes.Buffer
+
+	// Feed the handshake one byte at a time
+	h := NewHandshake([]Authenticator{UserPassAuthenticator{Credentials: StaticCredentials{"foo": "bar"}}})
+	for i, b := range in {
+		err := h.Feed([]byte{b}, &out)
+		if i < len(in)-3 && err != ErrNeedMore {
+			t.Fatalf("err at %d: %v", i, err)
+		}
+		if i >= len(in)-3 && err != nil {
+			t.Fatalf("err at %d: %v", i, err)
+		}
+
+		// The method is selected as soon as the greeting is complete
+		if i == 3 && !bytes.Equal(out.Bytes(), []byte{5, UserPassAuth}) {
+			t.Fatalf("bad: %v", out.Bytes())
+		}
+	}
+
+	if h.Phase() != PhaseReply {
+		t.Fatalf("bad phase: %v", h.Phase())
+	}
+	if h.Request.AuthContext.Payload["Username"] != "foo" {
+		t.Fatalf("bad: %v", h.Request.AuthContext)
+	}
+	if h.Request.Command != ConnectCommand || h.Request.DestAddr.Port != 80 {
+		t.Fatalf("bad: %v", h.Request)
+	}
+	if !bytes.Equal(h.Buffered(), []byte("hi")) {
+		t.Fatalf("bad: %v", h.Buffered())
+	}
+	expected := []byte{5, UserPassAuth, 1, authSuccess}
+	if !bytes.Equal(out.Bytes(), expected) {
+		t.Fatalf("bad: %v", out.Bytes())
+	}
+}
+
+func TestHandshake_FeedError(t *testing.T) {
+	var out bytes.Buffer
+	h := NewHandshake([]Authenticator{NoAuthAuthenticator{}})
+	if err := h.Feed([]byte{4}, &out); err == nil || err == ErrNeedMore {
+		t.Fatalf("err: %v", err)
+	}
+}
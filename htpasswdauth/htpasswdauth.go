@@ -0,0 +1,188 @@
+// Package htpasswdauth implements a socks5.CredentialStore backed by
+// an htpasswd file of bcrypt entries, which is reloaded as it changes.
+package htpasswdauth
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/armon/go-socks5"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const defaultPollInterval = 5 * time.Second
+
+// FileWatcher is used to notice changes to a file, such as by
+// polling its modification time or through fsnotify
+type FileWatcher interface {
+	// Watch signals on the returned channel whenever the file at
+	// path may have changed, until stop is closed
+	Watch(path string, stop <-chan struct{}) (<-chan struct{}, error)
+}
+
+// PollWatcher is a FileWatcher polling the modification
+// time and size of the file
+type PollWatcher struct {
+	// Interval between polls. Defaults to 5 seconds.
+	Interval time.Duration
+}
+
+func (p *PollWatcher) Watch(path string, stop <-chan struct{}) (<-chan struct{}, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	interval := p.Interval
+	if interval <= 0 {
+		interval = defaultPollInterval
+	}
+
+	changes := make(chan struct{}, 1)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		mtime, size := info.ModTime(), info.Size()
+		for {
+			select {
+			case <-ticker.C:
+			case <-stop:
+				return
+			}
+			info, err := os.Stat(path)
+			if err != nil || (info.ModTime().Equal(mtime) && info.Size() == size) {
+				continue
+			}
+			mtime, size = info.ModTime(), info.Size()
+			select {
+			case changes <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return changes, nil
+}
+
+// Store is a CredentialStore backed by an htpasswd file of bcrypt
+// entries, as created by "htpasswd -B". The file can be reloaded,
+// atomically swapping the users and keeping the previous ones if it
+// fails to parse.
+type Store struct {
+	path  string
+	table atomic.Value
+
+	// Metrics receives reload and parse error counts.
+	// Defaults to NoopMetrics.
+	Metrics socks5.Metrics
+
+	// OnError is invoked when a reload triggered by Watch fails
+	OnError func(err error)
+
+	stopOnce sync.Once
+	stopCh   chan struct{}
+}
+
+// New loads the htpasswd file at path
+func New(path string) (*Store, error) {
+	h := &Store{path: path, stopCh: make(chan struct{})}
+	if err := h.Reload(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+func (h *Store) metrics() socks5.Metrics {
+	if h.Metrics == nil {
+		return socks5.NoopMetrics{}
+	}
+	return h.Metrics
+}
+
+// parseHtpasswd reads the users and bcrypt hashes of an htpasswd file.
+// Blank lines and lines starting with '#' are ignored.
+func parseHtpasswd(r io.Reader) (map[string][]byte, error) {
+	users := make(map[string][]byte)
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		entry := strings.TrimSpace(scanner.Text())
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+		i := strings.IndexByte(entry, ':')
+		if i <= 0 {
+			return nil, fmt.Errorf("Invalid htpasswd entry on line %d", line)
+		}
+		hash := entry[i+1:]
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("Unsupported htpasswd hash on line %d, only bcrypt is supported: %v", line, err)
+		}
+		users[entry[:i]] = []byte(hash)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// Reload reads the file and swaps in its users
+func (h *Store) Reload() error {
+	users, err := h.load()
+	if err != nil {
+		h.metrics().IncrCounter([]string{"socks5", "htpasswd", "reload_error"}, 1)
+		return err
+	}
+	h.table.Store(users)
+	h.metrics().IncrCounter([]string{"socks5", "htpasswd", "reload"}, 1)
+	h.metrics().SetGauge([]string{"socks5", "htpasswd", "users"}, float32(len(users)))
+	return nil
+}
+
+func (h *Store) load() (map[string][]byte, error) {
+	f, err := os.Open(h.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseHtpasswd(f)
+}
+
+// Watch reloads the file whenever the watcher notices a change,
+// until Stop is called
+func (h *Store) Watch(w FileWatcher) error {
+	changes, err := w.Watch(h.path, h.stopCh)
+	if err != nil {
+		return err
+	}
+	go func() {
+		for {
+			select {
+			case <-changes:
+				if err := h.Reload(); err != nil && h.OnError != nil {
+					h.OnError(err)
+				}
+			case <-h.stopCh:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// Stop ends watching the file
+func (h *Store) Stop() {
+	h.stopOnce.Do(func() { close(h.stopCh) })
+}
+
+func (h *Store) Valid(user, password string) bool {
+	users := h.table.Load().(map[string][]byte)
+	hash, ok := users[user]
+	if !ok {
+		return false
+	}
+	return bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil
+}
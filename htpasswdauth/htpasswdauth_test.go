@@ -0,0 +1,113 @@
+package htpasswdauth
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/armon/go-socks5"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// countingMetrics records the counters it receives
+type countingMetrics struct {
+	socks5.NoopMetrics
+	l        sync.Mutex
+	counters map[string]float32
+}
+
+func (m *countingMetrics) IncrCounter(key []string, val float32, labels ...socks5.Label) {
+	m.l.Lock()
+	defer m.l.Unlock()
+	m.counters[strings.Join(key, ".")] += val
+}
+
+func (m *countingMetrics) counter(key string) float32 {
+	m.l.Lock()
+	defer m.l.Unlock()
+	return m.counters[key]
+}
+
+func htpasswdEntry(t *testing.T, user, pass string) string {
+	hash, err := bcrypt.GenerateFromPassword([]byte(pass), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return fmt.Sprintf("%s:%s\n", user, hash)
+}
+
+func TestParseHtpasswd(t *testing.T) {
+	users, err := parseHtpasswd(strings.NewReader("# users\n\n" + htpasswdEntry(t, "foo", "bar")))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(users) != 1 || users["foo"] == nil {
+		t.Fatalf("bad: %v", users)
+	}
+
+	// Only bcrypt entries are supported
+	for _, bad := range []string{"foo\n", ":$2y$05$abc\n", "foo:{SHA}YmFy\n"} {
+		if _, err := parseHtpasswd(strings.NewReader(bad)); err == nil {
+			t.Fatalf("expected error for %q", bad)
+		}
+	}
+}
+
+func TestStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "socks5")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "htpasswd")
+	ioutil.WriteFile(path, []byte(htpasswdEntry(t, "foo", "bar")), 0644)
+
+	m := &countingMetrics{counters: make(map[string]float32)}
+	h, err := New(path)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer h.Stop()
+	h.Metrics = m
+	errCh := make(chan error, 1)
+	h.OnError = func(err error) { errCh <- err }
+	if err := h.Watch(&PollWatcher{Interval: 10 * time.Millisecond}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if !h.Valid("foo", "bar") || h.Valid("foo", "baz") || h.Valid("baz", "bar") {
+		t.Fatalf("bad credentials check")
+	}
+
+	// Changes to the file are picked up
+	ioutil.WriteFile(path, []byte(htpasswdEntry(t, "baz", "bar")+"# rotated\n"), 0644)
+	deadline := time.Now().Add(2 * time.Second)
+	for !h.Valid("baz", "bar") {
+		if time.Now().After(deadline) {
+			t.Fatalf("file was not reloaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if h.Valid("foo", "bar") {
+		t.Fatalf("expect invalid")
+	}
+
+	// A file which fails to parse keeps the previous users
+	ioutil.WriteFile(path, []byte("baz:plain\n"), 0644)
+	select {
+	case <-errCh:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timeout")
+	}
+	if !h.Valid("baz", "bar") {
+		t.Fatalf("expect valid")
+	}
+	if m.counter("socks5.htpasswd.reload") != 1 || m.counter("socks5.htpasswd.reload_error") != 1 {
+		t.Fatalf("bad: %v", m.counters)
+	}
+}
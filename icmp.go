@@ -0,0 +1,114 @@
+package socks5
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// icmpError is an ICMP error reported for a datagram relayed
+// by an association
+type icmpError struct {
+	// dest is the destination of the datagram which caused the
+	// error, nil if the platform does not report it
+	dest *net.UDPAddr
+	// err is the errno the ICMP error translates to
+	err error
+}
+
+func (e *icmpError) Error() string {
+	if e.dest == nil {
+		return fmt.Sprintf("ICMP error: %v", e.err)
+	}
+	return fmt.Sprintf("ICMP error for %v: %v", e.dest, e.err)
+}
+
+func (e *icmpError) Unwrap() error {
+	return e.err
+}
+
+// reason classifies the error for metrics
+func (e *icmpError) reason() string {
+	switch {
+	case errors.Is(e.err, syscall.ECONNREFUSED):
+		return "port_unreachable"
+	case errors.Is(e.err, syscall.EHOSTUNREACH):
+		return "host_unreachable"
+	case errors.Is(e.err, syscall.ENETUNREACH):
+		return "net_unreachable"
+	}
+	return "other"
+}
+
+// unreachable checks if the destination can not be reached at all,
+// rather than e.g. the datagram being too large
+func (e *icmpError) unreachable() bool {
+	return e.reason() != "other"
+}
+
+// isICMPError checks if err is the result of an ICMP error, which
+// sockets return on the next operation after it was received
+func isICMPError(err error) bool {
+	var errno syscall.Errno
+	if !errors.As(err, &errno) {
+		return false
+	}
+	switch errno {
+	case syscall.ECONNREFUSED, syscall.EHOSTUNREACH, syscall.ENETUNREACH,
+		syscall.EMSGSIZE, syscall.EPROTO:
+		return true
+	}
+	return false
+}
+
+// enableICMPErrors configures pc to report the ICMP errors caused by
+// the datagrams sent on it, where the platform supports it
+func enableICMPErrors(pc *net.UDPConn) error {
+	if !supportsICMPErrors {
+		return ErrUnsupportedPlatform
+	}
+	rc, err := pc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var setErr error
+	if err := rc.Control(func(fd uintptr) {
+		setErr = setRecvErr(fd)
+	}); err != nil {
+		return err
+	}
+	return setErr
+}
+
+// readICMPErrors returns the ICMP errors queued on pc, following
+// err returned by an operation on it. If the platform does not
+// queue them, err itself is returned without a destination.
+func readICMPErrors(pc *net.UDPConn, err error) []*icmpError {
+	var errno syscall.Errno
+	errors.As(err, &errno)
+	fallback := []*icmpError{{err: errno}}
+	if !supportsICMPErrors {
+		return fallback
+	}
+	rc, rcErr := pc.SyscallConn()
+	if rcErr != nil {
+		return fallback
+	}
+	var out []*icmpError
+	rc.Control(func(fd uintptr) {
+		for {
+			e, err := readErrQueue(fd)
+			if err != nil {
+				return
+			}
+			if e != nil {
+				out = append(out, e)
+			}
+		}
+	})
+	if len(out) == 0 {
+		return fallback
+	}
+	return out
+}
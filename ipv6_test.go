@@ -0,0 +1,152 @@
+package socks5
+
+import (
+	"bytes"
+	"log"
+	"net"
+	"os"
+	"testing"
+)
+
+func listenIPv6(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 loopback not available: %v", err)
+	}
+	return l
+}
+
+func TestIPv6_Connect(t *testing.T) {
+	l := listenIPv6(t)
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		conn.Write([]byte("pong"))
+		conn.Close()
+	}()
+	lAddr := l.Addr().(*net.TCPAddr)
+
+	s := &Server{config: &Config{
+		Rules:    PermitAll(),
+		Resolver: DNSResolver{},
+		Logger:   log.New(os.Stdout, "", log.LstdFlags),
+	}}
+
+	buf := bytes.NewBuffer([]byte{5, 1, 0, ipv6Address})
+	buf.Write(net.IPv6loopback)
+	buf.Write([]byte{byte(lAddr.Port >> 8), byte(lAddr.Port)})
+	req, err := NewRequest(buf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !req.DestAddr.IP.Equal(net.IPv6loopback) || len(req.DestAddr.IP) != net.IPv6len {
+		t.Fatalf("bad: %v", req.DestAddr)
+	}
+
+	resp := &MockConn{}
+	if err := s.handleRequest(req, resp); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The bind address is the IPv6 loopback
+	out := resp.buf.Bytes()
+	if out[1] != SuccessReply || out[3] != ipv6Address {
+		t.Fatalf("bad: %v", out)
+	}
+	if !bytes.Equal(out[4:20], net.IPv6loopback) || !bytes.HasSuffix(out, []byte("pong")) {
+		t.Fatalf("bad: %v", out)
+	}
+}
+
+func TestIPv6_PreferIPv6Reply(t *testing.T) {
+	s := &Server{config: &Config{PreferIPv6Reply: true}}
+	bind := &AddrSpec{IP: net.IPv4(10, 0, 0, 1), Port: 80}
+
+	// IPv4 clients get IPv4 replies
+	var out bytes.Buffer
+	req := &Request{RemoteAddr: &AddrSpec{IP: net.IPv4(10, 0, 0, 2), Port: 1234}}
+	if err := s.reply(&out, req, SuccessReply, bind); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.Equal(out.Bytes(), []byte{5, 0, 0, ipv4Address, 10, 0, 0, 1, 0, 80}) {
+		t.Fatalf("bad: %v", out.Bytes())
+	}
+
+	// IPv6 clients get the IPv4-mapped form
+	out.Reset()
+	req = &Request{RemoteAddr: &AddrSpec{IP: net.IPv6loopback, Port: 1234}}
+	if err := s.reply(&out, req, SuccessReply, bind); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expected := []byte{5, 0, 0, ipv6Address, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff, 10, 0, 0, 1, 0, 80}
+	if !bytes.Equal(out.Bytes(), expected) {
+		t.Fatalf("bad: %v", out.Bytes())
+	}
+
+	// Failures use the IPv6 unspecified address
+	out.Reset()
+	if err := s.reply(&out, req, HostUnreachable, nil); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expected = append([]byte{5, HostUnreachable, 0, ipv6Address}, make([]byte, 18)...)
+	if !bytes.Equal(out.Bytes(), expected) {
+		t.Fatalf("bad: %v", out.Bytes())
+	}
+}
+
+func TestIPv6_Zone(t *testing.T) {
+	a, err := ParseAddrSpec("[fe80::1%eth0]:80")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if a.FQDN != "" || a.Zone != "eth0" || !a.IP.Equal(net.ParseIP("fe80::1")) {
+		t.Fatalf("bad: %#v", a)
+	}
+	if a.Address() != "[fe80::1%eth0]:80" || a.String() != "[fe80::1%eth0]:80" {
+		t.Fatalf("bad: %v %v", a.Address(), a.String())
+	}
+
+	// The zone is not part of the wire format
+	b, err := a.MarshalBinary()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(b) != 1+net.IPv6len+2 || b[0] != ipv6Address {
+		t.Fatalf("bad: %v", b)
+	}
+}
+
+func TestIPv6_UDPDatagram(t *testing.T) {
+	d := &UDPDatagram{
+		DestAddr: &AddrSpec{IP: net.ParseIP("2001:db8::1"), Port: 53},
+		Data:     []byte("query"),
+	}
+	out, err := d.marshal()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out[3] != ipv6Address || len(out) != 3+1+net.IPv6len+2+5 {
+		t.Fatalf("bad: %v", out)
+	}
+
+	d2, err := readUDPDatagram(out)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !d2.DestAddr.IP.Equal(d.DestAddr.IP) || string(d2.Data) != "query" {
+		t.Fatalf("bad: %v", d2)
+	}
+
+	// IPv4-mapped sources, as seen on dual-stack sockets, are sent as IPv4
+	d.DestAddr.IP = net.ParseIP("::ffff:10.0.0.1")
+	out, err = d.marshal()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out[3] != ipv4Address || !bytes.Equal(out[4:8], []byte{10, 0, 0, 1}) {
+		t.Fatalf("bad: %v", out)
+	}
+}
@@ -0,0 +1,186 @@
+package socks5
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+const (
+	// labelOther replaces the values of a LabelTopN label
+	// which are not among the most frequent
+	labelOther = "other"
+
+	// defaultDestTopN bounds the dest label by default
+	defaultDestTopN = 100
+
+	// minLabelTracked is the least number of values tracked
+	// to rank those of a LabelTopN label
+	minLabelTracked = 64
+)
+
+// LabelMode selects how the values of a metric label are reported
+type LabelMode uint8
+
+const (
+	// LabelRaw reports the values as is
+	LabelRaw LabelMode = iota
+	// LabelTopN reports the N most frequent values as is,
+	// and the others as "other"
+	LabelTopN
+	// LabelHash reports a short hash of the values, which keeps them
+	// apart without exposing them, but does not bound them
+	LabelHash
+	// LabelDisabled drops the label
+	LabelDisabled
+)
+
+// LabelLimit bounds the values reported for a metric label, such
+// as the user or dest labels, whose values are unbounded. Sinks such
+// as Prometheus keep a series for each value, so thousands of users
+// or destinations can exhaust them.
+type LabelLimit struct {
+	Mode LabelMode
+
+	// N is the number of values reported with LabelTopN
+	N int
+}
+
+// labelLimiter is a Metrics applying the LabelLimits to the
+// labels of the measurements, before passing them to the sink
+type labelLimiter struct {
+	sink   Metrics
+	limits map[string]LabelLimit
+
+	l   sync.Mutex
+	top map[string]*labelValues
+}
+
+// labelValues counts the values of a LabelTopN label
+type labelValues struct {
+	n      int
+	counts map[string]uint64
+}
+
+// newLabelLimiter is used to wrap the sink with the limits, adding the
+// default limit of the dest label. Measurements are discarded anyway
+// without a sink, so it returns nil.
+func newLabelLimiter(sink Metrics, limits map[string]LabelLimit) *labelLimiter {
+	if _, ok := sink.(NoopMetrics); ok || sink == nil {
+		return nil
+	}
+	m := &labelLimiter{
+		sink:   sink,
+		limits: map[string]LabelLimit{"dest": {Mode: LabelTopN, N: defaultDestTopN}},
+		top:    make(map[string]*labelValues),
+	}
+	for name, limit := range limits {
+		m.limits[name] = limit
+	}
+	return m
+}
+
+func (m *labelLimiter) IncrCounter(key []string, val float32, labels ...Label) {
+	m.sink.IncrCounter(key, val, m.limit(labels)...)
+}
+
+func (m *labelLimiter) SetGauge(key []string, val float32, labels ...Label) {
+	m.sink.SetGauge(key, val, m.limit(labels)...)
+}
+
+func (m *labelLimiter) AddSample(key []string, val float32, labels ...Label) {
+	m.sink.AddSample(key, val, m.limit(labels)...)
+}
+
+func (m *labelLimiter) MeasureSince(key []string, start time.Time, labels ...Label) {
+	m.sink.MeasureSince(key, start, m.limit(labels)...)
+}
+
+// limit returns the labels with their limits applied
+func (m *labelLimiter) limit(labels []Label) []Label {
+	var out []Label
+	for i, l := range labels {
+		limit, ok := m.limits[l.Name]
+		if !ok || limit.Mode == LabelRaw {
+			if out != nil {
+				out = append(out, l)
+			}
+			continue
+		}
+		if out == nil {
+			out = append(make([]Label, 0, len(labels)), labels[:i]...)
+		}
+		switch limit.Mode {
+		case LabelTopN:
+			l.Value = m.topValue(l.Name, l.Value, limit.N)
+		case LabelHash:
+			l.Value = hashLabel(l.Value)
+		case LabelDisabled:
+			continue
+		}
+		out = append(out, l)
+	}
+	if out == nil {
+		return labels
+	}
+	return out
+}
+
+// topValue is used to count a value of a LabelTopN label, returning
+// it if it is among the n most frequent values, or "other"
+func (m *labelLimiter) topValue(name, value string, n int) string {
+	m.l.Lock()
+	defer m.l.Unlock()
+	v, ok := m.top[name]
+	if !ok {
+		v = &labelValues{n: n, counts: make(map[string]uint64)}
+		m.top[name] = v
+	}
+	return v.add(value)
+}
+
+// add is used to count a value, returning it if it ranks among
+// the top values, or "other". The lock must be held.
+func (v *labelValues) add(value string) string {
+	if _, ok := v.counts[value]; !ok {
+		// Forget the least frequent value to bound the memory
+		max := 4 * v.n
+		if max < minLabelTracked {
+			max = minLabelTracked
+		}
+		if len(v.counts) >= max {
+			var victim string
+			var least uint64
+			for other, count := range v.counts {
+				if victim == "" || count < least {
+					victim, least = other, count
+				}
+			}
+			delete(v.counts, victim)
+		}
+	}
+	v.counts[value]++
+	count := v.counts[value]
+
+	higher := 0
+	for _, other := range v.counts {
+		if other > count {
+			higher++
+		}
+	}
+	if higher >= v.n {
+		return labelOther
+	}
+	return value
+}
+
+// hashLabel returns a short hash of a label value, keeping
+// empty values empty
+func hashLabel(value string) string {
+	if value == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:8])
+}
@@ -0,0 +1,92 @@
+package socks5
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// labelMetrics records the labels of the last counter
+type labelMetrics struct {
+	NoopMetrics
+	l      sync.Mutex
+	labels []Label
+}
+
+func (m *labelMetrics) IncrCounter(key []string, val float32, labels ...Label) {
+	m.l.Lock()
+	defer m.l.Unlock()
+	m.labels = labels
+}
+
+func (m *labelMetrics) last() []Label {
+	m.l.Lock()
+	defer m.l.Unlock()
+	return m.labels
+}
+
+func TestLabelLimiter(t *testing.T) {
+	sink := &labelMetrics{}
+	m := newLabelLimiter(sink, map[string]LabelLimit{
+		"user":   {Mode: LabelHash},
+		"method": {Mode: LabelDisabled},
+		"reply":  {Mode: LabelRaw},
+	})
+	m.IncrCounter([]string{"socks5", "reply"}, 1,
+		Label{Name: "user", Value: "foo"},
+		Label{Name: "method", Value: "2"},
+		Label{Name: "reply", Value: "0"})
+	labels := sink.last()
+	if len(labels) != 2 || labels[0].Value != hashLabel("foo") || labels[1] != (Label{Name: "reply", Value: "0"}) {
+		t.Fatalf("bad: %v", labels)
+	}
+
+	// Labels without limits are passed as is
+	in := []Label{{Name: "result", Value: "ok"}}
+	if out := m.limit(in); &out[0] != &in[0] {
+		t.Fatalf("bad: %v", out)
+	}
+
+	if newLabelLimiter(NoopMetrics{}, nil) != nil {
+		t.Fatalf("expected no limiter")
+	}
+}
+
+func TestLabelLimiter_TopN(t *testing.T) {
+	sink := &labelMetrics{}
+	m := newLabelLimiter(sink, map[string]LabelLimit{"dest": {Mode: LabelTopN, N: 2}})
+	dest := func(host string) string {
+		m.MeasureSince([]string{"socks5", "dial"}, time.Now(), Label{Name: "dest", Value: host})
+		m.IncrCounter([]string{"socks5", "dial"}, 1, Label{Name: "dest", Value: host})
+		return sink.last()[0].Value
+	}
+	for i := 0; i < 3; i++ {
+		dest("a.com")
+		dest("b.com")
+	}
+
+	// Rare destinations are reported as other
+	if v := dest("c.com"); v != "other" {
+		t.Fatalf("bad: %v", v)
+	}
+	if v := dest("a.com"); v != "a.com" {
+		t.Fatalf("bad: %v", v)
+	}
+
+	// Until they become frequent
+	for i := 0; i < 10; i++ {
+		dest("c.com")
+	}
+	if v := dest("c.com"); v != "c.com" {
+		t.Fatalf("bad: %v", v)
+	}
+
+	// The tracked values are bounded
+	for i := 0; i < 1000; i++ {
+		dest(fmt.Sprintf("%d.com", i))
+	}
+	if n := len(m.top["dest"].counts); n != minLabelTracked {
+		t.Fatalf("bad: %v", n)
+	}
+}
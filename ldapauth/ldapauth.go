@@ -0,0 +1,227 @@
+// Package ldapauth implements a socks5.CredentialStore authenticating
+// users with an LDAP bind, and surfacing their groups into the
+// AuthContext for the rules.
+package ldapauth
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/armon/go-socks5"
+	"github.com/go-ldap/ldap/v3"
+)
+
+const (
+	defaultPoolSize = 4
+	defaultTimeout  = 10 * time.Second
+)
+
+// Store checks credentials by binding as the user to an LDAP server.
+// Once bound, the groups of the user are looked up and added to the
+// AuthContext Payload as a comma separated "Groups" entry:
+//
+//	store := &ldapauth.Store{
+//		URL:         "ldaps://ldap.example.com",
+//		UserDN:      "uid=%s,ou=people,dc=example,dc=com",
+//		GroupBaseDN: "ou=groups,dc=example,dc=com",
+//		GroupFilter: "(member=%s)",
+//		Groups:      []string{"proxy-users"},
+//	}
+//	conf := &socks5.Config{Credentials: store}
+type Store struct {
+	// URL of the server, such as "ldaps://ldap.example.com:636"
+	// or "ldap://ldap.example.com"
+	URL string
+
+	// TLSConfig is used for ldaps URLs and StartTLS
+	TLSConfig *tls.Config
+
+	// StartTLS upgrades ldap URLs to TLS before binding
+	StartTLS bool
+
+	// UserDN is the DN of a user, with %s replaced by the escaped
+	// username, e.g. "uid=%s,ou=people,dc=example,dc=com"
+	UserDN string
+
+	// GroupBaseDN is searched for the groups of the user, using the
+	// GroupFilter with %s replaced by the escaped user DN, such as
+	// "(member=%s)". The common names of the groups are used.
+	// Groups are not looked up if empty.
+	GroupBaseDN string
+	GroupFilter string
+
+	// Groups restricts authentication to members of any of the
+	// groups. Defaults to allowing all users.
+	Groups []string
+
+	// PoolSize bounds the idle connections kept for reuse.
+	// Defaults to 4.
+	PoolSize int
+
+	// Timeout bounds dialing and each operation. Defaults to 10 seconds.
+	Timeout time.Duration
+
+	poolOnce sync.Once
+	pool     chan *ldap.Conn
+}
+
+// Ensure we implement the optional interface
+var _ socks5.AttributeCredentialStore = &Store{}
+
+func (s *Store) Valid(user, password string) bool {
+	_, valid := s.Attributes(user, password)
+	return valid
+}
+
+// Attributes binds as the user, returning their groups if valid
+func (s *Store) Attributes(user, password string) (map[string]string, bool) {
+	// An empty password is an unauthenticated bind, which
+	// succeeds on many servers without checking anything
+	if user == "" || password == "" {
+		return nil, false
+	}
+
+	conn, err := s.get()
+	if err != nil {
+		return nil, false
+	}
+	dn := fmt.Sprintf(s.UserDN, ldap.EscapeDN(user))
+	if err := conn.Bind(dn, password); err != nil {
+		// Keep the connection for rejected credentials only,
+		// other errors may have left it unusable
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			s.put(conn)
+		} else {
+			conn.Close()
+		}
+		return nil, false
+	}
+
+	groups, err := s.groups(conn, dn)
+	if err != nil {
+		conn.Close()
+		return nil, false
+	}
+	s.put(conn)
+	if !allowed(groups, s.Groups) {
+		return nil, false
+	}
+
+	attrs := map[string]string{"DN": dn}
+	if len(groups) > 0 {
+		attrs["Groups"] = strings.Join(groups, ",")
+	}
+	return attrs, true
+}
+
+// groups looks up the common names of the groups of a user
+func (s *Store) groups(conn *ldap.Conn, dn string) ([]string, error) {
+	if s.GroupBaseDN == "" {
+		return nil, nil
+	}
+	req := ldap.NewSearchRequest(
+		s.GroupBaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+		fmt.Sprintf(s.GroupFilter, ldap.EscapeFilter(dn)),
+		[]string{"cn"}, nil)
+	res, err := conn.Search(req)
+	if err != nil {
+		return nil, err
+	}
+	var groups []string
+	for _, entry := range res.Entries {
+		if cn := entry.GetAttributeValue("cn"); cn != "" {
+			groups = append(groups, cn)
+		}
+	}
+	return groups, nil
+}
+
+// allowed checks if any of the groups is required
+func allowed(groups, required []string) bool {
+	if len(required) == 0 {
+		return true
+	}
+	for _, g := range groups {
+		for _, r := range required {
+			if strings.EqualFold(g, r) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// get takes an idle connection from the pool, or dials a new one
+func (s *Store) get() (*ldap.Conn, error) {
+	s.init()
+	for {
+		select {
+		case conn := <-s.pool:
+			if conn.IsClosing() {
+				continue
+			}
+			return conn, nil
+		default:
+			return s.dial()
+		}
+	}
+}
+
+// put returns a connection to the pool, closing it if full
+func (s *Store) put(conn *ldap.Conn) {
+	select {
+	case s.pool <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+func (s *Store) init() {
+	s.poolOnce.Do(func() {
+		size := s.PoolSize
+		if size <= 0 {
+			size = defaultPoolSize
+		}
+		s.pool = make(chan *ldap.Conn, size)
+	})
+}
+
+func (s *Store) timeout() time.Duration {
+	if s.Timeout <= 0 {
+		return defaultTimeout
+	}
+	return s.Timeout
+}
+
+func (s *Store) dial() (*ldap.Conn, error) {
+	dialer := &net.Dialer{Timeout: s.timeout()}
+	conn, err := ldap.DialURL(s.URL, ldap.DialWithDialer(dialer), ldap.DialWithTLSConfig(s.TLSConfig))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to connect to %s: %v", s.URL, err)
+	}
+	conn.SetTimeout(s.timeout())
+	if s.StartTLS {
+		if err := conn.StartTLS(s.TLSConfig); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("Failed to start TLS with %s: %v", s.URL, err)
+		}
+	}
+	return conn, nil
+}
+
+// Close closes the idle connections
+func (s *Store) Close() error {
+	s.init()
+	for {
+		select {
+		case conn := <-s.pool:
+			conn.Close()
+		default:
+			return nil
+		}
+	}
+}
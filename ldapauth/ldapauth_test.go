@@ -0,0 +1,147 @@
+package ldapauth
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+)
+
+// fakeServer is a minimal LDAP server, accepting simple binds
+// with the passwords of users and listing their groups
+type fakeServer struct {
+	l         net.Listener
+	passwords map[string]string
+	groups    map[string][]string
+	conns     int32
+}
+
+func newFakeServer(t *testing.T) *fakeServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	s := &fakeServer{
+		l:         l,
+		passwords: map[string]string{"uid=foo,dc=example": "bar", "uid=baz,dc=example": "bar"},
+		groups:    map[string][]string{"uid=foo,dc=example": {"proxy-users", "admins"}},
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&s.conns, 1)
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeServer) serve(conn net.Conn) {
+	defer conn.Close()
+	var bound string
+	for {
+		p, err := ber.ReadPacket(conn)
+		if err != nil || len(p.Children) < 2 {
+			return
+		}
+		id := p.Children[0].Value.(int64)
+		op := p.Children[1]
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			dn := op.Children[1].Value.(string)
+			code := int64(ldap.LDAPResultInvalidCredentials)
+			if pass, ok := s.passwords[dn]; ok && pass == op.Children[2].Data.String() {
+				code, bound = ldap.LDAPResultSuccess, dn
+			}
+			conn.Write(response(id, ldap.ApplicationBindResponse, code).Bytes())
+		case ldap.ApplicationSearchRequest:
+			for _, g := range s.groups[bound] {
+				entry := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "")
+				entry.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "cn="+g, ""))
+				attrs := ber.NewSequence("")
+				attr := ber.NewSequence("")
+				attr.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "cn", ""))
+				vals := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "")
+				vals.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, g, ""))
+				attr.AppendChild(vals)
+				attrs.AppendChild(attr)
+				entry.AppendChild(attrs)
+				conn.Write(message(id, entry).Bytes())
+			}
+			conn.Write(response(id, ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess).Bytes())
+		default:
+			return
+		}
+	}
+}
+
+func message(id int64, op *ber.Packet) *ber.Packet {
+	p := ber.NewSequence("")
+	p.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, ""))
+	p.AppendChild(op)
+	return p
+}
+
+func response(id int64, tag ber.Tag, code int64) *ber.Packet {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "")
+	op.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, code, ""))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	return message(id, op)
+}
+
+func TestStore(t *testing.T) {
+	srv := newFakeServer(t)
+	defer srv.l.Close()
+
+	store := &Store{
+		URL:         "ldap://" + srv.l.Addr().String(),
+		UserDN:      "uid=%s,dc=example",
+		GroupBaseDN: "ou=groups,dc=example",
+		GroupFilter: "(member=%s)",
+	}
+	defer store.Close()
+
+	attrs, ok := store.Attributes("foo", "bar")
+	if !ok {
+		t.Fatalf("expect valid")
+	}
+	if attrs["Groups"] != "proxy-users,admins" || attrs["DN"] != "uid=foo,dc=example" {
+		t.Fatalf("bad: %v", attrs)
+	}
+	if store.Valid("foo", "baz") || store.Valid("nobody", "bar") {
+		t.Fatalf("expect invalid")
+	}
+
+	// Empty passwords are never sent to the server
+	if store.Valid("foo", "") {
+		t.Fatalf("expect invalid")
+	}
+
+	// Connections are reused
+	if n := atomic.LoadInt32(&srv.conns); n != 1 {
+		t.Fatalf("bad: %d", n)
+	}
+
+	// Members of other groups are rejected
+	store.Groups = []string{"Proxy-Users"}
+	if !store.Valid("foo", "bar") || store.Valid("baz", "bar") {
+		t.Fatalf("bad group check")
+	}
+}
+
+func TestStore_Unreachable(t *testing.T) {
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	addr := l.Addr().String()
+	l.Close()
+
+	store := &Store{URL: "ldap://" + addr, UserDN: "uid=%s,dc=example"}
+	if store.Valid("foo", "bar") {
+		t.Fatalf("expect invalid")
+	}
+}
@@ -0,0 +1,108 @@
+package socks5
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+var (
+	// ErrRequestTooLarge is returned when a client sends more than
+	// MaxRequestBytes before its request has been parsed
+	ErrRequestTooLarge = errors.New("Request exceeds maximum size")
+
+	// ErrPipelined is returned in StrictFraming mode when a client
+	// sends the next negotiation phase before receiving our reply
+	ErrPipelined = errors.New("Client sent data before the negotiation phase completed")
+)
+
+// limitedReader is used to bound the bytes a client can send during
+// the handshake. Unlike io.LimitReader it fails loudly once the
+// limit is exceeded, rather than returning EOF.
+type limitedReader struct {
+	r        io.Reader
+	n        int
+	exceeded bool
+}
+
+func (l *limitedReader) Read(b []byte) (int, error) {
+	if l.n <= 0 {
+		l.exceeded = true
+		return 0, ErrRequestTooLarge
+	}
+	if len(b) > l.n {
+		b = b[:l.n]
+	}
+	n, err := l.r.Read(b)
+	l.n -= n
+	return n, err
+}
+
+// resetConn is used to abort a connection with a TCP reset
+// instead of an orderly shutdown, once it is closed
+func resetConn(conn net.Conn) {
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		tcp.SetLinger(0)
+	}
+}
+
+// checkFraming is used in StrictFraming mode to verify the client did
+// not send more than the current negotiation phase. As a compliant
+// client waits for our reply, nothing may be buffered at this point.
+func (s *Server) checkFraming(bufConn *bufio.Reader, phase HandshakePhase) error {
+	if !s.config.StrictFraming || bufConn.Buffered() == 0 {
+		return nil
+	}
+	s.metrics().IncrCounter([]string{"socks5", "handshake", "pipelined"}, 1)
+	return fmt.Errorf("%w: %d bytes after %v", ErrPipelined, bufConn.Buffered(), phase)
+}
+
+// checkReserved is used to validate a reserved field of the protocol,
+// which RFC 1928 requires to be zero. Violations are always counted,
+// but only rejected unless LenientRSV is set.
+func (s *Server) checkReserved(field string, rsv uint16) error {
+	if rsv == 0 {
+		return nil
+	}
+	s.metrics().IncrCounter([]string{"socks5", "protocol", "violation"}, 1, Label{Name: "field", Value: field})
+	if s.config.LenientRSV {
+		return nil
+	}
+	return fmt.Errorf("Reserved field of %s is not zero: %#x", field, rsv)
+}
+
+// phaseDeadlines is used to set the read deadline of each phase of the
+// handshake, bounded by the deadline of the handshake as a whole
+type phaseDeadlines struct {
+	conn    net.Conn
+	overall time.Time
+	current time.Time
+}
+
+// start sets the read deadline for the next phase. A zero
+// timeout leaves the phase bounded by the overall deadline.
+func (d *phaseDeadlines) start(timeout time.Duration) {
+	next := d.overall
+	if timeout > 0 {
+		if t := time.Now().Add(timeout); next.IsZero() || t.Before(next) {
+			next = t
+		}
+	}
+	if !next.Equal(d.current) {
+		d.current = next
+		d.conn.SetReadDeadline(next)
+	}
+}
+
+// used checks if any deadline was set on the connection
+func (d *phaseDeadlines) used() bool {
+	return !d.overall.IsZero() || !d.current.IsZero()
+}
+
+// expired checks if the deadline of the current phase has passed
+func (d *phaseDeadlines) expired() bool {
+	return !d.current.IsZero() && !time.Now().Before(d.current)
+}
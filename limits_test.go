@@ -0,0 +1,128 @@
+package socks5
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestLimitedReader(t *testing.T) {
+	l := &limitedReader{r: bytes.NewReader([]byte("hello world")), n: 5}
+
+	buf := make([]byte, 16)
+	n, err := l.Read(buf)
+	if err != nil || n != 5 {
+		t.Fatalf("bad: %v %v", n, err)
+	}
+	if _, err := l.Read(buf); err != ErrRequestTooLarge {
+		t.Fatalf("err: %v", err)
+	}
+	if !l.exceeded {
+		t.Fatalf("expected exceeded")
+	}
+}
+
+func TestSOCKS5_MaxRequestBytes(t *testing.T) {
+	serv, _ := New(&Config{
+		Credentials:     StaticCredentials{"foo": "bar"},
+		MaxRequestBytes: 8,
+	})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	go serv.Serve(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+
+	// The credentials push the handshake over the limit
+	req := bytes.NewBuffer(nil)
+	req.Write([]byte{5, 1, UserPassAuth})
+	req.Write([]byte{1, 3, 'f', 'o', 'o', 3, 'b', 'a', 'r'})
+	conn.Write(req.Bytes())
+
+	// Only the method selection should be received
+	conn.SetDeadline(time.Now().Add(time.Second))
+	out, err := io.ReadAll(conn)
+	if !bytes.Equal(out, []byte{socks5Version, UserPassAuth}) {
+		t.Fatalf("bad: %v", out)
+	}
+	if err == nil {
+		t.Fatalf("expected reset")
+	}
+}
+
+func TestSOCKS5_StrictFraming(t *testing.T) {
+	serv, _ := New(&Config{
+		Credentials:   StaticCredentials{"foo": "bar"},
+		Rules:         PermitNone(),
+		StrictFraming: true,
+	})
+	greeting := []byte{5, 1, UserPassAuth}
+	login := []byte{1, 3, 'f', 'o', 'o', 3, 'b', 'a', 'r'}
+	request := []byte{5, ConnectCommand, 0, ipv4Address, 10, 0, 0, 1, 0, 80}
+
+	// A client pipelining the credentials is rejected
+	client, server := net.Pipe()
+	errCh := make(chan error, 1)
+	go func() { errCh <- serv.ServeConn(server) }()
+	go client.Write(append(append([]byte{}, greeting...), login...))
+	client.SetDeadline(time.Now().Add(time.Second))
+	if out, _ := io.ReadAll(client); len(out) != 0 {
+		t.Fatalf("bad: %v", out)
+	}
+	if err := <-errCh; !errors.Is(err, ErrPipelined) {
+		t.Fatalf("err: %v", err)
+	}
+	client.Close()
+
+	// A client waiting for each reply is served
+	client, server = net.Pipe()
+	defer client.Close()
+	go serv.ServeConn(server)
+	client.SetDeadline(time.Now().Add(time.Second))
+	expect := [][]byte{
+		{socks5Version, UserPassAuth},
+		{userAuthVersion, authSuccess},
+		{socks5Version, RuleFailure, 0, ipv4Address, 0, 0, 0, 0, 0, 0},
+	}
+	for i, msg := range [][]byte{greeting, login, request} {
+		if _, err := client.Write(msg); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		out := make([]byte, len(expect[i]))
+		if _, err := io.ReadFull(client, out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if !bytes.Equal(out, expect[i]) {
+			t.Fatalf("bad: %v", out)
+		}
+	}
+}
+
+func TestCheckReserved(t *testing.T) {
+	metrics := newTestMetrics()
+	s := &Server{config: &Config{Metrics: metrics}}
+	if err := s.checkReserved("request", 0); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := s.checkReserved("request", 1); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	s.config.LenientRSV = true
+	if err := s.checkReserved("datagram", 0x0100); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if metrics.counter("socks5.protocol.violation") != 2 {
+		t.Fatalf("bad: %v", metrics.counters)
+	}
+}
@@ -0,0 +1,191 @@
+package socks5
+
+import (
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+var (
+	// ErrListenerRemoved is returned by Serve once
+	// its listener was removed with RemoveListener
+	ErrListenerRemoved = errors.New("socks: Listener removed")
+
+	// ErrUnknownListener is returned by RemoveListener
+	// for listeners which are not being served
+	ErrUnknownListener = errors.New("socks: Unknown listener")
+)
+
+// servedListener tracks the connections accepted from a listener.
+// It is guarded by the lock of the serverState.
+type servedListener struct {
+	conns   map[io.Closer]struct{}
+	removed bool
+
+	// done is closed once the listener stops accepting,
+	// to stop waiting for a connection slot
+	done    chan struct{}
+	stopped bool
+}
+
+func newServedListener() *servedListener {
+	return &servedListener{
+		conns: make(map[io.Closer]struct{}),
+		done:  make(chan struct{}),
+	}
+}
+
+// stop is used to close done once
+func (sl *servedListener) stop() {
+	if !sl.stopped {
+		sl.stopped = true
+		close(sl.done)
+	}
+}
+
+// assign is used to record the listener a connection was accepted
+// from, and if it holds a connection slot
+func (st *serverState) assign(c io.Closer, sl *servedListener, slot bool) {
+	if st == nil {
+		return
+	}
+	st.l.Lock()
+	defer st.l.Unlock()
+	sl.conns[c] = struct{}{}
+	st.served[c] = sl
+	if slot {
+		st.slotted[c] = struct{}{}
+	}
+}
+
+// release is used to forget the listener of a connection once closed
+func (st *serverState) release(c io.Closer) {
+	if st == nil {
+		return
+	}
+	st.l.Lock()
+	defer st.l.Unlock()
+	if sl, ok := st.served[c]; ok {
+		delete(sl.conns, c)
+		delete(st.served, c)
+	}
+	if _, ok := st.slotted[c]; ok {
+		delete(st.slotted, c)
+		st.releaseSlot()
+	}
+}
+
+// isRemoved returns if the listener was removed with RemoveListener
+func (st *serverState) isRemoved(sl *servedListener) bool {
+	if st == nil {
+		return false
+	}
+	st.l.Lock()
+	defer st.l.Unlock()
+	return sl.removed
+}
+
+// AddListener starts serving connections from a listener in the
+// background, for example to open a temporary debug port on a
+// running server. Errors of the listener are logged.
+func (s *Server) AddListener(l net.Listener) error {
+	sl := s.state.trackListener(l, true)
+	if sl == nil {
+		return ErrServerClosed
+	}
+	s.spawn("listener", func() {
+		err := s.serve(l, sl)
+		if err != ErrServerClosed && err != ErrListenerRemoved {
+			s.logf(LogError, "Listener %v failed: %v", l.Addr(), err)
+		}
+	})
+	return nil
+}
+
+// RemoveListener stops accepting connections from a listener, closing
+// it, and then waits for the connections accepted from it to finish.
+// Connections of other listeners are not affected. If the context
+// expires first, the remaining connections are force closed and the
+// context error is returned.
+func (s *Server) RemoveListener(ctx context.Context, l net.Listener) error {
+	st := s.state
+	st.l.Lock()
+	sl, ok := st.listeners[l]
+	if ok {
+		sl.removed = true
+		sl.stop()
+	}
+	st.l.Unlock()
+	if !ok {
+		return ErrUnknownListener
+	}
+	l.Close()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		st.l.Lock()
+		active := len(sl.conns)
+		st.l.Unlock()
+		if active == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			st.l.Lock()
+			for c := range sl.conns {
+				c.Close()
+			}
+			st.l.Unlock()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// acquireSlot is used to wait for a connection slot before serving
+// an accepted client, with MaxConcurrentConnections, returning if a
+// slot is held. It fails once the listener stops.
+func (s *Server) acquireSlot(sl *servedListener) (slot bool, ok bool) {
+	max := s.config.MaxConcurrentConnections
+	st := s.state
+	if max <= 0 || st == nil {
+		return false, true
+	}
+	st.l.Lock()
+	if st.slots == nil {
+		st.slots = make(chan struct{}, max)
+	}
+	slots := st.slots
+	st.l.Unlock()
+
+	select {
+	case slots <- struct{}{}:
+		return true, true
+	default:
+	}
+	s.metrics().IncrCounter([]string{"socks5", "accept", "limited"}, 1)
+	start := time.Now()
+	select {
+	case slots <- struct{}{}:
+		s.metrics().MeasureSince([]string{"socks5", "accept", "wait"}, start)
+		return true, true
+	case <-sl.done:
+		return false, false
+	}
+}
+
+// releaseSlot is used to free the slot of a closed connection.
+// The lock must be held.
+func (st *serverState) releaseSlot() {
+	if st.slots == nil {
+		return
+	}
+	select {
+	case <-st.slots:
+	default:
+	}
+}
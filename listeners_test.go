@@ -0,0 +1,146 @@
+package socks5
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestServer_AddRemoveListener(t *testing.T) {
+	serv, _ := New(&Config{})
+	defer serv.Close()
+
+	listen := func() net.Listener {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if err := serv.AddListener(l); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		return l
+	}
+	greet := func(l net.Listener) net.Conn {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		conn.SetDeadline(time.Now().Add(time.Second))
+		conn.Write([]byte{5, 1, NoAuth})
+		out := make([]byte, 2)
+		if _, err := io.ReadFull(conn, out); err != nil || !bytes.Equal(out, []byte{5, NoAuth}) {
+			t.Fatalf("bad: %v %v", out, err)
+		}
+		return conn
+	}
+	l1, l2 := listen(), listen()
+
+	// A client of the removed listener is drained
+	conn := greet(l1)
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		conn.Close()
+	}()
+	if err := serv.RemoveListener(context.Background(), l1); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := net.Dial("tcp", l1.Addr().String()); err == nil {
+		t.Fatalf("expected listener closed")
+	}
+	if err := serv.RemoveListener(context.Background(), l1); err != ErrUnknownListener {
+		t.Fatalf("err: %v", err)
+	}
+
+	// A client still open when the drain expires is force closed,
+	// while the clients of other listeners are not affected
+	conn2 := greet(l2)
+	defer conn2.Close()
+	l3 := listen()
+	conn3 := greet(l3)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := serv.RemoveListener(ctx, l3); err != context.DeadlineExceeded {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := conn3.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("err: %v", err)
+	}
+	conn2.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	if _, err := conn2.Read(make([]byte, 1)); err == io.EOF {
+		t.Fatalf("expected conn open")
+	}
+	greet(l2).Close()
+}
+
+func TestServer_MaxConcurrentConnections(t *testing.T) {
+	metrics := newTestMetrics()
+	serv, _ := New(&Config{MaxConcurrentConnections: 1, Metrics: metrics})
+	listen := func() net.Listener {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if err := serv.AddListener(l); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		return l
+	}
+	dial := func(l net.Listener) net.Conn {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		conn.Write([]byte{5, 1, NoAuth})
+		return conn
+	}
+	greeted := func(conn net.Conn, timeout time.Duration) bool {
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		out := make([]byte, 2)
+		_, err := io.ReadFull(conn, out)
+		return err == nil && bytes.Equal(out, []byte{5, NoAuth})
+	}
+	l1, l2 := listen(), listen()
+
+	first := dial(l1)
+	if !greeted(first, time.Second) {
+		t.Fatalf("expected greeting")
+	}
+
+	// The limit applies across listeners, the client
+	// waits in the backlog until the first one closes
+	second := dial(l2)
+	defer second.Close()
+	if greeted(second, 100*time.Millisecond) {
+		t.Fatalf("expected no greeting")
+	}
+	first.Close()
+	if !greeted(second, time.Second) {
+		t.Fatalf("expected greeting")
+	}
+	if metrics.counter("socks5.accept.limited") == 0 {
+		t.Fatalf("expected limited accept")
+	}
+
+	// Waiting listeners stop on shutdown
+	done := make(chan struct{})
+	go func() {
+		serv.Close()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("timeout")
+	}
+	deadline := time.Now().Add(time.Second)
+	for serv.Debug().Goroutines["listener"] != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("bad: %v", serv.Debug().Goroutines)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
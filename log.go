@@ -0,0 +1,93 @@
+package socks5
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync/atomic"
+
+	"golang.org/x/net/context"
+)
+
+// LogLevel is the minimum severity of the messages logged
+type LogLevel uint8
+
+const (
+	// LogDebug logs all messages
+	LogDebug LogLevel = iota
+	// LogInfo logs informational messages, warnings and errors
+	LogInfo
+	// LogWarn logs warnings and errors
+	LogWarn
+	// LogError logs only errors
+	LogError
+	// LogOff disables logging
+	LogOff
+)
+
+func (l LogLevel) String() string {
+	switch l {
+	case LogDebug:
+		return "DEBUG"
+	case LogInfo:
+		return "INFO"
+	case LogWarn:
+		return "WARN"
+	case LogError:
+		return "ERR"
+	case LogOff:
+		return "OFF"
+	}
+	return "unknown"
+}
+
+// newDefaultLogger returns the logger used when none is configured
+func newDefaultLogger() *log.Logger {
+	return log.New(os.Stdout, "", log.LstdFlags)
+}
+
+// logf is used to log a message at the given level through the
+// configured Logger. All the output of the server goes through it.
+func (s *Server) logf(level LogLevel, format string, args ...interface{}) {
+	if level < s.config.LogLevel {
+		return
+	}
+	s.output(level, fmt.Sprintf(format, args...))
+}
+
+func (s *Server) output(level LogLevel, msg string) {
+	logger := s.config.Logger
+	if logger == nil {
+		logger = newDefaultLogger()
+	}
+	logger.Printf("[%s] socks: %s", level, msg)
+}
+
+// SetTrace enables or disables the debug trace of the protocol
+// phases of each connection, see Config.Trace. It takes effect
+// immediately, also for the connections being served.
+func (s *Server) SetTrace(enabled bool) {
+	if s.state == nil {
+		return
+	}
+	var v int32
+	if enabled {
+		v = 1
+	}
+	atomic.StoreInt32(&s.state.trace, v)
+}
+
+// tracing checks if the debug trace is enabled
+func (s *Server) tracing() bool {
+	return s.state != nil && atomic.LoadInt32(&s.state.trace) == 1
+}
+
+// tracef is used to log a protocol phase of a connection in the
+// debug trace. Traces are logged regardless of the LogLevel.
+func (s *Server) tracef(ctx context.Context, phase string, format string, args ...interface{}) {
+	if !s.tracing() {
+		return
+	}
+	id, _ := ConnIDFromContext(ctx)
+	s.output(LogDebug, fmt.Sprintf("conn %d: %s: %s", id, phase, fmt.Sprintf(format, args...)))
+}
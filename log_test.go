@@ -0,0 +1,90 @@
+package socks5
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestServer_LogLevel(t *testing.T) {
+	var buf bytes.Buffer
+	s := &Server{config: &Config{
+		Logger:   log.New(&buf, "", 0),
+		LogLevel: LogWarn,
+	}}
+	s.logf(LogInfo, "hidden %d", 1)
+	s.logf(LogError, "shown %d", 2)
+	if out := buf.String(); out != "[ERR] socks: shown 2\n" {
+		t.Fatalf("bad: %q", out)
+	}
+
+	s.config.LogLevel = LogOff
+	s.logf(LogError, "hidden")
+	if buf.Len() != len("[ERR] socks: shown 2\n") {
+		t.Fatalf("bad: %q", buf.String())
+	}
+}
+
+func TestServer_Trace(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		conn.Write([]byte("pong"))
+		conn.Close()
+	}()
+	lAddr := l.Addr().(*net.TCPAddr)
+
+	var buf bytes.Buffer
+	serv, _ := New(&Config{
+		Logger:   log.New(&buf, "", 0),
+		LogLevel: LogOff,
+		Trace:    true,
+	})
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		serv.ServeConn(server)
+	}()
+
+	req := []byte{5, 1, NoAuth, 5, 1, 0, 1, 127, 0, 0, 1, 0, 0}
+	binary.BigEndian.PutUint16(req[len(req)-2:], uint16(lAddr.Port))
+	client.Write(req)
+	out := make([]byte, 10+4)
+	if _, err := io.ReadFull(client, out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	client.Close()
+	<-done
+
+	trace := buf.String()
+	for _, phase := range []string{"greeting", "auth", "request", "dial", "relay: started", "relay: stopped"} {
+		if !strings.Contains(trace, ": "+phase) {
+			t.Fatalf("missing %s: %s", phase, trace)
+		}
+	}
+	if !strings.Contains(trace, "4 bytes down") || !strings.HasPrefix(trace, "[DEBUG] socks: conn ") {
+		t.Fatalf("bad: %s", trace)
+	}
+
+	// Tracing can be disabled at runtime
+	serv.SetTrace(false)
+	n := len(buf.String())
+	serv.tracef(context.Background(), "greeting", "hidden")
+	if len(buf.String()) != n {
+		t.Fatalf("bad: %s", buf.String())
+	}
+}
@@ -0,0 +1,41 @@
+package socks5
+
+import (
+	"time"
+)
+
+// Label is a name/value pair attached to a measurement
+type Label struct {
+	Name  string
+	Value string
+}
+
+// Metrics is used to export measurements from the server.
+// It mirrors the go-metrics sink API so existing sinks are
+// easy to adapt.
+type Metrics interface {
+	IncrCounter(key []string, val float32, labels ...Label)
+	SetGauge(key []string, val float32, labels ...Label)
+	AddSample(key []string, val float32, labels ...Label)
+	MeasureSince(key []string, start time.Time, labels ...Label)
+}
+
+// NoopMetrics discards all measurements
+type NoopMetrics struct{}
+
+func (NoopMetrics) IncrCounter(key []string, val float32, labels ...Label)      {}
+func (NoopMetrics) SetGauge(key []string, val float32, labels ...Label)         {}
+func (NoopMetrics) AddSample(key []string, val float32, labels ...Label)        {}
+func (NoopMetrics) MeasureSince(key []string, start time.Time, labels ...Label) {}
+
+// metrics returns the configured Metrics, applying the LabelLimits,
+// or a NoopMetrics
+func (s *Server) metrics() Metrics {
+	if s.config.Metrics == nil {
+		return NoopMetrics{}
+	}
+	if s.labels != nil {
+		return s.labels
+	}
+	return s.config.Metrics
+}
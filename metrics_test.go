@@ -0,0 +1,110 @@
+package socks5
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testMetrics records the keys it receives
+type testMetrics struct {
+	l        sync.Mutex
+	counters map[string]float32
+	gauges   map[string]float32
+	samples  map[string]int
+}
+
+func newTestMetrics() *testMetrics {
+	return &testMetrics{
+		counters: make(map[string]float32),
+		gauges:   make(map[string]float32),
+		samples:  make(map[string]int),
+	}
+}
+
+func (m *testMetrics) IncrCounter(key []string, val float32, labels ...Label) {
+	m.l.Lock()
+	defer m.l.Unlock()
+	m.counters[strings.Join(key, ".")] += val
+}
+
+func (m *testMetrics) SetGauge(key []string, val float32, labels ...Label) {
+	m.l.Lock()
+	defer m.l.Unlock()
+	m.gauges[strings.Join(key, ".")] = val
+}
+
+func (m *testMetrics) AddSample(key []string, val float32, labels ...Label) {
+	m.l.Lock()
+	defer m.l.Unlock()
+	m.samples[strings.Join(key, ".")]++
+}
+
+func (m *testMetrics) MeasureSince(key []string, start time.Time, labels ...Label) {
+	m.AddSample(key, float32(time.Since(start)), labels...)
+}
+
+func (m *testMetrics) counter(key string) float32 {
+	m.l.Lock()
+	defer m.l.Unlock()
+	return m.counters[key]
+}
+
+func (m *testMetrics) sampled(key string) int {
+	m.l.Lock()
+	defer m.l.Unlock()
+	return m.samples[key]
+}
+
+func TestMetrics_Phases(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte("pong"))
+	}()
+	lAddr := l.Addr().(*net.TCPAddr)
+
+	m := newTestMetrics()
+	s := &Server{config: &Config{
+		Rules:    PermitAll(),
+		Resolver: DNSResolver{},
+		Logger:   log.New(os.Stdout, "", log.LstdFlags),
+		Metrics:  m,
+	}}
+
+	buf := bytes.NewBuffer(nil)
+	buf.Write([]byte{5, 1, 0, 3, 9})
+	buf.Write([]byte("localhost"))
+	port := []byte{0, 0}
+	binary.BigEndian.PutUint16(port, uint16(lAddr.Port))
+	buf.Write(port)
+
+	req, err := NewRequest(buf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := s.handleRequest(req, &MockConn{}); err != nil && err != io.EOF {
+		t.Fatalf("err: %v", err)
+	}
+
+	for _, key := range []string{"socks5.resolve", "socks5.dial", "socks5.first_byte"} {
+		if m.sampled(key) != 1 {
+			t.Fatalf("missing %s: %v", key, m.samples)
+		}
+	}
+}
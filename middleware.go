@@ -0,0 +1,177 @@
+package socks5
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Middleware is a stage of request processing, wrapped around the
+// next handler. Stages run after the client authenticated and the
+// destination was resolved and rewritten, and before the command is
+// served, which for the builtin commands checks the Rules and dials.
+// A stage may enrich the context, wrap the connection or reject the
+// request, in which case it is responsible for the reply, see
+// SendReply.
+type Middleware func(next CommandHandler) CommandHandler
+
+// chain is used to compose the middleware around the core
+// handler, the first being the outermost stage
+func chain(core CommandHandler, layers []Middleware) CommandHandler {
+	h := core
+	for i := len(layers) - 1; i >= 0; i-- {
+		h = layers[i](h)
+	}
+	return h
+}
+
+// serveMiddleware is used to serve a request through the middleware
+// of the Config, with the command as the core handler
+func (s *Server) serveMiddleware(ctx context.Context, conn conn, req *Request) error {
+	nc, ok := conn.(net.Conn)
+	if !ok {
+		return fmt.Errorf("Middleware requires a net.Conn")
+	}
+	if req.bufConn != nil {
+		nc = &bufferedConn{Conn: nc, r: req.bufConn}
+	}
+	core := CommandHandlerFunc(func(ctx context.Context, req *Request, c net.Conn) error {
+		// Use the original connection unless a stage wrapped it,
+		// which then sees both directions
+		if c == nc {
+			return s.serveCommand(ctx, conn, req)
+		}
+		req.bufConn = c
+		return s.serveCommand(ctx, c, req)
+	})
+	return chain(core, s.config.Middleware).Handle(ctx, req, nc)
+}
+
+// Builder composes a Server from layers, as an alternative to filling
+// in a Config. Auth runs in the handshake and the Rules are checked
+// with the final destination when serving the command, while the
+// stages added with Use, Logging, Metrics and Limit run in between,
+// in the order they are added.
+type Builder struct {
+	conf   Config
+	layers []func(s *Server) Middleware
+}
+
+// NewBuilder creates a Builder starting from the default Config
+func NewBuilder() *Builder {
+	return &Builder{}
+}
+
+// Config returns the Config being built, to set the options
+// which have no method of their own
+func (b *Builder) Config() *Config {
+	return &b.conf
+}
+
+// Auth sets the auth methods offered in the handshake
+func (b *Builder) Auth(methods ...Authenticator) *Builder {
+	b.conf.AuthMethods = methods
+	return b
+}
+
+// Rules sets the RuleSet checked when serving the builtin commands
+func (b *Builder) Rules(rules RuleSet) *Builder {
+	b.conf.Rules = rules
+	return b
+}
+
+// Logger sets the log target and minimum level of the server
+func (b *Builder) Logger(logger *log.Logger, level LogLevel) *Builder {
+	b.conf.Logger = logger
+	b.conf.LogLevel = level
+	return b
+}
+
+// Use adds stages of request processing
+func (b *Builder) Use(mw ...Middleware) *Builder {
+	for _, m := range mw {
+		m := m
+		b.layers = append(b.layers, func(*Server) Middleware { return m })
+	}
+	return b
+}
+
+// Logging adds a stage logging each request, with its outcome and
+// duration, at LogInfo
+func (b *Builder) Logging() *Builder {
+	b.layers = append(b.layers, func(s *Server) Middleware {
+		return func(next CommandHandler) CommandHandler {
+			return CommandHandlerFunc(func(ctx context.Context, req *Request, conn net.Conn) error {
+				start := time.Now()
+				err := next.Handle(ctx, req, conn)
+				reason := s.closeReason(req, err)
+				if err != nil {
+					s.logf(LogInfo, "Command %d from %v to %v (%s) failed after %v, %v: %v", req.Command, req.RemoteAddr, req.DestAddr, req.addrKind(), time.Since(start), reason, err)
+				} else {
+					s.logf(LogInfo, "Command %d from %v to %v (%s) done after %v, %v", req.Command, req.RemoteAddr, req.DestAddr, req.addrKind(), time.Since(start), reason)
+				}
+				return err
+			})
+		}
+	})
+	return b
+}
+
+// Metrics sets the metrics sink and adds a stage counting and timing
+// the requests by command and address type, as socks5.request
+func (b *Builder) Metrics(m Metrics) *Builder {
+	b.conf.Metrics = m
+	b.layers = append(b.layers, func(s *Server) Middleware {
+		return func(next CommandHandler) CommandHandler {
+			return CommandHandlerFunc(func(ctx context.Context, req *Request, conn net.Conn) error {
+				start := time.Now()
+				labels := []Label{
+					{Name: "command", Value: fmt.Sprint(req.Command)},
+					{Name: "addr", Value: req.addrKind()},
+				}
+				s.metrics().IncrCounter([]string{"socks5", "request"}, 1, labels...)
+				defer s.metrics().MeasureSince([]string{"socks5", "request"}, start, labels...)
+				return next.Handle(ctx, req, conn)
+			})
+		}
+	})
+	return b
+}
+
+// Limit adds a stage bounding the requests served at once, replying
+// ServerFailure to the requests beyond it
+func (b *Builder) Limit(max int) *Builder {
+	b.layers = append(b.layers, func(s *Server) Middleware {
+		var active int64
+		return func(next CommandHandler) CommandHandler {
+			return CommandHandlerFunc(func(ctx context.Context, req *Request, conn net.Conn) error {
+				defer atomic.AddInt64(&active, -1)
+				if atomic.AddInt64(&active, 1) > int64(max) {
+					s.metrics().IncrCounter([]string{"socks5", "request", "limited"}, 1)
+					if err := s.codec().WriteReply(conn, req, ServerFailure, nil); err != nil {
+						return fmt.Errorf("Failed to send reply: %v", err)
+					}
+					return fmt.Errorf("Request of %v exceeds the limit of %d", req.RemoteAddr, max)
+				}
+				return next.Handle(ctx, req, conn)
+			})
+		}
+	})
+	return b
+}
+
+// Build creates the Server. The Builder must not be used afterwards.
+func (b *Builder) Build() (*Server, error) {
+	s, err := New(&b.conf)
+	if err != nil {
+		return nil, err
+	}
+	for _, layer := range b.layers {
+		s.config.Middleware = append(s.config.Middleware, layer(s))
+	}
+	return s, nil
+}
@@ -0,0 +1,193 @@
+package socks5
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+type stageKey struct{}
+
+// stageRules records the stage seen in the context
+type stageRules struct {
+	seen interface{}
+}
+
+func (r *stageRules) Allow(ctx context.Context, req *Request) (context.Context, bool) {
+	r.seen = ctx.Value(stageKey{})
+	return ctx, true
+}
+
+// echoTarget starts a TCP server echoing each connection
+func echoTarget(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return l
+}
+
+// connectThrough sends a CONNECT to target through the server at
+// addr, returning the connection and the reply code
+func connectThrough(t *testing.T, addr, target net.Addr) (net.Conn, uint8) {
+	conn, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	conn.SetDeadline(time.Now().Add(time.Second))
+	tAddr := target.(*net.TCPAddr)
+	conn.Write([]byte{5, 1, NoAuth, 5, ConnectCommand, 0, ipv4Address, 127, 0, 0, 1, byte(tAddr.Port >> 8), byte(tAddr.Port)})
+	if _, err := io.ReadFull(conn, make([]byte, 2)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp, _, err := ReadReply(conn)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return conn, resp
+}
+
+func TestBuilder_Middleware(t *testing.T) {
+	target := echoTarget(t)
+	defer target.Close()
+
+	var order []string
+	stage := func(name string) Middleware {
+		return func(next CommandHandler) CommandHandler {
+			return CommandHandlerFunc(func(ctx context.Context, req *Request, conn net.Conn) error {
+				order = append(order, name)
+				return next.Handle(context.WithValue(ctx, stageKey{}, name), req, conn)
+			})
+		}
+	}
+	rules := &stageRules{}
+	metrics := newTestMetrics()
+	serv, err := NewBuilder().
+		Auth(&NoAuthAuthenticator{}).
+		Use(stage("a"), stage("b")).
+		Metrics(metrics).
+		Rules(rules).
+		Build()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	go serv.Serve(l)
+
+	conn, resp := connectThrough(t, l.Addr(), target.Addr())
+	defer conn.Close()
+	if resp != SuccessReply {
+		t.Fatalf("bad: %v", resp)
+	}
+	conn.Write([]byte("ping"))
+	out := make([]byte, 4)
+	if _, err := io.ReadFull(conn, out); err != nil || !bytes.Equal(out, []byte("ping")) {
+		t.Fatalf("bad: %v %v", out, err)
+	}
+
+	// The stages ran in order, before the rules
+	if fmt.Sprint(order) != "[a b]" || rules.seen != "b" {
+		t.Fatalf("bad: %v %v", order, rules.seen)
+	}
+	if metrics.counter("socks5.request") != 1 {
+		t.Fatalf("bad: %v", metrics.counters)
+	}
+}
+
+func TestBuilder_Reject(t *testing.T) {
+	target := echoTarget(t)
+	defer target.Close()
+
+	reject := func(next CommandHandler) CommandHandler {
+		return CommandHandlerFunc(func(ctx context.Context, req *Request, conn net.Conn) error {
+			if err := SendReply(conn, RuleFailure, nil); err != nil {
+				return err
+			}
+			return fmt.Errorf("rejected")
+		})
+	}
+	dialed := false
+	b := NewBuilder().Use(reject)
+	b.Config().Dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialed = true
+		return net.Dial(network, addr)
+	}
+	serv, err := b.Build()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	go serv.Serve(l)
+
+	conn, resp := connectThrough(t, l.Addr(), target.Addr())
+	defer conn.Close()
+	if resp != RuleFailure || dialed {
+		t.Fatalf("bad: %v %v", resp, dialed)
+	}
+}
+
+func TestBuilder_Limit(t *testing.T) {
+	target := echoTarget(t)
+	defer target.Close()
+
+	serv, err := NewBuilder().Limit(1).Build()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	go serv.Serve(l)
+
+	first, resp := connectThrough(t, l.Addr(), target.Addr())
+	if resp != SuccessReply {
+		t.Fatalf("bad: %v", resp)
+	}
+	second, resp := connectThrough(t, l.Addr(), target.Addr())
+	second.Close()
+	if resp != ServerFailure {
+		t.Fatalf("bad: %v", resp)
+	}
+
+	// The limit is released once the relay ends
+	first.Close()
+	deadline := time.Now().Add(time.Second)
+	for {
+		conn, resp := connectThrough(t, l.Addr(), target.Addr())
+		conn.Close()
+		if resp == SuccessReply {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("bad: %v", resp)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,7 @@
+// Package pamauth implements a socks5.CredentialStore validating
+// credentials against PAM, so the proxy can authenticate local system
+// accounts. It requires cgo and the PAM headers, and is only built
+// with the "pam" build tag:
+//
+//	go build -tags pam
+package pamauth
@@ -0,0 +1,118 @@
+//go:build pam && cgo && (linux || darwin || freebsd)
+
+package pamauth
+
+/*
+#cgo LDFLAGS: -lpam
+#include <security/pam_appl.h>
+#include <stdlib.h>
+#include <string.h>
+
+#define SOCKS5_PAM_MAX_MSG 32
+
+// socks5_conv answers the password prompts of the modules
+// with the password passed as the application data
+static int socks5_conv(int n, const struct pam_message **msg, struct pam_response **resp, void *data) {
+	struct pam_response *r;
+	int i;
+
+	if (n <= 0 || n > SOCKS5_PAM_MAX_MSG) {
+		return PAM_CONV_ERR;
+	}
+	r = calloc(n, sizeof(struct pam_response));
+	if (r == NULL) {
+		return PAM_BUF_ERR;
+	}
+	for (i = 0; i < n; i++) {
+		switch (msg[i]->msg_style) {
+		case PAM_PROMPT_ECHO_OFF:
+			r[i].resp = strdup((const char *)data);
+			if (r[i].resp == NULL) {
+				goto fail;
+			}
+			break;
+		case PAM_ERROR_MSG:
+		case PAM_TEXT_INFO:
+			break;
+		default:
+			goto fail;
+		}
+	}
+	*resp = r;
+	return PAM_SUCCESS;
+
+fail:
+	for (i = 0; i < n; i++) {
+		if (r[i].resp != NULL) {
+			memset(r[i].resp, 0, strlen(r[i].resp));
+			free(r[i].resp);
+		}
+	}
+	free(r);
+	return PAM_CONV_ERR;
+}
+
+static int socks5_pam_auth(const char *service, const char *user, const char *pass) {
+	struct pam_conv conv = { socks5_conv, (void *)pass };
+	pam_handle_t *h = NULL;
+	int rc;
+
+	rc = pam_start(service, user, &conv, &h);
+	if (rc != PAM_SUCCESS) {
+		return rc;
+	}
+	rc = pam_authenticate(h, PAM_SILENT | PAM_DISALLOW_NULL_AUTHTOK);
+	if (rc == PAM_SUCCESS) {
+		rc = pam_acct_mgmt(h, PAM_SILENT | PAM_DISALLOW_NULL_AUTHTOK);
+	}
+	pam_end(h, rc);
+	return rc;
+}
+*/
+import "C"
+
+import (
+	"strings"
+	"unsafe"
+
+	"github.com/armon/go-socks5"
+)
+
+const defaultService = "socks5"
+
+// Store checks credentials with pam_authenticate, and the account
+// with pam_acct_mgmt, so expired or locked accounts are rejected.
+// Empty passwords are never accepted. The modules of the service
+// must be safe to use concurrently, as pam_unix is.
+//
+//	conf := &socks5.Config{Credentials: &pamauth.Store{Service: "socks5"}}
+type Store struct {
+	// Service selects the PAM configuration, such as
+	// /etc/pam.d/socks5. Defaults to "socks5".
+	Service string
+}
+
+// Ensure we implement the interface
+var _ socks5.CredentialStore = &Store{}
+
+func (s *Store) Valid(user, password string) bool {
+	// C strings end at the first NUL
+	if user == "" || password == "" || strings.ContainsRune(user+password, 0) {
+		return false
+	}
+	service := s.Service
+	if service == "" {
+		service = defaultService
+	}
+
+	cService := C.CString(service)
+	defer C.free(unsafe.Pointer(cService))
+	cUser := C.CString(user)
+	defer C.free(unsafe.Pointer(cUser))
+	cPass := C.CString(password)
+	defer func() {
+		C.memset(unsafe.Pointer(cPass), 0, C.size_t(len(password)))
+		C.free(unsafe.Pointer(cPass))
+	}()
+	return C.socks5_pam_auth(cService, cUser, cPass) == C.PAM_SUCCESS
+}
@@ -0,0 +1,26 @@
+//go:build pam && cgo && (linux || darwin || freebsd)
+
+package pamauth
+
+import (
+	"testing"
+)
+
+func TestStore_Invalid(t *testing.T) {
+	s := &Store{Service: "socks5-test"}
+	for _, tc := range [][2]string{
+		{"", "bar"},
+		{"foo", ""},
+		{"foo\x00root", "bar"},
+		{"foo", "bar\x00"},
+	} {
+		if s.Valid(tc[0], tc[1]) {
+			t.Fatalf("expect invalid: %q", tc)
+		}
+	}
+
+	// Unknown users are rejected by the modules
+	if s.Valid("socks5-no-such-user", "bar") {
+		t.Fatalf("expect invalid")
+	}
+}
@@ -0,0 +1,86 @@
+package socks5
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// ErrUnsupportedPlatform is returned when a socket option
+// is not available on the current platform
+var ErrUnsupportedPlatform = errors.New("Not supported on this platform")
+
+// checkPlatform ensures the socket options of a Config are
+// supported, rather than silently ignoring them
+func checkPlatform(conf *Config) error {
+	if conf.UpstreamMark != 0 && !supportsSocketMark {
+		return fmt.Errorf("UpstreamMark: %w", ErrUnsupportedPlatform)
+	}
+	if conf.UpstreamDevice != "" && !supportsBindToDevice {
+		return fmt.Errorf("UpstreamDevice: %w", ErrUnsupportedPlatform)
+	}
+	return nil
+}
+
+// upstreamControl is used as the Control of the default dialer,
+// applying the socket options of upstream connections
+func (s *Server) upstreamControl(network, address string, c syscall.RawConn) error {
+	var err error
+	ctrlErr := c.Control(func(fd uintptr) {
+		if s.config.UpstreamFastOpen {
+			// Fall back to a regular connection if unsupported
+			if setFastOpenConnect(fd) != nil {
+				s.metrics().IncrCounter([]string{"socks5", "dial", "tfo"}, 1, Label{Name: "result", Value: "unsupported"})
+			}
+		}
+		if s.config.UpstreamMark != 0 {
+			if err = setSocketMark(fd, s.config.UpstreamMark); err != nil {
+				err = fmt.Errorf("Failed to set socket mark: %w", err)
+				return
+			}
+		}
+		if s.config.UpstreamDevice != "" {
+			if err = bindToDevice(fd, s.config.UpstreamDevice); err != nil {
+				err = fmt.Errorf("Failed to bind to device %s: %w", s.config.UpstreamDevice, err)
+			}
+		}
+	})
+	if ctrlErr != nil {
+		return ctrlErr
+	}
+	return err
+}
+
+// hasUpstreamOptions checks if upstream sockets need any options
+func (s *Server) hasUpstreamOptions() bool {
+	return s.config.UpstreamMark != 0 || s.config.UpstreamDevice != "" || s.config.UpstreamFastOpen
+}
+
+// countFastOpen is used to count whether an upstream connection
+// carried data in its SYN, once it relayed, with UpstreamFastOpen
+func (s *Server) countFastOpen(target net.Conn) {
+	if !s.config.UpstreamFastOpen || s.config.Dial != nil {
+		return
+	}
+	sc, ok := target.(syscall.Conn)
+	if !ok {
+		return
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return
+	}
+	var used bool
+	ctrlErr := raw.Control(func(fd uintptr) {
+		used, err = fastOpenUsed(fd)
+	})
+	if ctrlErr != nil || err != nil {
+		return
+	}
+	result := "regular"
+	if used {
+		result = "syn_data"
+	}
+	s.metrics().IncrCounter([]string{"socks5", "dial", "tfo"}, 1, Label{Name: "result", Value: result})
+}
@@ -0,0 +1,113 @@
+//go:build linux
+
+package socks5
+
+import (
+	"encoding/binary"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	supportsSocketMark   = true
+	supportsBindToDevice = true
+	supportsICMPErrors   = true
+)
+
+const (
+	// tcpFastOpenConnect is TCP_FASTOPEN_CONNECT, from linux/tcp.h
+	tcpFastOpenConnect = 30
+
+	// tcpiOptSynData is TCPI_OPT_SYN_DATA, set in the options of
+	// the TCP_INFO of connections which sent data in the SYN
+	tcpiOptSynData = 32
+)
+
+// Origins of the extended socket errors, from linux/errqueue.h
+const (
+	soEEOriginICMP  = 2
+	soEEOriginICMP6 = 3
+)
+
+// setSocketMark sets SO_MARK, used by policy routing and netfilter
+func setSocketMark(fd uintptr, mark int) error {
+	return syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK, mark)
+}
+
+// bindToDevice sets SO_BINDTODEVICE, restricting the socket to an interface
+func bindToDevice(fd uintptr, dev string) error {
+	return syscall.BindToDevice(int(fd), dev)
+}
+
+// setFastOpenConnect sets TCP_FASTOPEN_CONNECT, deferring the
+// handshake of the socket to its first write, which the SYN carries
+// once the destination handed out a cookie
+func setFastOpenConnect(fd uintptr) error {
+	return syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, tcpFastOpenConnect, 1)
+}
+
+// fastOpenUsed checks if a connection sent data in its SYN
+func fastOpenUsed(fd uintptr) (bool, error) {
+	var info syscall.TCPInfo
+	size := uint32(unsafe.Sizeof(info))
+	_, _, errno := syscall.Syscall6(syscall.SYS_GETSOCKOPT, fd, syscall.IPPROTO_TCP, syscall.TCP_INFO,
+		uintptr(unsafe.Pointer(&info)), uintptr(unsafe.Pointer(&size)), 0)
+	if errno != 0 {
+		return false, errno
+	}
+	return info.Options&tcpiOptSynData != 0, nil
+}
+
+// setRecvErr sets IP_RECVERR, and IPV6_RECVERR for IPv6 sockets,
+// queueing the ICMP errors caused by datagrams sent on the socket
+func setRecvErr(fd uintptr) error {
+	if err := syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_RECVERR, 1); err != nil {
+		return err
+	}
+	sa, err := syscall.Getsockname(int(fd))
+	if err != nil {
+		return err
+	}
+	if _, ok := sa.(*syscall.SockaddrInet6); ok {
+		return syscall.SetsockoptInt(int(fd), syscall.SOL_IPV6, syscall.IPV6_RECVERR, 1)
+	}
+	return nil
+}
+
+// readErrQueue reads an error from the error queue of the socket,
+// without blocking, returning nil if it is not an ICMP error. The destination of the datagram which
+// caused it is reported as the source of the message.
+func readErrQueue(fd uintptr) (*icmpError, error) {
+	var p [1]byte
+	oob := make([]byte, 128)
+	_, oobn, _, from, err := syscall.Recvmsg(int(fd), p[:], oob, syscall.MSG_ERRQUEUE|syscall.MSG_DONTWAIT)
+	if err != nil {
+		return nil, err
+	}
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return nil, err
+	}
+
+	// struct sock_extended_err starts with ee_errno and ee_origin
+	for _, m := range msgs {
+		isV4 := m.Header.Level == syscall.SOL_IP && m.Header.Type == syscall.IP_RECVERR
+		isV6 := m.Header.Level == syscall.SOL_IPV6 && m.Header.Type == syscall.IPV6_RECVERR
+		if !isV4 && !isV6 || len(m.Data) < 5 {
+			continue
+		}
+		if origin := m.Data[4]; origin != soEEOriginICMP && origin != soEEOriginICMP6 {
+			continue
+		}
+		e := &icmpError{err: syscall.Errno(binary.NativeEndian.Uint32(m.Data))}
+		switch sa := from.(type) {
+		case *syscall.SockaddrInet4:
+			e.dest = &net.UDPAddr{IP: net.IP(sa.Addr[:]).To16(), Port: sa.Port}
+		case *syscall.SockaddrInet6:
+			e.dest = &net.UDPAddr{IP: net.IP(sa.Addr[:]), Port: sa.Port}
+		}
+		return e, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,33 @@
+//go:build !linux
+
+package socks5
+
+const (
+	supportsSocketMark   = false
+	supportsBindToDevice = false
+	supportsICMPErrors   = false
+)
+
+func setSocketMark(fd uintptr, mark int) error {
+	return ErrUnsupportedPlatform
+}
+
+func bindToDevice(fd uintptr, dev string) error {
+	return ErrUnsupportedPlatform
+}
+
+func setFastOpenConnect(fd uintptr) error {
+	return ErrUnsupportedPlatform
+}
+
+func fastOpenUsed(fd uintptr) (bool, error) {
+	return false, ErrUnsupportedPlatform
+}
+
+func setRecvErr(fd uintptr) error {
+	return ErrUnsupportedPlatform
+}
+
+func readErrQueue(fd uintptr) (*icmpError, error) {
+	return nil, ErrUnsupportedPlatform
+}
@@ -0,0 +1,89 @@
+package socks5
+
+import (
+	"errors"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestNew_Platform(t *testing.T) {
+	_, err := New(&Config{UpstreamMark: 1})
+	if supportsSocketMark != (err == nil) {
+		t.Fatalf("err: %v", err)
+	}
+	if err != nil && !errors.Is(err, ErrUnsupportedPlatform) {
+		t.Fatalf("err: %v", err)
+	}
+	_, err = New(&Config{UpstreamDevice: "lo"})
+	if supportsBindToDevice != (err == nil) {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestServer_UpstreamDevice(t *testing.T) {
+	if !supportsBindToDevice {
+		t.Skip("SO_BINDTODEVICE not supported")
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+
+	s := &Server{config: &Config{UpstreamDevice: "lo"}}
+	addr := l.Addr().(*net.TCPAddr)
+	req := &Request{realDestAddr: &AddrSpec{IP: addr.IP, Port: addr.Port}}
+	conn, err := s.dial(context.Background(), req)
+	if errors.Is(err, syscall.EPERM) {
+		t.Skip("SO_BINDTODEVICE not permitted")
+	}
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	conn.Close()
+
+	// An unknown device fails the dial
+	s.config.UpstreamDevice = "nonexistent0"
+	if _, err := s.dial(context.Background(), req); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestServer_UpstreamFastOpen(t *testing.T) {
+	target := echoTarget(t)
+	defer target.Close()
+
+	metrics := newTestMetrics()
+	serv, _ := New(&Config{UpstreamFastOpen: true, Metrics: metrics})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	go serv.Serve(l)
+
+	// Connections fall back to a regular handshake without a cookie
+	conn, resp := connectThrough(t, l.Addr(), target.Addr())
+	if resp != SuccessReply {
+		t.Fatalf("bad: %v", resp)
+	}
+	conn.Write([]byte("ping"))
+	out := make([]byte, 4)
+	if _, err := io.ReadFull(conn, out); err != nil || string(out) != "ping" {
+		t.Fatalf("bad: %v %v", out, err)
+	}
+	conn.Close()
+
+	deadline := time.Now().Add(time.Second)
+	for metrics.counter("socks5.dial.tfo") != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("bad: %v", metrics.counter("socks5.dial.tfo"))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,113 @@
+package socks5
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// workerHandshakeTimeout bounds the handshakes on the workers when no
+// HandshakeTimeout is configured, so silent clients cannot hold every
+// worker of the pool
+var workerHandshakeTimeout = 10 * time.Second
+
+// workerPool runs handshakes on a bounded number of goroutines
+type workerPool struct {
+	s       *Server
+	queue   chan net.Conn
+	wg      sync.WaitGroup
+	timeout time.Duration
+}
+
+// newWorkerPool starts the handshake workers of a listener
+func (s *Server) newWorkerPool() *workerPool {
+	p := &workerPool{
+		s:       s,
+		queue:   make(chan net.Conn, s.config.HandshakeQueue),
+		timeout: workerHandshakeTimeout,
+	}
+	for i := 0; i < s.config.HandshakeWorkers; i++ {
+		p.wg.Add(1)
+		s.spawn("worker", p.worker)
+	}
+	return p
+}
+
+// submit queues a connection, rejecting it if the queue is full
+func (p *workerPool) submit(conn net.Conn) {
+	select {
+	case p.queue <- conn:
+		p.s.metrics().SetGauge([]string{"socks5", "pool", "queued"}, float32(len(p.queue)))
+	default:
+		p.s.metrics().IncrCounter([]string{"socks5", "pool", "rejected"}, 1)
+		p.s.state.release(conn)
+		conn.Close()
+	}
+}
+
+// stop waits for the workers to drain the queue and exit
+func (p *workerPool) stop() {
+	close(p.queue)
+	p.wg.Wait()
+}
+
+func (p *workerPool) worker() {
+	defer p.wg.Done()
+	for conn := range p.queue {
+		p.serve(conn)
+	}
+}
+
+// serve performs the handshake and then hands
+// the request off to its own goroutine
+func (p *workerPool) serve(conn net.Conn) {
+	s := p.s
+	tracked := false
+	defer func() {
+		if r := recover(); r != nil {
+			s.logPanic(r)
+			if tracked {
+				s.closeConn(conn, nil, fmt.Errorf("Panic serving connection: %v", r))
+			}
+			conn.Close()
+		}
+	}()
+	if !s.openConn(conn) {
+		conn.Close()
+		return
+	}
+	tracked = true
+	if err := s.controlClient(conn); err != nil {
+		s.logf(LogError, "%v", err)
+		s.closeConn(conn, nil, err)
+		conn.Close()
+		return
+	}
+	live := s.live()
+	timeout := live.config.HandshakeTimeout
+	if timeout <= 0 {
+		timeout = p.timeout
+		conn.SetDeadline(time.Now().Add(timeout))
+	}
+	srv, err := live.route(conn)
+	if err != nil {
+		s.closeConn(conn, nil, err)
+		conn.Close()
+		return
+	}
+	request, err := srv.handshake(conn, timeout)
+	if err != nil {
+		s.closeConn(conn, nil, err)
+		conn.Close()
+		return
+	}
+
+	s.spawn("conn", func() {
+		var err error
+		defer conn.Close()
+		defer func() { s.closeConn(conn, request, err) }()
+		defer s.recoverConn(conn, &err)
+		err = srv.serveRequest(request, conn)
+	})
+}
@@ -0,0 +1,119 @@
+package socks5
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestWorkerPool_Serve(t *testing.T) {
+	serv, _ := New(&Config{HandshakeWorkers: 2, HandshakeQueue: 2})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	go serv.Serve(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte{5, 1, NoAuth})
+
+	out := make([]byte, 2)
+	conn.SetDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(conn, out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.Equal(out, []byte{5, NoAuth}) {
+		t.Fatalf("bad: %v", out)
+	}
+}
+
+func TestWorkerPool_Reject(t *testing.T) {
+	m := newTestMetrics()
+	serv, _ := New(&Config{HandshakeWorkers: 1, HandshakeQueue: 1, Metrics: m})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	go serv.Serve(l)
+
+	// Occupy the worker and the queue with stalled handshakes
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		defer conn.Close()
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	// The next connection is rejected
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("err: %v", err)
+	}
+	if m.counter("socks5.pool.rejected") != 1 {
+		t.Fatalf("bad: %v", m.counters)
+	}
+}
+
+func TestWorkerPool_SilentClients(t *testing.T) {
+	defer func(d time.Duration) { workerHandshakeTimeout = d }(workerHandshakeTimeout)
+	workerHandshakeTimeout = 50 * time.Millisecond
+
+	serv, _ := New(&Config{HandshakeWorkers: 2, HandshakeQueue: 2})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Wait for the workers to exit before restoring the timeout
+	done := make(chan struct{})
+	go func() {
+		serv.Serve(l)
+		close(done)
+	}()
+	defer func() {
+		l.Close()
+		<-done
+	}()
+
+	// Fill the workers with clients which never greet
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		defer conn.Close()
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	// The next client is served once they are reaped
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte{5, 1, NoAuth})
+
+	out := make([]byte, 2)
+	conn.SetDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(conn, out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.Equal(out, []byte{5, NoAuth}) {
+		t.Fatalf("bad: %v", out)
+	}
+}
@@ -0,0 +1,63 @@
+package socks5
+
+import (
+	"strings"
+
+	"golang.org/x/net/context"
+)
+
+// PortMapping translates a destination port, e.g. from 80 to 8080
+type PortMapping struct {
+	// Host selects the destinations by FQDN or IP. A "*.example.com"
+	// wildcard matches the subdomains, and "*" or empty any host.
+	Host string
+
+	// From is the port requested by the client
+	From int
+
+	// To is the port dialed by the proxy
+	To int
+}
+
+// matches checks if the mapping applies to a destination
+func (m *PortMapping) matches(dest *AddrSpec) bool {
+	if dest.Port != m.From {
+		return false
+	}
+	switch {
+	case m.Host == "" || m.Host == "*":
+		return true
+	case strings.HasPrefix(m.Host, "*."):
+		return dest.FQDN != "" && strings.HasSuffix(strings.ToLower(dest.FQDN), strings.ToLower(m.Host[1:]))
+	case dest.FQDN != "" && strings.EqualFold(dest.FQDN, m.Host):
+		return true
+	}
+	return dest.IP != nil && dest.IP.String() == m.Host
+}
+
+// PortMapper is an AddressRewriter translating destination ports with
+// a mapping table, for example so clients connecting to host:80 reach
+// host:8080. The first matching mapping applies. The requested address
+// is kept in the DestAddr of the request, so rules and logs see both.
+// Replies carry the proxy's address of the upstream connection as usual.
+type PortMapper struct {
+	Mappings []PortMapping
+
+	// Rewriter is used for the destinations which no mapping
+	// matches, if set
+	Rewriter AddressRewriter
+}
+
+func (p *PortMapper) Rewrite(ctx context.Context, req *Request) (context.Context, *AddrSpec, error) {
+	dest := req.DestAddr
+	for i := range p.Mappings {
+		m := &p.Mappings[i]
+		if m.matches(dest) {
+			return ctx, &AddrSpec{FQDN: dest.FQDN, IP: dest.IP, Port: m.To, Zone: dest.Zone}, nil
+		}
+	}
+	if p.Rewriter == nil {
+		return ctx, nil, nil
+	}
+	return p.Rewriter.Rewrite(ctx, req)
+}
@@ -0,0 +1,81 @@
+package socks5
+
+import (
+	"bytes"
+	"log"
+	"net"
+	"os"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestPortMapper(t *testing.T) {
+	p := &PortMapper{Mappings: []PortMapping{
+		{Host: "*.example.com", From: 80, To: 8080},
+		{Host: "10.0.0.1", From: 22, To: 2222},
+		{From: 443, To: 8443},
+	}}
+	cases := []struct {
+		dest   *AddrSpec
+		expect int
+	}{
+		{&AddrSpec{FQDN: "www.Example.com", Port: 80}, 8080},
+		{&AddrSpec{FQDN: "example.com", Port: 80}, 0},
+		{&AddrSpec{IP: net.IPv4(10, 0, 0, 1), Port: 22}, 2222},
+		{&AddrSpec{IP: net.IPv4(10, 0, 0, 2), Port: 22}, 0},
+		{&AddrSpec{FQDN: "foo.org", Port: 443}, 8443},
+	}
+	for _, c := range cases {
+		_, addr, err := p.Rewrite(context.Background(), &Request{DestAddr: c.dest})
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if (addr == nil && c.expect != 0) || (addr != nil && addr.Port != c.expect) {
+			t.Fatalf("bad: %v %v", c.dest, addr)
+		}
+	}
+}
+
+func TestRequest_PortMapping(t *testing.T) {
+	// Create a local listener
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte("pong"))
+	}()
+	port := l.Addr().(*net.TCPAddr).Port
+
+	// The client asks for port 80
+	s := &Server{config: &Config{
+		Rules:    PermitAll(),
+		Resolver: DNSResolver{},
+		Rewriter: &PortMapper{Mappings: []PortMapping{{Host: "127.0.0.1", From: 80, To: port}}},
+		Logger:   log.New(os.Stdout, "", log.LstdFlags),
+	}}
+	req, err := NewRequest(bytes.NewBuffer([]byte{5, 1, 0, 1, 127, 0, 0, 1, 0, 80}))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	req.bufConn = bytes.NewBuffer(nil)
+	resp := &MockConn{}
+	if err := s.handleRequest(req, resp); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	out := resp.buf.Bytes()
+	if len(out) < 10 || out[1] != SuccessReply || !bytes.HasSuffix(out, []byte("pong")) {
+		t.Fatalf("bad: %v", out)
+	}
+	if req.DestAddr.Port != 80 {
+		t.Fatalf("bad: %v", req.DestAddr)
+	}
+}
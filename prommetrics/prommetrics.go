@@ -0,0 +1,197 @@
+// Package prommetrics implements a socks5.Metrics sink exporting the
+// measurements of a server to Prometheus, so it can be scraped without
+// writing an adapter:
+//
+//	reg := prometheus.NewRegistry()
+//	serv, _ := socks5.New(&socks5.Config{Metrics: prommetrics.New(reg)})
+//	http.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+//
+// The metrics are registered when first measured, named after their key,
+// such as socks5_reply_total for the socks5.reply counter, which counts
+// the replies by command, reply code, auth method and user.
+package prommetrics
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/armon/go-socks5"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// userLabel is the label of the metrics holding a username
+const userLabel = "user"
+
+// Sink is a socks5.Metrics registering a collector for each key.
+// Counters are suffixed with _total, and the timings of MeasureSince
+// are histograms suffixed with _seconds. The labels of a metric are
+// those of its first measurement: labels it did not have are dropped
+// from the later ones, and those it had are left empty if missing.
+type Sink struct {
+	// Buckets are the buckets of the histograms, in seconds for the
+	// timings. Defaults to prometheus.DefBuckets.
+	Buckets []float64
+
+	// RawUsers exports the user label as is, rather than as a hash of
+	// the username, which keeps the users apart without exposing them
+	RawUsers bool
+
+	reg     prometheus.Registerer
+	l       sync.Mutex
+	metrics map[string]*metric
+}
+
+// metric is a registered collector and its label names
+type metric struct {
+	labels     []string
+	counter    *prometheus.CounterVec
+	gauge      *prometheus.GaugeVec
+	histogram  *prometheus.HistogramVec
+	registered bool
+}
+
+// New creates a Sink registering its collectors with reg, or with
+// prometheus.DefaultRegisterer if nil
+func New(reg prometheus.Registerer) *Sink {
+	if reg == nil {
+		reg = prometheus.DefaultRegisterer
+	}
+	return &Sink{reg: reg, metrics: make(map[string]*metric)}
+}
+
+func (s *Sink) IncrCounter(key []string, val float32, labels ...socks5.Label) {
+	m := s.metric(name(key, "_total"), labels, func(opts prometheus.Opts, names []string) prometheus.Collector {
+		return prometheus.NewCounterVec(prometheus.CounterOpts(opts), names)
+	})
+	if m == nil || m.counter == nil || val < 0 {
+		return
+	}
+	if c, err := m.counter.GetMetricWithLabelValues(s.values(m, labels)...); err == nil {
+		c.Add(float64(val))
+	}
+}
+
+func (s *Sink) SetGauge(key []string, val float32, labels ...socks5.Label) {
+	m := s.metric(name(key, ""), labels, func(opts prometheus.Opts, names []string) prometheus.Collector {
+		return prometheus.NewGaugeVec(prometheus.GaugeOpts(opts), names)
+	})
+	if m == nil || m.gauge == nil {
+		return
+	}
+	if g, err := m.gauge.GetMetricWithLabelValues(s.values(m, labels)...); err == nil {
+		g.Set(float64(val))
+	}
+}
+
+func (s *Sink) AddSample(key []string, val float32, labels ...socks5.Label) {
+	s.observe(name(key, ""), float64(val), labels)
+}
+
+func (s *Sink) MeasureSince(key []string, start time.Time, labels ...socks5.Label) {
+	s.observe(name(key, "_seconds"), time.Since(start).Seconds(), labels)
+}
+
+func (s *Sink) observe(name string, val float64, labels []socks5.Label) {
+	m := s.metric(name, labels, func(opts prometheus.Opts, names []string) prometheus.Collector {
+		return prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    opts.Name,
+			Help:    opts.Help,
+			Buckets: s.Buckets,
+		}, names)
+	})
+	if m == nil || m.histogram == nil {
+		return
+	}
+	if h, err := m.histogram.GetMetricWithLabelValues(s.values(m, labels)...); err == nil {
+		h.Observe(val)
+	}
+}
+
+// metric returns the metric of the name, creating and registering
+// its collector on first use. It returns nil if the registration
+// failed, for example as another collector has the name.
+func (s *Sink) metric(name string, labels []socks5.Label, create func(prometheus.Opts, []string) prometheus.Collector) *metric {
+	s.l.Lock()
+	defer s.l.Unlock()
+	if m, ok := s.metrics[name]; ok {
+		if !m.registered {
+			return nil
+		}
+		return m
+	}
+
+	names := make([]string, len(labels))
+	for i, l := range labels {
+		names[i] = sanitize(l.Name)
+	}
+	opts := prometheus.Opts{Name: name, Help: "SOCKS5 server metric " + name + "."}
+	c := create(opts, names)
+	m := &metric{labels: names, registered: true}
+	if err := s.reg.Register(c); err != nil {
+		are, ok := err.(prometheus.AlreadyRegisteredError)
+		if !ok {
+			m.registered = false
+			s.metrics[name] = m
+			return nil
+		}
+		c = are.ExistingCollector
+	}
+	switch c := c.(type) {
+	case *prometheus.CounterVec:
+		m.counter = c
+	case *prometheus.GaugeVec:
+		m.gauge = c
+	case *prometheus.HistogramVec:
+		m.histogram = c
+	}
+	s.metrics[name] = m
+	return m
+}
+
+// values returns the values of the labels of a metric, in order
+func (s *Sink) values(m *metric, labels []socks5.Label) []string {
+	values := make([]string, len(m.labels))
+	for i, name := range m.labels {
+		for _, l := range labels {
+			if sanitize(l.Name) != name {
+				continue
+			}
+			values[i] = l.Value
+			if name == userLabel && !s.RawUsers {
+				values[i] = hashUser(l.Value)
+			}
+			break
+		}
+	}
+	return values
+}
+
+// hashUser returns a short hash of a username, keeping empty
+// usernames empty
+func hashUser(user string) string {
+	if user == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(user))
+	return hex.EncodeToString(sum[:8])
+}
+
+// name returns the name of the metric of a key, with the suffix
+func name(key []string, suffix string) string {
+	return sanitize(strings.Join(key, "_")) + suffix
+}
+
+// sanitize replaces the characters not allowed in metric
+// and label names with underscores
+func sanitize(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_':
+			return r
+		}
+		return '_'
+	}, s)
+}
@@ -0,0 +1,95 @@
+package prommetrics
+
+import (
+	"testing"
+	"time"
+
+	"github.com/armon/go-socks5"
+	"github.com/armon/go-socks5/socks5test"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// family returns the gathered metric family of the name
+func family(t *testing.T, reg *prometheus.Registry, name string) *dto.MetricFamily {
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	for _, f := range families {
+		if f.GetName() == name {
+			return f
+		}
+	}
+	t.Fatalf("missing %s", name)
+	return nil
+}
+
+func TestSink_Reply(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	serv, err := socks5.New(&socks5.Config{
+		Credentials: socks5.StaticCredentials{"foo": "bar"},
+		Rules:       socks5.PermitNone(),
+		Metrics:     New(reg),
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	err = socks5test.NewScript().
+		Greet(socks5.UserPassAuth).
+		ExpectMethod(socks5.UserPassAuth).
+		UserPass("foo", "bar").
+		ExpectAuth(socks5test.AuthSuccess).
+		Request(socks5.ConnectCommand, "127.0.0.1:80").
+		ExpectReply(socks5.RuleFailure).
+		RunServer(serv)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	f := family(t, reg, "socks5_reply_total")
+	if len(f.Metric) != 1 || f.Metric[0].GetCounter().GetValue() != 1 {
+		t.Fatalf("bad: %v", f)
+	}
+	labels := make(map[string]string)
+	for _, l := range f.Metric[0].Label {
+		labels[l.GetName()] = l.GetValue()
+	}
+	expected := map[string]string{
+		"command": "1",
+		"reply":   "2",
+		"method":  "2",
+		"user":    hashUser("foo"),
+	}
+	for name, value := range expected {
+		if labels[name] != value {
+			t.Fatalf("bad: %v", labels)
+		}
+	}
+}
+
+func TestSink_Labels(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	s := New(reg)
+	s.IncrCounter([]string{"socks5", "dial"}, 1, socks5.Label{Name: "result", Value: "ok"})
+
+	// Unknown labels are dropped and missing ones left empty
+	s.IncrCounter([]string{"socks5", "dial"}, 2, socks5.Label{Name: "other", Value: "x"})
+	f := family(t, reg, "socks5_dial_total")
+	if len(f.Metric) != 2 {
+		t.Fatalf("bad: %v", f)
+	}
+
+	s.SetGauge([]string{"socks5", "pool", "queued"}, 3)
+	if v := family(t, reg, "socks5_pool_queued").Metric[0].GetGauge().GetValue(); v != 3 {
+		t.Fatalf("bad: %v", v)
+	}
+	s.MeasureSince([]string{"socks5", "first-byte"}, time.Now())
+	if n := family(t, reg, "socks5_first_byte_seconds").Metric[0].GetHistogram().GetSampleCount(); n != 1 {
+		t.Fatalf("bad: %v", n)
+	}
+
+	// Names taken by other collectors are skipped
+	reg.MustRegister(prometheus.NewGauge(prometheus.GaugeOpts{Name: "socks5_taken_total", Help: "taken"}))
+	s.IncrCounter([]string{"socks5", "taken"}, 1)
+}
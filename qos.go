@@ -0,0 +1,158 @@
+package socks5
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// WithQoSClass returns a context assigning the request to a QoS class.
+// Rules assign classes by returning such a context from Allow, and the
+// BandwidthLimiter shares the bandwidth between classes by weight.
+func WithQoSClass(ctx context.Context, class string) context.Context {
+	return context.WithValue(ctx, qosClassKey, class)
+}
+
+// QoSClassFromContext returns the QoS class of a request,
+// which is the empty default class if none was assigned
+func QoSClassFromContext(ctx context.Context) string {
+	class, _ := ctx.Value(qosClassKey).(string)
+	return class
+}
+
+const (
+	// minClassBurst is the least burst of a class, so that classes
+	// with a small share still make progress a packet at a time
+	minClassBurst = 1500
+
+	// classActiveWindow is how long a class is considered active
+	// after it last relayed data
+	classActiveWindow = time.Second
+)
+
+// BandwidthLimiter limits the total bandwidth relayed by a server.
+// The bandwidth is shared between the QoS classes with active relays
+// in proportion to their weights, so that e.g. interactive sessions
+// are prioritized over bulk transfers. A class is active while it
+// relayed data within the last second, so the shares of classes whose
+// relays are open but idle are redistributed to the others.
+type BandwidthLimiter struct {
+	rate    float64
+	burst   float64
+	weights map[string]int
+
+	l       sync.Mutex
+	classes map[string]*classBucket
+}
+
+// classBucket is the token bucket of a single QoS class
+type classBucket struct {
+	active int
+	tokens float64
+	last   time.Time
+
+	// used is the last time the class relayed data
+	used time.Time
+}
+
+// NewBandwidthLimiter creates a limiter for the given rate in bytes
+// per second. Classes without a weight, including the default class,
+// have a weight of 1.
+func NewBandwidthLimiter(rate int, weights map[string]int) *BandwidthLimiter {
+	return &BandwidthLimiter{
+		rate:    float64(rate),
+		burst:   float64(rate) / 10,
+		weights: weights,
+		classes: make(map[string]*classBucket),
+	}
+}
+
+// weight returns the weight of a class
+func (b *BandwidthLimiter) weight(class string) int {
+	if w, ok := b.weights[class]; ok && w > 0 {
+		return w
+	}
+	return 1
+}
+
+// share returns the rate of a class, the lock must be held
+func (b *BandwidthLimiter) share(class string) float64 {
+	total := 0
+	now := time.Now()
+	for name, c := range b.classes {
+		if c.active > 0 && now.Sub(c.used) < classActiveWindow || name == class {
+			total += b.weight(name)
+		}
+	}
+	return b.rate * float64(b.weight(class)) / float64(total)
+}
+
+// open registers an active relay of a class
+func (b *BandwidthLimiter) open(class string) {
+	b.l.Lock()
+	defer b.l.Unlock()
+	c, ok := b.classes[class]
+	if !ok {
+		c = &classBucket{tokens: b.burst, last: time.Now()}
+		b.classes[class] = c
+	}
+	c.active++
+	c.used = time.Now()
+}
+
+// close unregisters an active relay of a class
+func (b *BandwidthLimiter) close(class string) {
+	b.l.Lock()
+	defer b.l.Unlock()
+	c := b.classes[class]
+	c.active--
+	if c.active == 0 {
+		delete(b.classes, class)
+	}
+}
+
+// wait blocks until up to n bytes may be relayed for a
+// class, returning how many were granted
+func (b *BandwidthLimiter) wait(ctx context.Context, class string, n int) (int, error) {
+	for {
+		b.l.Lock()
+		c := b.classes[class]
+		share := b.share(class)
+		now := time.Now()
+		c.tokens += now.Sub(c.last).Seconds() * share
+		c.last = now
+		c.used = now
+		burst := b.burst * share / b.rate
+		if burst < minClassBurst {
+			burst = minClassBurst
+		}
+		if c.tokens > burst {
+			c.tokens = burst
+		}
+		if c.tokens >= 1 {
+			granted := n
+			if float64(granted) > c.tokens {
+				granted = int(c.tokens)
+			}
+			c.tokens -= float64(granted)
+			b.l.Unlock()
+			return granted, nil
+		}
+		delay := time.Duration((1 - c.tokens) / share * float64(time.Second))
+		b.l.Unlock()
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+	}
+}
+
+// refund returns unused bytes to the bucket of a class
+func (b *BandwidthLimiter) refund(class string, n int) {
+	b.l.Lock()
+	defer b.l.Unlock()
+	b.classes[class].tokens += float64(n)
+}
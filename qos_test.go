@@ -0,0 +1,108 @@
+package socks5
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestQoSClassFromContext(t *testing.T) {
+	ctx := context.Background()
+	if class := QoSClassFromContext(ctx); class != "" {
+		t.Fatalf("bad: %v", class)
+	}
+	if class := QoSClassFromContext(WithQoSClass(ctx, "interactive")); class != "interactive" {
+		t.Fatalf("bad: %v", class)
+	}
+}
+
+func TestBandwidthLimiter_Share(t *testing.T) {
+	b := NewBandwidthLimiter(1000, map[string]int{"interactive": 9})
+
+	// A single active class gets the full rate
+	b.open("bulk")
+	if share := b.share("bulk"); share != 1000 {
+		t.Fatalf("bad: %v", share)
+	}
+
+	// Classes share by weight when both are active
+	b.open("interactive")
+	if share := b.share("interactive"); share != 900 {
+		t.Fatalf("bad: %v", share)
+	}
+	if share := b.share("bulk"); share != 100 {
+		t.Fatalf("bad: %v", share)
+	}
+
+	b.close("interactive")
+	if share := b.share("bulk"); share != 1000 {
+		t.Fatalf("bad: %v", share)
+	}
+}
+
+func TestBandwidthLimiter_Stream(t *testing.T) {
+	b := NewBandwidthLimiter(10000, nil)
+	b.open("")
+	defer b.close("")
+
+	data := bytes.Repeat([]byte{'a'}, 3000)
+	out := &bytes.Buffer{}
+	stream := &relayCopy{
+		ctx:     context.Background(),
+		dst:     out,
+		src:     bytes.NewReader(data),
+		limiter: b,
+	}
+
+	// The burst is a tenth of the rate, the rest is paced
+	start := time.Now()
+	if _, err := stream.run(make([]byte, 1024)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.Equal(out.Bytes(), data) {
+		t.Fatalf("bad: %d bytes", out.Len())
+	}
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Fatalf("too fast: %v", elapsed)
+	}
+}
+
+func TestBandwidthLimiter_SmallShare(t *testing.T) {
+	for _, b := range []*BandwidthLimiter{
+		NewBandwidthLimiter(5, nil),
+		NewBandwidthLimiter(1000, map[string]int{"ssh": 100}),
+	} {
+		b.open("ssh")
+		b.open("")
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		granted, err := b.wait(ctx, "", 1024)
+		cancel()
+		if err != nil || granted == 0 {
+			t.Fatalf("bad: %v %v", granted, err)
+		}
+		b.close("ssh")
+		b.close("")
+	}
+}
+
+func TestBandwidthLimiter_IdleClass(t *testing.T) {
+	b := NewBandwidthLimiter(1000, map[string]int{"ssh": 100})
+	b.open("ssh")
+	b.open("")
+	defer b.close("ssh")
+	defer b.close("")
+
+	// An open but idle class does not hold back the others
+	b.classes["ssh"].used = time.Now().Add(-2 * classActiveWindow)
+	if share := b.share(""); share != 1000 {
+		t.Fatalf("bad: %v", share)
+	}
+
+	// Once it relays again, it takes its share back
+	b.wait(context.Background(), "ssh", 1)
+	if share := b.share(""); share >= 1000 {
+		t.Fatalf("bad: %v", share)
+	}
+}
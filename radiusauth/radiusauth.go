@@ -0,0 +1,116 @@
+// Package radiusauth implements a socks5.CredentialStore checking
+// credentials with a RADIUS Access-Request, so existing AAA
+// infrastructure can be reused for the proxy.
+package radiusauth
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/armon/go-socks5"
+	"golang.org/x/net/context"
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+)
+
+const defaultTimeout = 5 * time.Second
+
+// Store sends an Access-Request for each check, accepting the
+// credentials on an Access-Accept. Attributes of the accept are
+// added to the AuthContext Payload, for logging and the rules:
+// "FramedIP", "Class", "FilterID" and "SessionTimeout".
+//
+//	store := &radiusauth.Store{Addr: "radius.example.com:1812", Secret: []byte("secret")}
+//	conf := &socks5.Config{Credentials: store}
+type Store struct {
+	// Addr of the RADIUS server, as host:port
+	Addr string
+
+	// Secret shared with the server
+	Secret []byte
+
+	// NASIdentifier identifies the proxy to the server, if set
+	NASIdentifier string
+
+	// Timeout bounds each exchange, including retries.
+	// Defaults to 5 seconds.
+	Timeout time.Duration
+
+	// Client is used for the exchanges. Defaults to
+	// radius.DefaultClient, which retries every second.
+	Client *radius.Client
+}
+
+// Ensure we implement the optional interface
+var _ socks5.AttributeCredentialStore = &Store{}
+
+func (s *Store) Valid(user, password string) bool {
+	_, valid := s.Attributes(user, password)
+	return valid
+}
+
+// Attributes sends an Access-Request for the user, returning
+// the attributes of the Access-Accept
+func (s *Store) Attributes(user, password string) (map[string]string, bool) {
+	if user == "" {
+		return nil, false
+	}
+	packet := radius.New(radius.CodeAccessRequest, s.Secret)
+	if err := rfc2865.UserName_SetString(packet, user); err != nil {
+		return nil, false
+	}
+	if err := rfc2865.UserPassword_Set(packet, padPassword(password)); err != nil {
+		return nil, false
+	}
+	if s.NASIdentifier != "" {
+		if err := rfc2865.NASIdentifier_SetString(packet, s.NASIdentifier); err != nil {
+			return nil, false
+		}
+	}
+
+	timeout := s.Timeout
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	client := s.Client
+	if client == nil {
+		client = radius.DefaultClient
+	}
+	resp, err := client.Exchange(ctx, packet, s.Addr)
+	if err != nil || resp.Code != radius.CodeAccessAccept {
+		return nil, false
+	}
+	return attributes(resp), true
+}
+
+// padPassword pads a password with NULs to a multiple of 16 bytes,
+// as required by RFC 2865 to hide its length
+func padPassword(password string) []byte {
+	n := (len(password) + 15) / 16 * 16
+	if n == 0 {
+		n = 16
+	}
+	padded := make([]byte, n)
+	copy(padded, password)
+	return padded
+}
+
+// attributes extracts the attributes of interest from an Access-Accept
+func attributes(resp *radius.Packet) map[string]string {
+	attrs := make(map[string]string)
+	if ip := rfc2865.FramedIPAddress_Get(resp); ip != nil {
+		attrs["FramedIP"] = ip.String()
+	}
+	if class := rfc2865.Class_GetString(resp); class != "" {
+		attrs["Class"] = class
+	}
+	if filter := rfc2865.FilterID_GetString(resp); filter != "" {
+		attrs["FilterID"] = filter
+	}
+	if timeout := rfc2865.SessionTimeout_Get(resp); timeout > 0 {
+		attrs["SessionTimeout"] = strconv.FormatUint(uint64(timeout), 10)
+	}
+	return attrs
+}
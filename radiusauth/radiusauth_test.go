@@ -0,0 +1,61 @@
+package radiusauth
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+)
+
+func TestStore(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	nas := make(chan string, 4)
+	server := &radius.PacketServer{
+		SecretSource: radius.StaticSecretSource([]byte("secret")),
+		Handler: radius.HandlerFunc(func(w radius.ResponseWriter, r *radius.Request) {
+			nas <- rfc2865.NASIdentifier_GetString(r.Packet)
+			if rfc2865.UserName_GetString(r.Packet) != "foo" || rfc2865.UserPassword_GetString(r.Packet) != "bar" {
+				w.Write(r.Response(radius.CodeAccessReject))
+				return
+			}
+			resp := r.Response(radius.CodeAccessAccept)
+			rfc2865.FramedIPAddress_Set(resp, net.IPv4(10, 0, 0, 7))
+			rfc2865.Class_SetString(resp, "staff")
+			w.Write(resp)
+		}),
+	}
+	go server.Serve(conn)
+	defer server.Shutdown(context.Background())
+
+	store := &Store{
+		Addr:          conn.LocalAddr().String(),
+		Secret:        []byte("secret"),
+		NASIdentifier: "proxy-1",
+	}
+	attrs, ok := store.Attributes("foo", "bar")
+	if !ok {
+		t.Fatalf("expect valid")
+	}
+	if attrs["FramedIP"] != "10.0.0.7" || attrs["Class"] != "staff" {
+		t.Fatalf("bad: %v", attrs)
+	}
+	if id := <-nas; id != "proxy-1" {
+		t.Fatalf("bad: %v", id)
+	}
+	if store.Valid("foo", "baz") {
+		t.Fatalf("expect invalid")
+	}
+
+	// A wrong secret fails the response verification
+	store.Secret = []byte("wrong")
+	store.Timeout = 100 * time.Millisecond
+	if store.Valid("foo", "bar") {
+		t.Fatalf("expect invalid")
+	}
+}
@@ -0,0 +1,187 @@
+package socks5
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	defaultGreylistDuration = time.Minute
+	defaultRateLimitClients = 65536
+	defaultIPv6PrefixLen    = 64
+)
+
+// RateLimitFilter is a ClientFilter limiting the rate of new connections
+// per client IP with a token bucket, to protect against scanners opening
+// thousands of handshakes per second. Clients exceeding the rate are
+// dropped, and repeat offenders are greylisted for a while. IPv6 clients
+// are limited by prefix, as a single host usually controls a whole /64.
+type RateLimitFilter struct {
+	// Rate is the sustained number of connections per second
+	// allowed from each IP. Zero disables the limit.
+	Rate float64
+
+	// Burst is the number of connections allowed at once.
+	// Defaults to 1.
+	Burst int
+
+	// GreylistAfter is the number of dropped connections after which
+	// a client is greylisted. Zero disables greylisting.
+	GreylistAfter int
+
+	// GreylistDuration is how long all connections of a greylisted
+	// client are dropped. Defaults to a minute.
+	GreylistDuration time.Duration
+
+	// IPv6PrefixLen is the length of the prefix IPv6 clients are
+	// limited by, sharing a bucket. Defaults to 64.
+	IPv6PrefixLen int
+
+	// MaxClients bounds the number of tracked clients. Defaults to
+	// 65536. Once reached, the clients which are within the rate are
+	// forgotten to make room, while greylisted ones are kept, so new
+	// clients are dropped if all tracked ones are greylisted.
+	MaxClients int
+
+	// Filter is consulted for the clients within the rate, if set
+	Filter ClientFilter
+
+	// Metrics receives the limited and greylisted counts.
+	// Defaults to NoopMetrics.
+	Metrics Metrics
+
+	// Clock returns the current time. Defaults to time.Now.
+	Clock func() time.Time
+
+	l       sync.Mutex
+	buckets map[string]*rateBucket
+}
+
+type rateBucket struct {
+	tokens     float64
+	last       time.Time
+	violations int
+	greylisted time.Time
+}
+
+func (f *RateLimitFilter) metrics() Metrics {
+	if f.Metrics == nil {
+		return NoopMetrics{}
+	}
+	return f.Metrics
+}
+
+func (f *RateLimitFilter) burst() float64 {
+	if f.Burst <= 0 {
+		return 1
+	}
+	return float64(f.Burst)
+}
+
+func (f *RateLimitFilter) AllowClient(addr net.Addr) bool {
+	if f.Rate > 0 && !f.take(addr) {
+		return false
+	}
+	return f.Filter == nil || f.Filter.AllowClient(addr)
+}
+
+// clientKey returns the key of the bucket of a client IP, which
+// is the IP itself for IPv4 clients, and its prefix for IPv6
+func (f *RateLimitFilter) clientKey(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.String()
+	}
+	bits := f.IPv6PrefixLen
+	if bits <= 0 || bits > 8*net.IPv6len {
+		bits = defaultIPv6PrefixLen
+	}
+	n := &net.IPNet{IP: ip.Mask(net.CIDRMask(bits, 8*net.IPv6len)), Mask: net.CIDRMask(bits, 8*net.IPv6len)}
+	return n.String()
+}
+
+// take is used to take a token from the bucket of the client
+func (f *RateLimitFilter) take(addr net.Addr) bool {
+	ip := addrIP(addr)
+	if ip == nil {
+		return true
+	}
+	key := f.clientKey(ip)
+	now := time.Now()
+	if f.Clock != nil {
+		now = f.Clock()
+	}
+
+	f.l.Lock()
+	defer f.l.Unlock()
+	b, ok := f.buckets[key]
+	if !ok {
+		if !f.prune(now) {
+			f.metrics().IncrCounter([]string{"socks5", "ratelimit", "full"}, 1)
+			return false
+		}
+		b = &rateBucket{tokens: f.burst(), last: now}
+		f.buckets[key] = b
+	}
+
+	if now.Before(b.greylisted) {
+		f.metrics().IncrCounter([]string{"socks5", "ratelimit", "greylist_drop"}, 1)
+		return false
+	}
+
+	// Refill the bucket for the time passed
+	b.tokens += now.Sub(b.last).Seconds() * f.Rate
+	if burst := f.burst(); b.tokens > burst {
+		b.tokens = burst
+	}
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true
+	}
+
+	f.metrics().IncrCounter([]string{"socks5", "ratelimit", "limited"}, 1)
+	b.violations++
+	if f.GreylistAfter > 0 && b.violations >= f.GreylistAfter {
+		duration := f.GreylistDuration
+		if duration == 0 {
+			duration = defaultGreylistDuration
+		}
+		b.greylisted = now.Add(duration)
+		b.violations = 0
+		f.metrics().IncrCounter([]string{"socks5", "ratelimit", "greylisted"}, 1)
+	}
+	return false
+}
+
+// prune is used to make room for a new client, dropping the clients
+// whose buckets refilled and which are not greylisted. If none can be
+// dropped, all clients which are not greylisted are forgotten. Returns
+// false if there is no room as all clients are greylisted.
+func (f *RateLimitFilter) prune(now time.Time) bool {
+	max := f.MaxClients
+	if max == 0 {
+		max = defaultRateLimitClients
+	}
+	if f.buckets == nil {
+		f.buckets = make(map[string]*rateBucket)
+	}
+	if len(f.buckets) < max {
+		return true
+	}
+	for key, b := range f.buckets {
+		refilled := b.tokens+now.Sub(b.last).Seconds()*f.Rate >= f.burst()
+		if refilled && !now.Before(b.greylisted) {
+			delete(f.buckets, key)
+		}
+	}
+	if len(f.buckets) < max {
+		return true
+	}
+	for key, b := range f.buckets {
+		if !now.Before(b.greylisted) {
+			delete(f.buckets, key)
+		}
+	}
+	return len(f.buckets) < max
+}
@@ -0,0 +1,131 @@
+package socks5
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRateLimitFilter(t *testing.T) {
+	now := time.Unix(1000, 0)
+	metrics := newTestMetrics()
+	f := &RateLimitFilter{
+		Rate:             1,
+		Burst:            2,
+		GreylistAfter:    2,
+		GreylistDuration: 10 * time.Second,
+		Metrics:          metrics,
+		Clock:            func() time.Time { return now },
+	}
+	client := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1234}
+	other := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 1234}
+
+	// The burst is allowed, then the rate applies
+	if !f.AllowClient(client) || !f.AllowClient(client) {
+		t.Fatalf("expected burst")
+	}
+	if f.AllowClient(client) {
+		t.Fatalf("expected limit")
+	}
+	if !f.AllowClient(other) {
+		t.Fatalf("expected other client allowed")
+	}
+	now = now.Add(time.Second)
+	if !f.AllowClient(client) {
+		t.Fatalf("expected refill")
+	}
+
+	// The second violation greylists the client
+	if f.AllowClient(client) {
+		t.Fatalf("expected limit")
+	}
+	now = now.Add(5 * time.Second)
+	if f.AllowClient(client) {
+		t.Fatalf("expected greylisted")
+	}
+	now = now.Add(5 * time.Second)
+	if !f.AllowClient(client) {
+		t.Fatalf("expected greylist expired")
+	}
+
+	if metrics.counter("socks5.ratelimit.limited") != 2 ||
+		metrics.counter("socks5.ratelimit.greylisted") != 1 ||
+		metrics.counter("socks5.ratelimit.greylist_drop") != 1 {
+		t.Fatalf("bad: %v", metrics.counters)
+	}
+}
+
+func TestRateLimitFilter_MaxClients(t *testing.T) {
+	now := time.Unix(1000, 0)
+	f := &RateLimitFilter{
+		Rate:       1,
+		MaxClients: 2,
+		Clock:      func() time.Time { return now },
+	}
+	for i := 1; i <= 3; i++ {
+		if !f.AllowClient(&net.TCPAddr{IP: net.IPv4(10, 0, 0, byte(i))}) {
+			t.Fatalf("expected allow")
+		}
+	}
+	if len(f.buckets) > 2 {
+		t.Fatalf("bad: %v", len(f.buckets))
+	}
+}
+
+func TestRateLimitFilter_IPv6Prefix(t *testing.T) {
+	now := time.Unix(1000, 0)
+	f := &RateLimitFilter{
+		Rate:  1,
+		Clock: func() time.Time { return now },
+	}
+	if !f.AllowClient(&net.TCPAddr{IP: net.ParseIP("2001:db8:0:1::1")}) {
+		t.Fatalf("expected allow")
+	}
+
+	// Other addresses of the same /64 share the bucket
+	if f.AllowClient(&net.TCPAddr{IP: net.ParseIP("2001:db8:0:1::2")}) {
+		t.Fatalf("expected deny")
+	}
+	if !f.AllowClient(&net.TCPAddr{IP: net.ParseIP("2001:db8:0:2::1")}) {
+		t.Fatalf("expected allow")
+	}
+
+	// The prefix is configurable
+	f = &RateLimitFilter{Rate: 1, IPv6PrefixLen: 128, Clock: f.Clock}
+	if !f.AllowClient(&net.TCPAddr{IP: net.ParseIP("2001:db8:0:1::1")}) ||
+		!f.AllowClient(&net.TCPAddr{IP: net.ParseIP("2001:db8:0:1::2")}) {
+		t.Fatalf("expected allow")
+	}
+}
+
+func TestRateLimitFilter_KeepGreylisted(t *testing.T) {
+	now := time.Unix(1000, 0)
+	f := &RateLimitFilter{
+		Rate:          1,
+		GreylistAfter: 1,
+		MaxClients:    2,
+		Clock:         func() time.Time { return now },
+	}
+	bad := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1)}
+	f.AllowClient(bad)
+	if f.AllowClient(bad) {
+		t.Fatalf("expected deny")
+	}
+
+	// Overflowing the clients keeps the greylisted one
+	for i := 2; i <= 5; i++ {
+		f.AllowClient(&net.TCPAddr{IP: net.IPv4(10, 0, 0, byte(i))})
+	}
+	now = now.Add(10 * time.Second)
+	if f.AllowClient(bad) {
+		t.Fatalf("expected greylisted")
+	}
+
+	// New clients are dropped once all tracked ones are greylisted
+	other := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 9)}
+	f.AllowClient(other)
+	f.AllowClient(other)
+	if f.AllowClient(&net.TCPAddr{IP: net.IPv4(10, 0, 0, 10)}) {
+		t.Fatalf("expected deny")
+	}
+}
@@ -0,0 +1,28 @@
+package socks5
+
+import (
+	"fmt"
+	"io"
+	"runtime/debug"
+)
+
+// recoverConn is deferred by the goroutines serving a connection, so a
+// panic, e.g. in a hook, only closes that connection instead of crashing
+// the server. If err is not nil, it is set to describe the panic.
+func (s *Server) recoverConn(c io.Closer, err *error) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	s.logPanic(r)
+	c.Close()
+	if err != nil {
+		*err = fmt.Errorf("Panic serving connection: %v", r)
+	}
+}
+
+// logPanic is used to log a recovered panic with its stack trace
+func (s *Server) logPanic(r interface{}) {
+	s.metrics().IncrCounter([]string{"socks5", "panic"}, 1)
+	s.logf(LogError, "Panic serving connection: %v\n%s", r, debug.Stack())
+}
@@ -0,0 +1,66 @@
+package socks5
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// panicRules panics for port 666
+type panicRules struct{}
+
+func (panicRules) Allow(ctx context.Context, req *Request) (context.Context, bool) {
+	if req.DestAddr.Port == 666 {
+		panic("bad hook")
+	}
+	return ctx, false
+}
+
+func TestSOCKS5_RecoverPanic(t *testing.T) {
+	for _, workers := range []int{0, 1} {
+		metrics := newTestMetrics()
+		var logs bytes.Buffer
+		serv, _ := New(&Config{
+			Rules:            panicRules{},
+			Metrics:          metrics,
+			Logger:           log.New(&logs, "", 0),
+			HandshakeWorkers: workers,
+			HandshakeQueue:   workers,
+		})
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		go serv.Serve(l)
+
+		request := func(port int) []byte {
+			conn, err := net.Dial("tcp", l.Addr().String())
+			if err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(time.Second))
+			conn.Write([]byte{5, 1, NoAuth, 5, 1, 0, 1, 127, 0, 0, 1, byte(port >> 8), byte(port)})
+			out, _ := io.ReadAll(conn)
+			return out
+		}
+
+		// Only the panicking connection is closed
+		if out := request(666); len(out) != 2 {
+			t.Fatalf("bad: %v", out)
+		}
+		if out := request(80); len(out) != 12 || out[3] != RuleFailure {
+			t.Fatalf("bad: %v", out)
+		}
+		serv.Close()
+
+		if metrics.counter("socks5.panic") != 1 || !bytes.Contains(logs.Bytes(), []byte("bad hook")) {
+			t.Fatalf("bad: %v %s", metrics.counters, logs.Bytes())
+		}
+	}
+}
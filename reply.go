@@ -0,0 +1,61 @@
+package socks5
+
+import (
+	"net"
+
+	"golang.org/x/net/context"
+)
+
+// ReplyAddressMode selects the BND.ADDR sent in successful replies
+type ReplyAddressMode uint8
+
+const (
+	// ReplyBindAddr sends the local address of the upstream connection
+	ReplyBindAddr ReplyAddressMode = iota
+	// ReplyPlaceholder always sends 0.0.0.0:0
+	ReplyPlaceholder
+	// ReplyIPv4Mapped sends IPv4-mapped addresses in their IPv4 form and
+	// replaces native IPv6 addresses with the 0.0.0.0:0 placeholder,
+	// for clients which cannot parse IPv6 addresses
+	ReplyIPv4Mapped
+	// ReplyListenerAddr sends the address of the listener
+	// the client connected to
+	ReplyListenerAddr
+)
+
+// replyAddr applies the ReplyAddress mode to a bind address
+func (s *Server) replyAddr(req *Request, bind *AddrSpec) *AddrSpec {
+	switch s.config.ReplyAddress {
+	case ReplyPlaceholder:
+		return nil
+	case ReplyIPv4Mapped:
+		if bind.FQDN != "" {
+			return bind
+		}
+		if ip4 := bind.IP.To4(); ip4 != nil {
+			return &AddrSpec{IP: ip4, Port: bind.Port}
+		}
+		return &AddrSpec{IP: net.IPv4zero, Port: 0}
+	case ReplyListenerAddr:
+		if req.localAddr != nil {
+			return req.localAddr
+		}
+	}
+	return bind
+}
+
+// AdvertiseAddr applies the ReplyAddressHook to the bind address of a
+// successful reply, for custom command handlers which reply with
+// SendReply. A nil address stands for 0.0.0.0:0.
+func (s *Server) AdvertiseAddr(ctx context.Context, req *Request, bind *AddrSpec) *AddrSpec {
+	hook := s.config.ReplyAddressHook
+	if hook == nil {
+		return bind
+	}
+	addr := AddrSpec{IP: net.IPv4zero}
+	if bind != nil {
+		addr = *bind
+	}
+	addr = hook(ctx, req, addr)
+	return &addr
+}
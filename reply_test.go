@@ -0,0 +1,78 @@
+package socks5
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestReplyAddress(t *testing.T) {
+	req := &Request{localAddr: &AddrSpec{IP: net.IPv4(192, 0, 2, 1), Port: 1080}}
+	v4 := &AddrSpec{IP: net.IPv4(10, 0, 0, 1), Port: 80}
+	v6 := &AddrSpec{IP: net.ParseIP("2001:db8::1"), Port: 80}
+
+	cases := []struct {
+		mode   ReplyAddressMode
+		bind   *AddrSpec
+		expect []byte
+	}{
+		{ReplyBindAddr, v4, []byte{ipv4Address, 10, 0, 0, 1, 0, 80}},
+		{ReplyPlaceholder, v4, []byte{ipv4Address, 0, 0, 0, 0, 0, 0}},
+		{ReplyIPv4Mapped, v4, []byte{ipv4Address, 10, 0, 0, 1, 0, 80}},
+		{ReplyIPv4Mapped, v6, []byte{ipv4Address, 0, 0, 0, 0, 0, 0}},
+		{ReplyListenerAddr, v6, []byte{ipv4Address, 192, 0, 2, 1, 4, 56}},
+	}
+	for _, tc := range cases {
+		s := &Server{config: &Config{ReplyAddress: tc.mode}}
+		var out bytes.Buffer
+		if err := s.reply(&out, req, SuccessReply, tc.bind); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		expected := append([]byte{5, SuccessReply, 0}, tc.expect...)
+		if !bytes.Equal(out.Bytes(), expected) {
+			t.Fatalf("mode %v: bad: %v", tc.mode, out.Bytes())
+		}
+	}
+}
+
+func TestServer_ReplyAddressHook(t *testing.T) {
+	public := net.IPv4(203, 0, 113, 1)
+	seen := make(chan AddrSpec, 1)
+	serv, _ := New(&Config{
+		ReplyAddressHook: func(ctx context.Context, req *Request, bind AddrSpec) AddrSpec {
+			seen <- bind
+			return AddrSpec{IP: public, Port: bind.Port}
+		},
+	})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	go serv.Serve(l)
+
+	// The relay address of UDP ASSOCIATE is advertised
+	conn, relay := associate(t, l.Addr(), &AddrSpec{IP: net.IPv4zero})
+	conn.Close()
+	bind := <-seen
+	if !relay.IP.Equal(public) || !bind.IP.Equal(net.IPv4(127, 0, 0, 1)) || bind.Port != relay.Port {
+		t.Fatalf("bad: %v %v", relay, bind)
+	}
+
+	// Failures carry no address
+	var out bytes.Buffer
+	if err := serv.reply(&out, &Request{}, ServerFailure, nil); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.Equal(out.Bytes(), []byte{5, ServerFailure, 0, ipv4Address, 0, 0, 0, 0, 0, 0}) {
+		t.Fatalf("bad: %v", out.Bytes())
+	}
+
+	// Custom handlers apply it explicitly
+	addr := serv.AdvertiseAddr(context.Background(), &Request{}, nil)
+	if !addr.IP.Equal(public) || addr.Port != 0 || (<-seen).Port != 0 {
+		t.Fatalf("bad: %v", addr)
+	}
+}
@@ -1,11 +1,15 @@
 package socks5
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"golang.org/x/net/context"
 )
@@ -19,25 +23,55 @@ const (
 	ipv6Address      = uint8(4)
 )
 
+// CommandSet is a set of the commands of RFC 1928, as a bitmask
+type CommandSet uint8
+
+const (
+	ConnectEnabled CommandSet = 1 << iota
+	BindEnabled
+	AssociateEnabled
+
+	// AllCommands enables all the commands
+	AllCommands = ConnectEnabled | BindEnabled | AssociateEnabled
+)
+
+// disables returns if the set disables the command. Commands other
+// than those of RFC 1928 are never disabled.
+func (c CommandSet) disables(cmd uint8) bool {
+	switch cmd {
+	case ConnectCommand:
+		return c&ConnectEnabled == 0
+	case BindCommand:
+		return c&BindEnabled == 0
+	case AssociateCommand:
+		return c&AssociateEnabled == 0
+	}
+	return false
+}
+
+// Reply codes of RFC 1928, for use with SendReply
 const (
-	successReply uint8 = iota
-	serverFailure
-	ruleFailure
-	networkUnreachable
-	hostUnreachable
-	connectionRefused
-	ttlExpired
-	commandNotSupported
-	addrTypeNotSupported
+	SuccessReply uint8 = iota
+	ServerFailure
+	RuleFailure
+	NetworkUnreachable
+	HostUnreachable
+	ConnectionRefused
+	TTLExpired
+	CommandNotSupported
+	AddrTypeNotSupported
 )
 
 var (
 	unrecognizedAddrType = fmt.Errorf("Unrecognized address type")
 )
 
-// AddressRewriter is used to rewrite a destination transparently
+// AddressRewriter is used to rewrite a destination transparently.
+// Returning an error vetoes the request, for example when the
+// destination cannot be mapped, and the client is denied.
+// Returning a nil AddrSpec leaves the destination unchanged.
 type AddressRewriter interface {
-	Rewrite(ctx context.Context, request *Request) (context.Context, *AddrSpec)
+	Rewrite(ctx context.Context, request *Request) (context.Context, *AddrSpec, error)
 }
 
 // AddrSpec is used to return the target AddrSpec
@@ -46,24 +80,89 @@ type AddrSpec struct {
 	FQDN string
 	IP   net.IP
 	Port int
+	// Zone is the IPv6 scoped addressing zone, if any.
+	// It is never sent on the wire.
+	Zone string
 }
 
 func (a *AddrSpec) String() string {
 	if a.FQDN != "" {
-		return fmt.Sprintf("%s (%s):%d", a.FQDN, a.IP, a.Port)
+		return fmt.Sprintf("%s (%s):%d", a.FQDN, a.ipString(), a.Port)
+	}
+	return net.JoinHostPort(a.ipString(), strconv.Itoa(a.Port))
+}
+
+// ipString formats the IP including the zone
+func (a AddrSpec) ipString() string {
+	if a.Zone != "" {
+		return a.IP.String() + "%" + a.Zone
 	}
-	return fmt.Sprintf("%s:%d", a.IP, a.Port)
+	return a.IP.String()
 }
 
 // Address returns a string suitable to dial; prefer returning IP-based
 // address, fallback to FQDN
 func (a AddrSpec) Address() string {
 	if 0 != len(a.IP) {
-		return net.JoinHostPort(a.IP.String(), strconv.Itoa(a.Port))
+		return net.JoinHostPort(a.ipString(), strconv.Itoa(a.Port))
 	}
 	return net.JoinHostPort(a.FQDN, strconv.Itoa(a.Port))
 }
 
+// Network returns the network of the address, so that
+// AddrSpec implements net.Addr
+func (a *AddrSpec) Network() string {
+	return "tcp"
+}
+
+// MarshalBinary encodes the AddrSpec in the wire format
+// used by requests and replies
+func (a *AddrSpec) MarshalBinary() ([]byte, error) {
+	return formatAddrSpec(a)
+}
+
+// UnmarshalBinary decodes an AddrSpec from the wire format
+func (a *AddrSpec) UnmarshalBinary(b []byte) error {
+	r := bytes.NewReader(b)
+	d, err := readAddrSpec(r)
+	if err != nil {
+		return err
+	}
+	if r.Len() != 0 {
+		return fmt.Errorf("Trailing data after address: %d bytes", r.Len())
+	}
+	*a = *d
+	return nil
+}
+
+// ParseAddrSpec parses a host:port string into an AddrSpec.
+// Hosts which are not IP addresses are treated as a FQDN.
+func ParseAddrSpec(addr string) (*AddrSpec, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 0 || port > 0xffff {
+		return nil, fmt.Errorf("Invalid port: %q", portStr)
+	}
+
+	a := &AddrSpec{Port: port}
+	if i := strings.LastIndexByte(host, '%'); i > 0 {
+		if ip := net.ParseIP(host[:i]); ip != nil && ip.To4() == nil {
+			a.IP = ip
+			a.Zone = host[i+1:]
+			return a, nil
+		}
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		a.IP = ip
+	} else {
+		a.FQDN = host
+	}
+	return a, nil
+}
+
 // A Request represents request received by a server
 type Request struct {
 	// Protocol version
@@ -76,9 +175,42 @@ type Request struct {
 	RemoteAddr *AddrSpec
 	// AddrSpec of the desired destination
 	DestAddr *AddrSpec
+	// SentFQDN is set if the client sent the destination as an FQDN,
+	// leaving the resolution to the server (socks5h), rather than an
+	// IP it resolved itself, leaking the lookup locally (socks5)
+	SentFQDN bool
+	// PinnedIP is the destination IP approved by the rules. Connections
+	// are only relayed if the upstream peer has exactly this address.
+	// Not set if the destination was not resolved before dialing.
+	PinnedIP net.IP
+	// Extensions is the data beyond RFC 1928 read by the Codec
+	// of the server, such as vendor data following the request
+	Extensions []byte
 	// AddrSpec of the actual destination (might be affected by rewrite)
 	realDestAddr *AddrSpec
-	bufConn      io.Reader
+	// failoverIPs are the IPs of the other backends approved by the
+	// rules, which the connection may reach instead of the PinnedIP
+	failoverIPs []net.IP
+	// ctx is the enriched context passed to the hooks
+	ctx context.Context
+	// rsv is the reserved byte, which must be zero
+	rsv uint8
+	// AddrSpec of the listener the client connected to
+	localAddr *AddrSpec
+	bufConn   io.Reader
+	// relayEnd describes how the relay of a CONNECT ended
+	relayEnd *RelayEnd
+	// denied is set once the request was denied
+	denied bool
+}
+
+// addrKind describes how the client sent the destination,
+// for logs and metrics
+func (r *Request) addrKind() string {
+	if r.SentFQDN {
+		return "fqdn"
+	}
+	return "ip"
 }
 
 type conn interface {
@@ -91,7 +223,7 @@ func NewRequest(bufConn io.Reader) (*Request, error) {
 	// Read the version byte
 	header := []byte{0, 0, 0}
 	if _, err := io.ReadAtLeast(bufConn, header, 3); err != nil {
-		return nil, fmt.Errorf("Failed to get command version: %v", err)
+		return nil, fmt.Errorf("Failed to get command version: %w", err)
 	}
 
 	// Ensure we are compatible
@@ -109,7 +241,9 @@ func NewRequest(bufConn io.Reader) (*Request, error) {
 		Version:  socks5Version,
 		Command:  header[1],
 		DestAddr: dest,
+		SentFQDN: dest.FQDN != "",
 		bufConn:  bufConn,
+		rsv:      header[2],
 	}
 
 	return request, nil
@@ -117,26 +251,37 @@ func NewRequest(bufConn io.Reader) (*Request, error) {
 
 // handleRequest is used for request processing after authentication
 func (s *Server) handleRequest(req *Request, conn conn) error {
-	ctx := context.Background()
-
-	// Resolve the address if we have a FQDN
-	dest := req.DestAddr
-	if dest.FQDN != "" {
-		ctx_, addr, err := s.config.Resolver.Resolve(ctx, dest.FQDN)
-		if err != nil {
-			if err := sendReply(conn, hostUnreachable, nil); err != nil {
-				return fmt.Errorf("Failed to send reply: %v", err)
-			}
-			return fmt.Errorf("Failed to resolve destination '%v': %v", dest.FQDN, err)
-		}
-		ctx = ctx_
-		dest.IP = addr
+	if s.config.EnabledCommands != 0 && s.config.EnabledCommands.disables(req.Command) {
+		err := fmt.Errorf("Command %v is disabled", req.Command)
+		s.deny(req.context(), req, DenyCommand, CommandNotSupported, err)
+		return s.replyError(conn, req, &requestError{CommandNotSupported, err})
+	}
+	if err := s.checkAddrType(req.SentFQDN); err != nil {
+		s.deny(req.context(), req, DenyAddress, AddrTypeNotSupported, err)
+		return s.replyError(conn, req, &requestError{AddrTypeNotSupported, err})
+	}
+	ctx, err := s.prepare(req.context(), req)
+	if err != nil {
+		return s.replyError(conn, req, err)
+	}
+	if len(s.config.Middleware) > 0 {
+		return s.serveMiddleware(ctx, conn, req)
 	}
+	return s.serveCommand(ctx, conn, req)
+}
 
-	// Apply any address rewrites
-	req.realDestAddr = req.DestAddr
-	if s.config.Rewriter != nil {
-		ctx, req.realDestAddr = s.config.Rewriter.Rewrite(ctx, req)
+// serveCommand is used to serve the command of a prepared request
+func (s *Server) serveCommand(ctx context.Context, conn conn, req *Request) error {
+	// Prefer any registered handler
+	if handler := s.state.command(req.Command); handler != nil {
+		nc, ok := conn.(net.Conn)
+		if !ok {
+			return fmt.Errorf("Command %v requires a net.Conn", req.Command)
+		}
+		if req.bufConn != nil {
+			nc = &bufferedConn{Conn: nc, r: req.bufConn}
+		}
+		return handler.Handle(ctx, req, nc)
 	}
 
 	// Switch on the command
@@ -148,107 +293,417 @@ func (s *Server) handleRequest(req *Request, conn conn) error {
 	case AssociateCommand:
 		return s.handleAssociate(ctx, conn, req)
 	default:
-		if err := sendReply(conn, commandNotSupported, nil); err != nil {
+		err := fmt.Errorf("Unsupported command: %v", req.Command)
+		s.deny(ctx, req, DenyCommand, CommandNotSupported, err)
+		if err := s.reply(conn, req, CommandNotSupported, nil); err != nil {
 			return fmt.Errorf("Failed to send reply: %v", err)
 		}
-		return fmt.Errorf("Unsupported command: %v", req.Command)
+		return err
 	}
 }
 
-// handleConnect is used to handle a connect command
-func (s *Server) handleConnect(ctx context.Context, conn conn, req *Request) error {
-	// Check if this is allowed
-	if ctx_, ok := s.config.Rules.Allow(ctx, req); !ok {
-		if err := sendReply(conn, ruleFailure, nil); err != nil {
+// requestError is a failure to serve a request,
+// carrying the reply code to send to the client
+type requestError struct {
+	reply uint8
+	err   error
+}
+
+func (e *requestError) Error() string {
+	return e.err.Error()
+}
+
+// replyError is used to send the reply code of a
+// requestError to the client, returning the error
+func (s *Server) replyError(conn conn, req *Request, err error) error {
+	if re, ok := err.(*requestError); ok {
+		if err := s.reply(conn, req, re.reply, nil); err != nil {
 			return fmt.Errorf("Failed to send reply: %v", err)
 		}
-		return fmt.Errorf("Connect to %v blocked by rules", req.DestAddr)
-	} else {
+	}
+	return err
+}
+
+// prepare is used to validate and resolve the destination of
+// a request, and then apply any address rewrites
+func (s *Server) prepare(ctx context.Context, req *Request) (context.Context, error) {
+	// Resolve the address if we have a FQDN
+	dest := req.DestAddr
+	if dest.FQDN != "" {
+		name, err := s.validateFQDN(dest.FQDN)
+		if err != nil {
+			err = fmt.Errorf("Invalid destination: %v", err)
+			s.deny(ctx, req, DenyAddress, HostUnreachable, err)
+			return ctx, &requestError{HostUnreachable, err}
+		}
+		dest.FQDN = name
+
+		start := time.Now()
+		ctx_, addr, err := s.config.Resolver.Resolve(ctx, dest.FQDN)
+		s.metrics().MeasureSince([]string{"socks5", "resolve"}, start)
+		if err != nil {
+			err = fmt.Errorf("Failed to resolve destination %q: %v", dest.FQDN, err)
+			return ctx, &requestError{HostUnreachable, err}
+		}
 		ctx = ctx_
+		dest.IP = addr
 	}
 
-	// Attempt to connect
-	dial := s.config.Dial
-	if dial == nil {
-		dial = func(ctx context.Context, net_, addr string) (net.Conn, error) {
-			return net.Dial(net_, addr)
+	// Apply any address rewrites
+	req.realDestAddr = req.DestAddr
+	if s.config.Rewriter != nil {
+		ctx_, addr, err := s.config.Rewriter.Rewrite(ctx, req)
+		if err != nil {
+			err = fmt.Errorf("Rewrite of %v denied: %v", req.DestAddr, err)
+			s.deny(ctx, req, DenyRewrite, RuleFailure, err)
+			return ctx, &requestError{RuleFailure, err}
+		}
+		ctx = ctx_
+		if addr != nil {
+			req.realDestAddr = addr
 		}
 	}
-	target, err := dial(ctx, "tcp", req.realDestAddr.Address())
+	return ctx, nil
+}
+
+// handleConnect is used to handle a connect command
+func (s *Server) handleConnect(ctx context.Context, conn conn, req *Request) error {
+	// Attempt to connect, giving up if the client goes away meanwhile
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stop := func() {}
+	if s.config.CancelOnClientClose {
+		stop = s.watchClient(conn, req.bufConn, cancel)
+	}
+	ctx, target, err := s.connect(ctx, req)
+	stop()
 	if err != nil {
-		msg := err.Error()
-		resp := hostUnreachable
-		if strings.Contains(msg, "refused") {
-			resp = connectionRefused
-		} else if strings.Contains(msg, "network is unreachable") {
-			resp = networkUnreachable
-		}
-		if err := sendReply(conn, resp, nil); err != nil {
-			return fmt.Errorf("Failed to send reply: %v", err)
+		if ctx.Err() != nil {
+			s.metrics().IncrCounter([]string{"socks5", "dial", "canceled"}, 1)
+			return fmt.Errorf("Connect to %v canceled: %v", req.DestAddr, err)
 		}
-		return fmt.Errorf("Connect to %v failed: %v", req.DestAddr, err)
+		return s.replyError(conn, req, err)
 	}
-	defer target.Close()
+	s.state.upstream(1)
+	s.config.Destinations.opened(req.DestAddr)
+	parked := false
+	defer func() {
+		s.state.upstream(-1)
+		if !parked {
+			target.Close()
+		}
+	}()
+	defer s.countFastOpen(target)
 
 	// Send success
-	local := target.LocalAddr().(*net.TCPAddr)
-	bind := AddrSpec{IP: local.IP, Port: local.Port}
-	if err := sendReply(conn, successReply, &bind); err != nil {
+	// Upstreams which are not TCP, e.g. from a custom Dial,
+	// are replied with the 0.0.0.0:0 placeholder
+	bind := netAddrSpec(target.LocalAddr())
+	if err := s.reply(conn, req, SuccessReply, bind); err != nil {
 		return fmt.Errorf("Failed to send reply: %v", err)
 	}
 
+	parked, err = s.proxy(ctx, conn, req, target, true)
+	return err
+}
+
+// proxy is used to relay between the client and the target until
+// either side closes, returning if the target was parked for the
+// client to resume, which requires the request to be resumable
+func (s *Server) proxy(ctx context.Context, conn conn, req *Request, target net.Conn, resumable bool) (parked bool, err error) {
+	client := &errorRecorder{r: req.bufConn}
+	var upstream, downstream io.Reader = client, target
+
+	// Let the StreamTransformer wrap both sides, if any
+	var clientW, targetW io.Writer = conn, target
+	if t := s.config.StreamTransformer; t != nil {
+		clientRW, targetRW, err := t.Transform(ctx, req, &streamPair{upstream, conn}, &streamPair{downstream, target})
+		if err != nil {
+			return false, fmt.Errorf("Failed to transform stream to %v: %v", req.DestAddr, err)
+		}
+		upstream, clientW = clientRW, clientRW
+		downstream, targetW = targetRW, targetRW
+	}
+
 	// Start proxying
-	errCh := make(chan error, 2)
-	go proxy(target, req.bufConn, errCh)
-	go proxy(conn, target, errCh)
-
-	// Wait
-	for i := 0; i < 2; i++ {
-		e := <-errCh
-		if e != nil {
-			// return from this function closes target (and conn).
-			return e
+	session := &streamCounters{start: time.Now()}
+	relay := &relayEntry{ctx: ctx, req: req, session: session}
+	s.state.trackRelay(relay, true)
+	defer s.state.trackRelay(relay, false)
+	s.tracef(ctx, "relay", "started")
+	defer func() {
+		stats := session.snapshot()
+		s.config.Destinations.closed(req.DestAddr, stats)
+		if end := req.relayEnd; end != nil {
+			s.tracef(ctx, "relay", "stopped after %v, %d bytes up, %d bytes down, ended by %v (%s)", stats.Elapsed, stats.BytesUp, stats.BytesDown, end.Side, end.Class)
+		} else {
+			s.tracef(ctx, "relay", "stopped after %v, %d bytes up, %d bytes down", stats.Elapsed, stats.BytesUp, stats.BytesDown)
 		}
+	}()
+	up, down := s.relayCopies(ctx, conn, target, session)
+	up.dst, up.src = targetW, upstream
+	down.dst, down.src = clientW, downstream
+	if limiter := up.limiter; limiter != nil {
+		limiter.open(up.class)
+		defer limiter.close(up.class)
 	}
-	return nil
+	upCh, downCh := make(chan error, 1), make(chan error, 1)
+	s.spawn("relay", func() { s.relay(up, upCh) })
+	s.spawn("relay", func() { s.relay(down, downCh) })
+
+	// Wait, checking the StreamPolicy periodically
+	var tick <-chan time.Time
+	if s.config.StreamPolicy != nil {
+		ticker := time.NewTicker(s.streamPolicyInterval())
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	var expired <-chan time.Time
+	lifetime := s.relayLifetime()
+	if lifetime > 0 {
+		timer := time.NewTimer(lifetime)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	ended := func(c *relayCopy, err error) {
+		if req.relayEnd == nil {
+			req.relayEnd = c.end(err)
+		}
+	}
+	for upCh != nil || downCh != nil {
+		select {
+		case e := <-upCh:
+			ended(up, e)
+			if e != nil {
+				s.emit(&Event{Type: EventRelayError, Addr: conn.RemoteAddr(), Request: req, Err: e, Relay: req.relayEnd})
+				// Keep the upstream if the client may resume
+				if resumable && client.err != nil && s.config.ResumeWindow > 0 && e != ErrIdleTimeout && e != ErrQuotaExceeded {
+					parked = s.park(req, target, downCh)
+				}
+				// the handler closes target (and conn) once we return
+				return parked, e
+			}
+			upCh = nil
+		case e := <-downCh:
+			ended(down, e)
+			if e != nil {
+				s.emit(&Event{Type: EventRelayError, Addr: conn.RemoteAddr(), Request: req, Err: e, Relay: req.relayEnd})
+				return parked, e
+			}
+			downCh = nil
+		case <-tick:
+			if err := s.config.StreamPolicy.Check(ctx, req, session.snapshot()); err != nil {
+				s.metrics().IncrCounter([]string{"socks5", "stream", "terminated"}, 1)
+				err = fmt.Errorf("Session to %v terminated by policy: %v", req.DestAddr, err)
+				req.relayEnd = &RelayEnd{Side: SideProxy, Class: errClassClosed, Err: err}
+				req.denied = true
+				return parked, err
+			}
+		case <-expired:
+			s.metrics().IncrCounter([]string{"socks5", "relay", "lifetime"}, 1)
+			s.expire(ctx, req, ExpireSession, lifetime, ErrMaxLifetime)
+			req.relayEnd = &RelayEnd{Side: SideProxy, Class: errClassLifetime, Err: ErrMaxLifetime}
+			return parked, ErrMaxLifetime
+		case <-ctx.Done():
+			if req.relayEnd == nil {
+				req.relayEnd = &RelayEnd{Side: SideProxy, Class: errClassClosed, Err: ctx.Err()}
+			}
+			return parked, ctx.Err()
+		}
+	}
+	return parked, nil
 }
 
-// handleBind is used to handle a connect command
-func (s *Server) handleBind(ctx context.Context, conn conn, req *Request) error {
+// park is used to stop relaying an upstream connection, after the
+// client disconnected abnormally, and keep it for resumption
+func (s *Server) park(req *Request, target net.Conn, downCh chan error) bool {
+	// The upstream closed its side already, so it cannot be resumed
+	if downCh == nil {
+		return false
+	}
+
+	// Interrupt the relay to the client, without closing the upstream
+	target.SetReadDeadline(time.Now())
+	<-downCh
+	target.SetReadDeadline(time.Time{})
+	return s.parkSession(req, target)
+}
+
+// connect is used to check a prepared request against the rules
+// and dial its destination, ensuring the approved IP was reached
+func (s *Server) connect(ctx context.Context, req *Request) (context.Context, net.Conn, error) {
+	// Never connect back to the proxy, if guarded
+	if err := s.checkSelf(req); err != nil {
+		s.deny(ctx, req, DenySelf, RuleFailure, err)
+		return ctx, nil, &requestError{RuleFailure, err}
+	}
+
 	// Check if this is allowed
 	if ctx_, ok := s.config.Rules.Allow(ctx, req); !ok {
-		if err := sendReply(conn, ruleFailure, nil); err != nil {
-			return fmt.Errorf("Failed to send reply: %v", err)
-		}
-		return fmt.Errorf("Bind to %v blocked by rules", req.DestAddr)
+		denial := denialFromContext(ctx_)
+		err := denial.denyError("Connect", req.DestAddr)
+		s.deny(ctx, req, DenyRule, denial.Reply, err)
+		return ctx, nil, &requestError{denial.Reply, err}
 	} else {
 		ctx = ctx_
 	}
 
-	// TODO: Support bind
-	if err := sendReply(conn, commandNotSupported, nil); err != nil {
-		return fmt.Errorf("Failed to send reply: %v", err)
+	// Pin the approved address, and the backends a ServiceRouter
+	// may fail over to which the rules approve as well
+	req.PinnedIP = req.realDestAddr.IP
+	ctx = s.approveBackends(ctx, req)
+
+	// Attempt to connect, unless the client resumes a session
+	// or an idle connection is available
+	start := time.Now()
+	target, err := s.resumeSession(req), error(nil)
+	resumed := target != nil
+	if target == nil {
+		target = s.pooledConn(req, func(req *Request) (net.Conn, error) {
+			return s.dial(context.Background(), req)
+		})
 	}
-	return nil
+	if target == nil {
+		target, err = s.dial(ctx, req)
+	}
+	s.metrics().MeasureSince([]string{"socks5", "dial"}, start, Label{Name: "dest", Value: destHost(req.DestAddr)})
+	if err != nil {
+		s.tracef(ctx, "dial", "%v failed after %v: %v", req.realDestAddr, time.Since(start), err)
+		atomic.AddUint64(&s.state.stats().dialFailures, 1)
+		resp := dialErrorReply(err)
+		reason := ExpireDial
+		if errors.Is(err, ErrDialLimit) {
+			reason = ExpireDialQueue
+		}
+		err = fmt.Errorf("Connect to %v failed: %v", req.DestAddr, err)
+		if resp == TTLExpired {
+			s.expire(ctx, req, reason, time.Since(start), err)
+		}
+		return ctx, nil, &requestError{resp, err}
+	}
+
+	s.tracef(ctx, "dial", "connected to %v in %v, resumed %v", target.RemoteAddr(), time.Since(start), resumed)
+
+	// Ensure we connected to the approved destination
+	if err := s.verifyTarget(ctx, req, target); err != nil {
+		target.Close()
+		err = fmt.Errorf("Connect to %v rejected: %v", req.DestAddr, err)
+		s.deny(ctx, req, DenyRule, RuleFailure, err)
+		return ctx, nil, &requestError{RuleFailure, err}
+	}
+
+	// Resumed sessions were wrapped already
+	if !resumed {
+		conn, err := s.originateTLS(ctx, req, target)
+		if err != nil {
+			target.Close()
+			return ctx, nil, &requestError{HostUnreachable, err}
+		}
+		target = conn
+	}
+	return ctx, target, nil
 }
 
-// handleAssociate is used to handle a connect command
-func (s *Server) handleAssociate(ctx context.Context, conn conn, req *Request) error {
+// handleBind is used to handle a bind command, accepting one
+// connection from the peer of the client and relaying it
+func (s *Server) handleBind(ctx context.Context, conn conn, req *Request) error {
 	// Check if this is allowed
 	if ctx_, ok := s.config.Rules.Allow(ctx, req); !ok {
-		if err := sendReply(conn, ruleFailure, nil); err != nil {
+		denial := denialFromContext(ctx_)
+		err := denial.denyError("Bind", req.DestAddr)
+		s.deny(ctx, req, DenyRule, denial.Reply, err)
+		if err := s.reply(conn, req, denial.Reply, nil); err != nil {
 			return fmt.Errorf("Failed to send reply: %v", err)
 		}
-		return fmt.Errorf("Associate to %v blocked by rules", req.DestAddr)
+		return err
 	} else {
 		ctx = ctx_
 	}
 
-	// TODO: Support associate
-	if err := sendReply(conn, commandNotSupported, nil); err != nil {
+	ln, err := net.ListenTCP("tcp", s.bindAddr(req))
+	if err != nil {
+		err = fmt.Errorf("Failed to listen for bind: %v", err)
+		if err := s.reply(conn, req, ServerFailure, nil); err != nil {
+			return fmt.Errorf("Failed to send reply: %v", err)
+		}
+		return err
+	}
+	defer ln.Close()
+	if !s.state.trackResource(ln, true) {
+		s.reply(conn, req, ServerFailure, nil)
+		return ErrServerClosed
+	}
+	defer s.state.trackResource(ln, false)
+
+	// Send the address the peer is to connect to
+	if err := s.reply(conn, req, SuccessReply, netAddrSpec(ln.Addr())); err != nil {
 		return fmt.Errorf("Failed to send reply: %v", err)
 	}
-	return nil
+
+	// Wait for the peer, giving up once the client goes away
+	stop := s.watchClient(conn, req.bufConn, func() { ln.Close() })
+	peer, err := s.acceptPeer(ln, req)
+	stop()
+	if err != nil {
+		err = fmt.Errorf("Failed to accept bind peer: %v", err)
+		if err := s.reply(conn, req, ServerFailure, nil); err != nil {
+			return fmt.Errorf("Failed to send reply: %v", err)
+		}
+		return err
+	}
+	ln.Close()
+	s.state.upstream(1)
+	s.config.Destinations.opened(req.DestAddr)
+	defer func() {
+		s.state.upstream(-1)
+		peer.Close()
+	}()
+
+	// Send the address of the peer as is, which the
+	// ReplyAddressHook does not apply to
+	s.countReply(req, SuccessReply)
+	if err := s.codec().WriteReply(conn, req, SuccessReply, netAddrSpec(peer.RemoteAddr())); err != nil {
+		return fmt.Errorf("Failed to send reply: %v", err)
+	}
+
+	_, err = s.proxy(ctx, conn, req, peer, false)
+	return err
+}
+
+// bindAddr returns the address to accept the peer of a bind on,
+// which is the address the client reached us at unless configured
+// otherwise
+func (s *Server) bindAddr(req *Request) *net.TCPAddr {
+	switch {
+	case s.config.BindIP != nil:
+		return &net.TCPAddr{IP: s.config.BindIP}
+	case req.localAddr != nil:
+		return &net.TCPAddr{IP: req.localAddr.IP, Zone: req.localAddr.Zone}
+	}
+	return &net.TCPAddr{}
+}
+
+// acceptPeer is used to accept the connection of the peer of a bind,
+// within the DialTimeout. Connections from other addresses than the
+// one requested, if any, are closed.
+func (s *Server) acceptPeer(ln *net.TCPListener, req *Request) (net.Conn, error) {
+	if timeout := s.config.DialTimeout; timeout > 0 {
+		ln.SetDeadline(time.Now().Add(timeout))
+	}
+	expected := req.DestAddr.IP
+	for {
+		peer, err := ln.AcceptTCP()
+		if err != nil {
+			return nil, err
+		}
+		addr := peer.RemoteAddr().(*net.TCPAddr)
+		if expected == nil || expected.IsUnspecified() || expected.Equal(addr.IP) {
+			return peer, nil
+		}
+		s.metrics().IncrCounter([]string{"socks5", "bind", "rejected"}, 1)
+		s.logf(LogWarn, "Rejected bind peer %v, expected %v", addr, req.DestAddr)
+		peer.Close()
+	}
 }
 
 // readAddrSpec is used to read AddrSpec.
@@ -258,7 +713,7 @@ func readAddrSpec(r io.Reader) (*AddrSpec, error) {
 
 	// Get the address type
 	addrType := []byte{0}
-	if _, err := r.Read(addrType); err != nil {
+	if _, err := io.ReadFull(r, addrType); err != nil {
 		return nil, err
 	}
 
@@ -279,10 +734,13 @@ func readAddrSpec(r io.Reader) (*AddrSpec, error) {
 		d.IP = net.IP(addr)
 
 	case fqdnAddress:
-		if _, err := r.Read(addrType); err != nil {
+		if _, err := io.ReadFull(r, addrType); err != nil {
 			return nil, err
 		}
 		addrLen := int(addrType[0])
+		if addrLen == 0 {
+			return nil, fmt.Errorf("Empty FQDN")
+		}
 		fqdn := make([]byte, addrLen)
 		if _, err := io.ReadAtLeast(r, fqdn, addrLen); err != nil {
 			return nil, err
@@ -303,9 +761,94 @@ func readAddrSpec(r io.Reader) (*AddrSpec, error) {
 	return d, nil
 }
 
-// sendReply is used to send a reply message
-func sendReply(w io.Writer, resp uint8, addr *AddrSpec) error {
+// reply is used to send the reply to a request, applying
+// the configured reply address mode and family preference
+func (s *Server) reply(w io.Writer, req *Request, resp uint8, addr *AddrSpec) error {
+	if addr != nil {
+		addr = s.replyAddr(req, addr)
+	}
+	return s.sendReply(w, req, resp, addr)
+}
+
+// sendReply is used to send a reply with the address as is, for
+// addresses the client must reach, encoded by the codec
+func (s *Server) sendReply(w io.Writer, req *Request, resp uint8, addr *AddrSpec) error {
+	if resp == SuccessReply {
+		addr = s.AdvertiseAddr(req.context(), req, addr)
+	}
+	s.countReply(req, resp)
+	return s.codec().WriteReply(w, req, resp, addr)
+}
+
+// countReply is used to count the replies by command, reply code,
+// auth method and user, as socks5.reply
+func (s *Server) countReply(req *Request, resp uint8) {
+	var method, user string
+	if ac := req.AuthContext; ac != nil {
+		method = strconv.Itoa(int(ac.Method))
+		user = ac.Payload["Username"]
+	}
+	s.metrics().IncrCounter([]string{"socks5", "reply"}, 1,
+		Label{Name: "command", Value: strconv.Itoa(int(req.Command))},
+		Label{Name: "reply", Value: strconv.Itoa(int(resp))},
+		Label{Name: "method", Value: method},
+		Label{Name: "user", Value: user})
+}
+
+// SendReply is used to send a reply message with the given reply code
+// and bound address. A nil address is sent as 0.0.0.0:0. It allows
+// custom command handlers to answer clients in the wire format.
+func SendReply(w io.Writer, resp uint8, addr *AddrSpec) error {
+	return writeReply(w, resp, addr, false)
+}
+
+// ReadReply is used to read a reply message, returning the reply
+// code and bound address. It allows clients to parse the replies
+// of a server.
+func ReadReply(r io.Reader) (uint8, *AddrSpec, error) {
+	header := []byte{0, 0, 0}
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, fmt.Errorf("Failed to read reply: %v", err)
+	}
+	if header[0] != socks5Version {
+		return 0, nil, fmt.Errorf("Unsupported reply version: %v", header[0])
+	}
+	addr, err := readAddrSpec(r)
+	if err != nil {
+		return 0, nil, fmt.Errorf("Failed to read bound address: %v", err)
+	}
+	return header[1], addr, nil
+}
+
+// writeReply is used to send a reply message, optionally
+// encoding IPv4 addresses in their IPv4-mapped IPv6 form
+func writeReply(w io.Writer, resp uint8, addr *AddrSpec, ipv6 bool) error {
 	// Format the address
+	formatAddr := formatAddrSpec
+	if ipv6 {
+		formatAddr = formatIPv6AddrSpec
+	}
+	addrBody, err := formatAddr(addr)
+	if err != nil {
+		return err
+	}
+
+	// Format the message
+	msg := make([]byte, 3+len(addrBody))
+	msg[0] = socks5Version
+	msg[1] = resp
+	msg[2] = 0 // Reserved
+	copy(msg[3:], addrBody)
+
+	// Send the message
+	_, err = w.Write(msg)
+	return err
+}
+
+// formatAddrSpec is used to encode an AddrSpec as the address type,
+// address and port, the inverse of readAddrSpec. A nil AddrSpec
+// is encoded as the IPv4 address 0.0.0.0 and port 0.
+func formatAddrSpec(addr *AddrSpec) ([]byte, error) {
 	var addrType uint8
 	var addrBody []byte
 	var addrPort uint16
@@ -316,6 +859,9 @@ func sendReply(w io.Writer, resp uint8, addr *AddrSpec) error {
 		addrPort = 0
 
 	case addr.FQDN != "":
+		if len(addr.FQDN) > 255 {
+			return nil, fmt.Errorf("Failed to format address: FQDN too long: %v", addr)
+		}
 		addrType = fqdnAddress
 		addrBody = append([]byte{byte(len(addr.FQDN))}, addr.FQDN...)
 		addrPort = uint16(addr.Port)
@@ -331,22 +877,32 @@ func sendReply(w io.Writer, resp uint8, addr *AddrSpec) error {
 		addrPort = uint16(addr.Port)
 
 	default:
-		return fmt.Errorf("Failed to format address: %v", addr)
+		return nil, fmt.Errorf("Failed to format address: %v", addr)
 	}
 
-	// Format the message
-	msg := make([]byte, 6+len(addrBody))
-	msg[0] = socks5Version
-	msg[1] = resp
-	msg[2] = 0 // Reserved
-	msg[3] = addrType
-	copy(msg[4:], addrBody)
-	msg[4+len(addrBody)] = byte(addrPort >> 8)
-	msg[4+len(addrBody)+1] = byte(addrPort & 0xff)
+	return appendAddrSpec(addrType, addrBody, addrPort), nil
+}
 
-	// Send the message
-	_, err := w.Write(msg)
-	return err
+// formatIPv6AddrSpec is like formatAddrSpec, but encodes all IP
+// addresses as IPv6, using the IPv4-mapped form for IPv4 addresses.
+// A nil AddrSpec is encoded as the IPv6 address :: and port 0.
+func formatIPv6AddrSpec(addr *AddrSpec) ([]byte, error) {
+	switch {
+	case addr == nil:
+		return appendAddrSpec(ipv6Address, net.IPv6zero, 0), nil
+	case addr.FQDN == "" && addr.IP.To16() != nil:
+		return appendAddrSpec(ipv6Address, addr.IP.To16(), uint16(addr.Port)), nil
+	}
+	return formatAddrSpec(addr)
+}
+
+// appendAddrSpec is used to join the encoded parts of an address
+func appendAddrSpec(addrType uint8, addrBody []byte, addrPort uint16) []byte {
+	buf := make([]byte, 0, 3+len(addrBody))
+	buf = append(buf, addrType)
+	buf = append(buf, addrBody...)
+	buf = append(buf, byte(addrPort>>8), byte(addrPort&0xff))
+	return buf
 }
 
 type closeWriter interface {
@@ -355,9 +911,9 @@ type closeWriter interface {
 
 // proxy is used to suffle data from src to destination, and sends errors
 // down a dedicated channel
-func proxy(dst io.Writer, src io.Reader, errCh chan error) {
-	_, err := io.Copy(dst, src)
-	if tcpConn, ok := dst.(closeWriter); ok {
+func proxy(c *relayCopy, buf []byte, errCh chan error) {
+	_, err := c.run(buf)
+	if tcpConn, ok := c.dst.(closeWriter); ok && err == nil {
 		tcpConn.CloseWrite()
 	}
 	errCh <- err
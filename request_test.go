@@ -3,12 +3,17 @@ package socks5
 import (
 	"bytes"
 	"encoding/binary"
+	"fmt"
 	"io"
 	"log"
 	"net"
 	"os"
 	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"golang.org/x/net/context"
 )
 
 type MockConn struct {
@@ -29,22 +34,27 @@ func TestRequest_Connect(t *testing.T) {
 	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
+	errCh := make(chan error, 1)
 	go func() {
 		conn, err := l.Accept()
 		if err != nil {
-			t.Fatalf("err: %v", err)
+			errCh <- err
+			return
 		}
 		defer conn.Close()
 
 		buf := make([]byte, 4)
 		if _, err := io.ReadAtLeast(conn, buf, 4); err != nil {
-			t.Fatalf("err: %v", err)
+			errCh <- err
+			return
 		}
 
 		if !bytes.Equal(buf, []byte("ping")) {
-			t.Fatalf("bad: %v", buf)
+			errCh <- fmt.Errorf("bad: %v", buf)
+			return
 		}
 		conn.Write([]byte("pong"))
+		errCh <- nil
 	}()
 	lAddr := l.Addr().(*net.TCPAddr)
 
@@ -96,6 +106,9 @@ func TestRequest_Connect(t *testing.T) {
 	if !bytes.Equal(out, expected) {
 		t.Fatalf("bad: %v %v", out, expected)
 	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("err: %v", err)
+	}
 }
 
 func TestRequest_Connect_RuleFail(t *testing.T) {
@@ -104,22 +117,27 @@ func TestRequest_Connect_RuleFail(t *testing.T) {
 	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
+	errCh := make(chan error, 1)
 	go func() {
 		conn, err := l.Accept()
 		if err != nil {
-			t.Fatalf("err: %v", err)
+			errCh <- err
+			return
 		}
 		defer conn.Close()
 
 		buf := make([]byte, 4)
 		if _, err := io.ReadAtLeast(conn, buf, 4); err != nil {
-			t.Fatalf("err: %v", err)
+			errCh <- err
+			return
 		}
 
 		if !bytes.Equal(buf, []byte("ping")) {
-			t.Fatalf("bad: %v", buf)
+			errCh <- fmt.Errorf("bad: %v", buf)
+			return
 		}
 		conn.Write([]byte("pong"))
+		errCh <- nil
 	}()
 	lAddr := l.Addr().(*net.TCPAddr)
 
@@ -166,4 +184,340 @@ func TestRequest_Connect_RuleFail(t *testing.T) {
 	if !bytes.Equal(out, expected) {
 		t.Fatalf("bad: %v %v", out, expected)
 	}
+	select {
+	case err := <-errCh:
+		t.Fatalf("err: %v", err)
+	default:
+	}
+}
+
+func TestAddrSpec_NetAddr(t *testing.T) {
+	var addr net.Addr = &AddrSpec{IP: net.ParseIP("10.0.0.1"), Port: 80}
+	if addr.Network() != "tcp" || addr.String() != "10.0.0.1:80" {
+		t.Fatalf("bad: %v %v", addr.Network(), addr.String())
+	}
+}
+
+func TestAddrSpec_Binary(t *testing.T) {
+	for _, a := range []*AddrSpec{
+		{IP: net.ParseIP("10.0.0.1").To4(), Port: 80},
+		{IP: net.ParseIP("::1"), Port: 443},
+		{FQDN: "example.com", Port: 8080},
+	} {
+		b, err := a.MarshalBinary()
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		var out AddrSpec
+		if err := out.UnmarshalBinary(b); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if out.FQDN != a.FQDN || !out.IP.Equal(a.IP) || out.Port != a.Port {
+			t.Fatalf("bad: %v %v", a, out)
+		}
+	}
+
+	var out AddrSpec
+	if err := out.UnmarshalBinary([]byte{ipv4Address, 10, 0, 0, 1, 0, 80, 0}); err == nil {
+		t.Fatalf("expected error on trailing data")
+	}
+}
+
+func TestParseAddrSpec(t *testing.T) {
+	a, err := ParseAddrSpec("[::1]:1080")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !a.IP.Equal(net.ParseIP("::1")) || a.Port != 1080 || a.FQDN != "" {
+		t.Fatalf("bad: %v", a)
+	}
+
+	a, err = ParseAddrSpec("example.com:80")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if a.FQDN != "example.com" || a.Port != 80 || a.IP != nil {
+		t.Fatalf("bad: %v", a)
+	}
+	if a.Address() != "example.com:80" {
+		t.Fatalf("bad: %v", a.Address())
+	}
+
+	for _, bad := range []string{"example.com", "example.com:http", "10.0.0.1:70000"} {
+		if _, err := ParseAddrSpec(bad); err == nil {
+			t.Fatalf("expected error: %v", bad)
+		}
+	}
+}
+
+// mapRewriter rewrites known FQDNs and vetoes everything else
+type mapRewriter map[string]*AddrSpec
+
+func (m mapRewriter) Rewrite(ctx context.Context, req *Request) (context.Context, *AddrSpec, error) {
+	addr, ok := m[req.DestAddr.FQDN]
+	if !ok {
+		return ctx, nil, fmt.Errorf("unknown service %q", req.DestAddr.FQDN)
+	}
+	return ctx, addr, nil
+}
+
+func TestRequest_Rewrite(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		conn.Write([]byte("pong"))
+		conn.Close()
+	}()
+	lAddr := l.Addr().(*net.TCPAddr)
+
+	s := &Server{config: &Config{
+		Rules:    PermitAll(),
+		Resolver: DNSResolver{},
+		Logger:   log.New(os.Stdout, "", log.LstdFlags),
+		Rewriter: mapRewriter{
+			"localhost": {IP: lAddr.IP, Port: lAddr.Port},
+		},
+	}}
+
+	// A known name is rewritten to the listener
+	buf := bytes.NewBuffer([]byte{5, 1, 0, 3, 9})
+	buf.WriteString("localhost")
+	buf.Write([]byte{0, 1})
+	req, err := NewRequest(buf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp := &MockConn{}
+	if err := s.handleRequest(req, resp); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out := resp.buf.Bytes(); out[1] != SuccessReply || !bytes.HasSuffix(out, []byte("pong")) {
+		t.Fatalf("bad: %v", out)
+	}
+
+	// Anything else is vetoed
+	buf = bytes.NewBuffer([]byte{5, 1, 0, 1, 127, 0, 0, 1, 0, 1})
+	req, err = NewRequest(buf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp = &MockConn{}
+	if err := s.handleRequest(req, resp); err == nil || !strings.Contains(err.Error(), "unknown service") {
+		t.Fatalf("err: %v", err)
+	}
+	if out := resp.buf.Bytes(); out[1] != RuleFailure {
+		t.Fatalf("bad: %v", out)
+	}
+}
+
+func TestSendReply(t *testing.T) {
+	var buf bytes.Buffer
+	addr := &AddrSpec{IP: net.ParseIP("10.0.0.1"), Port: 1080}
+	if err := SendReply(&buf, SuccessReply, addr); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expected := []byte{5, SuccessReply, 0, ipv4Address, 10, 0, 0, 1, 4, 56}
+	if !bytes.Equal(buf.Bytes(), expected) {
+		t.Fatalf("bad: %v", buf.Bytes())
+	}
+
+	buf.Reset()
+	if err := SendReply(&buf, HostUnreachable, nil); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expected = []byte{5, HostUnreachable, 0, ipv4Address, 0, 0, 0, 0, 0, 0}
+	if !bytes.Equal(buf.Bytes(), expected) {
+		t.Fatalf("bad: %v", buf.Bytes())
+	}
+}
+
+func TestReadReply(t *testing.T) {
+	var buf bytes.Buffer
+	addr := &AddrSpec{FQDN: "example.com", Port: 80}
+	if err := SendReply(&buf, ConnectionRefused, addr); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp, bind, err := ReadReply(&buf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if resp != ConnectionRefused || bind.FQDN != "example.com" || bind.Port != 80 {
+		t.Fatalf("bad: %v %v", resp, bind)
+	}
+
+	if _, _, err := ReadReply(bytes.NewReader([]byte{4, 0, 0})); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestRequest_ConnectNonTCP(t *testing.T) {
+	s := &Server{config: &Config{
+		Rules:    PermitAll(),
+		Resolver: DNSResolver{},
+		Logger:   log.New(os.Stdout, "", log.LstdFlags),
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			client, server := net.Pipe()
+			go func() {
+				server.Write([]byte("pong"))
+				server.Close()
+			}()
+			return client, nil
+		},
+	}}
+
+	req, err := NewRequest(bytes.NewBuffer([]byte{5, 1, 0, 1, 127, 0, 0, 1, 0, 80}))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	req.bufConn = bytes.NewBuffer(nil)
+	resp := &MockConn{}
+	if err := s.handleRequest(req, resp); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The bind address of the pipe is replaced by a placeholder
+	expected := []byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0, 'p', 'o', 'n', 'g'}
+	if !bytes.Equal(resp.buf.Bytes(), expected) {
+		t.Fatalf("bad: %v", resp.buf.Bytes())
+	}
+}
+
+// addrMetrics records the address type of the requests
+type addrMetrics struct {
+	*testMetrics
+	l     sync.Mutex
+	types []string
+}
+
+func (m *addrMetrics) IncrCounter(key []string, val float32, labels ...Label) {
+	m.testMetrics.IncrCounter(key, val, labels...)
+	if strings.Join(key, ".") != "socks5.request.addr" {
+		return
+	}
+	m.l.Lock()
+	defer m.l.Unlock()
+	for _, label := range labels {
+		m.types = append(m.types, label.Value)
+	}
+}
+
+func TestRequest_SentFQDN(t *testing.T) {
+	req, err := NewRequest(bytes.NewBuffer([]byte{5, 1, 0, 3, 7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 0, 80}))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !req.SentFQDN {
+		t.Fatalf("bad: %v", req)
+	}
+	req, err = NewRequest(bytes.NewBuffer([]byte{5, 1, 0, 1, 127, 0, 0, 1, 0, 80}))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if req.SentFQDN {
+		t.Fatalf("bad: %v", req)
+	}
+
+	target := echoTarget(t)
+	defer target.Close()
+	port := target.Addr().(*net.TCPAddr).Port
+
+	metrics := &addrMetrics{testMetrics: newTestMetrics()}
+	serv, err := New(&Config{Resolver: loopbackResolver{}, Metrics: metrics})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	go serv.Serve(l)
+
+	conn, resp := connectThrough(t, l.Addr(), target.Addr())
+	conn.Close()
+	if resp != SuccessReply {
+		t.Fatalf("bad: %v", resp)
+	}
+
+	conn, err = net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+	conn.Write([]byte{5, 1, NoAuth, 5, ConnectCommand, 0, fqdnAddress, 7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', byte(port >> 8), byte(port)})
+	if _, err := io.ReadFull(conn, make([]byte, 2)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if resp, _, err := ReadReply(conn); err != nil || resp != SuccessReply {
+		t.Fatalf("bad: %v %v", resp, err)
+	}
+
+	metrics.l.Lock()
+	defer metrics.l.Unlock()
+	if fmt.Sprint(metrics.types) != "[ip fqdn]" {
+		t.Fatalf("bad: %v", metrics.types)
+	}
+}
+
+func TestRequest_Bind(t *testing.T) {
+	serv, _ := New(&Config{LogLevel: LogOff})
+	defer serv.Close()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	go serv.Serve(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	conn.Write([]byte{5, 1, NoAuth})
+	conn.Write([]byte{5, BindCommand, 0, ipv4Address, 127, 0, 0, 1, 0, 0})
+	out := make([]byte, 2)
+	if _, err := io.ReadFull(conn, out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The first reply holds the address the peer connects to
+	resp, bind, err := ReadReply(conn)
+	if err != nil || resp != SuccessReply {
+		t.Fatalf("bad: %v %v", resp, err)
+	}
+	peer, err := net.Dial("tcp", bind.Address())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer peer.Close()
+	peer.SetDeadline(time.Now().Add(2 * time.Second))
+
+	// The second reply holds the address of the peer
+	resp, accepted, err := ReadReply(conn)
+	if err != nil || resp != SuccessReply {
+		t.Fatalf("bad: %v %v", resp, err)
+	}
+	if accepted.Port != peer.LocalAddr().(*net.TCPAddr).Port {
+		t.Fatalf("bad: %v %v", accepted, peer.LocalAddr())
+	}
+
+	// Then both are relayed
+	conn.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(peer, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("bad: %q %v", buf, err)
+	}
+	peer.Write([]byte("pong"))
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "pong" {
+		t.Fatalf("bad: %q %v", buf, err)
+	}
 }
@@ -0,0 +1,73 @@
+package socks5
+
+import (
+	"errors"
+	"io"
+	"net"
+	"syscall"
+)
+
+// Classes of the errors which end connections, telling clients
+// which went away apart from actual failures
+const (
+	errClassEOF      = "eof"
+	errClassReset    = "reset"
+	errClassTimeout  = "timeout"
+	errClassClosed   = "closed"
+	errClassAuth     = "auth"
+	errClassProtocol = "protocol"
+
+	// errClassLifetime ends relays which reached their maximum
+	// lifetime, it is not the class of any error
+	errClassLifetime = "lifetime"
+)
+
+// classifyError is used to classify the error which ended a
+// connection by its cause
+func classifyError(err error) string {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return errClassEOF
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE),
+		errors.Is(err, io.ErrClosedPipe):
+		return errClassReset
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return errClassTimeout
+	case errors.Is(err, net.ErrClosed):
+		return errClassClosed
+	case errors.Is(err, UserAuthFailed), errors.Is(err, NoSupportedAuth):
+		return errClassAuth
+	}
+	return errClassProtocol
+}
+
+// handshakeError is the error of a failed handshake, with the
+// phase it failed in
+type handshakeError struct {
+	phase HandshakePhase
+	err   error
+}
+
+func (e *handshakeError) Error() string {
+	return e.err.Error()
+}
+
+func (e *handshakeError) Unwrap() error {
+	return e.err
+}
+
+// handshakeFailed is used to log and count a failed handshake,
+// classified by its phase and cause. Every failure goes through
+// it, including clients which disconnect at any point.
+func (s *Server) handshakeFailed(err error) {
+	phase := "unknown"
+	var hsErr *handshakeError
+	if errors.As(err, &hsErr) {
+		phase = hsErr.phase.String()
+	}
+	class := classifyError(err)
+	s.metrics().IncrCounter([]string{"socks5", "handshake", "failed"}, 1,
+		Label{Name: "phase", Value: phase}, Label{Name: "class", Value: class})
+	s.logf(LogError, "Handshake failed in %s (%s): %v", phase, class, err)
+}
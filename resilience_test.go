@@ -0,0 +1,159 @@
+package socks5
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"runtime"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// goroutines returns the stacks of the running goroutines by ID
+func goroutines() map[string]string {
+	buf := make([]byte, 1<<20)
+	buf = buf[:runtime.Stack(buf, true)]
+	out := make(map[string]string)
+	for _, g := range strings.Split(string(buf), "\n\n") {
+		fields := strings.Fields(g)
+		if len(fields) > 1 {
+			out[fields[1]] = g
+		}
+	}
+	return out
+}
+
+// checkLeaks fails the test if goroutines started after before was
+// taken are still running, giving them some time to exit first
+func checkLeaks(t *testing.T, before map[string]string) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		var leaked []string
+		for id, stack := range goroutines() {
+			if _, ok := before[id]; !ok {
+				leaked = append(leaked, stack)
+			}
+		}
+		if len(leaked) == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("leaked %d goroutines:\n\n%s", len(leaked), strings.Join(leaked, "\n\n"))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestClassifyError(t *testing.T) {
+	timeout := &net.OpError{Op: "read", Err: &timeoutError{}}
+	for err, class := range map[error]string{
+		io.EOF:                                   errClassEOF,
+		fmt.Errorf("x: %w", io.ErrUnexpectedEOF): errClassEOF,
+		&net.OpError{Op: "read", Err: syscall.ECONNRESET}: errClassReset,
+		io.ErrClosedPipe:                        errClassReset,
+		timeout:                                 errClassTimeout,
+		net.ErrClosed:                           errClassClosed,
+		ErrEmptyCredentials:                     errClassAuth,
+		errors.New("Unsupported SOCKS version"): errClassProtocol,
+	} {
+		if got := classifyError(err); got != class {
+			t.Fatalf("bad: %v %v", err, got)
+		}
+	}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// TestResilience_Disconnect closes the client connection at every
+// byte offset of the handshake, which must fail cleanly each time
+func TestResilience_Disconnect(t *testing.T) {
+	userPass := &UserPassAuthenticator{Credentials: StaticCredentials{"user": "pass"}}
+	for _, c := range []struct {
+		methods                 []Authenticator
+		greeting, auth, request []byte
+	}{
+		{
+			greeting: []byte{5, 1, NoAuth},
+			request:  []byte{5, ConnectCommand, 0, fqdnAddress, 9, 'l', 'o', 'c', 'a', 'l', 'h', 'o', 's', 't', 0, 9},
+		},
+		{
+			methods:  []Authenticator{userPass},
+			greeting: []byte{5, 2, NoAuth, UserPassAuth},
+			auth:     []byte{userAuthVersion, 4, 'u', 's', 'e', 'r', 4, 'p', 'a', 's', 's'},
+			request:  []byte{5, ConnectCommand, 0, ipv4Address, 127, 0, 0, 1, 0, 9},
+		},
+	} {
+		script := append(append(append([]byte{}, c.greeting...), c.auth...), c.request...)
+		before := goroutines()
+		for i := 0; i < len(script); i++ {
+			phase := PhaseRequest
+			switch {
+			case i < len(c.greeting):
+				phase = PhaseGreeting
+			case i < len(c.greeting)+len(c.auth):
+				phase = PhaseAuth
+			}
+
+			var logs bytes.Buffer
+			metrics := newTestMetrics()
+			serv, err := New(&Config{AuthMethods: c.methods, Logger: log.New(&logs, "", 0), Metrics: metrics})
+			if err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			client, server := net.Pipe()
+			done := make(chan error, 1)
+			go func() {
+				done <- serv.ServeConn(server)
+			}()
+
+			// Read the replies to the complete phases, so the server
+			// is reading when the client goes away
+			client.SetDeadline(time.Now().Add(time.Second))
+			if _, err := client.Write(script[:i]); err != nil {
+				t.Fatalf("err at %d: %v", i, err)
+			}
+			replies := 0
+			if i >= len(c.greeting) {
+				replies += 2
+			}
+			if len(c.auth) > 0 && i >= len(c.greeting)+len(c.auth) {
+				replies += 2
+			}
+			if _, err := io.ReadFull(client, make([]byte, replies)); err != nil {
+				t.Fatalf("err at %d: %v", i, err)
+			}
+			client.Close()
+
+			select {
+			case err := <-done:
+				if err == nil {
+					t.Fatalf("no error at %d", i)
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatalf("server hung at %d", i)
+			}
+
+			out := logs.String()
+			if strings.Contains(out, "Panic") || metrics.counter("socks5.panic") != 0 {
+				t.Fatalf("panic at %d: %s", i, out)
+			}
+			if !strings.Contains(out, fmt.Sprintf("Handshake failed in %v (%s)", phase, errClassEOF)) {
+				t.Fatalf("bad log at %d: %s", i, out)
+			}
+			if metrics.counter("socks5.handshake.failed") != 1 {
+				t.Fatalf("bad: %v", metrics.counters)
+			}
+		}
+		checkLeaks(t, before)
+	}
+}
@@ -11,6 +11,12 @@ type NameResolver interface {
 	Resolve(ctx context.Context, name string) (context.Context, net.IP, error)
 }
 
+// IPResolver is implemented by NameResolvers which can return all the
+// addresses of a name, which are tried by DialRetry with AlternateIPs
+type IPResolver interface {
+	ResolveAll(ctx context.Context, name string) ([]net.IP, error)
+}
+
 // DNSResolver uses the system DNS to resolve host names
 type DNSResolver struct{}
 
@@ -21,3 +27,15 @@ func (d DNSResolver) Resolve(ctx context.Context, name string) (context.Context,
 	}
 	return ctx, addr.IP, err
 }
+
+func (d DNSResolver) ResolveAll(ctx context.Context, name string) ([]net.IP, error) {
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IP, len(addrs))
+	for i, addr := range addrs {
+		ips[i] = addr.IP
+	}
+	return ips, nil
+}
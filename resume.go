@@ -0,0 +1,170 @@
+package socks5
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// connCache holds idle upstream connections by key, closing
+// each once it expires. It is safe for concurrent use.
+type connCache struct {
+	l       sync.Mutex
+	entries map[string][]*cachedConn
+}
+
+// cachedConn is an idle connection and its expiry timer
+type cachedConn struct {
+	conn  net.Conn
+	timer *time.Timer
+}
+
+// put adds a connection which expires after the ttl, unless there
+// are already max connections for the key. Returns if it was added.
+func (c *connCache) put(key string, conn net.Conn, ttl time.Duration, max int) bool {
+	c.l.Lock()
+	defer c.l.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[string][]*cachedConn)
+	}
+	if len(c.entries[key]) >= max {
+		return false
+	}
+	entry := &cachedConn{conn: conn}
+	entry.timer = time.AfterFunc(ttl, func() {
+		if c.remove(key, entry) {
+			conn.Close()
+		}
+	})
+	c.entries[key] = append(c.entries[key], entry)
+	return true
+}
+
+// remove deletes an entry, returning if it was present
+func (c *connCache) remove(key string, entry *cachedConn) bool {
+	c.l.Lock()
+	defer c.l.Unlock()
+	list := c.entries[key]
+	for i, e := range list {
+		if e == entry {
+			list = append(list[:i], list[i+1:]...)
+			if len(list) == 0 {
+				delete(c.entries, key)
+			} else {
+				c.entries[key] = list
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// get removes and returns the most recently added connection
+// for the key, or nil if there is none
+func (c *connCache) get(key string) net.Conn {
+	c.l.Lock()
+	defer c.l.Unlock()
+	list := c.entries[key]
+	if len(list) == 0 {
+		return nil
+	}
+	entry := list[len(list)-1]
+	if len(list) == 1 {
+		delete(c.entries, key)
+	} else {
+		c.entries[key] = list[:len(list)-1]
+	}
+	entry.timer.Stop()
+	return entry.conn
+}
+
+// count returns the number of cached connections for a key
+func (c *connCache) count(key string) int {
+	c.l.Lock()
+	defer c.l.Unlock()
+	return len(c.entries[key])
+}
+
+// len returns the number of cached connections
+func (c *connCache) len() int {
+	c.l.Lock()
+	defer c.l.Unlock()
+	n := 0
+	for _, list := range c.entries {
+		n += len(list)
+	}
+	return n
+}
+
+// Close closes all cached connections
+func (c *connCache) Close() error {
+	c.l.Lock()
+	defer c.l.Unlock()
+	for key, list := range c.entries {
+		for _, e := range list {
+			e.timer.Stop()
+			e.conn.Close()
+		}
+		delete(c.entries, key)
+	}
+	return nil
+}
+
+// sessionKey identifies the upstream connection of a client for
+// resumption, by its username. Clients which did not authenticate
+// are never resumed, as any other client behind the same IP could
+// otherwise take over their upstream.
+func sessionKey(req *Request) string {
+	if req.AuthContext == nil || req.AuthContext.Payload["Username"] == "" {
+		return ""
+	}
+	return "user:" + req.AuthContext.Payload["Username"] + "|" + req.realDestAddr.Address()
+}
+
+// resumeSession returns an upstream connection kept after an abnormal
+// disconnect of the same client from the same destination, if any
+func (s *Server) resumeSession(req *Request) net.Conn {
+	if s.config.ResumeWindow <= 0 || s.state == nil {
+		return nil
+	}
+	key := sessionKey(req)
+	if key == "" {
+		return nil
+	}
+	conn := s.state.sessions.get(key)
+	if conn != nil {
+		s.metrics().IncrCounter([]string{"socks5", "session", "resumed"}, 1)
+	}
+	return conn
+}
+
+// parkSession keeps the upstream connection of a client which
+// disconnected abnormally for the ResumeWindow. Returns if the
+// connection was kept, otherwise the caller must close it.
+func (s *Server) parkSession(req *Request, target net.Conn) bool {
+	if s.config.ResumeWindow <= 0 || s.state == nil || s.state.isClosed() {
+		return false
+	}
+	key := sessionKey(req)
+	if key == "" || !s.state.sessions.put(key, target, s.config.ResumeWindow, 1) {
+		return false
+	}
+	s.metrics().IncrCounter([]string{"socks5", "session", "parked"}, 1)
+	return true
+}
+
+// errorRecorder is used to record the read error of a stream,
+// to tell an abnormal disconnect apart from an orderly close
+type errorRecorder struct {
+	r   io.Reader
+	err error
+}
+
+func (e *errorRecorder) Read(b []byte) (int, error) {
+	n, err := e.r.Read(b)
+	if err != nil && err != io.EOF {
+		e.err = err
+	}
+	return n, err
+}
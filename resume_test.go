@@ -0,0 +1,136 @@
+package socks5
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestConnCache(t *testing.T) {
+	var c connCache
+	a, _ := net.Pipe()
+	b, _ := net.Pipe()
+
+	if !c.put("key", a, time.Minute, 1) {
+		t.Fatalf("expected put")
+	}
+	if c.put("key", b, time.Minute, 1) {
+		t.Fatalf("expected max")
+	}
+	if conn := c.get("key"); conn != a {
+		t.Fatalf("bad: %v", conn)
+	}
+	if conn := c.get("key"); conn != nil {
+		t.Fatalf("bad: %v", conn)
+	}
+
+	// Entries expire and are closed
+	c.put("key", b, 10*time.Millisecond, 1)
+	time.Sleep(50 * time.Millisecond)
+	if c.len() != 0 {
+		t.Fatalf("bad: %d", c.len())
+	}
+	if _, err := b.Write([]byte("x")); err != io.ErrClosedPipe {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestSOCKS5_ResumeWindow(t *testing.T) {
+	// Echo target counting its connections
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	var accepted int32
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&accepted, 1)
+			go io.Copy(conn, conn)
+		}
+	}()
+	lAddr := l.Addr().(*net.TCPAddr)
+
+	serv, _ := New(&Config{
+		Credentials:  StaticCredentials{"foo": "bar"},
+		ResumeWindow: time.Second,
+	})
+	defer serv.Close()
+	proxyL, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	go serv.Serve(proxyL)
+
+	connect := func() net.Conn {
+		conn, err := net.Dial("tcp", proxyL.Addr().String())
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		conn.SetDeadline(time.Now().Add(time.Second))
+		req := bytes.NewBuffer(nil)
+		req.Write([]byte{5, 1, UserPassAuth, 1, 3, 'f', 'o', 'o', 3, 'b', 'a', 'r'})
+		req.Write([]byte{5, ConnectCommand, 0, ipv4Address, 127, 0, 0, 1})
+		binary.Write(req, binary.BigEndian, uint16(lAddr.Port))
+		req.Write([]byte("ping"))
+		conn.Write(req.Bytes())
+
+		out := make([]byte, 2+2+10+4)
+		if _, err := io.ReadFull(conn, out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if out[5] != SuccessReply || string(out[14:]) != "ping" {
+			t.Fatalf("bad: %v", out)
+		}
+		return conn
+	}
+
+	// Reset the first connection, which parks the upstream
+	conn := connect()
+	conn.(*net.TCPConn).SetLinger(0)
+	conn.Close()
+	deadline := time.Now().Add(time.Second)
+	for serv.state.sessions.len() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("session not parked")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// Reconnecting resumes the upstream
+	conn = connect()
+	defer conn.Close()
+	if n := atomic.LoadInt32(&accepted); n != 1 {
+		t.Fatalf("bad: %d", n)
+	}
+}
+
+func TestSessionKey(t *testing.T) {
+	dest := &AddrSpec{IP: net.ParseIP("10.0.0.1"), Port: 143}
+	req := &Request{
+		RemoteAddr:   &AddrSpec{IP: net.ParseIP("192.168.0.1"), Port: 5000},
+		realDestAddr: dest,
+	}
+
+	// Clients which did not authenticate are not resumed
+	if key := sessionKey(req); key != "" {
+		t.Fatalf("bad: %v", key)
+	}
+	req.AuthContext = &AuthContext{Method: NoAuth, Payload: map[string]string{}}
+	if key := sessionKey(req); key != "" {
+		t.Fatalf("bad: %v", key)
+	}
+
+	req.AuthContext = &AuthContext{Method: UserPassAuth, Payload: map[string]string{"Username": "foo"}}
+	if key := sessionKey(req); key != "user:foo|10.0.0.1:143" {
+		t.Fatalf("bad: %v", key)
+	}
+}
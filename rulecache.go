@@ -0,0 +1,125 @@
+package socks5
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	defaultRuleCacheTTL  = time.Minute
+	defaultRuleCacheSize = 4096
+)
+
+// CachedRuleSet memoizes the decisions of a RuleSet, for hot paths
+// where the same user and destination recur. Only the decision and any
+// Denial are cached, so rules which attach other values to the context
+// should not be wrapped. Call Invalidate when the rules change, e.g.
+// from the OnChange hook of a DynamicRuleSet.
+type CachedRuleSet struct {
+	// Rules is the RuleSet whose decisions are cached
+	Rules RuleSet
+
+	// Key returns the cache key of a request. Defaults to the user,
+	// command, client IP and requested and rewritten destinations.
+	Key func(ctx context.Context, req *Request) string
+
+	// TTL is how long decisions are cached. Defaults to a minute.
+	TTL time.Duration
+
+	// Size bounds the number of cached decisions. Defaults to 4096.
+	Size int
+
+	// Metrics receives hit and miss counts. Defaults to NoopMetrics.
+	Metrics Metrics
+
+	l     sync.Mutex
+	cache map[string]ruleCacheEntry
+}
+
+type ruleCacheEntry struct {
+	allow   bool
+	denial  *Denial
+	expires time.Time
+}
+
+func (c *CachedRuleSet) metrics() Metrics {
+	if c.Metrics == nil {
+		return NoopMetrics{}
+	}
+	return c.Metrics
+}
+
+// ruleCacheKey is the default cache key of a request
+func ruleCacheKey(ctx context.Context, req *Request) string {
+	user, _ := UserFromContext(ctx)
+	parts := []string{user, strconv.Itoa(int(req.Command)), "", "", ""}
+	if req.RemoteAddr != nil {
+		parts[2] = req.RemoteAddr.IP.String()
+	}
+	if req.DestAddr != nil {
+		parts[3] = req.DestAddr.String()
+	}
+	if req.realDestAddr != nil {
+		parts[4] = req.realDestAddr.String()
+	}
+	return strings.Join(parts, "\x00")
+}
+
+func (c *CachedRuleSet) Allow(ctx context.Context, req *Request) (context.Context, bool) {
+	keyFn := c.Key
+	if keyFn == nil {
+		keyFn = ruleCacheKey
+	}
+	key := keyFn(ctx, req)
+	now := time.Now()
+
+	c.l.Lock()
+	entry, ok := c.cache[key]
+	c.l.Unlock()
+	if ok && now.Before(entry.expires) {
+		c.metrics().IncrCounter([]string{"socks5", "rules", "cache_hit"}, 1)
+		if !entry.allow && entry.denial != nil {
+			ctx = DenyWith(ctx, entry.denial.Reply, entry.denial.Reason)
+		}
+		return ctx, entry.allow
+	}
+	c.metrics().IncrCounter([]string{"socks5", "rules", "cache_miss"}, 1)
+
+	ctx_, allow := c.Rules.Allow(ctx, req)
+	entry = ruleCacheEntry{allow: allow, expires: now.Add(c.ttl())}
+	if !allow && ctx_ != nil {
+		if d, ok := ctx_.Value(ruleDenialKey{}).(*Denial); ok {
+			entry.denial = d
+		}
+	}
+
+	size := c.Size
+	if size == 0 {
+		size = defaultRuleCacheSize
+	}
+	c.l.Lock()
+	defer c.l.Unlock()
+	if c.cache == nil || len(c.cache) >= size {
+		c.cache = make(map[string]ruleCacheEntry)
+	}
+	c.cache[key] = entry
+	return ctx_, allow
+}
+
+func (c *CachedRuleSet) ttl() time.Duration {
+	if c.TTL == 0 {
+		return defaultRuleCacheTTL
+	}
+	return c.TTL
+}
+
+// Invalidate drops all cached decisions
+func (c *CachedRuleSet) Invalidate() {
+	c.l.Lock()
+	defer c.l.Unlock()
+	c.cache = nil
+}
@@ -0,0 +1,62 @@
+package socks5
+
+import (
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+// countingRules counts its evaluations, allowing port 80 only
+type countingRules struct {
+	calls int
+}
+
+func (r *countingRules) Allow(ctx context.Context, req *Request) (context.Context, bool) {
+	r.calls++
+	if req.DestAddr.Port != 80 {
+		return DenyWith(ctx, ConnectionRefused, "port"), false
+	}
+	return ctx, true
+}
+
+func TestCachedRuleSet(t *testing.T) {
+	rules := &countingRules{}
+	metrics := newTestMetrics()
+	c := &CachedRuleSet{Rules: rules, Metrics: metrics}
+
+	check := func(user string, port int) (context.Context, bool) {
+		ctx := WithUser(context.Background(), user)
+		return c.Allow(ctx, &Request{Command: ConnectCommand, DestAddr: &AddrSpec{FQDN: "example.com", Port: port}})
+	}
+	for i := 0; i < 3; i++ {
+		if _, ok := check("foo", 80); !ok {
+			t.Fatalf("expected allow")
+		}
+	}
+	if rules.calls != 1 {
+		t.Fatalf("bad: %v", rules.calls)
+	}
+
+	// Other users are evaluated separately
+	check("bar", 80)
+	if rules.calls != 2 {
+		t.Fatalf("bad: %v", rules.calls)
+	}
+
+	// Denials keep their reply code
+	check("foo", 22)
+	ctx, ok := check("foo", 22)
+	if ok || denialFromContext(ctx).Reply != ConnectionRefused || rules.calls != 3 {
+		t.Fatalf("bad: %v %v", ok, rules.calls)
+	}
+	if metrics.counter("socks5.rules.cache_hit") != 3 || metrics.counter("socks5.rules.cache_miss") != 3 {
+		t.Fatalf("bad: %v", metrics.counters)
+	}
+
+	// Invalidation drops the decisions
+	c.Invalidate()
+	check("foo", 80)
+	if rules.calls != 4 {
+		t.Fatalf("bad: %v", rules.calls)
+	}
+}
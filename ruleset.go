@@ -1,6 +1,8 @@
 package socks5
 
 import (
+	"fmt"
+
 	"golang.org/x/net/context"
 )
 
@@ -39,3 +41,43 @@ func (p *PermitCommand) Allow(ctx context.Context, req *Request) (context.Contex
 
 	return ctx, false
 }
+
+// ruleDenialKey is the context key of a Denial
+type ruleDenialKey struct{}
+
+// Denial describes why a RuleSet denied a request
+type Denial struct {
+	// Reply is the code sent to the client, such as HostUnreachable
+	Reply uint8
+	// Reason is recorded in logs and deny reports, but never
+	// sent to the client
+	Reason string
+}
+
+// DenyWith is used by a RuleSet to attach a reply code and reason
+// to a denial, instead of the default RuleFailure:
+//
+//	return socks5.DenyWith(ctx, socks5.HostUnreachable, "internal network"), false
+func DenyWith(ctx context.Context, reply uint8, reason string) context.Context {
+	return context.WithValue(ctx, ruleDenialKey{}, &Denial{Reply: reply, Reason: reason})
+}
+
+// denialFromContext returns the Denial attached by a RuleSet,
+// defaulting to RuleFailure
+func denialFromContext(ctx context.Context) *Denial {
+	if ctx == nil {
+		return &Denial{Reply: RuleFailure}
+	}
+	if d, ok := ctx.Value(ruleDenialKey{}).(*Denial); ok && d.Reply != SuccessReply {
+		return d
+	}
+	return &Denial{Reply: RuleFailure}
+}
+
+// denyError describes a denied request for logs
+func (d *Denial) denyError(op string, dest *AddrSpec) error {
+	if d.Reason == "" {
+		return fmt.Errorf("%s to %v blocked by rules", op, dest)
+	}
+	return fmt.Errorf("%s to %v blocked by rules: %s", op, dest, d.Reason)
+}
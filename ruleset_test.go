@@ -1,6 +1,10 @@
 package socks5
 
 import (
+	"bytes"
+	"log"
+	"os"
+	"strings"
 	"testing"
 
 	"golang.org/x/net/context"
@@ -22,3 +26,74 @@ func TestPermitCommand(t *testing.T) {
 		t.Fatalf("do not expect associate")
 	}
 }
+
+// unreachableRules denies all requests as unreachable
+type unreachableRules struct{}
+
+func (unreachableRules) Allow(ctx context.Context, req *Request) (context.Context, bool) {
+	return DenyWith(ctx, HostUnreachable, "internal network"), false
+}
+
+func TestDenyWith(t *testing.T) {
+	var reasons []*DenyReason
+	s := &Server{config: &Config{
+		Rules:    unreachableRules{},
+		Resolver: DNSResolver{},
+		Logger:   log.New(os.Stdout, "", log.LstdFlags),
+		OnDeny: func(ctx context.Context, req *Request, reason *DenyReason) {
+			reasons = append(reasons, reason)
+		},
+	}}
+
+	buf := bytes.NewBuffer([]byte{5, 1, 0, 1, 127, 0, 0, 1, 0, 80})
+	req, err := NewRequest(buf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp := &MockConn{}
+	if err := s.handleRequest(req, resp); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	if out := resp.buf.Bytes(); len(out) < 2 || out[1] != HostUnreachable {
+		t.Fatalf("bad: %v", out)
+	}
+	if len(reasons) != 1 || reasons[0].Reply != HostUnreachable ||
+		!strings.Contains(reasons[0].Err.Error(), "internal network") {
+		t.Fatalf("bad: %v", reasons)
+	}
+
+	// Rules without a denial default to RuleFailure
+	if d := denialFromContext(context.Background()); d.Reply != RuleFailure {
+		t.Fatalf("bad: %v", d)
+	}
+}
+
+func TestServer_EnabledCommands(t *testing.T) {
+	rules := &countingRules{}
+	s := &Server{config: &Config{
+		EnabledCommands: ConnectEnabled,
+		Rules:           rules,
+		Logger:          newDefaultLogger(),
+	}}
+	for _, cmd := range []uint8{BindCommand, AssociateCommand} {
+		req, err := NewRequest(bytes.NewBuffer([]byte{5, cmd, 0, 1, 127, 0, 0, 1, 0, 80}))
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		resp := &MockConn{}
+		if err := s.handleRequest(req, resp); err == nil || !strings.Contains(err.Error(), "disabled") {
+			t.Fatalf("err: %v", err)
+		}
+		if out := resp.buf.Bytes(); len(out) < 2 || out[1] != CommandNotSupported {
+			t.Fatalf("bad: %v", out)
+		}
+	}
+	if rules.calls != 0 {
+		t.Fatalf("bad: %v", rules.calls)
+	}
+
+	if AllCommands.disables(AssociateCommand) || !ConnectEnabled.disables(BindCommand) || ConnectEnabled.disables(9) {
+		t.Fatalf("bad")
+	}
+}
@@ -0,0 +1,144 @@
+package socks5
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// TimeWindow is a recurring window of time, such as 9:00 to 17:00
+// on weekdays. End before Start spans midnight, e.g. 22:00 to 6:00.
+type TimeWindow struct {
+	// Days the window starts on. Defaults to every day.
+	Days []time.Weekday
+
+	// Start and End are times of the day, e.g. 9 * time.Hour
+	Start time.Duration
+	End   time.Duration
+
+	// Location is the time zone of the window. Defaults to UTC.
+	Location *time.Location
+}
+
+// Contains checks if a time falls in the window
+func (w *TimeWindow) Contains(t time.Time) bool {
+	loc := w.Location
+	if loc == nil {
+		loc = time.UTC
+	}
+	t = t.In(loc)
+	hour, min, sec := t.Clock()
+	offset := time.Duration(hour)*time.Hour + time.Duration(min)*time.Minute + time.Duration(sec)*time.Second
+
+	if w.Start <= w.End {
+		return w.onDay(t.Weekday()) && offset >= w.Start && offset < w.End
+	}
+
+	// Spanning midnight, the early hours belong to the previous day
+	if offset >= w.Start {
+		return w.onDay(t.Weekday())
+	}
+	return offset < w.End && w.onDay((t.Weekday()+6)%7)
+}
+
+// onDay checks if the window starts on a weekday
+func (w *TimeWindow) onDay(day time.Weekday) bool {
+	if len(w.Days) == 0 {
+		return true
+	}
+	for _, d := range w.Days {
+		if d == day {
+			return true
+		}
+	}
+	return false
+}
+
+// Weekdays are the days from Monday to Friday
+var Weekdays = []time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday}
+
+// Schedule restricts the matching requests to, or out of, time windows
+type Schedule struct {
+	// Users selects the users the schedule applies to.
+	// Defaults to all clients.
+	Users []string
+
+	// Match further selects the requests it applies to,
+	// e.g. by destination. Defaults to all requests.
+	Match func(req *Request) bool
+
+	// Windows are the times the schedule is in effect
+	Windows []TimeWindow
+
+	// Deny blocks the requests during the windows, e.g. for
+	// maintenance. Otherwise they are only allowed during them.
+	Deny bool
+}
+
+// applies checks if the schedule applies to a request
+func (s *Schedule) applies(ctx context.Context, req *Request) bool {
+	if len(s.Users) > 0 {
+		user, _ := UserFromContext(ctx)
+		found := false
+		for _, u := range s.Users {
+			if u == user {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return s.Match == nil || s.Match(req)
+}
+
+// active checks if a time falls in one of the windows
+func (s *Schedule) active(t time.Time) bool {
+	for i := range s.Windows {
+		if s.Windows[i].Contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// ScheduleRuleSet is a RuleSet enforcing time-window policies, such as
+// contractors only using the proxy on weekdays from 9 to 5, or blocking
+// destinations during a maintenance window. A request is denied if
+// any schedule which applies to it denies it.
+type ScheduleRuleSet struct {
+	Schedules []Schedule
+
+	// Clock returns the current time. Defaults to time.Now.
+	Clock func() time.Time
+
+	// Rules is consulted once the schedules pass.
+	// Defaults to PermitAll.
+	Rules RuleSet
+}
+
+func (r *ScheduleRuleSet) Allow(ctx context.Context, req *Request) (context.Context, bool) {
+	now := time.Now()
+	if r.Clock != nil {
+		now = r.Clock()
+	}
+	for i := range r.Schedules {
+		s := &r.Schedules[i]
+		if !s.applies(ctx, req) {
+			continue
+		}
+		active := s.active(now)
+		if s.Deny && active {
+			return DenyWith(ctx, RuleFailure, "blocked by schedule"), false
+		}
+		if !s.Deny && !active {
+			return DenyWith(ctx, RuleFailure, "outside of scheduled hours"), false
+		}
+	}
+
+	if r.Rules == nil {
+		return ctx, true
+	}
+	return r.Rules.Allow(ctx, req)
+}
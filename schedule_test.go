@@ -0,0 +1,84 @@
+package socks5
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestTimeWindow_Contains(t *testing.T) {
+	office := &TimeWindow{Days: Weekdays, Start: 9 * time.Hour, End: 17 * time.Hour}
+	night := &TimeWindow{Days: []time.Weekday{time.Friday}, Start: 22 * time.Hour, End: 6 * time.Hour}
+
+	// 2024-01-05 is a Friday
+	at := func(day, hour int) time.Time {
+		return time.Date(2024, 1, day, hour, 30, 0, 0, time.UTC)
+	}
+	cases := []struct {
+		w      *TimeWindow
+		t      time.Time
+		expect bool
+	}{
+		{office, at(5, 9), true},
+		{office, at(5, 17), false},
+		{office, at(5, 8), false},
+		{office, at(6, 10), false},
+		{night, at(5, 23), true},
+		{night, at(6, 3), true},
+		{night, at(6, 7), false},
+		{night, at(5, 3), false},
+	}
+	for _, c := range cases {
+		if c.w.Contains(c.t) != c.expect {
+			t.Fatalf("bad: %v %v", c.t, c.expect)
+		}
+	}
+
+	// Windows are evaluated in their time zone
+	est := time.FixedZone("EST", -5*3600)
+	zoned := &TimeWindow{Start: 9 * time.Hour, End: 17 * time.Hour, Location: est}
+	if zoned.Contains(at(5, 9)) || !zoned.Contains(at(5, 15)) {
+		t.Fatalf("bad zone")
+	}
+}
+
+func TestScheduleRuleSet(t *testing.T) {
+	now := time.Date(2024, 1, 6, 10, 0, 0, 0, time.UTC) // Saturday
+	r := &ScheduleRuleSet{
+		Schedules: []Schedule{{
+			Users:   []string{"contractor"},
+			Windows: []TimeWindow{{Days: Weekdays, Start: 9 * time.Hour, End: 17 * time.Hour}},
+		}, {
+			Match: func(req *Request) bool {
+				return req.DestAddr.FQDN == "db.internal"
+			},
+			Windows: []TimeWindow{{Start: 9 * time.Hour, End: 11 * time.Hour}},
+			Deny:    true,
+		}},
+		Clock: func() time.Time { return now },
+	}
+	check := func(user, fqdn string) bool {
+		ctx := context.Background()
+		if user != "" {
+			ctx = WithUser(ctx, user)
+		}
+		_, ok := r.Allow(ctx, &Request{Command: ConnectCommand, DestAddr: &AddrSpec{FQDN: fqdn, Port: 80}})
+		return ok
+	}
+
+	if check("contractor", "example.com") {
+		t.Fatalf("contractor allowed on the weekend")
+	}
+	if !check("employee", "example.com") {
+		t.Fatalf("employee denied")
+	}
+	if check("employee", "db.internal") {
+		t.Fatalf("allowed during maintenance")
+	}
+
+	now = now.AddDate(0, 0, 2).Add(2 * time.Hour) // Monday 12:00
+	if !check("contractor", "example.com") || !check("", "db.internal") {
+		t.Fatalf("denied outside of the windows")
+	}
+}
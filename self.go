@@ -0,0 +1,89 @@
+package socks5
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// listenAddrs returns the addresses of the served listeners
+func (st *serverState) listenAddrs() []net.Addr {
+	if st == nil {
+		return nil
+	}
+	st.l.Lock()
+	defer st.l.Unlock()
+	addrs := make([]net.Addr, 0, len(st.listeners))
+	for l := range st.listeners {
+		addrs = append(addrs, l.Addr())
+	}
+	return addrs
+}
+
+// selfAllowed checks if a destination is on the SelfAllowlist
+func (s *Server) selfAllowed(dest *AddrSpec) bool {
+	hostPort := net.JoinHostPort(dest.IP.String(), strconv.Itoa(dest.Port))
+	for _, allowed := range s.config.SelfAllowlist {
+		if allowed == hostPort {
+			return true
+		}
+		if ip := net.ParseIP(allowed); ip != nil && ip.Equal(dest.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// isSelf checks if a destination is the proxy itself: a loopback or
+// unspecified address, or the address of one of its listeners
+func (s *Server) isSelf(req *Request, dest *AddrSpec) bool {
+	if dest.IP.IsLoopback() || dest.IP.IsUnspecified() {
+		return true
+	}
+
+	addrs := s.state.listenAddrs()
+	if req.localAddr != nil {
+		addrs = append(addrs, req.localAddr)
+	}
+	wildcard := false
+	for _, addr := range addrs {
+		listen := netAddrSpec(addr)
+		if listen == nil || listen.Port != dest.Port {
+			continue
+		}
+		if listen.IP.Equal(dest.IP) {
+			return true
+		}
+		if listen.IP == nil || listen.IP.IsUnspecified() {
+			wildcard = true
+		}
+	}
+	if !wildcard {
+		return false
+	}
+
+	// Listening on all interfaces, so any local address is the proxy
+	local, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range local {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(dest.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkSelf is used to deny requests to the proxy itself, if DenySelf
+// is set, preventing loops and access to localhost-only services
+func (s *Server) checkSelf(req *Request) error {
+	dest := req.realDestAddr
+	if !s.config.DenySelf || dest == nil || dest.IP == nil {
+		return nil
+	}
+	if !s.isSelf(req, dest) || s.selfAllowed(dest) {
+		return nil
+	}
+	return fmt.Errorf("Connect to %v denied: destination is the proxy itself", req.DestAddr)
+}
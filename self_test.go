@@ -0,0 +1,64 @@
+package socks5
+
+import (
+	"net"
+	"testing"
+)
+
+func TestServer_CheckSelf(t *testing.T) {
+	serv, _ := New(&Config{
+		DenySelf:      true,
+		SelfAllowlist: []string{"127.0.0.1:8080", "::1"},
+	})
+	l, err := net.Listen("tcp", "0.0.0.0:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	if serv.state.trackListener(l, true) == nil {
+		t.Fatalf("expected listener")
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+
+	// Find a non-loopback local address, if any
+	var local net.IP
+	addrs, _ := net.InterfaceAddrs()
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && !ipNet.IP.IsLoopback() {
+			local = ipNet.IP
+			break
+		}
+	}
+
+	type selfCase struct {
+		dest   *AddrSpec
+		denied bool
+	}
+	cases := []selfCase{
+		{&AddrSpec{IP: net.IPv4(127, 0, 0, 1), Port: 22}, true},
+		{&AddrSpec{IP: net.IPv4(127, 0, 0, 2), Port: 80}, true},
+		{&AddrSpec{IP: net.IPv4zero, Port: 80}, true},
+		{&AddrSpec{IP: net.IPv4(127, 0, 0, 1), Port: 8080}, false},
+		{&AddrSpec{IP: net.IPv6loopback, Port: 80}, false},
+		{&AddrSpec{IP: net.IPv4(192, 0, 2, 1), Port: port}, false},
+		{&AddrSpec{FQDN: "example.com", Port: 80}, false},
+	}
+	if local != nil {
+		cases = append(cases,
+			selfCase{&AddrSpec{IP: local, Port: port}, true},
+			selfCase{&AddrSpec{IP: local, Port: port + 1}, false})
+	}
+	for _, c := range cases {
+		req := &Request{DestAddr: c.dest, realDestAddr: c.dest}
+		if err := serv.checkSelf(req); (err != nil) != c.denied {
+			t.Fatalf("bad: %v %v", c.dest, err)
+		}
+	}
+
+	// Without DenySelf nothing is denied
+	serv.config.DenySelf = false
+	req := &Request{DestAddr: cases[0].dest, realDestAddr: cases[0].dest}
+	if err := serv.checkSelf(req); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
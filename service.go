@@ -0,0 +1,162 @@
+package socks5
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Backend is a concrete address serving a logical service
+type Backend struct {
+	Addr *AddrSpec
+	// Healthy is false for backends which should not be used
+	Healthy bool
+}
+
+// ServiceRegistry is used to look up the backends of a logical
+// service, such as a static map, DNS SRV records or Consul
+type ServiceRegistry interface {
+	Backends(ctx context.Context, name string, port int) ([]*Backend, error)
+}
+
+// StaticRegistry enables using a map directly as a ServiceRegistry.
+// It is keyed by the logical host:port, e.g. "db.internal:5432",
+// and all backends are considered healthy.
+type StaticRegistry map[string][]*AddrSpec
+
+func (s StaticRegistry) Backends(ctx context.Context, name string, port int) ([]*Backend, error) {
+	addrs, ok := s[net.JoinHostPort(name, strconv.Itoa(port))]
+	if !ok {
+		return nil, fmt.Errorf("Unknown service %s:%d", name, port)
+	}
+	backends := make([]*Backend, len(addrs))
+	for i, addr := range addrs {
+		backends[i] = &Backend{Addr: addr, Healthy: true}
+	}
+	return backends, nil
+}
+
+// ServiceRouter routes requests for logical service names to backends
+// chosen from a ServiceRegistry. As service names usually do not
+// resolve, it must be used as both the Resolver and the Rewriter.
+// To retry other backends when a dial fails, also use its Dial:
+//
+//	router := &socks5.ServiceRouter{Registry: registry, Suffix: ".internal"}
+//	conf := &socks5.Config{Resolver: router, Rewriter: router, Dial: router.Dial(nil)}
+type ServiceRouter struct {
+	// Registry is used to look up the service backends
+	Registry ServiceRegistry
+
+	// Suffix selects the FQDNs which are service names, e.g. ".internal".
+	// Other destinations are left untouched. If empty, every FQDN
+	// is looked up in the registry.
+	Suffix string
+
+	// Resolver is used for names which are not services.
+	// Defaults to DNSResolver.
+	Resolver NameResolver
+
+	// Policy selects how the load is balanced between backends.
+	// Defaults to BalanceRandom.
+	Policy BalancePolicy
+
+	// FailureTimeout is how long a backend which failed to connect
+	// is only tried after all others. Defaults to 10 seconds.
+	FailureTimeout time.Duration
+
+	balancer
+}
+
+// isService checks if a name should be routed through the registry
+func (r *ServiceRouter) isService(name string) bool {
+	return name != "" && strings.HasSuffix(name, r.Suffix)
+}
+
+// Resolve defers service names to Rewrite, resolving any other names
+func (r *ServiceRouter) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	if r.isService(name) {
+		return ctx, nil, nil
+	}
+	resolver := r.Resolver
+	if resolver == nil {
+		resolver = DNSResolver{}
+	}
+	return resolver.Resolve(ctx, name)
+}
+
+// ResolveAll lists the addresses of names which are not services,
+// if the Resolver can list them
+func (r *ServiceRouter) ResolveAll(ctx context.Context, name string) ([]net.IP, error) {
+	if r.isService(name) {
+		return nil, nil
+	}
+	var resolver NameResolver = DNSResolver{}
+	if r.Resolver != nil {
+		resolver = r.Resolver
+	}
+	if ir, ok := resolver.(IPResolver); ok {
+		return ir.ResolveAll(ctx, name)
+	}
+	return nil, nil
+}
+
+// Rewrite maps service names to one of their healthy backends.
+// The remaining backends are kept in the context for Dial to retry.
+func (r *ServiceRouter) Rewrite(ctx context.Context, req *Request) (context.Context, *AddrSpec, error) {
+	dest := req.DestAddr
+	if !r.isService(dest.FQDN) {
+		return ctx, nil, nil
+	}
+
+	backends, err := r.Registry.Backends(ctx, dest.FQDN, dest.Port)
+	if err != nil {
+		return ctx, nil, err
+	}
+	var healthy []*Backend
+	for _, b := range backends {
+		if b.Healthy {
+			healthy = append(healthy, b)
+		}
+	}
+	if len(healthy) == 0 {
+		return ctx, nil, fmt.Errorf("No healthy backend for %s:%d", dest.FQDN, dest.Port)
+	}
+
+	timeout := r.FailureTimeout
+	if timeout == 0 {
+		timeout = defaultFailureTimeout
+	}
+	ordered := r.order(r.Policy, timeout, healthy)
+	return context.WithValue(ctx, backendsKey{}, ordered), ordered[0].Addr, nil
+}
+
+// Dial wraps a dial function to try the backends chosen by Rewrite in
+// order until one succeeds, tracking failures and open connections.
+// A nil dial uses a net.Dialer.
+func (r *ServiceRouter) Dial(dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	if dial == nil {
+		dial = new(net.Dialer).DialContext
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		backends, ok := ctx.Value(backendsKey{}).([]*Backend)
+		if !ok {
+			return dial(ctx, network, addr)
+		}
+
+		var lastErr error
+		for _, b := range backends {
+			conn, err := dial(ctx, network, b.Addr.Address())
+			if err != nil {
+				r.failed(b.Addr)
+				lastErr = err
+				continue
+			}
+			return r.opened(b.Addr, conn), nil
+		}
+		return nil, fmt.Errorf("All %d backends failed, last error: %v", len(backends), lastErr)
+	}
+}
@@ -0,0 +1,74 @@
+package socks5
+
+import (
+	"net"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+type healthRegistry []*Backend
+
+func (h healthRegistry) Backends(ctx context.Context, name string, port int) ([]*Backend, error) {
+	return h, nil
+}
+
+func TestServiceRouter_Resolve(t *testing.T) {
+	r := &ServiceRouter{Registry: StaticRegistry{}, Suffix: ".internal"}
+	ctx := context.Background()
+
+	_, ip, err := r.Resolve(ctx, "db.internal")
+	if err != nil || ip != nil {
+		t.Fatalf("bad: %v %v", ip, err)
+	}
+
+	_, ip, err = r.Resolve(ctx, "localhost")
+	if err != nil || !ip.IsLoopback() {
+		t.Fatalf("bad: %v %v", ip, err)
+	}
+}
+
+func TestServiceRouter_Rewrite(t *testing.T) {
+	backend := &AddrSpec{IP: net.ParseIP("10.0.0.1"), Port: 5433}
+	r := &ServiceRouter{
+		Registry: StaticRegistry{"db.internal:5432": {backend}},
+		Suffix:   ".internal",
+	}
+	ctx := context.Background()
+
+	_, addr, err := r.Rewrite(ctx, &Request{DestAddr: &AddrSpec{FQDN: "db.internal", Port: 5432}})
+	if err != nil || addr != backend {
+		t.Fatalf("bad: %v %v", addr, err)
+	}
+
+	// Unknown services are vetoed
+	if _, _, err := r.Rewrite(ctx, &Request{DestAddr: &AddrSpec{FQDN: "db.internal", Port: 1}}); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	// Other destinations pass through
+	_, addr, err = r.Rewrite(ctx, &Request{DestAddr: &AddrSpec{FQDN: "example.com", Port: 80}})
+	if err != nil || addr != nil {
+		t.Fatalf("bad: %v %v", addr, err)
+	}
+}
+
+func TestServiceRouter_Health(t *testing.T) {
+	good := &AddrSpec{IP: net.ParseIP("10.0.0.2"), Port: 80}
+	r := &ServiceRouter{Registry: healthRegistry{
+		{Addr: &AddrSpec{IP: net.ParseIP("10.0.0.1"), Port: 80}},
+		{Addr: good, Healthy: true},
+	}}
+	req := &Request{DestAddr: &AddrSpec{FQDN: "web", Port: 80}}
+
+	for i := 0; i < 10; i++ {
+		if _, addr, err := r.Rewrite(context.Background(), req); err != nil || addr != good {
+			t.Fatalf("bad: %v %v", addr, err)
+		}
+	}
+
+	r.Registry = healthRegistry{{Addr: good}}
+	if _, _, err := r.Rewrite(context.Background(), req); err == nil {
+		t.Fatalf("expected error")
+	}
+}
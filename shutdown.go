@@ -0,0 +1,281 @@
+package socks5
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+var (
+	// ErrServerClosed is returned by Serve and ServeConn
+	// once Shutdown or Close has been called
+	ErrServerClosed = errors.New("socks: Server closed")
+)
+
+// shutdownPollInterval is how often Shutdown checks
+// if all connections have finished
+const shutdownPollInterval = 50 * time.Millisecond
+
+// serverState tracks the listeners, connections and other resources
+// of a Server. It is shared with the copies used by ServeWithConfig.
+type serverState struct {
+	// pending is the number of connections in the handshake.
+	// It is first to keep it 64-bit aligned for atomic access.
+	pending int64
+
+	// counters are the cumulative statistics, also
+	// accessed atomically so kept after pending
+	counters serverStats
+
+	l         sync.Mutex
+	closed    bool
+	listeners map[net.Listener]*servedListener
+	conns     map[io.Closer]struct{}
+
+	// served maps connections to the listener they were accepted from
+	served map[io.Closer]*servedListener
+
+	// resources are sockets owned by connections, such as UDP
+	// relays or BIND listeners, which are force closed on shutdown
+	resources map[io.Closer]struct{}
+
+	// commands are the handlers added with RegisterCommand
+	commands map[uint8]CommandHandler
+
+	// sessions are upstream connections kept for resumption
+	sessions connCache
+
+	// dials limits the concurrent dials per destination
+	dials dialLimiter
+
+	// given is the Config as given to New or last applied with
+	// ApplyConfig, before the defaults, and applied is the server
+	// using it since ApplyConfig, serving the new connections
+	given   *Config
+	applied *Server
+
+	// onClose are the functions registered with OnClose
+	onClose []func()
+
+	// slots bounds the connections accepted from all listeners,
+	// with MaxConcurrentConnections, and slotted are those holding one
+	slots   chan struct{}
+	slotted map[io.Closer]struct{}
+
+	// subscribers are the callbacks added with Subscribe
+	subL        sync.RWMutex
+	subscribers map[uint64]func(*Event)
+	lastSub     uint64
+
+	// trace is set while the debug trace is enabled
+	trace int32
+
+	// debug is the accounting of goroutines and sockets
+	debug debugState
+}
+
+func newServerState() *serverState {
+	return &serverState{
+		listeners: make(map[net.Listener]*servedListener),
+		conns:     make(map[io.Closer]struct{}),
+		served:    make(map[io.Closer]*servedListener),
+		slotted:   make(map[io.Closer]struct{}),
+		resources: make(map[io.Closer]struct{}),
+		commands:  make(map[uint8]CommandHandler),
+	}
+}
+
+// track is used to add or remove an entry from one of the
+// tracked sets. Adding fails once the server is closed.
+func (st *serverState) track(set map[io.Closer]struct{}, c io.Closer, add bool) bool {
+	st.l.Lock()
+	defer st.l.Unlock()
+	if !add {
+		delete(set, c)
+		return true
+	}
+	if st.closed {
+		return false
+	}
+	set[c] = struct{}{}
+	return true
+}
+
+func (st *serverState) trackConn(c io.Closer, add bool) bool {
+	if st == nil {
+		return true
+	}
+	if !st.track(st.conns, c, add) {
+		return false
+	}
+	if add {
+		atomic.AddUint64(&st.counters.accepted, 1)
+	}
+	return true
+}
+
+func (st *serverState) trackResource(c io.Closer, add bool) bool {
+	if st == nil {
+		return true
+	}
+	return st.track(st.resources, c, add)
+}
+
+// trackListener is used to add or remove a listener, returning
+// the state of its connections. Adding fails with nil once the
+// server is closed.
+func (st *serverState) trackListener(l net.Listener, add bool) *servedListener {
+	if st == nil {
+		return newServedListener()
+	}
+	st.l.Lock()
+	defer st.l.Unlock()
+	if !add {
+		sl := st.listeners[l]
+		delete(st.listeners, l)
+		return sl
+	}
+	if st.closed {
+		return nil
+	}
+	sl := newServedListener()
+	st.listeners[l] = sl
+	return sl
+}
+
+// handshaking adjusts and returns the number of pending handshakes
+func (st *serverState) handshaking(delta int64) int64 {
+	if st == nil {
+		return 0
+	}
+	return atomic.AddInt64(&st.pending, delta)
+}
+
+// isClosed returns if the server is shutting down
+func (st *serverState) isClosed() bool {
+	if st == nil {
+		return false
+	}
+	st.l.Lock()
+	defer st.l.Unlock()
+	return st.closed
+}
+
+// closeListeners stops accepting new connections, and runs
+// the functions registered with OnClose
+func (st *serverState) closeListeners() {
+	st.l.Lock()
+	st.closed = true
+	for l, sl := range st.listeners {
+		l.Close()
+		sl.stop()
+		delete(st.listeners, l)
+	}
+	onClose := st.onClose
+	st.onClose = nil
+	st.l.Unlock()
+	for _, fn := range onClose {
+		fn()
+	}
+}
+
+// closeAll force closes all connections and resources
+func (st *serverState) closeAll() {
+	st.l.Lock()
+	defer st.l.Unlock()
+	for c := range st.conns {
+		c.Close()
+	}
+	for c := range st.resources {
+		c.Close()
+	}
+	st.sessions.Close()
+}
+
+// activeConns returns the number of open connections
+func (st *serverState) activeConns() int {
+	st.l.Lock()
+	defer st.l.Unlock()
+	return len(st.conns)
+}
+
+// Shutdown gracefully shuts down the server. It closes all listeners
+// and then waits for the active connections to finish. If the context
+// expires first, the remaining connections, UDP relays and BIND
+// listeners are force closed and the context error is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.state.closeListeners()
+	s.closePool()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		if s.state.activeConns() == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			s.state.closeAll()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// OnClose registers a function called once the server is closed with
+// Close or Shutdown, for example to stop reloading the Rules. It is
+// called right away if the server is closed already.
+func (s *Server) OnClose(fn func()) {
+	st := s.state
+	st.l.Lock()
+	if !st.closed {
+		st.onClose = append(st.onClose, fn)
+		st.l.Unlock()
+		return
+	}
+	st.l.Unlock()
+	fn()
+}
+
+// Close immediately closes all listeners, connections
+// and any other resources of the server
+func (s *Server) Close() error {
+	s.state.closeListeners()
+	s.closePool()
+	s.state.closeAll()
+	return nil
+}
+
+// closePool closes the idle connections of the UpstreamPool
+func (s *Server) closePool() {
+	if s.config.UpstreamPool != nil {
+		s.config.UpstreamPool.Close()
+	}
+}
+
+// ShutdownOnSignal blocks until one of the given signals is received,
+// SIGINT or SIGTERM if none are given, and then shuts down the server.
+// Connections still open after the timeout are force closed.
+func (s *Server) ShutdownOnSignal(timeout time.Duration, sig ...os.Signal) error {
+	if len(sig) == 0 {
+		sig = []os.Signal{os.Interrupt, syscall.SIGTERM}
+	}
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, sig...)
+	defer signal.Stop(ch)
+
+	recv := <-ch
+	s.logf(LogInfo, "Received %v, shutting down", recv)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return s.Shutdown(ctx)
+}
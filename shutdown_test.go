@@ -0,0 +1,90 @@
+package socks5
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestShutdown_Idle(t *testing.T) {
+	serv, _ := New(&Config{})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- serv.Serve(l) }()
+	time.Sleep(10 * time.Millisecond)
+
+	if err := serv.Shutdown(context.Background()); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	select {
+	case err := <-errCh:
+		if err != ErrServerClosed {
+			t.Fatalf("err: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timeout")
+	}
+
+	// Serving after shutdown should fail
+	if err := serv.Serve(l); err != ErrServerClosed {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestShutdown_ForceClose(t *testing.T) {
+	serv, _ := New(&Config{})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	go serv.Serve(l)
+
+	// Open a connection which stalls during the handshake
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte{5})
+	time.Sleep(10 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := serv.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The stalled connection should be closed
+	conn.SetDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatalf("expected closed connection")
+	}
+}
+
+func TestServer_OnClose(t *testing.T) {
+	serv, _ := New(&Config{})
+	var calls int
+	serv.OnClose(func() { calls++ })
+	if calls != 0 {
+		t.Fatalf("bad: %d", calls)
+	}
+
+	// Called once, however often the server is closed
+	serv.Close()
+	serv.Shutdown(context.Background())
+	if calls != 1 {
+		t.Fatalf("bad: %d", calls)
+	}
+
+	// Called right away once closed
+	serv.OnClose(func() { calls++ })
+	if calls != 2 {
+		t.Fatalf("bad: %d", calls)
+	}
+}
@@ -0,0 +1,32 @@
+package socks5
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// controlClient is used to apply the ClientControl callback to the
+// socket of a client connection, unwrapping TLS connections
+func (s *Server) controlClient(conn net.Conn) error {
+	if s.config.ClientControl == nil {
+		return nil
+	}
+	var inner net.Conn = conn
+	if tlsConn, ok := inner.(*tls.Conn); ok {
+		inner = tlsConn.NetConn()
+	}
+	sc, ok := inner.(syscall.Conn)
+	if !ok {
+		return nil
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	if err := s.config.ClientControl(conn, raw); err != nil {
+		return fmt.Errorf("Failed to configure client socket: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package socks5
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestSOCKS5_ClientControl(t *testing.T) {
+	controlled := make(chan net.Addr, 1)
+	var fail int32
+	serv, _ := New(&Config{
+		ClientControl: func(conn net.Conn, c syscall.RawConn) error {
+			if atomic.LoadInt32(&fail) == 1 {
+				return errors.New("refused")
+			}
+			var called bool
+			if err := c.Control(func(fd uintptr) { called = true }); err != nil || !called {
+				return errors.New("no socket")
+			}
+			controlled <- conn.RemoteAddr()
+			return nil
+		},
+	})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	go serv.Serve(l)
+	defer serv.Close()
+
+	greet := func() ([]byte, error) {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(time.Second))
+		conn.Write([]byte{5, 1, NoAuth})
+		out := make([]byte, 2)
+		_, err = io.ReadFull(conn, out)
+		return out, err
+	}
+	if out, err := greet(); err != nil || out[1] != NoAuth {
+		t.Fatalf("bad: %v %v", out, err)
+	}
+	select {
+	case <-controlled:
+	default:
+		t.Fatalf("expected control")
+	}
+
+	// A failing callback closes the connection
+	atomic.StoreInt32(&fail, 1)
+	if _, err := greet(); err == nil {
+		t.Fatalf("expected error")
+	}
+}
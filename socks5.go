@@ -2,10 +2,14 @@ package socks5
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
-	"os"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"golang.org/x/net/context"
 )
@@ -14,6 +18,13 @@ const (
 	socks5Version = uint8(5)
 )
 
+const (
+	// minAcceptBackoff and maxAcceptBackoff bound the delay
+	// between retries of a failed Accept
+	minAcceptBackoff = 5 * time.Millisecond
+	maxAcceptBackoff = time.Second
+)
+
 // Config is used to setup and configure a Server
 type Config struct {
 	// AuthMethods can be provided to implement custom authentication
@@ -30,6 +41,30 @@ type Config struct {
 	// Defaults to DNSResolver if not provided.
 	Resolver NameResolver
 
+	// MaxFQDNLength bounds the length of requested FQDNs.
+	// Defaults to 253, the longest name DNS can represent.
+	MaxFQDNLength int
+
+	// FQDNValidator can be provided to check and normalize requested
+	// FQDNs before they are resolved, for example to convert Unicode
+	// names. Defaults to ValidateHostname with MaxFQDNLength.
+	FQDNValidator func(name string) (string, error)
+
+	// RequireFQDN rejects requests and datagrams to IP destinations, so
+	// clients must leave the resolution to the server (socks5h) rather
+	// than leaking their lookups locally. DenyFQDN rejects those to FQDN
+	// destinations instead, so only IPs are relayed, for deployments
+	// which allow lists of IPs. Rejected requests are replied with
+	// AddrTypeNotSupported.
+	RequireFQDN bool
+	DenyFQDN    bool
+
+	// EnabledCommands are the commands served, any other command of
+	// RFC 1928 being replied with CommandNotSupported before the
+	// request is processed or the Rules run. Registered handlers
+	// of other commands are not affected. Defaults to AllCommands.
+	EnabledCommands CommandSet
+
 	// Rules is provided to enable custom logic around permitting
 	// various commands. If not provided, PermitAll is used.
 	Rules RuleSet
@@ -39,15 +74,335 @@ type Config struct {
 	// Defaults to NoRewrite.
 	Rewriter AddressRewriter
 
-	// BindIP is used for bind or udp associate
+	// BindIP is used for bind or udp associate. It may be the address
+	// of another interface than the one of the TCP listener, to relay
+	// datagrams on a separate network.
 	BindIP net.IP
 
+	// UDPAdvertiseIP is sent in the reply to UDP ASSOCIATE instead of
+	// the address the relay is bound to, for relays behind NAT which
+	// clients reach on a public IP.
+	UDPAdvertiseIP net.IP
+
+	// UDPPortRange restricts the ports UDP relays are bound to, for
+	// firewalls which only forward a range. Once all ports of the
+	// range are in use, associations are replied ServerFailure.
+	// Defaults to ports chosen by the system.
+	UDPPortRange PortRange
+
+	// AssociateKeepAlive enables TCP keepalive probes on the control
+	// connection of UDP associations, with this period. Associations
+	// end once their control connection closes, so probing frees the
+	// relays of clients which vanished without closing it. Defaults
+	// to the keepalive of the listener.
+	AssociateKeepAlive time.Duration
+
+	// AssociateIdleTimeout ends UDP associations which relayed no
+	// datagram in either direction for this long, reaping the relays
+	// of clients which keep the control connection open but stopped
+	// using it. Defaults to no limit.
+	AssociateIdleTimeout time.Duration
+
+	// UDPDualStack relays the datagrams of UDP associations on sockets
+	// bound to the wildcard address, which accept both IPv4 and IPv6,
+	// rather than the address the client connected to. This supports
+	// clients whose datagrams use the other family than their TCP
+	// connection. The address the client connected to is still sent
+	// in the reply.
+	UDPDualStack bool
+
+	// UDPUnreachableTeardown ends UDP associations as soon as a relayed
+	// datagram is answered with an ICMP port, host or network
+	// unreachable error, rather than only counting these errors in the
+	// socks5.udp.icmp metric. Only Linux reports the ICMP errors of
+	// unconnected sockets.
+	UDPUnreachableTeardown bool
+
+	// PreferIPv6Reply encodes the reply addresses sent to clients which
+	// connected over IPv6 as IPv6, using the IPv4-mapped form if needed
+	PreferIPv6Reply bool
+
+	// Codec encodes and decodes the requests and replies, to support
+	// extensions of the protocol. Defaults to RFC1928Codec, using
+	// PreferIPv6Reply.
+	Codec Codec
+
+	// ReplyAddress selects the address sent to clients in successful
+	// replies. Defaults to ReplyBindAddr.
+	ReplyAddress ReplyAddressMode
+
+	// ReplyAddressHook can be provided to rewrite the BND.ADDR of
+	// successful replies, after the ReplyAddress mode, including the
+	// relay address of UDP ASSOCIATE. Behind NAT, load balancers or
+	// port forwarding it should return the externally reachable
+	// address, as clients of UDP ASSOCIATE and BIND cannot reach the
+	// proxy otherwise. Custom command handlers apply it with
+	// AdvertiseAddr.
+	ReplyAddressHook func(ctx context.Context, req *Request, bind AddrSpec) AddrSpec
+
 	// Logger can be used to provide a custom log target.
-	// Defaults to stdout.
+	// Defaults to stdout. All output of the server goes through it.
 	Logger *log.Logger
 
+	// LogLevel is the minimum level of the messages to log.
+	// Defaults to LogDebug, logging everything.
+	LogLevel LogLevel
+
+	// Trace logs each protocol phase of every connection, from the
+	// greeting to the end of the relay, with the connection ID. This
+	// is meant for debugging interop with clients, and can be toggled
+	// at runtime with SetTrace.
+	Trace bool
+
 	// Optional function for dialing out
 	Dial func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// VerifyDial is invoked with the peer address of each upstream
+	// connection before it is used. Returning an error rejects the
+	// request. Useful to check destinations which are resolved by the
+	// dialer rather than pinned before the rules are applied.
+	VerifyDial func(ctx context.Context, req *Request, remote net.Addr) error
+
+	// CancelOnClientClose watches the client connection while the
+	// upstream is dialed, canceling the dial context as soon as the
+	// client closes or resets it, instead of completing the dial of
+	// an upstream connection nobody will use.
+	CancelOnClientClose bool
+
+	// Bandwidth limits the total bandwidth relayed by the server,
+	// shared between QoS classes assigned by the rules. Defaults to
+	// no limit. See WithQoSClass.
+	Bandwidth *BandwidthLimiter
+
+	// UpstreamPool can be provided to keep idle connections to
+	// recently used destinations, skipping the connection setup
+	// for frequently accessed ones. Defaults to no pooling.
+	UpstreamPool *UpstreamPool
+
+	// ResumeWindow keeps the upstream connection of a client which
+	// disconnected abnormally, such as by a reset, for the given time.
+	// If the client requests the same destination meanwhile, the
+	// connection is reused rather than dialed again, saving latency on
+	// high RTT upstreams. Any data in flight while the client was gone
+	// is lost, so resuming mid-stream corrupts stateful protocols such
+	// as TLS or HTTP, and only suits protocols which tolerate it. Only
+	// clients which authenticated are resumed, identified by username.
+	// Defaults to 0, which disables resumption.
+	ResumeWindow time.Duration
+
+	// DialTimeout bounds how long the upstream dial may take, including
+	// any retries. Dials timing out are rejected with a TTL expired
+	// reply. It also bounds how long BIND waits for its peer to
+	// connect. Defaults to no timeout beyond the operating system's.
+	DialTimeout time.Duration
+
+	// OnExpire is invoked whenever a dial or session expires,
+	// in addition to the socks5.expired metric
+	OnExpire func(ctx context.Context, req *Request, ev *ExpireEvent)
+
+	// MaxDialsPerDest bounds the concurrent dials to each destination
+	// host and port, protecting fragile backends from connection storms.
+	// Excess requests wait up to the DialQueueTimeout for a slot, and
+	// are then rejected with a TTL expired reply. Defaults to no limit.
+	MaxDialsPerDest int
+
+	// DialQueueTimeout is how long a request may wait for a dial slot
+	// of its destination. Defaults to 0, rejecting excess requests.
+	DialQueueTimeout time.Duration
+
+	// DialRetry can be provided to retry transient dial failures
+	// before replying with an error. By default dials are not retried.
+	DialRetry *DialRetry
+
+	// OnAcceptError is invoked when accepting a connection fails.
+	// Returning true keeps the server accepting, after a short backoff,
+	// while returning false causes Serve to return the error.
+	// By default temporary errors are retried and all others are fatal.
+	OnAcceptError func(err error) bool
+
+	// OnDeny is invoked whenever a client is denied, due to the rules,
+	// failed authentication or an unsupported command. It is intended
+	// for auditing and is called in addition to any logging.
+	OnDeny func(ctx context.Context, req *Request, reason *DenyReason)
+
+	// StrictUDPClientBinding selects the sources UDP associations
+	// accept datagrams from. Defaults to UDPBindAnnounced, the address
+	// announced by the client, learning any zero parts of it from the
+	// first datagram.
+	StrictUDPClientBinding UDPClientBinding
+
+	// OnGreeting is invoked with the auth methods offered by the client,
+	// in its order, before authenticating. As the offered methods vary
+	// between client software, this allows fingerprinting clients and
+	// collecting telemetry. Returning an error rejects the client, as
+	// if none of its methods were acceptable.
+	OnGreeting func(ctx context.Context, methods []byte, conn net.Conn) error
+
+	// Destinations aggregates the traffic by destination host, for
+	// the Debug snapshot of the server. Disabled by default.
+	Destinations *DestinationTracker
+
+	// Middleware are stages of request processing run between the
+	// authentication and serving the command, the first being the
+	// outermost. See Builder for composing a server from stages.
+	Middleware []Middleware
+
+	// MaxRequestBytes bounds how many bytes a client may send before
+	// its request is parsed, including the auth negotiation. Clients
+	// exceeding it are reset. Defaults to no limit beyond the protocol.
+	MaxRequestBytes int
+
+	// StrictFraming rejects clients which send the next negotiation
+	// phase before receiving the reply to the current one, e.g. the
+	// request before the auth status. By default such pipelined
+	// bytes are buffered and accepted.
+	StrictFraming bool
+
+	// LenientRSV accepts requests and datagrams with non-zero reserved
+	// fields, which RFC 1928 requires to be zero. Violations are still
+	// counted by the socks5.protocol.violation metric.
+	LenientRSV bool
+
+	// SNIRoutes selects the Config of TLS connections by the server
+	// name the client requested, enabling different auth and rules per
+	// hostname on one port. Names are either exact or wildcards such as
+	// "*.example.com". Other server names use this Config.
+	SNIRoutes map[string]*Config
+
+	// ClientFilter is used to drop clients right after they are
+	// accepted, before any protocol bytes are read. See CIDRFilter.
+	ClientFilter ClientFilter
+
+	// MaxConcurrentConnections bounds the client connections served at
+	// once, across all listeners of the server. Once reached, each
+	// listener holds the next client until a connection closes, and
+	// stops accepting meanwhile, so further clients queue in the backlog
+	// of the listening sockets rather than being served and starved.
+	// Defaults to no limit.
+	MaxConcurrentConnections int
+
+	// HandshakeWorkers enables a bounded pool of goroutines per listener
+	// which perform the handshake of accepted connections, only
+	// spawning a goroutine per connection for requests. Defaults to 0,
+	// serving each accepted connection in its own goroutine. Without a
+	// HandshakeTimeout, the handshakes on the workers are bounded by
+	// 10 seconds, so silent clients cannot hold every worker.
+	HandshakeWorkers int
+
+	// HandshakeQueue is how many accepted connections may wait for
+	// a handshake worker. Connections beyond it are rejected.
+	HandshakeQueue int
+
+	// CertProvider obtains the certificates of ListenAndServeTLS and
+	// ServeTLS, such as an autocert.Manager renewing them with ACME
+	CertProvider CertProvider
+
+	// DenySelf rejects requests to the proxy itself: loopback and
+	// unspecified addresses and the addresses of its listeners. This
+	// prevents loops and access to localhost-only admin services.
+	DenySelf bool
+
+	// SelfAllowlist exempts destinations from DenySelf, as an IP
+	// for any port or an IP and port, e.g. "127.0.0.1:8080"
+	SelfAllowlist []string
+
+	// UpstreamTLS wraps the connections to selected destinations
+	// in TLS, while clients speak plaintext to the proxy
+	UpstreamTLS *UpstreamTLS
+
+	// ClientControl is called with the socket of each accepted client
+	// connection, before the handshake, to set socket options such as
+	// the receive buffer size, TCP_NODELAY or keepalives. Returning an
+	// error closes the connection. Connections without a socket, such
+	// as pipes, are skipped.
+	ClientControl func(conn net.Conn, c syscall.RawConn) error
+
+	// UpstreamMark sets SO_MARK on upstream connections, for policy
+	// routing. UpstreamDevice binds them to a network interface with
+	// SO_BINDTODEVICE. Both are only supported on Linux, where New
+	// fails otherwise, and are not applied to a custom Dial.
+	UpstreamMark   int
+	UpstreamDevice string
+
+	// UpstreamFastOpen enables TCP Fast Open on upstream connections,
+	// sending the first data of the client in the SYN once the
+	// destination handed out a cookie, to save a round trip for short
+	// lived connections. As the handshake is deferred to the first
+	// write, a refused connection then ends the relay rather than being
+	// replied as such. It falls back to regular connections where TFO is
+	// not supported, including on platforms other than Linux, and is not
+	// applied to a custom Dial. Upstreams are counted as socks5.dial.tfo
+	// by result: syn_data, regular or unsupported.
+	UpstreamFastOpen bool
+
+	// StreamPolicy is checked periodically while relaying a session,
+	// with its byte counts, and may terminate it, e.g. on a quota
+	StreamPolicy StreamPolicy
+
+	// StreamPolicyInterval is how often the StreamPolicy is checked.
+	// Defaults to a second.
+	StreamPolicyInterval time.Duration
+
+	// StreamTransformer wraps both sides of relayed sessions, e.g.
+	// to insert compression, throttling or encryption
+	StreamTransformer StreamTransformer
+
+	// ReadBufferSize is the size of the buffer used to read from
+	// clients, for the handshake and then the upstream direction.
+	// Defaults to 4KB.
+	ReadBufferSize int
+
+	// IdleTimeout ends relays which relayed no data in either
+	// direction for this long, with ErrIdleTimeout. Defaults to no
+	// timeout.
+	IdleTimeout time.Duration
+
+	// ByteQuota bounds the bytes relayed for each connection, in both
+	// directions together, ending the relay with ErrQuotaExceeded once
+	// reached. Defaults to no quota.
+	ByteQuota uint64
+
+	// MaxConnectionLifetime ends CONNECT relays once they lasted this
+	// long, with ErrMaxLifetime, so long lived tunnels reconnect and get
+	// rebalanced across the proxies behind a load balancer. Up to
+	// MaxConnectionLifetimeJitter is added at random to each relay, so
+	// the connections opened together do not all end at once. Defaults
+	// to no maximum.
+	MaxConnectionLifetime       time.Duration
+	MaxConnectionLifetimeJitter time.Duration
+
+	// RelayBufferSize is the size of each of the two buffers used to
+	// relay a connection. Buffers are pooled between connections.
+	// Defaults to 32KB, as io.Copy.
+	//
+	// Each relayed connection uses about ReadBufferSize plus twice
+	// RelayBufferSize of memory, besides the kernel socket buffers.
+	RelayBufferSize int
+
+	// HandshakeTimeout bounds how long a client may take from being
+	// accepted until its request is read. Half-open connections which
+	// exceed it are closed and counted. Defaults to no timeout.
+	HandshakeTimeout time.Duration
+
+	// GreetingTimeout, AuthTimeout and RequestTimeout bound the reads of
+	// each phase of the handshake: the greeting with the offered auth
+	// methods, the sub-negotiation of the selected method, and the
+	// request. A client stalling within a phase is reaped as for
+	// HandshakeTimeout, which still bounds the handshake as a whole.
+	// Default to no timeout.
+	GreetingTimeout time.Duration
+	AuthTimeout     time.Duration
+	RequestTimeout  time.Duration
+
+	// Metrics receives measurements of the handshake, resolve,
+	// dial and first byte latencies. Defaults to NoopMetrics.
+	Metrics Metrics
+
+	// LabelLimits bounds the values of the metric labels, by name,
+	// such as user for the username or dest for the destination host.
+	// Defaults to the 100 most frequent values for dest, leaving the
+	// other labels as is.
+	LabelLimits map[string]LabelLimit
 }
 
 // Server is reponsible for accepting connections and handling
@@ -55,14 +410,40 @@ type Config struct {
 type Server struct {
 	config      *Config
 	authMethods map[uint8]Authenticator
+	state       *serverState
+
+	// sni are the servers of the SNIRoutes, by server name
+	sni map[string]*Server
+
+	// labels applies the LabelLimits to the Metrics
+	labels *labelLimiter
+
+	// listenerConfig is set for the servers of ServeWithConfig,
+	// which keep their own Config rather than the one applied
+	// with ApplyConfig
+	listenerConfig bool
 }
 
 // New creates a new Server and potentially returns an error
 func New(conf *Config) (*Server, error) {
+	if err := checkPlatform(conf); err != nil {
+		return nil, err
+	}
+	server := &Server{state: newServerState()}
+	given := *conf
+	server.state.given = &given
+	server.configure(conf)
+	server.SetTrace(conf.Trace)
+	return server, nil
+}
+
+// configure applies the defaults to a Config and
+// prepares the server to use it
+func (s *Server) configure(conf *Config) {
 	// Ensure we have at least one authentication method enabled
 	if len(conf.AuthMethods) == 0 {
 		if conf.Credentials != nil {
-			conf.AuthMethods = []Authenticator{&UserPassAuthenticator{conf.Credentials}}
+			conf.AuthMethods = []Authenticator{&UserPassAuthenticator{Credentials: conf.Credentials}}
 		} else {
 			conf.AuthMethods = []Authenticator{&NoAuthAuthenticator{}}
 		}
@@ -78,22 +459,32 @@ func New(conf *Config) (*Server, error) {
 		conf.Rules = PermitAll()
 	}
 
-	// Ensure we have a log target
-	if conf.Logger == nil {
-		conf.Logger = log.New(os.Stdout, "", log.LstdFlags)
+	// Ensure we have a metrics sink
+	if conf.Metrics == nil {
+		conf.Metrics = NoopMetrics{}
 	}
 
-	server := &Server{
-		config: conf,
+	// Ensure we have a log target
+	if conf.Logger == nil {
+		conf.Logger = newDefaultLogger()
 	}
 
-	server.authMethods = make(map[uint8]Authenticator)
+	s.config = conf
+	s.labels = newLabelLimiter(conf.Metrics, conf.LabelLimits)
+	s.authMethods = make(map[uint8]Authenticator)
 
 	for _, a := range conf.AuthMethods {
-		server.authMethods[a.GetCode()] = a
+		s.authMethods[a.GetCode()] = a
 	}
+	s.configureSNI(conf)
+}
 
-	return server, nil
+// withConfig returns a copy of the server which uses the given
+// Config. Any state shared between listeners is retained.
+func (s *Server) withConfig(conf *Config) *Server {
+	child := *s
+	child.configure(conf)
+	return &child
 }
 
 // ListenAndServe is used to create a listener and serve on it
@@ -107,63 +498,290 @@ func (s *Server) ListenAndServe(network, addr string) error {
 
 // Serve is used to serve connections from a listener
 func (s *Server) Serve(l net.Listener) error {
+	sl := s.state.trackListener(l, true)
+	if sl == nil {
+		return ErrServerClosed
+	}
+	return s.serve(l, sl)
+}
+
+// serve is used to accept connections from a tracked listener
+func (s *Server) serve(l net.Listener, sl *servedListener) (err error) {
+	defer s.state.trackListener(l, false)
+	s.emit(&Event{Type: EventServerStarted, Addr: l.Addr()})
+	defer func() {
+		s.emit(&Event{Type: EventListenerClosed, Addr: l.Addr(), Err: err})
+	}()
+
+	serve := func(conn net.Conn) { s.spawn("conn", func() { s.ServeConn(conn) }) }
+	if s.config.HandshakeWorkers > 0 {
+		pool := s.newWorkerPool()
+		defer pool.stop()
+		serve = pool.submit
+	}
+
+	var backoff time.Duration
 	for {
 		conn, err := l.Accept()
 		if err != nil {
-			return err
+			if s.state.isClosed() {
+				return ErrServerClosed
+			}
+			if s.state.isRemoved(sl) {
+				return ErrListenerRemoved
+			}
+			if !s.acceptErrorContinue(err) {
+				return err
+			}
+			if backoff == 0 {
+				backoff = minAcceptBackoff
+			} else {
+				backoff *= 2
+			}
+			if backoff > maxAcceptBackoff {
+				backoff = maxAcceptBackoff
+			}
+			s.logf(LogError, "Accept error: %v; retrying in %v", err, backoff)
+			time.Sleep(backoff)
+			continue
+		}
+		backoff = 0
+
+		// Drop filtered clients before reading anything
+		if filter := s.live().config.ClientFilter; filter != nil && !filter.AllowClient(conn.RemoteAddr()) {
+			s.metrics().IncrCounter([]string{"socks5", "client", "filtered"}, 1)
+			conn.Close()
+			continue
 		}
-		go s.ServeConn(conn)
+
+		// Hold the client until a connection slot is free,
+		// leaving the following ones in the backlog
+		slot, ok := s.acquireSlot(sl)
+		if !ok {
+			conn.Close()
+			if s.state.isClosed() {
+				return ErrServerClosed
+			}
+			return ErrListenerRemoved
+		}
+		s.state.assign(conn, sl, slot)
+		serve(conn)
 	}
-	return nil
+}
+
+// ServeWithConfig is used to serve connections from a listener using
+// a distinct Config, for example to require authentication or apply
+// stricter rules on a public interface than on localhost.
+func (s *Server) ServeWithConfig(l net.Listener, conf *Config) error {
+	child := s.withConfig(conf)
+	child.listenerConfig = true
+	return child.Serve(l)
+}
+
+// acceptErrorContinue decides if Serve should keep accepting
+// after the given error
+func (s *Server) acceptErrorContinue(err error) bool {
+	if s.config.OnAcceptError != nil {
+		return s.config.OnAcceptError(err)
+	}
+	if ne, ok := err.(interface {
+		Temporary() bool
+	}); ok {
+		return ne.Temporary()
+	}
+	return false
 }
 
 // ServeConn is used to serve a single connection.
-func (s *Server) ServeConn(conn net.Conn) error {
+func (s *Server) ServeConn(conn net.Conn) (err error) {
 	defer conn.Close()
-	bufConn := bufio.NewReader(conn)
+	defer s.recoverConn(conn, &err)
+	if !s.openConn(conn) {
+		return ErrServerClosed
+	}
+	var request *Request
+	defer func() { s.closeConn(conn, request, err) }()
 
-	// Read the version byte
-	version := []byte{0}
-	if _, err := bufConn.Read(version); err != nil {
-		s.config.Logger.Printf("[ERR] socks: Failed to get version byte: %v", err)
+	if err := s.controlClient(conn); err != nil {
+		s.logf(LogError, "%v", err)
 		return err
 	}
-
-	// Ensure we are compatible
-	if version[0] != socks5Version {
-		err := fmt.Errorf("Unsupported SOCKS version: %v", version)
-		s.config.Logger.Printf("[ERR] socks: %v", err)
+	srv, err := s.live().route(conn)
+	if err != nil {
 		return err
 	}
-
-	// Authenticate the connection
-	authContext, err := s.authenticate(conn, bufConn)
+	request, err = srv.handshake(conn, 0)
 	if err != nil {
-		err = fmt.Errorf("Failed to authenticate: %v", err)
-		s.config.Logger.Printf("[ERR] socks: %v", err)
 		return err
 	}
+	return srv.serveRequest(request, conn)
+}
+
+// handshake is used to negotiate with the client, up to and including
+// reading its request. Clients which do not complete the handshake
+// within the HandshakeTimeout, or a phase of it within its own
+// timeout, are reaped. The fallback timeout applies when the
+// server has no HandshakeTimeout.
+func (s *Server) handshake(conn net.Conn, fallback time.Duration) (*Request, error) {
+	pending := s.state.handshaking(1)
+	s.metrics().SetGauge([]string{"socks5", "handshake", "pending"}, float32(pending))
+	defer func() {
+		pending := s.state.handshaking(-1)
+		s.metrics().SetGauge([]string{"socks5", "handshake", "pending"}, float32(pending))
+	}()
 
-	request, err := NewRequest(bufConn)
+	deadlines := &phaseDeadlines{conn: conn}
+	timeout := s.config.HandshakeTimeout
+	if timeout <= 0 {
+		timeout = fallback
+	}
+	if timeout > 0 {
+		deadlines.overall = time.Now().Add(timeout)
+		deadlines.current = deadlines.overall
+		conn.SetDeadline(deadlines.overall)
+	}
+	request, err := s.negotiate(conn, deadlines)
 	if err != nil {
-		if err == unrecognizedAddrType {
-			if err := sendReply(conn, addrTypeNotSupported, nil); err != nil {
-				return fmt.Errorf("Failed to send reply: %v", err)
+		if deadlines.expired() {
+			s.metrics().IncrCounter([]string{"socks5", "handshake", "reaped"}, 1, Label{Name: "kind", Value: "handshake"})
+		}
+		s.handshakeFailed(err)
+		return nil, err
+	}
+	if deadlines.used() {
+		conn.SetDeadline(time.Time{})
+	}
+	return request, nil
+}
+
+// checkGreeting is used to run the OnGreeting hook, rejecting
+// the client if it fails
+func (s *Server) checkGreeting(ctx context.Context, methods []byte, conn net.Conn) error {
+	if s.config.OnGreeting == nil {
+		return nil
+	}
+	err := s.config.OnGreeting(ctx, methods, conn)
+	if err == nil {
+		return nil
+	}
+	s.metrics().IncrCounter([]string{"socks5", "greeting", "rejected"}, 1)
+	err = fmt.Errorf("Greeting rejected: %v", err)
+	req := &Request{Version: socks5Version, RemoteAddr: remoteAddrSpec(conn)}
+	s.deny(ctx, req, DenyGreeting, 0, err)
+	noAcceptableAuth(conn)
+	return err
+}
+
+// negotiate performs the handshake steps with the client
+func (s *Server) negotiate(conn net.Conn, deadlines *phaseDeadlines) (*Request, error) {
+	start := time.Now()
+	bufConn := bufio.NewReaderSize(conn, s.readBufferSize())
+
+	// Bound the bytes read until the request is parsed,
+	// resetting clients which exceed the limit
+	var hsConn io.Reader = bufConn
+	if s.config.MaxRequestBytes > 0 {
+		limit := &limitedReader{r: bufConn, n: s.config.MaxRequestBytes}
+		defer func() {
+			if limit.exceeded {
+				resetConn(conn)
 			}
+		}()
+		hsConn = limit
+	}
+
+	ctx := withConnID(context.Background())
+
+	// Read the greeting
+	hs := &Handshake{authMethods: s.authMethods, ctx: ctx, conn: conn, codec: s.codec()}
+	deadlines.start(s.config.GreetingTimeout)
+	if err := hs.Step(hsConn, conn); err != nil {
+		return nil, &handshakeError{PhaseGreeting, err}
+	}
+	if err := s.checkFraming(bufConn, PhaseGreeting); err != nil {
+		return nil, &handshakeError{PhaseGreeting, err}
+	}
+	s.tracef(ctx, "greeting", "from %v, offered methods %v", conn.RemoteAddr(), hs.Methods)
+	if err := s.checkGreeting(ctx, hs.Methods, conn); err != nil {
+		return nil, &handshakeError{PhaseGreeting, err}
+	}
+
+	// Authenticate the connection
+	deadlines.start(s.config.AuthTimeout)
+	if err := hs.Step(hsConn, conn); err != nil {
+		if errors.Is(err, UserAuthFailed) || errors.Is(err, NoSupportedAuth) {
+			req := &Request{Version: socks5Version, RemoteAddr: remoteAddrSpec(conn)}
+			s.deny(ctx, req, DenyAuth, 0, err)
 		}
-		return fmt.Errorf("Failed to read destination address: %v", err)
+		err = fmt.Errorf("Failed to authenticate: %w", err)
+		s.tracef(ctx, "auth", "%v", err)
+		return nil, &handshakeError{PhaseAuth, err}
+	}
+
+	if err := s.checkFraming(bufConn, PhaseAuth); err != nil {
+		return nil, &handshakeError{PhaseAuth, err}
 	}
-	request.AuthContext = authContext
-	if client, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
-		request.RemoteAddr = &AddrSpec{IP: client.IP, Port: client.Port}
+	atomic.AddUint64(&s.state.stats().authenticated, 1)
+	authEvent := &Event{Type: EventAuthSucceeded, Addr: conn.RemoteAddr()}
+	if ac := hs.AuthContext; ac != nil && ac.Payload["Username"] != "" {
+		ctx = WithUser(ctx, ac.Payload["Username"])
+		authEvent.User = ac.Payload["Username"]
+	}
+	s.emit(authEvent)
+	if ac := hs.AuthContext; ac != nil {
+		s.tracef(ctx, "auth", "method %d succeeded, user %q", ac.Method, authEvent.User)
 	}
 
-	// Process the client request
+	// Read the request
+	deadlines.start(s.config.RequestTimeout)
+	if err := hs.Step(hsConn, conn); err != nil {
+		s.tracef(ctx, "request", "failed to parse: %v", err)
+		err = fmt.Errorf("Failed to read destination address: %w", err)
+		return nil, &handshakeError{PhaseRequest, err}
+	}
+	request := hs.Request
+	s.tracef(ctx, "request", "command %d to %v (%s)", request.Command, request.DestAddr, request.addrKind())
+	if err := s.checkReserved("request", uint16(request.rsv)); err != nil {
+		if err := s.reply(conn, request, ServerFailure, nil); err != nil {
+			err = fmt.Errorf("Failed to send reply: %w", err)
+			return nil, &handshakeError{PhaseReply, err}
+		}
+		return nil, &handshakeError{PhaseRequest, err}
+	}
+	request.bufConn = bufConn
+	request.ctx = withRequest(ctx, request)
+	request.RemoteAddr = remoteAddrSpec(conn)
+	if local, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		request.localAddr = &AddrSpec{IP: local.IP, Port: local.Port, Zone: local.Zone}
+	}
+	s.metrics().MeasureSince([]string{"socks5", "handshake"}, start)
+	s.metrics().IncrCounter([]string{"socks5", "request", "addr"}, 1, Label{Name: "type", Value: request.addrKind()})
+	return request, nil
+}
+
+// serveRequest is used to process the request of a client
+func (s *Server) serveRequest(request *Request, conn net.Conn) error {
 	if err := s.handleRequest(request, conn); err != nil {
 		err = fmt.Errorf("Failed to handle request: %v", err)
-		s.config.Logger.Printf("[ERR] socks: %v", err)
+		s.logf(LogError, "%v", err)
 		return err
 	}
+	return nil
+}
+
+// remoteAddrSpec returns the AddrSpec of the client, if known
+func remoteAddrSpec(conn conn) *AddrSpec {
+	return netAddrSpec(conn.RemoteAddr())
+}
 
+// netAddrSpec converts a TCP address to an AddrSpec.
+// Returns nil for other kinds of addresses.
+func netAddrSpec(addr net.Addr) *AddrSpec {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return &AddrSpec{IP: a.IP, Port: a.Port, Zone: a.Zone}
+	case *AddrSpec:
+		return a
+	}
 	return nil
 }
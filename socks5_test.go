@@ -3,6 +3,7 @@ package socks5
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"io"
 	"log"
 	"net"
@@ -108,3 +109,163 @@ func TestSOCKS5_Connect(t *testing.T) {
 		t.Fatalf("bad: %v", out)
 	}
 }
+
+type tempErr struct{}
+
+func (tempErr) Error() string   { return "temporary failure" }
+func (tempErr) Temporary() bool { return true }
+func (tempErr) Timeout() bool   { return false }
+
+// errListener returns the queued errors from Accept in order
+type errListener struct {
+	errs []error
+}
+
+func (l *errListener) Accept() (net.Conn, error) {
+	err := l.errs[0]
+	if len(l.errs) > 1 {
+		l.errs = l.errs[1:]
+	}
+	return nil, err
+}
+
+func (l *errListener) Close() error   { return nil }
+func (l *errListener) Addr() net.Addr { return &net.TCPAddr{} }
+
+func TestSOCKS5_Serve_TemporaryAcceptError(t *testing.T) {
+	fatal := errors.New("fatal")
+	l := &errListener{errs: []error{tempErr{}, tempErr{}, fatal}}
+
+	serv, _ := New(&Config{})
+	if err := serv.Serve(l); err != fatal {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestSOCKS5_Serve_OnAcceptError(t *testing.T) {
+	fatal := errors.New("fatal")
+	l := &errListener{errs: []error{fatal, fatal, tempErr{}}}
+
+	var seen []error
+	serv, _ := New(&Config{
+		OnAcceptError: func(err error) bool {
+			seen = append(seen, err)
+			return err == fatal
+		},
+	})
+	if err, ok := serv.Serve(l).(tempErr); !ok {
+		t.Fatalf("err: %v", err)
+	}
+	if len(seen) != 3 {
+		t.Fatalf("bad: %v", seen)
+	}
+}
+
+func TestSOCKS5_ServeWithConfig(t *testing.T) {
+	serv, _ := New(&Config{})
+
+	public, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer public.Close()
+	local, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer local.Close()
+
+	go serv.Serve(local)
+	go serv.ServeWithConfig(public, &Config{
+		Credentials: StaticCredentials{"foo": "bar"},
+	})
+
+	// Each listener should select its own auth method
+	for _, tc := range []struct {
+		l      net.Listener
+		method uint8
+	}{
+		{local, NoAuth},
+		{public, UserPassAuth},
+	} {
+		conn, err := net.Dial("tcp", tc.l.Addr().String())
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		conn.Write([]byte{5, 2, NoAuth, UserPassAuth})
+
+		out := make([]byte, 2)
+		conn.SetDeadline(time.Now().Add(time.Second))
+		if _, err := io.ReadAtLeast(conn, out, len(out)); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		conn.Close()
+		if !bytes.Equal(out, []byte{socks5Version, tc.method}) {
+			t.Fatalf("bad: %v", out)
+		}
+	}
+}
+
+func TestSOCKS5_HandshakeTimeout(t *testing.T) {
+	metrics := newTestMetrics()
+	serv, _ := New(&Config{
+		HandshakeTimeout: 50 * time.Millisecond,
+		Metrics:          metrics,
+	})
+
+	// A client which never completes the greeting is reaped
+	client, server := net.Pipe()
+	defer client.Close()
+	errCh := make(chan error, 1)
+	go func() { errCh <- serv.ServeConn(server) }()
+	client.Write([]byte{5, 1})
+
+	select {
+	case err := <-errCh:
+		if err == nil {
+			t.Fatalf("expected error")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timeout")
+	}
+	if metrics.counter("socks5.handshake.reaped") != 1 {
+		t.Fatalf("bad: %v", metrics.counters)
+	}
+	if serv.state.handshaking(0) != 0 {
+		t.Fatalf("bad: %d", serv.state.handshaking(0))
+	}
+}
+
+func TestSOCKS5_AuthTimeout(t *testing.T) {
+	metrics := newTestMetrics()
+	serv, _ := New(&Config{
+		Credentials:     StaticCredentials{"foo": "bar"},
+		GreetingTimeout: time.Second,
+		AuthTimeout:     50 * time.Millisecond,
+		Metrics:         metrics,
+	})
+
+	// A client which stalls during the sub-negotiation is reaped
+	client, server := net.Pipe()
+	defer client.Close()
+	errCh := make(chan error, 1)
+	go func() { errCh <- serv.ServeConn(server) }()
+	client.Write([]byte{5, 1, UserPassAuth})
+	out := make([]byte, 2)
+	if _, err := io.ReadFull(client, out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	client.Write([]byte{1, 3, 'f'})
+
+	select {
+	case err := <-errCh:
+		if err == nil {
+			t.Fatalf("expected error")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timeout")
+	}
+	if metrics.counter("socks5.handshake.reaped") != 1 {
+		t.Fatalf("bad: %v", metrics.counters)
+	}
+}
@@ -0,0 +1,190 @@
+package socks5test
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/armon/go-socks5"
+)
+
+const (
+	// NoAcceptableMethod is the method a server selects when it
+	// supports none of the methods of the greeting
+	NoAcceptableMethod = uint8(255)
+
+	// AuthSuccess and AuthFailure are the statuses of a RFC 1929
+	// username and password authentication
+	AuthSuccess = uint8(0)
+	AuthFailure = uint8(1)
+)
+
+// defaultScriptTimeout bounds a script run with RunServer
+const defaultScriptTimeout = 5 * time.Second
+
+// Script is a scripted SOCKS5 client, which sends messages and expects
+// the answers of the server in order, so the methods, commands and
+// reply codes of a server can be tested declaratively:
+//
+//	err := socks5test.NewScript().
+//		Greet(socks5.UserPassAuth).
+//		ExpectMethod(socks5.UserPassAuth).
+//		UserPass("foo", "bar").
+//		ExpectAuth(socks5test.AuthSuccess).
+//		Request(socks5.ConnectCommand, echo.Addr()).
+//		ExpectReply(socks5.SuccessReply).
+//		RunServer(serv)
+//
+// A Script can be run any number of times.
+type Script struct {
+	steps []scriptStep
+}
+
+// scriptStep is a step of a Script, described by name in errors
+type scriptStep struct {
+	name string
+	run  func(conn net.Conn) error
+}
+
+// NewScript returns an empty Script
+func NewScript() *Script {
+	return &Script{}
+}
+
+func (s *Script) step(name string, run func(conn net.Conn) error) *Script {
+	s.steps = append(s.steps, scriptStep{name: name, run: run})
+	return s
+}
+
+// Send sends raw bytes, such as malformed messages
+func (s *Script) Send(b []byte) *Script {
+	return s.step(fmt.Sprintf("send %x", b), func(conn net.Conn) error {
+		_, err := conn.Write(b)
+		return err
+	})
+}
+
+// Greet sends a greeting offering the methods
+func (s *Script) Greet(methods ...uint8) *Script {
+	msg := append([]byte{5, byte(len(methods))}, methods...)
+	return s.step(fmt.Sprintf("greet %v", methods), func(conn net.Conn) error {
+		_, err := conn.Write(msg)
+		return err
+	})
+}
+
+// ExpectMethod expects the server to select the method
+func (s *Script) ExpectMethod(method uint8) *Script {
+	return s.step(fmt.Sprintf("expect method %d", method), func(conn net.Conn) error {
+		return expect(conn, []byte{5, method})
+	})
+}
+
+// UserPass sends a RFC 1929 username and password
+func (s *Script) UserPass(user, pass string) *Script {
+	msg := []byte{1, byte(len(user))}
+	msg = append(msg, user...)
+	msg = append(msg, byte(len(pass)))
+	msg = append(msg, pass...)
+	return s.step(fmt.Sprintf("send user %q", user), func(conn net.Conn) error {
+		_, err := conn.Write(msg)
+		return err
+	})
+}
+
+// ExpectAuth expects the status of a RFC 1929 authentication
+func (s *Script) ExpectAuth(status uint8) *Script {
+	return s.step(fmt.Sprintf("expect auth status %d", status), func(conn net.Conn) error {
+		return expect(conn, []byte{1, status})
+	})
+}
+
+// Request sends a request of the command for the host:port address.
+// Hosts which are not IP addresses are sent as a FQDN.
+func (s *Script) Request(cmd uint8, addr string) *Script {
+	name := fmt.Sprintf("request %d %s", cmd, addr)
+	spec, err := socks5.ParseAddrSpec(addr)
+	if err != nil {
+		return s.step(name, func(net.Conn) error { return err })
+	}
+	body, err := spec.MarshalBinary()
+	if err != nil {
+		return s.step(name, func(net.Conn) error { return err })
+	}
+	msg := append([]byte{5, cmd, 0}, body...)
+	return s.step(name, func(conn net.Conn) error {
+		_, err := conn.Write(msg)
+		return err
+	})
+}
+
+// ExpectReply expects a reply with the code, whatever its address
+func (s *Script) ExpectReply(reply uint8) *Script {
+	return s.step(fmt.Sprintf("expect reply %d", reply), func(conn net.Conn) error {
+		got, _, err := socks5.ReadReply(conn)
+		if err != nil {
+			return err
+		}
+		if got != reply {
+			return fmt.Errorf("Unexpected reply %d", got)
+		}
+		return nil
+	})
+}
+
+// Expect expects the server to send exactly the bytes
+func (s *Script) Expect(b []byte) *Script {
+	return s.step(fmt.Sprintf("expect %x", b), func(conn net.Conn) error {
+		return expect(conn, b)
+	})
+}
+
+// ExpectClose expects the server to close the connection
+// without sending anything more
+func (s *Script) ExpectClose() *Script {
+	return s.step("expect close", func(conn net.Conn) error {
+		n, err := conn.Read(make([]byte, 1))
+		if n > 0 {
+			return fmt.Errorf("Unexpected data before close")
+		}
+		if err != io.EOF {
+			return fmt.Errorf("Connection not closed: %v", err)
+		}
+		return nil
+	})
+}
+
+// Run runs the steps on the connection, returning the error of the
+// first step which failed. The connection is left open, so a relay
+// can be tested afterwards.
+func (s *Script) Run(conn net.Conn) error {
+	for i, step := range s.steps {
+		if err := step.run(conn); err != nil {
+			return fmt.Errorf("Step %d (%s) failed: %v", i+1, step.name, err)
+		}
+	}
+	return nil
+}
+
+// RunServer runs the steps on a new Pipe to the server, which is
+// closed afterwards, failing steps which wait for over 5 seconds
+func (s *Script) RunServer(serv *socks5.Server) error {
+	conn := Pipe(serv)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(defaultScriptTimeout))
+	return s.Run(conn)
+}
+
+// expect is used to read len(want) bytes, failing if they differ
+func expect(r io.Reader, want []byte) error {
+	got := make([]byte, len(want))
+	if n, err := io.ReadFull(r, got); err != nil {
+		return fmt.Errorf("Read %x: %v", got[:n], err)
+	}
+	if !bytes.Equal(got, want) {
+		return fmt.Errorf("Unexpected %x", got)
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package socks5test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/armon/go-socks5"
+)
+
+func TestScript(t *testing.T) {
+	echo, err := NewEchoServer()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer echo.Close()
+
+	serv, err := socks5.New(&socks5.Config{
+		Credentials: socks5.StaticCredentials{"foo": "bar"},
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	cases := []struct {
+		name   string
+		script *Script
+	}{
+		{"connect", NewScript().
+			Greet(socks5.NoAuth, socks5.UserPassAuth).
+			ExpectMethod(socks5.UserPassAuth).
+			UserPass("foo", "bar").
+			ExpectAuth(AuthSuccess).
+			Request(socks5.ConnectCommand, echo.Addr()).
+			ExpectReply(socks5.SuccessReply).
+			Send([]byte("ping")).
+			Expect([]byte("ping"))},
+		{"no acceptable method", NewScript().
+			Greet(socks5.NoAuth).
+			ExpectMethod(NoAcceptableMethod).
+			ExpectClose()},
+		{"bad password", NewScript().
+			Greet(socks5.UserPassAuth).
+			ExpectMethod(socks5.UserPassAuth).
+			UserPass("foo", "baz").
+			ExpectAuth(AuthFailure).
+			ExpectClose()},
+		{"unknown command", NewScript().
+			Greet(socks5.UserPassAuth).
+			ExpectMethod(socks5.UserPassAuth).
+			UserPass("foo", "bar").
+			ExpectAuth(AuthSuccess).
+			Request(9, echo.Addr()).
+			ExpectReply(socks5.CommandNotSupported)},
+	}
+	for _, c := range cases {
+		if err := c.script.RunServer(serv); err != nil {
+			t.Fatalf("%s: err: %v", c.name, err)
+		}
+	}
+
+	// Failures name the step
+	err = NewScript().
+		Greet(socks5.UserPassAuth).
+		ExpectMethod(socks5.NoAuth).
+		RunServer(serv)
+	if err == nil || !strings.Contains(err.Error(), "Step 2 (expect method 0)") {
+		t.Fatalf("bad: %v", err)
+	}
+}
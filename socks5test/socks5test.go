@@ -0,0 +1,89 @@
+// Package socks5test provides utilities for testing SOCKS5 flows
+// without real listeners for the proxy or fixed ports.
+package socks5test
+
+import (
+	"io"
+	"net"
+	"sync"
+
+	"github.com/armon/go-socks5"
+)
+
+// Pipe returns the client side of an in-memory connection, whose
+// server side is served by a goroutine running ServeConn. Closing
+// the returned connection ends the served connection.
+func Pipe(s *socks5.Server) net.Conn {
+	client, server := net.Pipe()
+	go s.ServeConn(server)
+	return client
+}
+
+// EchoServer is a TCP target which writes back everything it reads,
+// listening on an ephemeral loopback port
+type EchoServer struct {
+	l      net.Listener
+	wg     sync.WaitGroup
+	lock   sync.Mutex
+	closed bool
+	conns  map[net.Conn]struct{}
+}
+
+// NewEchoServer starts an EchoServer
+func NewEchoServer() (*EchoServer, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	e := &EchoServer{l: l, conns: make(map[net.Conn]struct{})}
+	e.wg.Add(1)
+	go e.serve()
+	return e, nil
+}
+
+// Addr returns the address of the server, as a host:port
+// suitable for a SOCKS request
+func (e *EchoServer) Addr() string {
+	return e.l.Addr().String()
+}
+
+// Close stops the server and closes all its connections
+func (e *EchoServer) Close() error {
+	err := e.l.Close()
+	e.lock.Lock()
+	e.closed = true
+	for conn := range e.conns {
+		conn.Close()
+	}
+	e.lock.Unlock()
+	e.wg.Wait()
+	return err
+}
+
+func (e *EchoServer) serve() {
+	defer e.wg.Done()
+	for {
+		conn, err := e.l.Accept()
+		if err != nil {
+			return
+		}
+		e.lock.Lock()
+		if e.closed {
+			e.lock.Unlock()
+			conn.Close()
+			return
+		}
+		e.conns[conn] = struct{}{}
+		e.lock.Unlock()
+
+		e.wg.Add(1)
+		go func() {
+			defer e.wg.Done()
+			io.Copy(conn, conn)
+			conn.Close()
+			e.lock.Lock()
+			delete(e.conns, conn)
+			e.lock.Unlock()
+		}()
+	}
+}
@@ -0,0 +1,54 @@
+package socks5test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/armon/go-socks5"
+)
+
+func TestPipe_Echo(t *testing.T) {
+	echo, err := NewEchoServer()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer echo.Close()
+	addr := echo.l.Addr().(*net.TCPAddr)
+
+	serv, err := socks5.New(&socks5.Config{})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	conn := Pipe(serv)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+
+	// Negotiate, connect to the echo server and send a ping
+	req := bytes.NewBuffer(nil)
+	req.Write([]byte{5, 1, socks5.NoAuth})
+	req.Write([]byte{5, socks5.ConnectCommand, 0, 1, 127, 0, 0, 1})
+	binary.Write(req, binary.BigEndian, uint16(addr.Port))
+	req.Write([]byte("ping"))
+	go conn.Write(req.Bytes())
+
+	// Method selection and reply, up to the bound port
+	header := make([]byte, 2+10)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if header[3] != socks5.SuccessReply {
+		t.Fatalf("bad: %v", header)
+	}
+
+	out := make([]byte, 4)
+	if _, err := io.ReadFull(conn, out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(out) != "ping" {
+		t.Fatalf("bad: %v", out)
+	}
+}
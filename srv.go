@@ -0,0 +1,135 @@
+package socks5
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"strings"
+
+	"golang.org/x/net/context"
+)
+
+// SRVRegistry is a ServiceRegistry looking up the backends of a
+// service with DNS SRV records, for example to point legacy clients
+// at services discovered through Consul or Kubernetes DNS. Backends
+// are ordered by priority, and by weight within a priority, as in
+// RFC 2782. Use it with a ServiceRouter and BalanceOrdered to keep
+// that order:
+//
+//	router := &socks5.ServiceRouter{
+//		Registry: &socks5.SRVRegistry{},
+//		Suffix:   ".service.consul",
+//		Policy:   socks5.BalanceOrdered,
+//	}
+type SRVRegistry struct {
+	// Service and Proto select the records of _service._proto.name,
+	// e.g. "http" and "tcp". If both are empty, the name is looked
+	// up as is, e.g. for "_http._tcp.web.default.svc.cluster.local".
+	Service string
+	Proto   string
+
+	// ValidatePort only uses the records whose port is the one the
+	// client requested, failing if there are none. By default the
+	// requested port is ignored in favor of the records.
+	ValidatePort bool
+
+	// Resolver is used to resolve the targets of the records.
+	// Targets which fail to resolve are unhealthy.
+	// Defaults to DNSResolver.
+	Resolver NameResolver
+
+	// LookupSRV is used to look up the records.
+	// Defaults to net.DefaultResolver.LookupSRV.
+	LookupSRV func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+}
+
+func (r *SRVRegistry) Backends(ctx context.Context, name string, port int) ([]*Backend, error) {
+	lookup := r.LookupSRV
+	if lookup == nil {
+		lookup = net.DefaultResolver.LookupSRV
+	}
+	_, records, err := lookup(ctx, r.Service, r.Proto, name)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to look up SRV records of %s: %v", name, err)
+	}
+	if r.ValidatePort {
+		var matching []*net.SRV
+		for _, srv := range records {
+			if int(srv.Port) == port {
+				matching = append(matching, srv)
+			}
+		}
+		records = matching
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("No SRV records for %s:%d", name, port)
+	}
+
+	resolver := r.Resolver
+	if resolver == nil {
+		resolver = DNSResolver{}
+	}
+	backends := make([]*Backend, 0, len(records))
+	for _, srv := range orderSRV(records) {
+		target := strings.TrimSuffix(srv.Target, ".")
+		addr := &AddrSpec{FQDN: target, Port: int(srv.Port)}
+		_, ip, err := resolver.Resolve(ctx, target)
+		addr.IP = ip
+		backends = append(backends, &Backend{Addr: addr, Healthy: err == nil && ip != nil})
+	}
+	return backends, nil
+}
+
+// orderSRV is used to order records by priority, and then by
+// weighted random selection within each priority, per RFC 2782
+func orderSRV(records []*net.SRV) []*net.SRV {
+	sorted := make([]*net.SRV, len(records))
+	copy(sorted, records)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Priority < sorted[j].Priority
+	})
+
+	out := make([]*net.SRV, 0, len(sorted))
+	for i := 0; i < len(sorted); {
+		j := i
+		for j < len(sorted) && sorted[j].Priority == sorted[i].Priority {
+			j++
+		}
+		out = append(out, weighted(sorted[i:j])...)
+		i = j
+	}
+	return out
+}
+
+// weighted orders records of the same priority, picking each next
+// record with a probability proportional to its weight
+func weighted(records []*net.SRV) []*net.SRV {
+	// Zero weight records go first, to have a small chance too
+	remaining := make([]*net.SRV, len(records))
+	copy(remaining, records)
+	sort.SliceStable(remaining, func(i, j int) bool {
+		return remaining[i].Weight == 0 && remaining[j].Weight != 0
+	})
+	out := make([]*net.SRV, 0, len(records))
+	for len(remaining) > 0 {
+		total := 0
+		for _, srv := range remaining {
+			total += int(srv.Weight)
+		}
+		pick := 0
+		if total > 0 {
+			n := rand.Intn(total + 1)
+			sum := 0
+			for i, srv := range remaining {
+				if sum += int(srv.Weight); sum >= n {
+					pick = i
+					break
+				}
+			}
+		}
+		out = append(out, remaining[pick])
+		remaining = append(remaining[:pick], remaining[pick+1:]...)
+	}
+	return out
+}
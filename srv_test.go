@@ -0,0 +1,127 @@
+package socks5
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// srvRecords serves fixed SRV records for any name
+func srvRecords(records ...*net.SRV) func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	return func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+		if len(records) == 0 {
+			return "", nil, fmt.Errorf("no such host")
+		}
+		return name, records, nil
+	}
+}
+
+func TestSRVRegistry_Backends(t *testing.T) {
+	r := &SRVRegistry{
+		Resolver: loopbackResolver{},
+		LookupSRV: srvRecords(
+			&net.SRV{Target: "b.example.", Port: 8080, Priority: 20, Weight: 1},
+			&net.SRV{Target: "a.example.", Port: 9090, Priority: 10, Weight: 1},
+		),
+	}
+	backends, err := r.Backends(context.Background(), "api.service.consul", 80)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Ordered by priority, with the resolved targets
+	if len(backends) != 2 || backends[0].Addr.FQDN != "a.example" || backends[0].Addr.Port != 9090 {
+		t.Fatalf("bad: %v", backends)
+	}
+	if !backends[0].Healthy || !backends[0].Addr.IP.IsLoopback() || backends[1].Addr.FQDN != "b.example" {
+		t.Fatalf("bad: %v", backends)
+	}
+
+	// Only the records with the requested port are valid
+	r.ValidatePort = true
+	backends, err = r.Backends(context.Background(), "api.service.consul", 8080)
+	if err != nil || len(backends) != 1 || backends[0].Addr.FQDN != "b.example" {
+		t.Fatalf("bad: %v %v", backends, err)
+	}
+	if _, err := r.Backends(context.Background(), "api.service.consul", 80); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	// Names without records fail
+	r.LookupSRV = srvRecords()
+	if _, err := r.Backends(context.Background(), "api.service.consul", 80); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestOrderSRV_Weight(t *testing.T) {
+	records := []*net.SRV{
+		{Target: "zero", Priority: 1, Weight: 0},
+		{Target: "heavy", Priority: 1, Weight: 1000},
+		{Target: "other", Priority: 2, Weight: 1000},
+	}
+	heavyFirst := 0
+	for i := 0; i < 100; i++ {
+		out := orderSRV(records)
+		if len(out) != 3 || out[2].Target != "other" {
+			t.Fatalf("bad: %v", out)
+		}
+		if out[0].Target == "heavy" {
+			heavyFirst++
+		}
+	}
+	if heavyFirst < 90 {
+		t.Fatalf("bad: %d", heavyFirst)
+	}
+}
+
+func TestSRVRegistry_Connect(t *testing.T) {
+	target := echoTarget(t)
+	defer target.Close()
+	tAddr := target.Addr().(*net.TCPAddr)
+
+	router := &ServiceRouter{
+		Registry: &SRVRegistry{
+			Resolver: loopbackResolver{},
+			LookupSRV: srvRecords(
+				&net.SRV{Target: "echo.example.", Port: uint16(tAddr.Port), Priority: 10},
+			),
+		},
+		Suffix: ".service.consul",
+		Policy: BalanceOrdered,
+	}
+	serv, _ := New(&Config{Resolver: router, Rewriter: router, Dial: router.Dial(nil)})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	go serv.Serve(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+	name := "echo.service.consul"
+	req := []byte{5, 1, NoAuth, 5, ConnectCommand, 0, fqdnAddress, byte(len(name))}
+	req = append(append(req, name...), 0, 80)
+	conn.Write(append(req, "ping"...))
+
+	if _, err := io.ReadFull(conn, make([]byte, 2)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if resp, _, err := ReadReply(conn); err != nil || resp != SuccessReply {
+		t.Fatalf("bad: %v %v", resp, err)
+	}
+	out := make([]byte, 4)
+	if _, err := io.ReadFull(conn, out); err != nil || !bytes.Equal(out, []byte("ping")) {
+		t.Fatalf("bad: %v %v", out, err)
+	}
+}
@@ -0,0 +1,69 @@
+package socks5
+
+import (
+	"sync/atomic"
+)
+
+// Stats is a snapshot of the statistics of a Server. The JSON field
+// names are stable, so it can be served to external agents as is.
+type Stats struct {
+	// Accepted is the number of connections accepted
+	Accepted uint64 `json:"accepted"`
+
+	// Active is the number of currently open connections,
+	// of which Handshaking are still in the handshake
+	Active      int   `json:"active"`
+	Handshaking int64 `json:"handshaking"`
+
+	// Authenticated is the number of clients which authenticated
+	Authenticated uint64 `json:"authenticated"`
+
+	// Denied is the number of denials, as reported to OnDeny
+	Denied uint64 `json:"denied"`
+
+	// DialFailures is the number of failed dials to destinations
+	DialFailures uint64 `json:"dial_failures"`
+
+	// BytesUp and BytesDown are the bytes relayed from
+	// clients to destinations and back
+	BytesUp   uint64 `json:"bytes_up"`
+	BytesDown uint64 `json:"bytes_down"`
+}
+
+// serverStats are the cumulative counters of a serverState,
+// which must only be accessed atomically
+type serverStats struct {
+	accepted      uint64
+	authenticated uint64
+	denied        uint64
+	dialFailures  uint64
+	bytesUp       uint64
+	bytesDown     uint64
+}
+
+// stats returns the counters to update. Servers without
+// a state, as used in tests, update discarded counters.
+func (st *serverState) stats() *serverStats {
+	if st == nil {
+		return new(serverStats)
+	}
+	return &st.counters
+}
+
+// Stats returns a snapshot of the statistics of the server
+func (s *Server) Stats() Stats {
+	c := s.state.stats()
+	stats := Stats{
+		Accepted:      atomic.LoadUint64(&c.accepted),
+		Handshaking:   s.state.handshaking(0),
+		Authenticated: atomic.LoadUint64(&c.authenticated),
+		Denied:        atomic.LoadUint64(&c.denied),
+		DialFailures:  atomic.LoadUint64(&c.dialFailures),
+		BytesUp:       atomic.LoadUint64(&c.bytesUp),
+		BytesDown:     atomic.LoadUint64(&c.bytesDown),
+	}
+	if s.state != nil {
+		stats.Active = s.state.activeConns()
+	}
+	return stats
+}
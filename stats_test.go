@@ -0,0 +1,86 @@
+package socks5
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestServer_Stats(t *testing.T) {
+	// Create a local listener
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer target.Close()
+	go func() {
+		conn, err := target.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+	lAddr := target.Addr().(*net.TCPAddr)
+
+	serv, _ := New(&Config{Credentials: StaticCredentials{"foo": "bar"}})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	go serv.Serve(l)
+	defer serv.Close()
+
+	connect := func(pass string) []byte {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		defer conn.Close()
+		req := bytes.NewBuffer(nil)
+		req.Write([]byte{5, 1, UserPassAuth, 1, 3, 'f', 'o', 'o', byte(len(pass))})
+		req.WriteString(pass)
+		req.Write([]byte{5, 1, 0, 1, 127, 0, 0, 1, byte(lAddr.Port >> 8), byte(lAddr.Port)})
+		req.WriteString("ping")
+		conn.Write(req.Bytes())
+		if conn, ok := conn.(*net.TCPConn); ok {
+			conn.CloseWrite()
+		}
+		conn.SetDeadline(time.Now().Add(time.Second))
+		out, _ := io.ReadAll(conn)
+		return out
+	}
+	if out := connect("bar"); !bytes.HasSuffix(out, []byte("ping")) {
+		t.Fatalf("bad: %v", out)
+	}
+	connect("baz")
+
+	// Wait for the connections to be closed
+	deadline := time.Now().Add(time.Second)
+	for serv.Stats().Active != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	stats := serv.Stats()
+	expect := Stats{
+		Accepted:      2,
+		Authenticated: 1,
+		Denied:        1,
+		BytesUp:       4,
+		BytesDown:     4,
+	}
+	if stats != expect {
+		t.Fatalf("bad: %#v", stats)
+	}
+
+	out, err := json.Marshal(stats)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.Contains(out, []byte(`"dial_failures":0`)) {
+		t.Fatalf("bad: %s", out)
+	}
+}
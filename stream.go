@@ -0,0 +1,59 @@
+package socks5
+
+import (
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// defaultStreamPolicyInterval is how often the StreamPolicy is checked
+const defaultStreamPolicyInterval = time.Second
+
+// StreamStats are the cumulative counts of a relayed session
+type StreamStats struct {
+	// BytesUp and BytesDown are the bytes relayed from
+	// the client to the destination and back
+	BytesUp   uint64
+	BytesDown uint64
+
+	// Elapsed is the time since relaying started
+	Elapsed time.Duration
+}
+
+// StreamPolicy is used to police sessions while they are relayed,
+// for example to enforce quotas or flag anomalies. Returning an
+// error terminates the session.
+type StreamPolicy interface {
+	Check(ctx context.Context, req *Request, stats *StreamStats) error
+}
+
+// StreamPolicyFunc adapts a function to a StreamPolicy
+type StreamPolicyFunc func(ctx context.Context, req *Request, stats *StreamStats) error
+
+func (f StreamPolicyFunc) Check(ctx context.Context, req *Request, stats *StreamStats) error {
+	return f(ctx, req, stats)
+}
+
+// streamCounters count the bytes of a session,
+// which must only be accessed atomically
+type streamCounters struct {
+	up    uint64
+	down  uint64
+	start time.Time
+}
+
+func (c *streamCounters) snapshot() *StreamStats {
+	return &StreamStats{
+		BytesUp:   atomic.LoadUint64(&c.up),
+		BytesDown: atomic.LoadUint64(&c.down),
+		Elapsed:   time.Since(c.start),
+	}
+}
+
+func (s *Server) streamPolicyInterval() time.Duration {
+	if s.config.StreamPolicyInterval > 0 {
+		return s.config.StreamPolicyInterval
+	}
+	return defaultStreamPolicyInterval
+}
@@ -0,0 +1,82 @@
+package socks5
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestSOCKS5_StreamPolicy(t *testing.T) {
+	// Create an echo target
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer target.Close()
+	go func() {
+		conn, err := target.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+	lAddr := target.Addr().(*net.TCPAddr)
+
+	checks := make(chan *StreamStats, 100)
+	serv, _ := New(&Config{
+		StreamPolicy: StreamPolicyFunc(func(ctx context.Context, req *Request, stats *StreamStats) error {
+			checks <- stats
+			if stats.BytesUp > 10 {
+				return errors.New("quota exceeded")
+			}
+			return nil
+		}),
+		StreamPolicyInterval: 10 * time.Millisecond,
+	})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	go serv.Serve(l)
+	defer serv.Close()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+	conn.Write([]byte{5, 1, NoAuth, 5, 1, 0, 1, 127, 0, 0, 1, byte(lAddr.Port >> 8), byte(lAddr.Port)})
+	out := make([]byte, 12)
+	if _, err := io.ReadFull(conn, out); err != nil || out[3] != SuccessReply {
+		t.Fatalf("bad: %v %v", out, err)
+	}
+
+	// Within the quota the session is relayed
+	conn.Write([]byte("hello"))
+	if _, err := io.ReadFull(conn, out[:5]); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if stats := <-checks; stats.BytesUp > 5 || stats.Elapsed <= 0 {
+		t.Fatalf("bad: %v", stats)
+	}
+
+	// Exceeding it terminates the session
+	conn.Write([]byte("hello world"))
+	if _, err := io.Copy(io.Discard, conn); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	for stats := range checks {
+		if stats.BytesUp > 10 {
+			if stats.BytesDown != 5 && stats.BytesDown != 16 {
+				t.Fatalf("bad: %v", stats)
+			}
+			break
+		}
+	}
+}
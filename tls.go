@@ -0,0 +1,164 @@
+package socks5
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// acmeALPNProto is the ALPN protocol of the ACME tls-alpn-01 challenge
+const acmeALPNProto = "acme-tls/1"
+
+// CertProvider is used to obtain certificates during the TLS handshake,
+// for example from ACME. An autocert.Manager can be used directly:
+//
+//	m := &autocert.Manager{
+//		Prompt:     autocert.AcceptTOS,
+//		HostPolicy: autocert.HostWhitelist("proxy.example.com"),
+//		Cache:      autocert.DirCache("certs"),
+//	}
+//	conf := &socks5.Config{CertProvider: m}
+type CertProvider interface {
+	GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error)
+}
+
+// ListenAndServeTLS is used to create a TLS listener and serve on it.
+// The config may be nil if a CertProvider is configured.
+func (s *Server) ListenAndServeTLS(network, addr string, conf *tls.Config) error {
+	l, err := tls.Listen(network, addr, s.tlsConfig(conf))
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// ServeTLS is used to serve TLS connections from a listener.
+// The config may be nil if a CertProvider is configured.
+func (s *Server) ServeTLS(l net.Listener, conf *tls.Config) error {
+	return s.Serve(tls.NewListener(l, s.tlsConfig(conf)))
+}
+
+// tlsConfig is used to obtain certificates from the CertProvider,
+// if configured, and to answer its tls-alpn-01 challenges
+func (s *Server) tlsConfig(conf *tls.Config) *tls.Config {
+	provider := s.config.CertProvider
+	if provider == nil {
+		return conf
+	}
+	if conf == nil {
+		conf = &tls.Config{}
+	} else {
+		conf = conf.Clone()
+	}
+	conf.GetCertificate = provider.GetCertificate
+	for _, proto := range conf.NextProtos {
+		if proto == acmeALPNProto {
+			return conf
+		}
+	}
+	conf.NextProtos = append(conf.NextProtos, acmeALPNProto)
+	return conf
+}
+
+// configureSNI is used to set up the servers of the SNIRoutes
+func (s *Server) configureSNI(conf *Config) {
+	s.sni = nil
+	if len(conf.SNIRoutes) == 0 {
+		return
+	}
+	s.sni = make(map[string]*Server, len(conf.SNIRoutes))
+	for name, routeConf := range conf.SNIRoutes {
+		route := &Server{state: s.state}
+		route.configure(routeConf)
+		s.sni[strings.ToLower(name)] = route
+	}
+}
+
+// route is used to select the server for a connection. For TLS
+// connections with SNIRoutes, this completes the TLS handshake to
+// learn the requested server name.
+func (s *Server) route(conn net.Conn) (*Server, error) {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok || len(s.sni) == 0 {
+		return s, nil
+	}
+
+	if timeout := s.config.HandshakeTimeout; timeout > 0 {
+		tlsConn.SetDeadline(time.Now().Add(timeout))
+		defer tlsConn.SetDeadline(time.Time{})
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		err = fmt.Errorf("TLS handshake failed: %v", err)
+		s.logf(LogError, "%v", err)
+		return nil, err
+	}
+
+	name := strings.ToLower(tlsConn.ConnectionState().ServerName)
+	if route, ok := s.sni[name]; ok {
+		return route, nil
+	}
+	if i := strings.IndexByte(name, '.'); i >= 0 {
+		if route, ok := s.sni["*"+name[i:]]; ok {
+			return route, nil
+		}
+	}
+	return s, nil
+}
+
+// UpstreamTLS configures TLS origination, where the proxy wraps
+// the upstream connection in TLS while the client speaks plaintext.
+// It lets legacy clients reach TLS-only services.
+type UpstreamTLS struct {
+	// Ports selects the destination ports to wrap, e.g. 443
+	Ports []int
+
+	// Match selects the requests to wrap, in addition to Ports
+	Match func(req *Request) bool
+
+	// Config is the base TLS config, e.g. with the RootCAs. Unless it
+	// sets a ServerName, the requested FQDN is used for SNI and
+	// verification, or else the destination IP.
+	Config *tls.Config
+}
+
+// matches checks if a request should be wrapped in TLS
+func (u *UpstreamTLS) matches(req *Request) bool {
+	for _, port := range u.Ports {
+		if req.DestAddr.Port == port {
+			return true
+		}
+	}
+	return u.Match != nil && u.Match(req)
+}
+
+// originateTLS is used to wrap an upstream connection in TLS, if
+// configured for the request, completing the TLS handshake
+func (s *Server) originateTLS(ctx context.Context, req *Request, target net.Conn) (net.Conn, error) {
+	u := s.config.UpstreamTLS
+	if u == nil || !u.matches(req) {
+		return target, nil
+	}
+
+	var conf *tls.Config
+	if u.Config != nil {
+		conf = u.Config.Clone()
+	} else {
+		conf = &tls.Config{}
+	}
+	if conf.ServerName == "" {
+		conf.ServerName = req.DestAddr.FQDN
+		if conf.ServerName == "" {
+			conf.ServerName = req.realDestAddr.IP.String()
+		}
+	}
+
+	conn := tls.Client(target, conf)
+	if err := conn.HandshakeContext(ctx); err != nil {
+		return nil, fmt.Errorf("TLS handshake with %v failed: %v", req.DestAddr, err)
+	}
+	return conn, nil
+}
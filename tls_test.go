@@ -0,0 +1,186 @@
+package socks5
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// testTLSConfig returns a TLS config with a self-signed certificate
+func testTLSConfig(t *testing.T) *tls.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "socks5 test"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	cert := tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	return &tls.Config{Certificates: []tls.Certificate{cert}}
+}
+
+func TestSOCKS5_SNIRoutes(t *testing.T) {
+	serverConf := testTLSConfig(t)
+	serv, _ := New(&Config{
+		SNIRoutes: map[string]*Config{
+			"*.secure.example.com": {Credentials: StaticCredentials{"foo": "bar"}},
+		},
+	})
+
+	greet := func(name string) []byte {
+		client, server := net.Pipe()
+		defer client.Close()
+		go serv.ServeConn(tls.Server(server, serverConf))
+
+		conn := tls.Client(client, &tls.Config{ServerName: name, InsecureSkipVerify: true})
+		conn.SetDeadline(time.Now().Add(time.Second))
+		if _, err := conn.Write([]byte{5, 1, NoAuth}); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		out := make([]byte, 2)
+		if _, err := io.ReadFull(conn, out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		return out
+	}
+
+	// The routed config requires credentials
+	if out := greet("a.secure.example.com"); !bytes.Equal(out, []byte{5, noAcceptable}) {
+		t.Fatalf("bad: %v", out)
+	}
+
+	// Other names use the default config
+	if out := greet("public.example.com"); !bytes.Equal(out, []byte{5, NoAuth}) {
+		t.Fatalf("bad: %v", out)
+	}
+}
+
+// loopbackResolver resolves all names to 127.0.0.1
+type loopbackResolver struct{}
+
+func (loopbackResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	return ctx, net.IPv4(127, 0, 0, 1), nil
+}
+
+func TestSOCKS5_UpstreamTLS(t *testing.T) {
+	serverConf := testTLSConfig(t)
+	l, err := tls.Listen("tcp", "127.0.0.1:0", serverConf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	port := l.Addr().(*net.TCPAddr).Port
+
+	cert, _ := x509.ParseCertificate(serverConf.Certificates[0].Certificate[0])
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	serv, _ := New(&Config{
+		Resolver: loopbackResolver{},
+		UpstreamTLS: &UpstreamTLS{
+			Ports:  []int{port},
+			Config: &tls.Config{RootCAs: roots},
+		},
+	})
+
+	// The client speaks plaintext, verified against the requested name
+	conn, err := serv.Dialer().Dial("tcp", net.JoinHostPort("localhost", strconv.Itoa(port)))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+	conn.Write([]byte("ping"))
+	out := make([]byte, 4)
+	if _, err := io.ReadFull(conn, out); err != nil || string(out) != "ping" {
+		t.Fatalf("bad: %v %v", out, err)
+	}
+
+	// A name the certificate is not valid for is rejected
+	_, err = serv.Dialer().Dial("tcp", net.JoinHostPort("example.com", strconv.Itoa(port)))
+	var reqErr *requestError
+	if !errors.As(err, &reqErr) || reqErr.reply != HostUnreachable {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+// testCertProvider serves a fixed certificate, recording the names
+type testCertProvider struct {
+	cert  *tls.Certificate
+	names chan string
+}
+
+func (p *testCertProvider) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	p.names <- hello.ServerName
+	return p.cert, nil
+}
+
+func TestSOCKS5_CertProvider(t *testing.T) {
+	provider := &testCertProvider{
+		cert:  &testTLSConfig(t).Certificates[0],
+		names: make(chan string, 1),
+	}
+	serv, _ := New(&Config{CertProvider: provider})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	go serv.ServeTLS(l, nil)
+	defer serv.Close()
+
+	conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{
+		ServerName:         "proxy.example.com",
+		InsecureSkipVerify: true,
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	if name := <-provider.names; name != "proxy.example.com" {
+		t.Fatalf("bad: %v", name)
+	}
+	conn.SetDeadline(time.Now().Add(time.Second))
+	conn.Write([]byte{5, 1, NoAuth})
+	out := make([]byte, 2)
+	if _, err := io.ReadFull(conn, out); err != nil || out[1] != NoAuth {
+		t.Fatalf("bad: %v %v", out, err)
+	}
+
+	// The ACME challenge protocol is offered
+	conf := serv.tlsConfig(&tls.Config{NextProtos: []string{"h2"}})
+	if len(conf.NextProtos) != 2 || conf.NextProtos[1] != acmeALPNProto {
+		t.Fatalf("bad: %v", conf.NextProtos)
+	}
+}
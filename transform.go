@@ -0,0 +1,137 @@
+package socks5
+
+import (
+	"compress/gzip"
+	"io"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// StreamTransformer is used to wrap the two sides of a session before
+// it is relayed. Reading from client yields the bytes sent by the
+// client, and writing to it sends bytes to the client; the target is
+// the destination. Returned streams should implement CloseWrite, if
+// possible, to propagate half-closes.
+type StreamTransformer interface {
+	Transform(ctx context.Context, req *Request, client, target io.ReadWriter) (io.ReadWriter, io.ReadWriter, error)
+}
+
+// streamPair joins the reader and writer of one side of a session
+type streamPair struct {
+	io.Reader
+	io.Writer
+}
+
+func (p *streamPair) CloseWrite() error {
+	if cw, ok := p.Writer.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// GzipTransformer compresses the stream between the proxy and clients
+// which speak gzip too, e.g. over slow links. Each write is flushed, so
+// interactive protocols are not delayed.
+type GzipTransformer struct {
+	// Level is the compression level. Defaults to gzip.DefaultCompression.
+	Level int
+}
+
+func (g *GzipTransformer) Transform(ctx context.Context, req *Request, client, target io.ReadWriter) (io.ReadWriter, io.ReadWriter, error) {
+	level := g.Level
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+	w, err := gzip.NewWriterLevel(client, level)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &gzipStream{inner: client, w: w}, target, nil
+}
+
+// gzipStream compresses writes and decompresses reads
+type gzipStream struct {
+	inner io.ReadWriter
+	r     *gzip.Reader
+	w     *gzip.Writer
+}
+
+func (g *gzipStream) Read(b []byte) (int, error) {
+	// Create the reader lazily, as it blocks reading the header
+	if g.r == nil {
+		r, err := gzip.NewReader(g.inner)
+		if err != nil {
+			return 0, err
+		}
+		g.r = r
+	}
+	return g.r.Read(b)
+}
+
+func (g *gzipStream) Write(b []byte) (int, error) {
+	n, err := g.w.Write(b)
+	if err != nil {
+		return n, err
+	}
+	return n, g.w.Flush()
+}
+
+func (g *gzipStream) CloseWrite() error {
+	if err := g.w.Close(); err != nil {
+		return err
+	}
+	if cw, ok := g.inner.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// RateLimitTransformer throttles each session to a fixed rate in each
+// direction. For limits shared between sessions, use BandwidthLimiter.
+type RateLimitTransformer struct {
+	// BytesPerSecond is the rate of each direction
+	BytesPerSecond int
+}
+
+func (t *RateLimitTransformer) Transform(ctx context.Context, req *Request, client, target io.ReadWriter) (io.ReadWriter, io.ReadWriter, error) {
+	if t.BytesPerSecond <= 0 {
+		return client, target, nil
+	}
+	return &throttledStream{ReadWriter: client, ctx: ctx, rate: t.BytesPerSecond},
+		&throttledStream{ReadWriter: target, ctx: ctx, rate: t.BytesPerSecond}, nil
+}
+
+// throttledStream paces reads to a rate
+type throttledStream struct {
+	io.ReadWriter
+	ctx  context.Context
+	rate int
+}
+
+func (t *throttledStream) Read(b []byte) (int, error) {
+	// Read at most a tenth of a second worth of data at once
+	if max := t.rate/10 + 1; len(b) > max {
+		b = b[:max]
+	}
+	start := time.Now()
+	n, err := t.ReadWriter.Read(b)
+	if n > 0 {
+		wait := time.Duration(n)*time.Second/time.Duration(t.rate) - time.Since(start)
+		if wait > 0 {
+			select {
+			case <-time.After(wait):
+			case <-t.ctx.Done():
+				return n, t.ctx.Err()
+			}
+		}
+	}
+	return n, err
+}
+
+func (t *throttledStream) CloseWrite() error {
+	if cw, ok := t.ReadWriter.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
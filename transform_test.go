@@ -0,0 +1,82 @@
+package socks5
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestSOCKS5_GzipTransformer(t *testing.T) {
+	// Create an echo target
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer target.Close()
+	go func() {
+		conn, err := target.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+	lAddr := target.Addr().(*net.TCPAddr)
+
+	serv, _ := New(&Config{StreamTransformer: &GzipTransformer{}})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	go serv.Serve(l)
+	defer serv.Close()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+	conn.Write([]byte{5, 1, NoAuth, 5, 1, 0, 1, 127, 0, 0, 1, byte(lAddr.Port >> 8), byte(lAddr.Port)})
+	out := make([]byte, 12)
+	if _, err := io.ReadFull(conn, out); err != nil || out[3] != SuccessReply {
+		t.Fatalf("bad: %v %v", out, err)
+	}
+
+	// The session is compressed in both directions
+	msg := bytes.Repeat([]byte("ping"), 100)
+	w := gzip.NewWriter(conn)
+	w.Write(msg)
+	w.Flush()
+	r, err := gzip.NewReader(conn)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	echoed := make([]byte, len(msg))
+	if _, err := io.ReadFull(r, echoed); err != nil || !bytes.Equal(echoed, msg) {
+		t.Fatalf("bad: %s %v", echoed, err)
+	}
+}
+
+func TestRateLimitTransformer(t *testing.T) {
+	tr := &RateLimitTransformer{BytesPerSecond: 10000}
+	client := &streamPair{bytes.NewReader(make([]byte, 1000)), io.Discard}
+	throttled, _, err := tr.Transform(context.Background(), nil, client, client)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	start := time.Now()
+	n, err := io.Copy(io.Discard, throttled)
+	if err != nil || n != 1000 {
+		t.Fatalf("bad: %v %v", n, err)
+	}
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Fatalf("bad: %v", elapsed)
+	}
+}
@@ -0,0 +1,85 @@
+package socks5
+
+import (
+	"bytes"
+	"fmt"
+)
+
+const (
+	// maxUDPPacketSize bounds the size of relayed UDP datagrams,
+	// including the SOCKS header
+	maxUDPPacketSize = 64 * 1024
+)
+
+// UDPDatagram is a UDP packet relayed through an association,
+// as described in section 7 of RFC 1928:
+//
+//	+----+------+------+----------+----------+----------+
+//	|RSV | FRAG | ATYP | DST.ADDR | DST.PORT |   DATA   |
+//	+----+------+------+----------+----------+----------+
+//	| 2  |  1   |  1   | Variable |    2     | Variable |
+//	+----+------+------+----------+----------+----------+
+type UDPDatagram struct {
+	// Fragment number, zero for a standalone datagram
+	Frag uint8
+	// AddrSpec of the destination, or the source for replies
+	DestAddr *AddrSpec
+	// Data is the payload of the datagram
+	Data []byte
+	// rsv is the reserved field, which must be zero
+	rsv uint16
+}
+
+// readUDPDatagram is used to parse a UDP datagram with its SOCKS header
+func readUDPDatagram(b []byte) (*UDPDatagram, error) {
+	if len(b) > maxUDPPacketSize {
+		return nil, fmt.Errorf("Datagram too large: %d bytes", len(b))
+	}
+	if len(b) < 4 {
+		return nil, fmt.Errorf("Datagram too short: %d bytes", len(b))
+	}
+
+	r := bytes.NewReader(b[3:])
+	dest, err := readAddrSpec(r)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &UDPDatagram{
+		Frag:     b[2],
+		DestAddr: dest,
+		Data:     b[len(b)-r.Len():],
+		rsv:      uint16(b[0])<<8 | uint16(b[1]),
+	}
+	return d, nil
+}
+
+// marshal is used to encode the datagram with its SOCKS header
+func (d *UDPDatagram) marshal() ([]byte, error) {
+	addr, err := formatAddrSpec(d.DestAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 0, 3+len(addr)+len(d.Data))
+	buf = append(buf, 0, 0, d.Frag)
+	buf = append(buf, addr...)
+	buf = append(buf, d.Data...)
+	return buf, nil
+}
+
+// MarshalBinary encodes the datagram with its SOCKS header
+func (d *UDPDatagram) MarshalBinary() ([]byte, error) {
+	return d.marshal()
+}
+
+// UnmarshalBinary decodes a datagram with its SOCKS header.
+// The Data of the datagram refers to b.
+func (d *UDPDatagram) UnmarshalBinary(b []byte) error {
+	out, err := readUDPDatagram(b)
+	if err != nil {
+		return err
+	}
+	*d = *out
+	return nil
+}
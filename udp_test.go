@@ -0,0 +1,55 @@
+package socks5
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestUDPDatagram_RoundTrip(t *testing.T) {
+	d := &UDPDatagram{
+		DestAddr: &AddrSpec{IP: net.ParseIP("10.0.0.1"), Port: 53},
+		Data:     []byte("query"),
+	}
+	out, err := d.marshal()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	expected := []byte{0, 0, 0, ipv4Address, 10, 0, 0, 1, 0, 53, 'q', 'u', 'e', 'r', 'y'}
+	if !bytes.Equal(out, expected) {
+		t.Fatalf("bad: %v", out)
+	}
+
+	d2, err := readUDPDatagram(out)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !d2.DestAddr.IP.Equal(d.DestAddr.IP) || d2.DestAddr.Port != 53 || string(d2.Data) != "query" {
+		t.Fatalf("bad: %v", d2)
+	}
+}
+
+func TestUDPDatagram_Malformed(t *testing.T) {
+	for _, b := range [][]byte{
+		{},
+		{0, 0, 0},
+		{0, 0, 0, 9, 1, 2, 3, 4, 0, 53},
+		{0, 0, 0, ipv4Address, 1, 2},
+		make([]byte, maxUDPPacketSize+1),
+	} {
+		if _, err := readUDPDatagram(b); err == nil {
+			t.Fatalf("expected error: %v", b)
+		}
+	}
+}
+
+func TestUDPDatagram_Reserved(t *testing.T) {
+	d, err := readUDPDatagram([]byte{1, 2, 0, ipv4Address, 10, 0, 0, 1, 0, 53})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if d.rsv != 0x0102 {
+		t.Fatalf("bad: %#x", d.rsv)
+	}
+}
@@ -0,0 +1,183 @@
+package socks5
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"sync"
+
+	"golang.org/x/net/context"
+)
+
+// ListenFDsEnv is the environment variable telling a process started
+// by Upgrade how many listeners it inherited. The listeners are passed
+// as the file descriptors starting at 3, followed by a pipe used to
+// report readiness.
+const ListenFDsEnv = "SOCKS5_LISTEN_FDS"
+
+// inheritedFDStart is the first file descriptor passed to a child,
+// after stdin, stdout and stderr
+const inheritedFDStart = 3
+
+var (
+	// upgradeReady is the pipe to the process which started this one
+	// with Upgrade, kept by InheritListeners for UpgradeReady
+	upgradeReadyL sync.Mutex
+	upgradeReady  *os.File
+)
+
+// fileListener is implemented by listeners which can be handed over,
+// such as *net.TCPListener and *net.UnixListener
+type fileListener interface {
+	File() (*os.File, error)
+}
+
+// Upgrade hands the listeners of the server over to a new process,
+// for example a new binary, without refusing any connection. The
+// command is started with the listeners as extra files, and should
+// call InheritListeners, serve them and then call UpgradeReady. Once it
+// is ready the server stops accepting and drains its connections, as
+// with Shutdown, while the new process accepts the new connections.
+//
+// The context bounds both the wait for the new process and the drain.
+// If the new process exits or the context expires before it is ready,
+// the server keeps serving, and the error is returned. The process is
+// not killed, the caller may do so with cmd.Process.
+func (s *Server) Upgrade(ctx context.Context, cmd *exec.Cmd) error {
+	files, err := s.listenerFiles()
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	if err != nil {
+		return err
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("Failed to create readiness pipe: %w", err)
+	}
+	defer r.Close()
+
+	extra := append(files, w)
+	cmd.ExtraFiles = append(extra, cmd.ExtraFiles...)
+	if cmd.Env == nil {
+		cmd.Env = os.Environ()
+	}
+	cmd.Env = append(cmd.Env, ListenFDsEnv+"="+strconv.Itoa(len(files)))
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		return fmt.Errorf("Failed to start new process: %w", err)
+	}
+	s.logf(LogInfo, "Handing %d listeners over to process %d", len(files), cmd.Process.Pid)
+
+	ready := make(chan error, 1)
+	go func() {
+		if _, err := io.ReadFull(r, make([]byte, 1)); err != nil {
+			ready <- fmt.Errorf("New process exited before it was ready: %w", err)
+			return
+		}
+		ready <- nil
+	}()
+	select {
+	case err := <-ready:
+		if err != nil {
+			return err
+		}
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	s.logf(LogInfo, "Process %d took over, draining", cmd.Process.Pid)
+	return s.Shutdown(ctx)
+}
+
+// listenerFiles returns duplicates of the file descriptors of the
+// listeners being served, ordered by address
+func (s *Server) listenerFiles() ([]*os.File, error) {
+	st := s.state
+	st.l.Lock()
+	listeners := make([]net.Listener, 0, len(st.listeners))
+	for l := range st.listeners {
+		listeners = append(listeners, l)
+	}
+	st.l.Unlock()
+	if len(listeners) == 0 {
+		return nil, fmt.Errorf("No listeners to hand over")
+	}
+	sort.Slice(listeners, func(i, j int) bool {
+		return listeners[i].Addr().String() < listeners[j].Addr().String()
+	})
+
+	var files []*os.File
+	for _, l := range listeners {
+		fl, ok := l.(fileListener)
+		if !ok {
+			return files, fmt.Errorf("Listener %v cannot be handed over", l.Addr())
+		}
+		f, err := fl.File()
+		if err != nil {
+			return files, fmt.Errorf("Failed to get file of listener %v: %w", l.Addr(), err)
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}
+
+// InheritListeners returns the listeners handed over by the process
+// which started this one with Upgrade, or none if it was not started
+// by Upgrade. The process should serve them, for example with
+// AddListener, and then call UpgradeReady.
+func InheritListeners() ([]net.Listener, error) {
+	count := os.Getenv(ListenFDsEnv)
+	if count == "" {
+		return nil, nil
+	}
+	os.Unsetenv(ListenFDsEnv)
+	n, err := strconv.Atoi(count)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("Invalid %s: %q", ListenFDsEnv, count)
+	}
+
+	var listeners []net.Listener
+	for i := 0; i < n; i++ {
+		f := os.NewFile(uintptr(inheritedFDStart+i), "listener")
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, fmt.Errorf("Failed to inherit listener %d: %w", i, err)
+		}
+		listeners = append(listeners, l)
+	}
+
+	upgradeReadyL.Lock()
+	upgradeReady = os.NewFile(uintptr(inheritedFDStart+n), "upgrade")
+	upgradeReadyL.Unlock()
+	return listeners, nil
+}
+
+// UpgradeReady tells the process which handed its listeners over with
+// Upgrade that this one is serving them, so it starts draining. It
+// does nothing if the listeners were not inherited.
+func UpgradeReady() error {
+	upgradeReadyL.Lock()
+	defer upgradeReadyL.Unlock()
+	if upgradeReady == nil {
+		return nil
+	}
+	_, err := upgradeReady.Write([]byte{1})
+	upgradeReady.Close()
+	upgradeReady = nil
+	if err != nil {
+		return fmt.Errorf("Failed to report readiness: %w", err)
+	}
+	return nil
+}
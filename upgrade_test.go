@@ -0,0 +1,99 @@
+package socks5
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// TestUpgrade_Child is run by TestServer_Upgrade as the new process
+func TestUpgrade_Child(t *testing.T) {
+	if os.Getenv("SOCKS5_TEST_UPGRADE_CHILD") == "" {
+		return
+	}
+	listeners, err := InheritListeners()
+	if err != nil || len(listeners) != 1 {
+		t.Fatalf("bad: %v %v", listeners, err)
+	}
+	serv, _ := New(&Config{})
+	for _, l := range listeners {
+		serv.AddListener(l)
+	}
+	if err := UpgradeReady(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	time.Sleep(10 * time.Second)
+}
+
+func TestServer_Upgrade(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	serv, _ := New(&Config{})
+	defer serv.Close()
+	if err := serv.AddListener(l); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	greet := func() net.Conn {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		conn.SetDeadline(time.Now().Add(2 * time.Second))
+		conn.Write([]byte{5, 1, NoAuth})
+		out := make([]byte, 2)
+		if _, err := io.ReadFull(conn, out); err != nil || !bytes.Equal(out, []byte{5, NoAuth}) {
+			t.Fatalf("bad: %v %v", out, err)
+		}
+		return conn
+	}
+
+	// A client of the old process is drained
+	conn := greet()
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		conn.Close()
+	}()
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestUpgrade_Child$")
+	cmd.Env = append(os.Environ(), "SOCKS5_TEST_UPGRADE_CHILD=1")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := serv.Upgrade(ctx, cmd); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}()
+
+	// The new process accepts on the same address
+	greet().Close()
+	if info := serv.Debug(); info.Goroutines["listener"] != 0 {
+		t.Fatalf("bad: %v", info.Goroutines)
+	}
+}
+
+func TestInheritListeners(t *testing.T) {
+	listeners, err := InheritListeners()
+	if err != nil || listeners != nil {
+		t.Fatalf("bad: %v %v", listeners, err)
+	}
+	if err := UpgradeReady(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	os.Setenv(ListenFDsEnv, "bad")
+	defer os.Unsetenv(ListenFDsEnv)
+	if _, err := InheritListeners(); err == nil {
+		t.Fatalf("expected error")
+	}
+}
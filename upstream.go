@@ -0,0 +1,145 @@
+package socks5
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultUpstreamTTL is how long idle upstream connections are kept
+	defaultUpstreamTTL = 30 * time.Second
+
+	// idleCheckTimeout is how long to wait for a pending close
+	// when checking an idle connection before use
+	idleCheckTimeout = time.Millisecond
+)
+
+// UpstreamPool keeps idle, freshly dialed connections to recently used
+// destinations, so that later connects to them skip the connection
+// setup. Whenever a destination is connected to, the pool is refilled
+// in the background. Idle connections closed by the destination in
+// the meantime are discarded rather than handed to clients.
+type UpstreamPool struct {
+	// TTL is how long an idle connection is kept. Defaults to 30 seconds.
+	TTL time.Duration
+
+	// MaxIdlePerHost bounds the idle connections per destination.
+	// Defaults to 1.
+	MaxIdlePerHost int
+
+	cache   connCache
+	l       sync.Mutex
+	pending map[string]int
+	closed  bool
+}
+
+func (p *UpstreamPool) ttl() time.Duration {
+	if p.TTL > 0 {
+		return p.TTL
+	}
+	return defaultUpstreamTTL
+}
+
+func (p *UpstreamPool) maxIdle() int {
+	if p.MaxIdlePerHost > 0 {
+		return p.MaxIdlePerHost
+	}
+	return 1
+}
+
+// get returns a usable idle connection to the destination, if any
+func (p *UpstreamPool) get(key string, m Metrics) net.Conn {
+	for {
+		conn := p.cache.get(key)
+		if conn == nil {
+			m.IncrCounter([]string{"socks5", "upstream_pool", "miss"}, 1)
+			return nil
+		}
+		if conn, ok := checkIdle(conn); ok {
+			m.IncrCounter([]string{"socks5", "upstream_pool", "hit"}, 1)
+			return conn
+		}
+		conn.Close()
+		m.IncrCounter([]string{"socks5", "upstream_pool", "discarded"}, 1)
+	}
+}
+
+// fill dials idle connections to the destination in the
+// background, until MaxIdlePerHost are available
+func (p *UpstreamPool) fill(key string, m Metrics, dial func() (net.Conn, error)) {
+	p.l.Lock()
+	if p.pending == nil {
+		p.pending = make(map[string]int)
+	}
+	if p.closed || p.cache.count(key)+p.pending[key] >= p.maxIdle() {
+		p.l.Unlock()
+		return
+	}
+	p.pending[key]++
+	p.l.Unlock()
+
+	go func() {
+		conn, err := dial()
+
+		p.l.Lock()
+		defer p.l.Unlock()
+		if p.pending[key]--; p.pending[key] == 0 {
+			delete(p.pending, key)
+		}
+		if err != nil {
+			return
+		}
+		if p.closed || !p.cache.put(key, conn, p.ttl(), p.maxIdle()) {
+			conn.Close()
+			return
+		}
+		m.SetGauge([]string{"socks5", "upstream_pool", "idle"}, float32(p.cache.len()))
+	}()
+}
+
+// Close closes all idle connections and stops refilling the pool
+func (p *UpstreamPool) Close() error {
+	p.l.Lock()
+	p.closed = true
+	p.l.Unlock()
+	return p.cache.Close()
+}
+
+// checkIdle is used to verify an idle connection was not closed by
+// the destination. Any data the destination sent meanwhile, such as
+// a banner, is kept for the client.
+func checkIdle(conn net.Conn) (net.Conn, bool) {
+	buf := make([]byte, 1)
+	conn.SetReadDeadline(time.Now().Add(idleCheckTimeout))
+	n, err := conn.Read(buf)
+	conn.SetReadDeadline(time.Time{})
+	if n > 0 {
+		r := io.MultiReader(bytes.NewReader(buf[:n]), conn)
+		return &bufferedConn{Conn: conn, r: r}, true
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return conn, true
+	}
+	return conn, false
+}
+
+// pooledConn returns an idle upstream connection for the request,
+// refilling the pool in the background using the dial function
+func (s *Server) pooledConn(req *Request, dial func(req *Request) (net.Conn, error)) net.Conn {
+	pool := s.config.UpstreamPool
+	if pool == nil {
+		return nil
+	}
+
+	// Dial a copy of the request, as it is used concurrently
+	key := req.realDestAddr.Address()
+	fillReq := *req
+	conn := pool.get(key, s.metrics())
+	pool.fill(key, s.metrics(), func() (net.Conn, error) {
+		return dial(&fillReq)
+	})
+	return conn
+}
@@ -0,0 +1,120 @@
+package socks5
+
+import (
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCheckIdle(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	conns := make(chan net.Conn, 3)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conns <- conn
+		}
+	}()
+	dial := func() (net.Conn, net.Conn) {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		return conn, <-conns
+	}
+
+	// Idle connections are usable
+	idle, peer := dial()
+	defer peer.Close()
+	if _, ok := checkIdle(idle); !ok {
+		t.Fatalf("expected usable")
+	}
+	idle.Close()
+
+	// Data sent meanwhile is kept
+	banner, peer := dial()
+	defer peer.Close()
+	peer.Write([]byte("hi"))
+	time.Sleep(10 * time.Millisecond)
+	conn, ok := checkIdle(banner)
+	if !ok {
+		t.Fatalf("expected usable")
+	}
+	out := make([]byte, 2)
+	if _, err := io.ReadFull(conn, out); err != nil || string(out) != "hi" {
+		t.Fatalf("bad: %v %v", out, err)
+	}
+	conn.Close()
+
+	// Half-closed connections are discarded
+	closed, peer := dial()
+	peer.Close()
+	time.Sleep(10 * time.Millisecond)
+	if _, ok := checkIdle(closed); ok {
+		t.Fatalf("expected discarded")
+	}
+	closed.Close()
+}
+
+func TestUpstreamPool(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(io.Discard, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	metrics := newTestMetrics()
+	pool := &UpstreamPool{MaxIdlePerHost: 2}
+	defer pool.Close()
+	s := &Server{config: &Config{UpstreamPool: pool, Metrics: metrics}}
+	dest := &AddrSpec{IP: net.IPv4(127, 0, 0, 1), Port: l.Addr().(*net.TCPAddr).Port}
+	req := &Request{DestAddr: dest, realDestAddr: dest}
+
+	var dials int32
+	dial := func(req *Request) (net.Conn, error) {
+		atomic.AddInt32(&dials, 1)
+		return net.Dial("tcp", req.realDestAddr.Address())
+	}
+
+	// The first connect misses and fills the pool
+	if conn := s.pooledConn(req, dial); conn != nil {
+		t.Fatalf("unexpected conn")
+	}
+	deadline := time.Now().Add(time.Second)
+	for pool.cache.count(dest.Address()) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("pool not filled")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	conn := s.pooledConn(req, dial)
+	if conn == nil {
+		t.Fatalf("expected conn")
+	}
+	conn.Close()
+	if metrics.counter("socks5.upstream_pool.hit") != 1 || metrics.counter("socks5.upstream_pool.miss") != 1 {
+		t.Fatalf("bad: %v", metrics.counters)
+	}
+}